@@ -3,13 +3,19 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
 	"time"
+	// Publish schedules name time zones; the image has no zoneinfo
+	_ "time/tzdata"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -24,12 +30,32 @@ func main() {
 	var webhookAddr string
 	var webhookSecret string
 	var allowedHosts string
+	var keepReleases int
+	var syncWorkers int
+	var maxSyncsPerHost int
+	var maxLFSSize string
+	var maxUploadSize string
+	var maxExtractSize string
+	var buildNamespace string
+	var buildVolumeClaim string
+	var gitCABundle string
+	var gitProxy string
 
 	flag.StringVar(&sitesRoot, "sites-root", "/sites", "Root directory for synced sites")
-	flag.DurationVar(&syncInterval, "sync-interval", 5*time.Minute, "Interval between full syncs")
+	flag.DurationVar(&syncInterval, "sync-interval", 5*time.Minute, "Sync interval for sites without spec.syncInterval")
 	flag.StringVar(&webhookAddr, "webhook-addr", ":8080", "Address for webhook HTTP server")
 	flag.StringVar(&webhookSecret, "webhook-secret", "", "Secret for webhook signature validation")
 	flag.StringVar(&allowedHosts, "allowed-hosts", "", "Comma-separated list of allowed Git hosts (SSRF protection)")
+	flag.IntVar(&keepReleases, "keep-releases", syncer.DefaultKeepReleases, "Number of previous releases kept per site for rollbacks")
+	flag.IntVar(&syncWorkers, "sync-workers", syncer.DefaultSyncWorkers, "Number of sites synced in parallel")
+	flag.IntVar(&maxSyncsPerHost, "max-syncs-per-host", syncer.DefaultMaxSyncsPerHost, "Maximum parallel syncs against the same Git host (0 = unlimited)")
+	flag.StringVar(&maxLFSSize, "max-lfs-size", resource.NewQuantity(syncer.DefaultMaxLFSSize, resource.BinarySI).String(), "Maximum total size of the Git LFS objects of a site (0 = unlimited)")
+	flag.StringVar(&maxUploadSize, "max-upload-size", resource.NewQuantity(syncer.DefaultMaxUploadSize, resource.BinarySI).String(), "Maximum size of a compressed upload to the deploy endpoint or a downloaded archive (0 = unlimited)")
+	flag.StringVar(&maxExtractSize, "max-extract-size", resource.NewQuantity(syncer.DefaultMaxExtractSize, resource.BinarySI).String(), "Maximum size of the content unpacked for a site from an archive, OCI artifact, upload or S3 bucket (0 = unlimited)")
+	flag.StringVar(&buildNamespace, "build-namespace", "", "Namespace the build Jobs of sites with spec.build run in")
+	flag.StringVar(&buildVolumeClaim, "build-volume-claim", "", "PersistentVolumeClaim of the sites root, mounted by build Jobs (empty = builds disabled)")
+	flag.StringVar(&gitCABundle, "git-ca-bundle", "", "PEM file with CA certificates trusted for Git and other source hosts, in addition to the system roots")
+	flag.StringVar(&gitProxy, "git-proxy", "", "HTTP proxy URL for requests to Git and other source hosts (default: HTTPS_PROXY/HTTP_PROXY)")
 
 	opts := zap.Options{Development: true}
 	opts.BindFlags(flag.CommandLine)
@@ -79,6 +105,64 @@ func main() {
 
 	log.Info("Allowed Git hosts configured", "hosts", hosts)
 
+	if keepReleases < 0 {
+		log.Error(nil, "--keep-releases must not be negative", "value", keepReleases)
+		os.Exit(1)
+	}
+
+	if syncWorkers < 1 {
+		log.Error(nil, "--sync-workers must be at least 1", "value", syncWorkers)
+		os.Exit(1)
+	}
+
+	if maxSyncsPerHost < 0 {
+		log.Error(nil, "--max-syncs-per-host must not be negative", "value", maxSyncsPerHost)
+		os.Exit(1)
+	}
+
+	lfsLimit, err := resource.ParseQuantity(maxLFSSize)
+	if err != nil || lfsLimit.Sign() < 0 {
+		log.Error(err, "--max-lfs-size must be a non-negative quantity like 500Mi or 2Gi", "value", maxLFSSize)
+		os.Exit(1)
+	}
+
+	uploadLimit, err := resource.ParseQuantity(maxUploadSize)
+	if err != nil || uploadLimit.Sign() < 0 {
+		log.Error(err, "--max-upload-size must be a non-negative quantity like 100Mi or 1Gi", "value", maxUploadSize)
+		os.Exit(1)
+	}
+
+	extractLimit, err := resource.ParseQuantity(maxExtractSize)
+	if err != nil || extractLimit.Sign() < 0 {
+		log.Error(err, "--max-extract-size must be a non-negative quantity like 1Gi or 4Gi", "value", maxExtractSize)
+		os.Exit(1)
+	}
+
+	if buildVolumeClaim != "" && buildNamespace == "" {
+		log.Error(nil, "--build-namespace is required with --build-volume-claim")
+		os.Exit(1)
+	}
+
+	var caBundle []byte
+	if gitCABundle != "" {
+		caBundle, err = os.ReadFile(gitCABundle)
+		if err == nil && !x509.NewCertPool().AppendCertsFromPEM(caBundle) {
+			err = fmt.Errorf("no PEM certificates found")
+		}
+		if err != nil {
+			log.Error(err, "--git-ca-bundle must be a PEM file with CA certificates", "value", gitCABundle)
+			os.Exit(1)
+		}
+	}
+
+	if gitProxy != "" {
+		proxyURL, err := url.Parse(gitProxy)
+		if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https") || proxyURL.Host == "" {
+			log.Error(err, "--git-proxy must be a URL like http://proxy.example.com:3128", "value", gitProxy)
+			os.Exit(1)
+		}
+	}
+
 	// Create Syncer
 	s := &syncer.Syncer{
 		DynamicClient:   dynamicClient,
@@ -86,6 +170,18 @@ func main() {
 		SitesRoot:       sitesRoot,
 		DefaultInterval: syncInterval,
 		AllowedHosts:    hosts,
+		KeepReleases:    keepReleases,
+		SyncWorkers:     syncWorkers,
+		MaxSyncsPerHost: maxSyncsPerHost,
+		MaxLFSSize:      lfsLimit.Value(),
+		MaxUploadSize:   uploadLimit.Value(),
+		MaxExtractSize:  extractLimit.Value(),
+
+		BuildNamespace:   buildNamespace,
+		BuildVolumeClaim: buildVolumeClaim,
+
+		GitCABundle: caBundle,
+		GitProxy:    gitProxy,
 	}
 
 	// Create Webhook Server
@@ -107,6 +203,18 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// Watch StaticSites, so syncs and webhooks work from a local cache
+	log.Info("Waiting for StaticSite cache")
+	if err := s.StartInformer(ctx); err != nil {
+		log.Error(err, "unable to start StaticSite informer")
+		os.Exit(1)
+	}
+
+	// Move content of older versions to the namespace-qualified layout
+	if err := s.MigrateLayout(ctx); err != nil {
+		log.Error(err, "failed to migrate site directories")
+	}
+
 	// Start Sync Loop in goroutine
 	go func() {
 		log.Info("Starting sync loop", "interval", syncInterval)
@@ -123,6 +231,7 @@ func main() {
 	log.Info("Syncer started",
 		"sitesRoot", sitesRoot,
 		"syncInterval", syncInterval,
+		"syncWorkers", syncWorkers,
 		"webhookAddr", webhookAddr,
 	)
 
@@ -25,17 +25,45 @@ type StaticSite struct {
 }
 
 // StaticSiteSpec defines the desired configuration
+// +kubebuilder:validation:XValidation:rule="has(self.repo) != has(self.source)",message="exactly one of repo and source must be set"
+// +kubebuilder:validation:XValidation:rule="!has(self.build) || !has(self.source) || !has(self.source.upload)",message="build cannot be used with source.upload"
+// +kubebuilder:validation:XValidation:rule="!has(self.publishSchedule) || !has(self.source) || !has(self.source.upload)",message="publishSchedule cannot be used with source.upload"
+// +kubebuilder:validation:XValidation:rule="!has(self.verification) || has(self.repo)",message="verification requires repo"
 type StaticSiteSpec struct {
-	// Repo is the Git repository URL (required)
-	// +kubebuilder:validation:Required
-	// +kubebuilder:validation:Pattern=`^https?://.*\.git$`
-	Repo string `json:"repo"`
+	// Repo is the Git repository URL: https://, ssh:// or scp-style like
+	// git@github.com:org/repo.git. SSH repos need a SecretRef with
+	// ssh-privatekey and known_hosts. Either Repo or Source must be set.
+	// +kubebuilder:validation:Pattern=`^(https?://|ssh://|[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:).*\.git$`
+	// +optional
+	Repo string `json:"repo,omitempty"`
+
+	// Source takes the site content from somewhere other than a Git repo.
+	// The Git fields (Branch, Tag, TagSelector, Revision, Submodules) don't
+	// apply; Path selects a subdirectory of the content.
+	// +optional
+	Source *SiteSource `json:"source,omitempty"`
 
 	// Branch is the Git branch (default: main)
 	// +kubebuilder:default=main
 	// +optional
 	Branch string `json:"branch,omitempty"`
 
+	// Tag pins the site to a Git tag instead of the tip of Branch.
+	// Takes precedence over TagSelector and Branch.
+	// +optional
+	Tag string `json:"tag,omitempty"`
+
+	// TagSelector deploys the highest remote tag matching a semver constraint
+	// or a glob pattern, instead of following Branch
+	// +optional
+	TagSelector *TagSelector `json:"tagSelector,omitempty"`
+
+	// Revision pins the site to an exact commit (full 40-character SHA).
+	// Takes precedence over Tag and Branch.
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{40}$`
+	// +optional
+	Revision string `json:"revision,omitempty"`
+
 	// Path is the subpath in the repo that gets served (default: /)
 	// e.g. "/dist" or "/public" for build output
 	// +kubebuilder:validation:Pattern=`^(/[a-zA-Z0-9._-]*[a-zA-Z0-9_-][a-zA-Z0-9._-]*)*/?$`
@@ -58,14 +86,221 @@ type StaticSiteSpec struct {
 	Domain string `json:"domain,omitempty"`
 
 	// SecretRef references a Secret with Git credentials
-	// For private repos
+	// For private repos. For SSH repos the Secret holds ssh-privatekey and
+	// known_hosts; Key is not used.
 	// +optional
 	SecretRef *SecretReference `json:"secretRef,omitempty"`
 
-	// SyncInterval defines how often the Syncer pulls (default: 5m)
+	// SyncInterval defines how often the Syncer pulls (default: 5m).
+	// Go duration like "30s" or "24h"; intervals below 10s are raised to 10s.
 	// +kubebuilder:default="5m"
 	// +optional
 	SyncInterval string `json:"syncInterval,omitempty"`
+
+	// Submodules checks out the Git submodules of the repo, recursively.
+	// Every submodule URL must be on an allowed host; credentials are only
+	// used for submodules on the host of Repo.
+	// +optional
+	Submodules bool `json:"submodules,omitempty"`
+
+	// Build runs a build step, like a static site generator, in a
+	// Kubernetes Job before publishing. The Job works on a copy of Path;
+	// what it writes to OutputDir gets published. Cannot be used with
+	// source.upload.
+	// +optional
+	Build *BuildSpec `json:"build,omitempty"`
+
+	// PublishSchedule holds new content back until it may go live. New
+	// commits are still fetched (and built) right away, but only served
+	// at the time the schedule allows.
+	// +optional
+	PublishSchedule *PublishSchedule `json:"publishSchedule,omitempty"`
+
+	// FreezeWindows are periods in which the served content doesn't change.
+	// New content waits until the window ends, unless a sync is triggered
+	// with the X-Pages-Override-Freeze: true header.
+	// +optional
+	FreezeWindows []FreezeWindow `json:"freezeWindows,omitempty"`
+
+	// Verification only publishes commits signed by trusted keys. Commits
+	// that are unsigned or signed by an unknown key are not checked out;
+	// the Verified condition shows the result. Requires Repo.
+	// +optional
+	Verification *VerificationSpec `json:"verification,omitempty"`
+}
+
+// SiteSource is a non-Git content source. Exactly one field must be set.
+// +kubebuilder:validation:XValidation:rule="[has(self.oci), has(self.archive), has(self.s3), has(self.upload)].filter(x, x).size() == 1",message="exactly one source must be set"
+type SiteSource struct {
+	// OCI pulls the content from an OCI artifact or image in a registry
+	// +optional
+	OCI *OCISource `json:"oci,omitempty"`
+
+	// Archive downloads the content as .tar.gz or .zip from a URL
+	// +optional
+	Archive *ArchiveSource `json:"archive,omitempty"`
+
+	// S3 mirrors the objects below a prefix of an S3-compatible bucket
+	// +optional
+	S3 *S3Source `json:"s3,omitempty"`
+
+	// Upload takes the content from uploads to the syncer's
+	// PUT /deploy/{namespace}/{name} endpoint instead of fetching it
+	// +optional
+	Upload *UploadSource `json:"upload,omitempty"`
+}
+
+// OCISource is an OCI artifact or image whose layers hold the site content
+type OCISource struct {
+	// Image is the reference without scheme, e.g.
+	// registry.example.com/team/site:latest. The registry host must be in
+	// the syncer's allowed hosts.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9.-]+(:[0-9]+)?/[a-z0-9._/-]+(:[A-Za-z0-9_][A-Za-z0-9._-]{0,127})?$`
+	Image string `json:"image"`
+
+	// Digest pins the manifest, e.g. sha256:<64 hex digits>. The tag of
+	// Image is ignored if set.
+	// +kubebuilder:validation:Pattern=`^sha256:[0-9a-f]{64}$`
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// SecretRef references a pull Secret, either of type
+	// kubernetes.io/dockerconfigjson or with username and password keys.
+	// Key is not used.
+	// +optional
+	SecretRef *SecretReference `json:"secretRef,omitempty"`
+}
+
+// ArchiveSource is a .tar.gz or .zip archive holding the site content, like
+// a CI artifact or a release asset
+type ArchiveSource struct {
+	// URL of the archive. The host, and the host of every redirect, must be
+	// in the syncer's allowed hosts.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
+
+	// SHA256 is the expected checksum of the archive as 64 hex digits.
+	// Archives with another checksum are not published.
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]{64}$`
+	// +optional
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// S3Source is a prefix in a bucket of an S3-compatible object store like
+// MinIO, whose objects are the site content
+type S3Source struct {
+	// Endpoint is the URL of the S3 API, e.g. https://minio.example.com.
+	// Buckets are addressed path-style. The host must be in the syncer's
+	// allowed hosts.
+	// +kubebuilder:validation:Pattern=`^https?://[^/?#]+/?$`
+	Endpoint string `json:"endpoint"`
+
+	// Bucket is the name of the bucket
+	// +kubebuilder:validation:Pattern=`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`
+	Bucket string `json:"bucket"`
+
+	// Prefix selects the objects below it, e.g. "sites/docs/". The prefix is
+	// stripped from the object keys to get the file paths.
+	// +optional
+	Prefix string `json:"prefix,omitempty"`
+
+	// Region is used for request signing (default: us-east-1)
+	// +kubebuilder:default=us-east-1
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// SecretRef references a Secret with accessKeyID and secretAccessKey
+	// keys. Without it the bucket is read anonymously. Key is not used.
+	// +optional
+	SecretRef *SecretReference `json:"secretRef,omitempty"`
+}
+
+// UploadSource marks a site whose content is pushed, e.g. by CI. It has no
+// settings; the syncer never fetches content for such a site.
+type UploadSource struct{}
+
+// BuildSpec is the build step that turns the fetched content into the site
+type BuildSpec struct {
+	// Image of the build container, e.g. hugomods/hugo:exts-0.139.0
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// Command runs in the build container, in a copy of Path, e.g.
+	// ["hugo", "--minify"]. The commit is passed as PAGES_REVISION.
+	// +kubebuilder:validation:MinItems=1
+	Command []string `json:"command"`
+
+	// OutputDir is the directory the build writes the site to, relative
+	// to Path, e.g. "public" or "dist"
+	// +kubebuilder:validation:Pattern=`^/?([a-zA-Z0-9._-]*[a-zA-Z0-9_-][a-zA-Z0-9._-]*/?)*$`
+	OutputDir string `json:"outputDir"`
+
+	// Timeout limits the build as Go duration (default: 10m)
+	// +kubebuilder:default="10m"
+	// +optional
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// PublishSchedule says when new content goes live. Exactly one of Cron and
+// PublishAt must be set.
+// +kubebuilder:validation:XValidation:rule="has(self.cron) != has(self.publishAt)",message="exactly one of cron and publishAt must be set"
+type PublishSchedule struct {
+	// Cron is a five-field cron expression (minute hour day-of-month month
+	// day-of-week), e.g. "0 9 * * 1-5". New content goes live at the first
+	// match after it was fetched.
+	// +kubebuilder:validation:Pattern=`^\S+(\s+\S+){4}$`
+	// +optional
+	Cron string `json:"cron,omitempty"`
+
+	// TimeZone of Cron as IANA name, e.g. "Europe/Berlin" (default: UTC)
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// PublishAt holds all new content until this time; content fetched
+	// afterwards goes live right away
+	// +optional
+	PublishAt *metav1.Time `json:"publishAt,omitempty"`
+}
+
+// FreezeWindow is a period in which the served content doesn't change
+// +kubebuilder:validation:XValidation:rule="timestamp(self.end) > timestamp(self.start)",message="end must be after start"
+type FreezeWindow struct {
+	// Start of the window
+	Start metav1.Time `json:"start"`
+
+	// End of the window; held content goes live from then on
+	End metav1.Time `json:"end"`
+
+	// Reason is shown in the status while content is held, e.g. "Product launch"
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// VerificationSpec restricts publishing to commits signed by trusted keys
+type VerificationSpec struct {
+	// SecretRef references a Secret with the public keys of the approved
+	// signers. Every entry holds an ASCII-armored OpenPGP key block or SSH
+	// public keys, one per line in authorized_keys or allowed_signers format.
+	SecretRef LocalSecretReference `json:"secretRef"`
+}
+
+// LocalSecretReference references a Secret in the site's namespace
+type LocalSecretReference struct {
+	// Name of the Secret
+	Name string `json:"name"`
+}
+
+// TagSelector selects the tag to deploy. Exactly one of Semver and Pattern must be set.
+type TagSelector struct {
+	// Semver is a version constraint like ">=1.2.0 <2.0.0" or "^1.4".
+	// Tags that are not valid semantic versions (an optional "v" prefix is allowed) are ignored.
+	// +optional
+	Semver string `json:"semver,omitempty"`
+
+	// Pattern is a glob like "release-*". Matching tags are ordered
+	// naturally, so "release-10" is higher than "release-9".
+	// +optional
+	Pattern string `json:"pattern,omitempty"`
 }
 
 // SecretReference references a Kubernetes Secret
@@ -112,6 +347,53 @@ type StaticSiteStatus struct {
 	// Provides visibility since resources are created in the system namespace
 	// +optional
 	Resources *ManagedResources `json:"resources,omitempty"`
+
+	// Build describes the last build Job of a site with spec.build
+	// +optional
+	Build *BuildStatus `json:"build,omitempty"`
+
+	// Pending is fetched content waiting for the publish schedule or the
+	// end of a freeze window
+	// +optional
+	Pending *PendingRelease `json:"pending,omitempty"`
+}
+
+// PendingRelease is fetched content that is not served yet
+type PendingRelease struct {
+	// Commit that goes live next
+	Commit string `json:"commit,omitempty"`
+
+	// PublishAt is when the commit goes live
+	// +optional
+	PublishAt *metav1.Time `json:"publishAt,omitempty"`
+
+	// Reason the commit is held, the publish schedule or a freeze window
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// BuildStatus describes a build Job
+type BuildStatus struct {
+	// Commit that was built
+	Commit string `json:"commit,omitempty"`
+
+	// Phase: Running, Succeeded, Failed
+	Phase string `json:"phase,omitempty"`
+
+	// Job is the namespace/name of the build Job
+	Job string `json:"job,omitempty"`
+
+	// Logs is the command to read the build log. Finished Jobs are kept
+	// for a day.
+	Logs string `json:"logs,omitempty"`
+
+	// StartTime of the build
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// Duration of the finished build, e.g. "1m23s"
+	// +optional
+	Duration string `json:"duration,omitempty"`
 }
 
 // ManagedResources tracks the Kubernetes resources created for a StaticSite
@@ -148,6 +430,14 @@ const (
 const (
 	// ConditionCertificateReady indicates whether the TLS certificate is ready
 	ConditionCertificateReady = "CertificateReady"
+
+	// ConditionRepaired is set by the syncer when it replaced a damaged
+	// checkout with a fresh clone
+	ConditionRepaired = "Repaired"
+
+	// ConditionVerified is set by the syncer for sites with verification:
+	// whether the last fetched commit is signed by a trusted key, and by whom
+	ConditionVerified = "Verified"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -9,6 +9,26 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3Source) DeepCopyInto(out *S3Source) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3Source.
+func (in *S3Source) DeepCopy() *S3Source {
+	if in == nil {
+		return nil
+	}
+	out := new(S3Source)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SecretReference) DeepCopyInto(out *SecretReference) {
 	*out = *in
@@ -24,6 +44,91 @@ func (in *SecretReference) DeepCopy() *SecretReference {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TagSelector) DeepCopyInto(out *TagSelector) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TagSelector.
+func (in *TagSelector) DeepCopy() *TagSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(TagSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SiteSource) DeepCopyInto(out *SiteSource) {
+	*out = *in
+	if in.OCI != nil {
+		in, out := &in.OCI, &out.OCI
+		*out = new(OCISource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Archive != nil {
+		in, out := &in.Archive, &out.Archive
+		*out = new(ArchiveSource)
+		**out = **in
+	}
+	if in.S3 != nil {
+		in, out := &in.S3, &out.S3
+		*out = new(S3Source)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Upload != nil {
+		in, out := &in.Upload, &out.Upload
+		*out = new(UploadSource)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SiteSource.
+func (in *SiteSource) DeepCopy() *SiteSource {
+	if in == nil {
+		return nil
+	}
+	out := new(SiteSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OCISource) DeepCopyInto(out *OCISource) {
+	*out = *in
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(SecretReference)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OCISource.
+func (in *OCISource) DeepCopy() *OCISource {
+	if in == nil {
+		return nil
+	}
+	out := new(OCISource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ArchiveSource) DeepCopyInto(out *ArchiveSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ArchiveSource.
+func (in *ArchiveSource) DeepCopy() *ArchiveSource {
+	if in == nil {
+		return nil
+	}
+	out := new(ArchiveSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StaticSite) DeepCopyInto(out *StaticSite) {
 	*out = *in
@@ -86,11 +191,43 @@ func (in *StaticSiteList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *StaticSiteSpec) DeepCopyInto(out *StaticSiteSpec) {
 	*out = *in
+	if in.Source != nil {
+		in, out := &in.Source, &out.Source
+		*out = new(SiteSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.TagSelector != nil {
+		in, out := &in.TagSelector, &out.TagSelector
+		*out = new(TagSelector)
+		**out = **in
+	}
 	if in.SecretRef != nil {
 		in, out := &in.SecretRef, &out.SecretRef
 		*out = new(SecretReference)
 		**out = **in
 	}
+	if in.Build != nil {
+		in, out := &in.Build, &out.Build
+		*out = new(BuildSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.PublishSchedule != nil {
+		in, out := &in.PublishSchedule, &out.PublishSchedule
+		*out = new(PublishSchedule)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.FreezeWindows != nil {
+		in, out := &in.FreezeWindows, &out.FreezeWindows
+		*out = make([]FreezeWindow, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Verification != nil {
+		in, out := &in.Verification, &out.Verification
+		*out = new(VerificationSpec)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StaticSiteSpec.
@@ -137,6 +274,16 @@ func (in *StaticSiteStatus) DeepCopyInto(out *StaticSiteStatus) {
 		*out = new(ManagedResources)
 		**out = **in
 	}
+	if in.Build != nil {
+		in, out := &in.Build, &out.Build
+		*out = new(BuildStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Pending != nil {
+		in, out := &in.Pending, &out.Pending
+		*out = new(PendingRelease)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StaticSiteStatus.
@@ -148,3 +295,142 @@ func (in *StaticSiteStatus) DeepCopy() *StaticSiteStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UploadSource) DeepCopyInto(out *UploadSource) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UploadSource.
+func (in *UploadSource) DeepCopy() *UploadSource {
+	if in == nil {
+		return nil
+	}
+	out := new(UploadSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildSpec) DeepCopyInto(out *BuildSpec) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildSpec.
+func (in *BuildSpec) DeepCopy() *BuildSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *BuildStatus) DeepCopyInto(out *BuildStatus) {
+	*out = *in
+	if in.StartTime != nil {
+		in, out := &in.StartTime, &out.StartTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new BuildStatus.
+func (in *BuildStatus) DeepCopy() *BuildStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(BuildStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PublishSchedule) DeepCopyInto(out *PublishSchedule) {
+	*out = *in
+	if in.PublishAt != nil {
+		in, out := &in.PublishAt, &out.PublishAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PublishSchedule.
+func (in *PublishSchedule) DeepCopy() *PublishSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(PublishSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *FreezeWindow) DeepCopyInto(out *FreezeWindow) {
+	*out = *in
+	in.Start.DeepCopyInto(&out.Start)
+	in.End.DeepCopyInto(&out.End)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new FreezeWindow.
+func (in *FreezeWindow) DeepCopy() *FreezeWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(FreezeWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PendingRelease) DeepCopyInto(out *PendingRelease) {
+	*out = *in
+	if in.PublishAt != nil {
+		in, out := &in.PublishAt, &out.PublishAt
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PendingRelease.
+func (in *PendingRelease) DeepCopy() *PendingRelease {
+	if in == nil {
+		return nil
+	}
+	out := new(PendingRelease)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VerificationSpec) DeepCopyInto(out *VerificationSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VerificationSpec.
+func (in *VerificationSpec) DeepCopy() *VerificationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VerificationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalSecretReference) DeepCopyInto(out *LocalSecretReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalSecretReference.
+func (in *LocalSecretReference) DeepCopy() *LocalSecretReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalSecretReference)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -123,6 +123,15 @@ func resourceNameWithSuffix(site *pagesv1.StaticSite, suffix string) string {
 	return truncateK8sName(name)
 }
 
+// siteContentDir returns the directory of the site's content below the nginx
+// root. It must match the directory the syncer publishes to, so sites with
+// the same name in different namespaces don't share content. Unlike resource
+// names it is not truncated.
+// Format: {namespace}--{name}, e.g., "customer-ns--my-site"
+func siteContentDir(site *pagesv1.StaticSite) string {
+	return fmt.Sprintf("%s--%s", site.Namespace, site.Name)
+}
+
 // generateSecureToken creates a cryptographically secure random token
 func generateSecureToken(length int) (string, error) {
 	b := make([]byte, length)
@@ -315,7 +324,7 @@ func (r *StaticSiteReconciler) reconcileMiddleware(ctx context.Context, site *pa
 	return nil
 }
 
-// createAddPrefixMiddleware creates the middleware that adds /<sitename> prefix for nginx routing
+// createAddPrefixMiddleware creates the middleware that adds the /{namespace}--{name} prefix for nginx routing
 // Created in the system namespace with namespace-prefixed name for isolation
 func (r *StaticSiteReconciler) createAddPrefixMiddleware(ctx context.Context, site *pagesv1.StaticSite) error {
 	middleware := &unstructured.Unstructured{
@@ -333,7 +342,7 @@ func (r *StaticSiteReconciler) createAddPrefixMiddleware(ctx context.Context, si
 			},
 			"spec": map[string]interface{}{
 				"addPrefix": map[string]interface{}{
-					"prefix": "/" + site.Name,
+					"prefix": "/" + siteContentDir(site),
 				},
 			},
 		},
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"strings"
 	"testing"
 
 	pagesv1 "github.com/kup6s/pages/pkg/apis/v1beta1"
@@ -14,6 +15,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/tools/events"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -396,6 +398,61 @@ func TestResourceNameWithSuffix(t *testing.T) {
 	}
 }
 
+func TestSiteContentDir(t *testing.T) {
+	long := strings.Repeat("a", 60)
+	tests := []struct {
+		namespace string
+		name      string
+		want      string
+	}{
+		{"default", "docs", "default--docs"},
+		{"team-b", "docs", "team-b--docs"},
+		// Not truncated like resource names, it must match the syncer
+		{long, "docs", long + "--docs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace+"/"+tt.name, func(t *testing.T) {
+			site := &pagesv1.StaticSite{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      tt.name,
+					Namespace: tt.namespace,
+				},
+			}
+			if got := siteContentDir(site); got != tt.want {
+				t.Errorf("siteContentDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateAddPrefixMiddleware_NamespaceQualified(t *testing.T) {
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{middlewareGVR: "MiddlewareList"},
+	)
+	r := &StaticSiteReconciler{DynamicClient: dynClient, NginxNamespace: "kup6s-pages"}
+	ctx := context.Background()
+
+	for _, ns := range []string{"team-a", "team-b"} {
+		site := &pagesv1.StaticSite{ObjectMeta: metav1.ObjectMeta{Name: "docs", Namespace: ns}}
+		if err := r.createAddPrefixMiddleware(ctx, site); err != nil {
+			t.Fatalf("createAddPrefixMiddleware() error = %v", err)
+		}
+	}
+
+	for _, ns := range []string{"team-a", "team-b"} {
+		mw, err := dynClient.Resource(middlewareGVR).Namespace("kup6s-pages").Get(ctx, ns+"--docs-prefix", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("middleware for %s not found: %v", ns, err)
+		}
+		prefix, _, _ := unstructured.NestedString(mw.Object, "spec", "addPrefix", "prefix")
+		if want := "/" + ns + "--docs"; prefix != want {
+			t.Errorf("addPrefix = %q, want %q", prefix, want)
+		}
+	}
+}
+
 // fakeDynamicClient für Controller-Tests
 type fakeDynamicClient struct{}
 
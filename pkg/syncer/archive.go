@@ -0,0 +1,306 @@
+// Package syncer - archive downloads as site content
+package syncer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// archiveStateFile remembers the last archive download of a site
+	archiveStateFile = ".archive.json"
+
+	// maxRedirects limits the redirects followed for a download
+	maxRedirects = 10
+)
+
+// archiveState is what the server told about the last downloaded archive,
+// so the next poll can ask whether it changed
+type archiveState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Release      string `json:"release"`
+}
+
+// archiveDownload is a downloaded archive and its SHA-256 checksum
+type archiveDownload struct {
+	file         string
+	sum          string
+	etag         string
+	lastModified string
+}
+
+// validateFetchURL checks that a URL content is downloaded from uses https
+// (http only for loopback hosts) and points to an allowed host
+func (s *Syncer) validateFetchURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", rawURL)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("credentials in URL are not allowed")
+	}
+	host := strings.ToLower(u.Hostname())
+	if u.Scheme != "https" && u.Scheme != registryScheme(host) {
+		return nil, fmt.Errorf("URL %s must use https", u.Redacted())
+	}
+	if err := s.validateHost(host); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// fetchClient returns an HTTP client that only follows redirects to
+// allowed hosts, since release assets usually redirect to a CDN. It trusts
+// caBundle in addition to the system roots.
+func (s *Syncer) fetchClient(caBundle []byte) (*http.Client, error) {
+	client, err := s.httpClient(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if _, err := s.validateFetchURL(req.URL.String()); err != nil {
+			return fmt.Errorf("redirect rejected: %w", err)
+		}
+		return nil
+	}
+	return client, nil
+}
+
+// downloadArchive downloads the site's archive into dir. With a previous
+// state the request is conditional; nil is returned if the archive didn't
+// change.
+func (s *Syncer) downloadArchive(ctx context.Context, site *staticSiteData, dir string, state *archiveState) (*archiveDownload, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, site.Archive.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		if state.ETag != "" {
+			req.Header.Set("If-None-Match", state.ETag)
+		}
+		if state.LastModified != "" {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	}
+
+	client, err := s.fetchClient(s.GitCABundle)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("archive download failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified && state != nil {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("archive download failed: %s", resp.Status)
+	}
+
+	// The archive is capped like an upload, so an endless response can't
+	// fill the volume
+	limit := s.MaxUploadSize
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, fmt.Errorf("archive exceeds the limit of %d bytes", limit)
+	}
+	body := io.Reader(resp.Body)
+	if limit > 0 {
+		body = io.LimitReader(resp.Body, limit+1)
+	}
+
+	f, err := os.Create(filepath.Join(dir, "archive"))
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), body)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("archive download failed: %w", err)
+	}
+	if limit > 0 && n > limit {
+		_ = f.Close()
+		return nil, fmt.Errorf("archive exceeds the limit of %d bytes", limit)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	download := &archiveDownload{
+		file:         f.Name(),
+		sum:          hex.EncodeToString(hash.Sum(nil)),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	if site.Archive.SHA256 != "" && download.sum != site.Archive.SHA256 {
+		return nil, fmt.Errorf("archive checksum mismatch: got %s, want %s", download.sum, site.Archive.SHA256)
+	}
+	return download, nil
+}
+
+// extractArchive unpacks a .tar.gz or .zip file into destDir, telling
+// them apart by their content
+func extractArchive(name, destDir string, limit *extractLimit) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(f, magic)
+	magic = magic[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("invalid gzip: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		return extractTar(gz, destDir, false, limit)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		return extractZip(name, destDir, limit)
+	default:
+		return fmt.Errorf("unsupported archive format, expected .tar.gz or .zip")
+	}
+}
+
+// readArchiveState returns the state of the last download of the site's
+// archive, or nil if there is none for the current URL and checksum or its
+// release is gone
+func (s *Syncer) readArchiveState(site *staticSiteData) *archiveState {
+	releasesDir := s.releasesDir(site.dirName())
+	data, err := os.ReadFile(filepath.Join(releasesDir, archiveStateFile))
+	if err != nil {
+		return nil
+	}
+	var state archiveState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	if state.URL != site.Archive.URL || state.Release == "" {
+		return nil
+	}
+	if site.Archive.SHA256 != "" && state.Release != site.Archive.SHA256 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(releasesDir, state.Release)); err != nil {
+		return nil
+	}
+	return &state
+}
+
+// syncArchive publishes the content of the site's archive. Releases are
+// named after the archive's SHA-256 checksum; unchanged archives are
+// detected with ETag and Last-Modified and not downloaded again.
+func (s *Syncer) syncArchive(ctx context.Context, site *staticSiteData) error {
+	logger := log.FromContext(ctx)
+
+	// SSRF protection: the archive must be on an allowed host
+	u, err := s.validateFetchURL(site.Archive.URL)
+	if err != nil {
+		return fmt.Errorf("archive URL validation failed: %w", err)
+	}
+
+	release, err := s.acquireHost(ctx, strings.ToLower(u.Hostname()))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// A Git checkout of a site that moved to an archive is no longer needed
+	if err := os.RemoveAll(s.repoDir(site.dirName())); err != nil {
+		return fmt.Errorf("failed to remove Git checkout: %w", err)
+	}
+
+	releasesDir := s.releasesDir(site.dirName())
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create releases directory: %w", err)
+	}
+	// Downloaded like an interrupted release, so leftovers get pruned
+	workDir, err := os.MkdirTemp(releasesDir, ".archive-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(workDir) }()
+
+	state := s.readArchiveState(site)
+	download, err := s.downloadArchive(ctx, site, workDir, state)
+	if err != nil {
+		return err
+	}
+	var releaseName string
+	if download != nil {
+		releaseName = download.sum
+	} else {
+		// Not modified, the archive is the one of the last download
+		releaseName = state.Release
+	}
+
+	content := func() (string, error) {
+		if download == nil {
+			// The layout changed, the content is needed after all
+			if download, err = s.downloadArchive(ctx, site, workDir, nil); err != nil {
+				return "", err
+			}
+			if download.sum != releaseName {
+				return "", fmt.Errorf("archive changed during sync")
+			}
+		}
+		logger.Info("Extracting archive", "site", site.Name, "url", u.Redacted(), "sha256", download.sum)
+		unpackDir := filepath.Join(workDir, "content")
+		if err := os.Mkdir(unpackDir, 0755); err != nil {
+			return "", err
+		}
+		if err := extractArchive(download.file, unpackDir, s.newExtractLimit()); err != nil {
+			return "", fmt.Errorf("failed to extract archive: %w", err)
+		}
+		contentDir, err := resolveSubpath(unpackDir, site.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to setup subpath: %w", err)
+		}
+		return contentDir, nil
+	}
+
+	if err := s.publishSite(ctx, site, releaseName, "Synced successfully", content); err != nil {
+		return err
+	}
+	if download == nil {
+		return nil
+	}
+	state = &archiveState{
+		URL:          site.Archive.URL,
+		ETag:         download.etag,
+		LastModified: download.lastModified,
+		Release:      releaseName,
+	}
+	if err := writeJSONFile(filepath.Join(releasesDir, archiveStateFile), state); err != nil {
+		return fmt.Errorf("failed to record archive state: %w", err)
+	}
+	return nil
+}
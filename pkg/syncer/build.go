@@ -0,0 +1,281 @@
+// Package syncer - site builds in Kubernetes Jobs
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// buildsDirName holds the workspaces of builds, one per site and commit
+	buildsDirName = ".builds"
+
+	// DefaultBuildTimeout limits builds without spec.build.timeout
+	DefaultBuildTimeout = 10 * time.Minute
+
+	// buildGracePeriod is added to the build timeout for pulling the image
+	// and scheduling the Pod, before the syncer gives up on a Job
+	buildGracePeriod = 5 * time.Minute
+
+	// buildJobTTL keeps finished build Jobs, and with them the logs, for a day
+	buildJobTTL = 24 * 60 * 60
+
+	// defaultBuildPollInterval is how often a running build Job is checked
+	defaultBuildPollInterval = 2 * time.Second
+
+	// buildWorkspace is where the workspace is mounted in the build container
+	buildWorkspace = "/workspace"
+)
+
+// buildSpec is the build step of a site
+type buildSpec struct {
+	Image     string
+	Command   []string
+	OutputDir string
+	Timeout   string
+}
+
+// key identifies the settings that determine what a build produces
+func (b *buildSpec) key() string {
+	data, _ := json.Marshal([]any{b.Image, b.Command, b.OutputDir})
+	return string(data)
+}
+
+// buildStatus is status.build of a StaticSite
+type buildStatus struct {
+	Commit    string `json:"commit"`
+	Phase     string `json:"phase"`
+	Job       string `json:"job"`
+	Logs      string `json:"logs"`
+	StartTime string `json:"startTime"`
+	Duration  string `json:"duration"`
+}
+
+// runBuild runs the site's build in a Job on a copy of contentDir and
+// returns the build's output directory. cleanup removes the copy once the
+// output is published.
+func (s *Syncer) runBuild(ctx context.Context, site *staticSiteData, commit, contentDir string) (output string, cleanup func(), err error) {
+	logger := log.FromContext(ctx)
+
+	if s.BuildVolumeClaim == "" {
+		return "", nil, fmt.Errorf("builds are not enabled on this syncer")
+	}
+	timeout := DefaultBuildTimeout
+	if site.Build.Timeout != "" {
+		timeout, err = time.ParseDuration(site.Build.Timeout)
+		if err != nil || timeout <= 0 {
+			return "", nil, fmt.Errorf("invalid build timeout %q", site.Build.Timeout)
+		}
+	}
+
+	// The build works on a copy on the shared volume, so the checkout
+	// stays clean for the next pull
+	subPath := filepath.Join(buildsDirName, site.dirName(), commit)
+	workspace := filepath.Join(s.SitesRoot, subPath)
+	cleanup = func() { _ = os.RemoveAll(workspace) }
+	cleanup()
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create build workspace: %w", err)
+	}
+	if err := copyTree(contentDir, workspace); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to prepare build workspace: %w", err)
+	}
+
+	started := time.Now()
+	job, err := s.ClientSet.BatchV1().Jobs(s.BuildNamespace).Create(ctx, s.buildJob(site, commit, subPath, timeout), metav1.CreateOptions{})
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to create build job: %w", err)
+	}
+	status := &buildStatus{
+		Commit:    shortHash(commit),
+		Phase:     "Running",
+		Job:       job.Namespace + "/" + job.Name,
+		Logs:      fmt.Sprintf("kubectl logs -n %s job/%s", job.Namespace, job.Name),
+		StartTime: started.UTC().Format(time.RFC3339),
+	}
+	s.updateBuildStatus(ctx, site, status)
+	logger.Info("Building site", "site", site.Name, "commit", shortHash(commit), "job", status.Job)
+
+	err = s.waitForBuild(ctx, job.Name, timeout)
+	status.Duration = time.Since(started).Round(time.Second).String()
+	if err != nil {
+		status.Phase = "Failed"
+		s.updateBuildStatus(ctx, site, status)
+		cleanup()
+		return "", nil, fmt.Errorf("build %s failed: %w", status.Job, err)
+	}
+	status.Phase = "Succeeded"
+	s.updateBuildStatus(ctx, site, status)
+	logger.Info("Build complete", "site", site.Name, "commit", shortHash(commit), "duration", status.Duration)
+
+	output, err = buildOutput(workspace, site.Build.OutputDir)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return output, cleanup, nil
+}
+
+// buildJob returns the Job that builds commit in the workspace at subPath
+// of the sites volume. It runs with the syncer's user, without API access
+// and privileges.
+func (s *Syncer) buildJob(site *staticSiteData, commit, subPath string, timeout time.Duration) *batchv1.Job {
+	labels := map[string]string{
+		"pages.kup6s.com/build":          "true",
+		"pages.kup6s.com/site-name":      site.Name,
+		"pages.kup6s.com/site-namespace": site.Namespace,
+	}
+	// Jobs of all sites share one namespace; the suffix keeps the names of
+	// sites with the same name, and of repeated builds, apart
+	prefix := strings.Trim(strings.ReplaceAll(site.Name[:min(len(site.Name), 40)], ".", "-"), "-")
+	name := fmt.Sprintf("build-%s-%s", prefix, utilrand.String(5))
+
+	uid, gid := int64(os.Getuid()), int64(os.Getgid())
+	deadline := int64(timeout.Seconds())
+	backoffLimit := int32(0)
+	ttl := int32(buildJobTTL)
+	disabled := false
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   s.BuildNamespace,
+			Labels:      labels,
+			Annotations: map[string]string{"pages.kup6s.com/revision": commit},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:                corev1.RestartPolicyNever,
+					AutomountServiceAccountToken: &disabled,
+					EnableServiceLinks:           &disabled,
+					SecurityContext: &corev1.PodSecurityContext{
+						RunAsUser:      &uid,
+						RunAsGroup:     &gid,
+						SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+					},
+					Containers: []corev1.Container{{
+						Name:       "build",
+						Image:      site.Build.Image,
+						Command:    site.Build.Command,
+						WorkingDir: buildWorkspace,
+						Env:        []corev1.EnvVar{{Name: "PAGES_REVISION", Value: commit}},
+						SecurityContext: &corev1.SecurityContext{
+							AllowPrivilegeEscalation: &disabled,
+							Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+						},
+						VolumeMounts: []corev1.VolumeMount{{Name: "workspace", MountPath: buildWorkspace, SubPath: subPath}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: "workspace",
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: s.BuildVolumeClaim},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// waitForBuild polls the Job name until it completed or failed. A Job that
+// hasn't finished within the timeout and a grace period is deleted.
+func (s *Syncer) waitForBuild(ctx context.Context, name string, timeout time.Duration) error {
+	jobs := s.ClientSet.BatchV1().Jobs(s.BuildNamespace)
+	interval := s.buildPollInterval
+	if interval == 0 {
+		interval = defaultBuildPollInterval
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout+buildGracePeriod)
+	defer cancel()
+	for {
+		job, err := jobs.Get(waitCtx, name, metav1.GetOptions{})
+		if err != nil && waitCtx.Err() == nil {
+			return fmt.Errorf("failed to get build job: %w", err)
+		}
+		if err == nil {
+			for _, c := range job.Status.Conditions {
+				if c.Status != corev1.ConditionTrue {
+					continue
+				}
+				switch c.Type {
+				case batchv1.JobComplete:
+					return nil
+				case batchv1.JobFailed:
+					return fmt.Errorf("%s: %s", c.Reason, c.Message)
+				}
+			}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			// Don't leave a build running that nobody waits for
+			propagation := metav1.DeletePropagationBackground
+			if err := jobs.Delete(context.WithoutCancel(ctx), name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil {
+				log.FromContext(ctx).Error(err, "Failed to delete build job", "job", name)
+			}
+			return fmt.Errorf("job did not finish: %w", waitCtx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// buildOutput returns the output directory of a build in workspace. It has
+// to be a directory inside the workspace, a symlink out of it is rejected.
+func buildOutput(workspace, outputDir string) (string, error) {
+	dir := filepath.Join(workspace, filepath.Clean("/"+outputDir))
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("build output directory %q not found: %w", outputDir, err)
+	}
+	root, err := filepath.EvalSymlinks(workspace)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("build output directory %q points outside of the workspace", outputDir)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("build output %q is not a directory", outputDir)
+	}
+	return resolved, nil
+}
+
+// updateBuildStatus sets status.build of a site
+func (s *Syncer) updateBuildStatus(ctx context.Context, site *staticSiteData, status *buildStatus) {
+	patch := map[string]interface{}{"status": map[string]interface{}{"build": status}}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to marshal build status patch", "site", site.Name)
+		return
+	}
+	_, err = s.DynamicClient.Resource(staticSiteGVR).
+		Namespace(site.Namespace).
+		Patch(ctx, site.Name, types.MergePatchType, patchBytes, metav1.PatchOptions{}, "status")
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update build status", "site", site.Name)
+	}
+}
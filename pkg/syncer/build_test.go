@@ -0,0 +1,299 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// buildRecorder stands in for the cluster running build Jobs: a created Job
+// runs build on its workspace and completes, or fails if build returns an
+// error
+type buildRecorder struct {
+	mu   sync.Mutex
+	jobs []*batchv1.Job
+}
+
+func (b *buildRecorder) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.jobs)
+}
+
+func newBuildTestSyncer(t *testing.T, build func(workspace string, job *batchv1.Job) error) (*Syncer, *fakeDynamicClient, *buildRecorder) {
+	t.Helper()
+
+	client := &fakeDynamicClient{activeSites: []string{"site"}}
+	clientset := fake.NewClientset()
+	s := &Syncer{
+		SitesRoot:         t.TempDir(),
+		AllowedHosts:      []string{"127.0.0.1"},
+		DynamicClient:     client,
+		ClientSet:         clientset,
+		KeepReleases:      3,
+		BuildNamespace:    "pages-system",
+		BuildVolumeClaim:  "pages-sites",
+		buildPollInterval: 10 * time.Millisecond,
+	}
+
+	recorder := &buildRecorder{}
+	clientset.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		recorder.mu.Lock()
+		recorder.jobs = append(recorder.jobs, job.DeepCopy())
+		recorder.mu.Unlock()
+
+		workspace := filepath.Join(s.SitesRoot, job.Spec.Template.Spec.Containers[0].VolumeMounts[0].SubPath)
+		condition := batchv1.JobCondition{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}
+		if err := build(workspace, job); err != nil {
+			condition = batchv1.JobCondition{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: err.Error()}
+		}
+		job.Status.Conditions = append(job.Status.Conditions, condition)
+		// Let the tracker store the finished Job
+		return false, nil, nil
+	})
+	return s, client, recorder
+}
+
+// renderSite is a build that turns index.md into public/index.html
+func renderSite(workspace string, job *batchv1.Job) error {
+	source, err := os.ReadFile(filepath.Join(workspace, "index.md"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(workspace, "public"), 0755); err != nil {
+		return err
+	}
+	revision := job.Spec.Template.Spec.Containers[0].Env[0].Value
+	html := "<h1>" + strings.TrimPrefix(string(source), "# ") + "</h1><!-- " + revision[:12] + " -->"
+	return os.WriteFile(filepath.Join(workspace, "public", "index.html"), []byte(html), 0644)
+}
+
+func TestSyncSite_Build(t *testing.T) {
+	archive := tarGz(t, map[string]string{"site/index.md": "# Hello", "site/config.toml": "title = 'x'"})
+	srv := newTestArchiveServer(t, archive)
+
+	s, client, recorder := newBuildTestSyncer(t, renderSite)
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/site",
+		Archive: &archiveSource{URL: srv.server.URL + "/site.tar.gz"},
+		Build:   &buildSpec{Image: "hugomods/hugo:exts", Command: []string{"hugo", "--minify"}, OutputDir: "public"},
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got, want := readSiteFile(t, s, "default--site", "index.html"), "<h1>Hello</h1><!-- "+sha256Hex(archive)[:12]+" -->"; got != want {
+		t.Errorf("index.html = %q, want %q", got, want)
+	}
+
+	// The Job runs the build on the workspace without privileges
+	job := recorder.jobs[0]
+	pod := job.Spec.Template.Spec
+	container := pod.Containers[0]
+	if job.Namespace != "pages-system" || !strings.HasPrefix(job.Name, "build-site-") {
+		t.Errorf("job = %s/%s", job.Namespace, job.Name)
+	}
+	if container.Image != "hugomods/hugo:exts" || strings.Join(container.Command, " ") != "hugo --minify" {
+		t.Errorf("container = %s %v", container.Image, container.Command)
+	}
+	if pod.Volumes[0].PersistentVolumeClaim.ClaimName != "pages-sites" ||
+		container.VolumeMounts[0].SubPath != filepath.Join(".builds", "default--site", sha256Hex(archive)) {
+		t.Errorf("workspace = %s on %s", container.VolumeMounts[0].SubPath, pod.Volumes[0].PersistentVolumeClaim.ClaimName)
+	}
+	if *pod.AutomountServiceAccountToken || *container.SecurityContext.AllowPrivilegeEscalation || *job.Spec.BackoffLimit != 0 {
+		t.Error("build job is not locked down")
+	}
+	if *job.Spec.ActiveDeadlineSeconds != int64(DefaultBuildTimeout.Seconds()) {
+		t.Errorf("activeDeadlineSeconds = %d", *job.Spec.ActiveDeadlineSeconds)
+	}
+
+	// The build is reported in status, the workspace is removed
+	var reported bool
+	for _, patch := range client.patches {
+		if strings.Contains(string(patch), `"phase":"Succeeded"`) &&
+			strings.Contains(string(patch), "kubectl logs -n pages-system job/"+job.Name) {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Errorf("build not reported in status patches")
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, ".builds", "default--site", sha256Hex(archive))); !os.IsNotExist(err) {
+		t.Error("build workspace not removed")
+	}
+
+	// A published commit isn't built again, a changed build is
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() unchanged error = %v", err)
+	}
+	if recorder.count() != 1 {
+		t.Errorf("builds = %d, want 1", recorder.count())
+	}
+	site.Build.Command = []string{"hugo"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with changed build error = %v", err)
+	}
+	if recorder.count() != 2 {
+		t.Errorf("builds after change = %d, want 2", recorder.count())
+	}
+}
+
+func TestSyncSite_BuildRejected(t *testing.T) {
+	srv := newTestArchiveServer(t, tarGz(t, map[string]string{"index.md": "# Hello"}))
+
+	tests := []struct {
+		name      string
+		build     func(workspace string, job *batchv1.Job) error
+		outputDir string
+		timeout   string
+		disabled  bool
+		wantErr   string
+	}{
+		{
+			name:      "build fails",
+			build:     func(string, *batchv1.Job) error { return errors.New("hugo: template error") },
+			outputDir: "public",
+			wantErr:   "template error",
+		},
+		{
+			name:      "output missing",
+			build:     renderSite,
+			outputDir: "dist",
+			wantErr:   "not found",
+		},
+		{
+			name: "output links outside",
+			build: func(workspace string, _ *batchv1.Job) error {
+				return os.Symlink("/etc", filepath.Join(workspace, "public"))
+			},
+			outputDir: "public",
+			wantErr:   "points outside",
+		},
+		{
+			name:      "invalid timeout",
+			build:     renderSite,
+			outputDir: "public",
+			timeout:   "soon",
+			wantErr:   "invalid build timeout",
+		},
+		{
+			name:      "builds disabled",
+			build:     renderSite,
+			outputDir: "public",
+			disabled:  true,
+			wantErr:   "builds are not enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, _ := newBuildTestSyncer(t, tt.build)
+			if tt.disabled {
+				s.BuildVolumeClaim = ""
+			}
+			site := &staticSiteData{
+				Name: "site", Namespace: "default", Path: "/",
+				Archive: &archiveSource{URL: srv.server.URL + "/site.tar.gz"},
+				Build:   &buildSpec{Image: "hugomods/hugo", Command: []string{"hugo"}, OutputDir: tt.outputDir, Timeout: tt.timeout},
+			}
+
+			err := s.syncSite(context.Background(), site)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("syncSite() error = %v, want %q", err, tt.wantErr)
+			}
+			if s.currentRelease("default--site") != "" {
+				t.Error("site was published")
+			}
+			if entries, _ := os.ReadDir(filepath.Join(s.SitesRoot, ".builds", "default--site")); len(entries) != 0 {
+				t.Error("build workspace not removed")
+			}
+		})
+	}
+}
+
+func TestSyncSite_BuildFreesHostSlot(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.md": "# Hello", "index.html": "home"})
+
+	s, client, _ := newBuildTestSyncer(t, renderSite)
+	s.MaxSyncsPerHost = 1
+	client.activeSites = []string{"built", "other"}
+
+	// The build Job stays pending until finish is closed
+	started, finish := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	s.ClientSet.(*fake.Clientset).PrependReactor("get", "jobs", func(k8stesting.Action) (bool, runtime.Object, error) {
+		select {
+		case <-finish:
+			return false, nil, nil
+		default:
+			once.Do(func() { close(started) })
+			return true, &batchv1.Job{}, nil
+		}
+	})
+
+	built := &staticSiteData{
+		Name: "built", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/",
+		Build: &buildSpec{Image: "hugomods/hugo", Command: []string{"hugo"}, OutputDir: "public"},
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.syncSite(context.Background(), built) }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("build did not start")
+	}
+
+	// Another site of the same host syncs while the build is pending
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	other := &staticSiteData{Name: "other", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/"}
+	if err := s.syncSite(ctx, other); err != nil {
+		t.Fatalf("syncSite() during build error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--other", "index.html"); got != "home" {
+		t.Errorf("index.html = %q, want home", got)
+	}
+
+	close(finish)
+	if err := <-done; err != nil {
+		t.Fatalf("syncSite() with build error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--built", "index.html"); !strings.HasPrefix(got, "<h1>Hello</h1>") {
+		t.Errorf("built index.html = %q", got)
+	}
+}
+
+func TestBuildSpecFromUnstructured(t *testing.T) {
+	site := &staticSiteData{}
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "site", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"repo": "https://example.com/repo.git",
+			"build": map[string]interface{}{
+				"image":     "node:22",
+				"command":   []interface{}{"sh", "-c", "npm ci && npm run build"},
+				"outputDir": "dist",
+				"timeout":   "20m",
+			},
+		},
+	}}
+	if err := site.fromUnstructured(u); err != nil {
+		t.Fatal(err)
+	}
+	if site.Build == nil || site.Build.Image != "node:22" || len(site.Build.Command) != 3 ||
+		site.Build.OutputDir != "dist" || site.Build.Timeout != "20m" {
+		t.Errorf("Build = %+v", site.Build)
+	}
+}
@@ -0,0 +1,140 @@
+// Package syncer - cron expressions of publish schedules
+package syncer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchLimit bounds the search for the next match of a cron
+// expression, so one that never matches (e.g. "0 0 31 2 *") can't loop
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronSchedule is a parsed five-field cron expression. Each field is a set
+// of allowed values, one bit per value.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// With a restricted day of month and day of week, either may match,
+	// like in cron(8)
+	domAny, dowAny bool
+
+	loc *time.Location
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with the
+// usual *, lists, ranges and steps. Day of week 0 and 7 are Sunday. Times
+// are matched in loc.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: want 5 fields, got %d", expr, len(fields))
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is 0 as well as 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+		loc:    loc,
+	}, nil
+}
+
+// parseCronField returns the values a field allows between lo and hi
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		first, last := lo, hi
+		if values != "*" {
+			from, to, isRange := strings.Cut(values, "-")
+			var err error
+			if first, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			switch {
+			case isRange:
+				if last, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", part)
+				}
+			case !hasStep:
+				// "5/15" means from 5 to the end in steps of 15
+				last = first
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// next returns the first match of the schedule after t, or the zero time if
+// there is none in the next years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronSearchLimit)
+
+	for t.Before(limit) {
+		year, month, day := t.Date()
+		switch {
+		case c.month&(1<<month) == 0:
+			t = time.Date(year, month+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(year, month, day+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, c.loc)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// atOrAfter returns the first match of the schedule at or after t
+func (c *cronSchedule) atOrAfter(t time.Time) time.Time {
+	return c.next(t.Add(-time.Nanosecond))
+}
+
+// dayMatches reports whether the day of t is allowed
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<t.Day()) != 0
+	dowMatch := c.dow&(1<<t.Weekday()) != 0
+	if c.domAny || c.dowAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
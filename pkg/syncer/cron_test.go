@@ -0,0 +1,66 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		loc  *time.Location
+		from string
+		want string
+	}{
+		{"* * * * *", time.UTC, "2026-03-02T08:15:30Z", "2026-03-02T08:16:00Z"},
+		{"0 9 * * *", time.UTC, "2026-03-02T08:15:00Z", "2026-03-02T09:00:00Z"},
+		{"0 9 * * *", time.UTC, "2026-03-02T09:00:00Z", "2026-03-03T09:00:00Z"},
+		{"*/15 * * * *", time.UTC, "2026-03-02T08:31:00Z", "2026-03-02T08:45:00Z"},
+		{"5/20 8-10 * * *", time.UTC, "2026-03-02T10:46:00Z", "2026-03-03T08:05:00Z"},
+		{"30 6 * * 1-5", time.UTC, "2026-03-06T07:00:00Z", "2026-03-09T06:30:00Z"},
+		{"0 0 * * 7", time.UTC, "2026-03-02T00:00:00Z", "2026-03-08T00:00:00Z"},
+		{"0 12 1,15 * *", time.UTC, "2026-03-02T00:00:00Z", "2026-03-15T12:00:00Z"},
+		{"0 0 29 2 *", time.UTC, "2026-03-02T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// Day of month and day of week both restricted: either matches
+		{"0 0 13 * 5", time.UTC, "2026-03-02T00:00:00Z", "2026-03-06T00:00:00Z"},
+		// Matched in the time zone, across the switch to summer time
+		{"0 9 * * *", berlin, "2026-03-28T12:00:00Z", "2026-03-29T07:00:00Z"},
+		{"30 2 * * *", berlin, "2026-03-28T12:00:00Z", "2026-03-30T00:30:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			c, err := parseCron(tt.expr, tt.loc)
+			if err != nil {
+				t.Fatalf("parseCron() error = %v", err)
+			}
+			from, _ := time.Parse(time.RFC3339, tt.from)
+			if got := c.next(from).UTC().Format(time.RFC3339); got != tt.want {
+				t.Errorf("next() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNext_NeverMatches(t *testing.T) {
+	c, err := parseCron("0 0 31 2 *", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.next(time.Now()); !got.IsZero() {
+		t.Errorf("next() = %s, want zero time", got)
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "* * * * * *"} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package syncer - content deployed by uploads
+package syncer
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultMaxUploadSize is the default limit for a compressed upload or
+// downloaded archive
+const DefaultMaxUploadSize = 512 << 20
+
+var (
+	// errNotUploadSite is returned when content is pushed to a site that
+	// fetches its content itself
+	errNotUploadSite = errors.New("site does not have spec.source.upload")
+
+	// errInvalidUpload is returned for uploads that can't be published
+	errInvalidUpload = errors.New("invalid upload")
+
+	// revisionLabelPattern matches revision labels, which name releases
+	revisionLabelPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+)
+
+// Deploy publishes a .tar.gz stream as the content of a site with
+// spec.source.upload and returns the revision label. The release is named
+// after the label, or after the checksum of the upload without one;
+// deploying a label again replaces its release. The label is reported as
+// the site's lastCommit. Deploys during a freeze window are refused unless
+// the freeze is overridden.
+func (s *Syncer) Deploy(ctx context.Context, namespace, name, revision string, body io.Reader) (string, error) {
+	logger := log.FromContext(ctx)
+
+	item, err := s.getSiteObject(ctx, namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get StaticSite %s/%s: %w", namespace, name, err)
+	}
+	site := &staticSiteData{}
+	if err := site.fromUnstructured(item); err != nil {
+		return "", err
+	}
+	if !site.Upload {
+		return "", errNotUploadSite
+	}
+	if err := site.checkFreeze(ctx); err != nil {
+		return "", err
+	}
+	if revision != "" && !revisionLabelPattern.MatchString(revision) {
+		return "", fmt.Errorf("%w: revision %q must match %s", errInvalidUpload, revision, revisionLabelPattern)
+	}
+
+	// Don't race with another deploy or a rollback
+	lock := s.siteLock(namespace, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	releasesDir := s.releasesDir(site.dirName())
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create releases directory: %w", err)
+	}
+	// Unpacked like an interrupted release, so leftovers get pruned
+	workDir, err := os.MkdirTemp(releasesDir, ".upload-")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.RemoveAll(workDir) }()
+
+	hash := sha256.New()
+	upload := io.TeeReader(body, hash)
+	gz, err := gzip.NewReader(upload)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+	if err := extractTar(gz, workDir, false, s.newExtractLimit()); err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+	// The checksum covers the whole upload
+	if _, err := io.Copy(io.Discard, upload); err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+	if revision == "" {
+		revision = hex.EncodeToString(hash.Sum(nil))[:12]
+	}
+
+	contentDir, err := resolveSubpath(workDir, site.Path)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidUpload, err)
+	}
+
+	// A deploy is deliberate, it ends a rollback
+	if err := s.clearRollbackHold(site.dirName()); err != nil {
+		return "", fmt.Errorf("failed to clear rollback: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(releasesDir, revision)); err == nil {
+		err = s.replaceRelease(site.dirName(), contentDir, revision)
+	} else {
+		err = s.publishRelease(site.dirName(), contentDir, revision)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to publish release: %w", err)
+	}
+	if err := s.recordReleaseLayout(site.dirName(), site, revision); err != nil {
+		return "", fmt.Errorf("failed to record release layout: %w", err)
+	}
+
+	s.updateStatus(ctx, site, "Ready", fmt.Sprintf("Deployed %s", revision), revision)
+	logger.Info("Deploy complete", "site", site.Name, "revision", revision)
+	return revision, nil
+}
+
+// syncUpload handles the periodic sync of a site deployed by uploads:
+// there is nothing to fetch, the current release stays
+func (s *Syncer) syncUpload(ctx context.Context, site *staticSiteData) error {
+	// A Git checkout of a site that moved to uploads is no longer needed
+	if err := os.RemoveAll(s.repoDir(site.dirName())); err != nil {
+		return fmt.Errorf("failed to remove Git checkout: %w", err)
+	}
+	if s.currentRelease(site.dirName()) == "" {
+		s.updateStatus(ctx, site, "Pending", fmt.Sprintf("Waiting for a deploy to PUT /deploy/%s/%s", site.Namespace, site.Name), "")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newUploadTestServer returns a webhook server for the upload site
+// default/mysite with the token "secret-token"
+func newUploadTestServer(t *testing.T) (*WebhookServer, *fakeDynamicClientWithToken) {
+	t.Helper()
+
+	client := &fakeDynamicClientWithToken{
+		token: "secret-token",
+		spec: map[string]interface{}{
+			"source": map[string]interface{}{"upload": map[string]interface{}{}},
+			"path":   "/public",
+		},
+	}
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client, KeepReleases: 3, MaxUploadSize: DefaultMaxUploadSize}
+	return &WebhookServer{Syncer: s}, client
+}
+
+func deployRequest(w *WebhookServer, query, token string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/deploy/default/mysite"+query, bytes.NewReader(body))
+	req.Header.Set("X-API-Key", token)
+	rr := httptest.NewRecorder()
+	w.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestDeployEndpoint(t *testing.T) {
+	w, client := newUploadTestServer(t)
+	s := w.Syncer
+
+	rr := deployRequest(w, "?revision=build-41", "secret-token", tarGz(t, map[string]string{"public/index.html": "v1"}))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "at build-41") {
+		t.Fatalf("deploy = %d %s", rr.Code, rr.Body.String())
+	}
+	if got := readSiteFile(t, s, "default--mysite", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+	if !strings.Contains(string(client.lastPatch), `"lastCommit":"build-41"`) {
+		t.Errorf("status patch = %s", client.lastPatch)
+	}
+
+	// Another label becomes a new release; rollbacks work by label
+	rr = deployRequest(w, "?revision=build-42", "secret-token", tarGz(t, map[string]string{"public/index.html": "v2"}))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("second deploy = %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := s.Rollback(context.Background(), "default", "mysite", "build-41"); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--mysite", "index.html"); got != "v1" {
+		t.Errorf("index.html after rollback = %q, want v1", got)
+	}
+
+	// Deploying a label again replaces its content and ends the rollback
+	rr = deployRequest(w, "?revision=build-42", "secret-token", tarGz(t, map[string]string{"public/index.html": "v2 fixed"}))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("redeploy = %d %s", rr.Code, rr.Body.String())
+	}
+	if got := readSiteFile(t, s, "default--mysite", "index.html"); got != "v2 fixed" {
+		t.Errorf("index.html after redeploy = %q, want v2 fixed", got)
+	}
+	if s.rollbackHold("default--mysite") != "" {
+		t.Error("rollback hold not cleared by deploy")
+	}
+
+	// Without a label the release is named after the upload's checksum
+	upload := tarGz(t, map[string]string{"public/index.html": "v3"})
+	rr = deployRequest(w, "", "secret-token", upload)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("deploy without revision = %d %s", rr.Code, rr.Body.String())
+	}
+	if want := sha256Hex(upload)[:12]; s.currentRelease("default--mysite") != want {
+		t.Errorf("current release = %q, want %q", s.currentRelease("default--mysite"), want)
+	}
+
+	// The periodic sync leaves deployed content alone
+	site := &staticSiteData{Name: "mysite", Namespace: "default", Path: "/public", Upload: true}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--mysite", "index.html"); got != "v3" {
+		t.Errorf("index.html after sync = %q, want v3", got)
+	}
+}
+
+func TestDeployEndpoint_Rejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		token      string
+		body       func(t *testing.T) []byte
+		repoSite   bool
+		maxSize    int64
+		wantStatus int
+	}{
+		{
+			name: "wrong token", token: "wrong-token",
+			body:       func(t *testing.T) []byte { return tarGz(t, map[string]string{"public/index.html": "x"}) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "site synced from Git", repoSite: true,
+			body:       func(t *testing.T) []byte { return tarGz(t, map[string]string{"public/index.html": "x"}) },
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "invalid revision", query: "?revision=../x",
+			body:       func(t *testing.T) []byte { return tarGz(t, map[string]string{"public/index.html": "x"}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not gzip",
+			body:       func(*testing.T) []byte { return []byte("<html></html>") },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "path traversal",
+			body:       func(t *testing.T) []byte { return tarGz(t, map[string]string{"../evil.html": "x"}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "path missing",
+			body:       func(t *testing.T) []byte { return tarGz(t, map[string]string{"index.html": "x"}) },
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name: "too large", maxSize: 64,
+			body: func(t *testing.T) []byte {
+				return tarGz(t, map[string]string{"public/index.html": strings.Repeat("abcdefgh", 4096)})
+			},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, client := newUploadTestServer(t)
+			if tt.repoSite {
+				client.spec = nil
+			}
+			if tt.maxSize != 0 {
+				w.Syncer.MaxUploadSize = tt.maxSize
+			}
+			token := tt.token
+			if token == "" {
+				token = "secret-token"
+			}
+
+			rr := deployRequest(w, tt.query, token, tt.body(t))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body: %s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if w.Syncer.currentRelease("default--mysite") != "" {
+				t.Error("site was published")
+			}
+		})
+	}
+}
+
+func TestSyncSite_UploadWithoutDeploy(t *testing.T) {
+	client := &fakeDynamicClient{activeSites: []string{"site"}}
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client}
+	site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", Upload: true}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if patch := string(client.lastPatch); !strings.Contains(patch, `"phase":"Pending"`) || !strings.Contains(patch, "PUT /deploy/default/site") {
+		t.Errorf("status patch = %s", patch)
+	}
+}
@@ -0,0 +1,336 @@
+// Package syncer - unpacking of downloaded content
+package syncer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultMaxExtractSize is the default limit for the unpacked content
+	// of a site
+	DefaultMaxExtractSize = 2 << 30
+
+	// maxExtractEntries limits the number of files, directories and links
+	// unpacked for a site
+	maxExtractEntries = 500000
+
+	// whiteoutPrefix marks a file deleted by an image layer
+	whiteoutPrefix = ".wh."
+
+	// whiteoutOpaque marks a directory whose content from lower layers is
+	// hidden
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// localPath returns the path of an archive entry below destDir. Absolute
+// names and names leaving destDir are rejected.
+func localPath(destDir, name string) (string, error) {
+	rel := strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	if rel == "" || rel == "." {
+		return destDir, nil
+	}
+	if strings.Contains(rel, "\\") || !filepath.IsLocal(filepath.FromSlash(rel)) {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+	return filepath.Join(destDir, filepath.FromSlash(rel)), nil
+}
+
+// extractLimit caps what unpacking the content of a site writes to the
+// sites volume, so an archive bomb can't fill it. One limit is shared by
+// all archives or layers of a sync.
+type extractLimit struct {
+	maxBytes int64 // 0 means no limit
+	written  int64
+	entries  int
+}
+
+// newExtractLimit returns the limit for unpacking the content of a site
+func (s *Syncer) newExtractLimit() *extractLimit {
+	return &extractLimit{maxBytes: s.MaxExtractSize}
+}
+
+// entry counts an unpacked file, directory or link
+func (l *extractLimit) entry() error {
+	l.entries++
+	if l.entries > maxExtractEntries {
+		return fmt.Errorf("content has more than %d entries", maxExtractEntries)
+	}
+	return nil
+}
+
+// add counts n bytes written
+func (l *extractLimit) add(n int64) error {
+	l.written += n
+	if l.maxBytes > 0 && l.written > l.maxBytes {
+		return fmt.Errorf("site content exceeds the limit of %d bytes", l.maxBytes)
+	}
+	return nil
+}
+
+// writeFile writes the content of r to name like writeFile, but stops one
+// byte after the limit
+func (l *extractLimit) writeFile(name string, r io.Reader, perm os.FileMode) error {
+	lr := &io.LimitedReader{R: r, N: math.MaxInt64}
+	if l.maxBytes > 0 {
+		lr.N = l.maxBytes - l.written + 1
+	}
+	n := lr.N
+	err := writeFile(name, lr, perm)
+	if limitErr := l.add(n - lr.N); limitErr != nil {
+		return limitErr
+	}
+	return err
+}
+
+// extractTar unpacks a tar stream into destDir. Only regular files,
+// directories and symlinks pointing inside the tree are created, so the
+// content can't write or link outside of destDir. With whiteouts set, the
+// stream is an image layer applied on top of the previous layers: .wh.
+// entries delete files instead of creating them. Unpacking stops at limit.
+func extractTar(r io.Reader, destDir string, whiteouts bool, limit *extractLimit) error {
+	tr := tar.NewReader(r)
+	// Opaque whiteouts only hide what earlier layers created
+	created := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar: %w", err)
+		}
+
+		target, err := localPath(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == destDir {
+			continue
+		}
+		if err := limit.entry(); err != nil {
+			return err
+		}
+		if err := ensureParentDirs(destDir, target); err != nil {
+			return err
+		}
+
+		base := filepath.Base(target)
+		if whiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			dir := filepath.Dir(target)
+			if base == whiteoutOpaque {
+				if err := clearDir(dir, created); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		created[target] = true
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := makeDir(target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := limit.writeFile(target, tr, os.FileMode(hdr.Mode).Perm()|0644); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := makeSymlink(destDir, target, hdr.Name, hdr.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := localPath(destDir, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			info, err := os.Lstat(source)
+			if err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("hard link %q to missing file %q", hdr.Name, hdr.Linkname)
+			}
+			if err := limit.add(info.Size()); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := copyFile(source, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			// Devices, FIFOs etc. have no place in a static site
+		}
+	}
+}
+
+// extractZip unpacks the zip file name into destDir with the same rules as
+// extractTar
+func extractZip(name, destDir string, limit *extractLimit) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return fmt.Errorf("invalid zip: %w", err)
+	}
+	defer func() { _ = zr.Close() }()
+
+	for _, f := range zr.File {
+		target, err := localPath(destDir, f.Name)
+		if err != nil {
+			return err
+		}
+		if target == destDir {
+			continue
+		}
+		if err := limit.entry(); err != nil {
+			return err
+		}
+		if err := ensureParentDirs(destDir, target); err != nil {
+			return err
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = makeDir(target)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipSymlink(f, destDir, target)
+		case mode.IsRegular():
+			err = extractZipFile(f, target, limit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractZipFile writes a regular file of a zip archive to target
+func extractZipFile(f *zip.File, target string, limit *extractLimit) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+	}
+	defer func() { _ = rc.Close() }()
+	return limit.writeFile(target, rc, f.Mode().Perm()|0644)
+}
+
+// extractZipSymlink creates a symlink of a zip archive, whose content is
+// the link target
+func extractZipSymlink(f *zip.File, destDir, target string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+	}
+	defer func() { _ = rc.Close() }()
+	linkname, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return fmt.Errorf("invalid zip entry %q: %w", f.Name, err)
+	}
+	return makeSymlink(destDir, target, f.Name, string(linkname))
+}
+
+// makeDir creates the directory target, replacing a file in its place
+func makeDir(target string) error {
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+// makeSymlink creates a symlink at target, which must stay inside destDir
+func makeSymlink(destDir, target, name, linkname string) error {
+	if !linkInside(destDir, target, linkname) {
+		return fmt.Errorf("symlink %q points outside of the content", name)
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return os.Symlink(linkname, target)
+}
+
+// ensureParentDirs creates the parent directories of target below destDir.
+// Symlinks on the way are refused, they could lead outside of destDir.
+func ensureParentDirs(destDir, target string) error {
+	rel, err := filepath.Rel(destDir, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	dir := destDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("path %q passes through a non-directory", target)
+		}
+	}
+	return nil
+}
+
+// linkInside reports whether a symlink at target with the given link
+// target stays inside destDir
+func linkInside(destDir, target, linkname string) bool {
+	if filepath.IsAbs(linkname) {
+		return false
+	}
+	resolved := filepath.Join(filepath.Dir(target), linkname)
+	rel, err := filepath.Rel(destDir, resolved)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// writeFile writes the content of r to name, replacing what is there
+func writeFile(name string, r io.Reader, perm os.FileMode) error {
+	if err := os.RemoveAll(name); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// clearDir removes the content of dir except the paths in keep
+func clearDir(dir string, keep map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if keep[name] {
+			continue
+		}
+		if err := os.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package syncer
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractTar(t *testing.T) {
+	type entry struct {
+		name     string
+		typeflag byte
+		linkname string
+		content  string
+	}
+
+	tests := []struct {
+		name     string
+		entries  []entry
+		maxBytes int64
+		wantErr  string
+		check    func(t *testing.T, destDir string)
+	}{
+		{
+			name: "files and dirs",
+			entries: []entry{
+				{name: "./", typeflag: tar.TypeDir},
+				{name: "a/b/c.html", typeflag: tar.TypeReg, content: "c"},
+				{name: "a/link.html", typeflag: tar.TypeSymlink, linkname: "b/c.html"},
+				{name: "a/copy.html", typeflag: tar.TypeLink, linkname: "a/b/c.html"},
+			},
+			check: func(t *testing.T, destDir string) {
+				for _, name := range []string{"a/b/c.html", "a/link.html", "a/copy.html"} {
+					data, err := os.ReadFile(filepath.Join(destDir, name))
+					if err != nil || string(data) != "c" {
+						t.Errorf("%s = %q, %v", name, data, err)
+					}
+				}
+			},
+		},
+		{
+			name:    "parent traversal",
+			entries: []entry{{name: "../evil.html", typeflag: tar.TypeReg, content: "x"}},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "absolute path",
+			entries: []entry{{name: "/etc/evil", typeflag: tar.TypeReg, content: "x"}},
+			wantErr: "invalid path",
+		},
+		{
+			name:    "symlink leaving the tree",
+			entries: []entry{{name: "passwd", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"}},
+			wantErr: "points outside",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []entry{{name: "passwd", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			wantErr: "points outside",
+		},
+		{
+			name: "write through symlink",
+			entries: []entry{
+				{name: "dir/", typeflag: tar.TypeDir},
+				{name: "link", typeflag: tar.TypeSymlink, linkname: "dir"},
+				{name: "link/evil.html", typeflag: tar.TypeReg, content: "x"},
+			},
+			wantErr: "non-directory",
+		},
+		{
+			name:    "hard link outside",
+			entries: []entry{{name: "shadow", typeflag: tar.TypeLink, linkname: "../shadow"}},
+			wantErr: "invalid path",
+		},
+		{
+			name: "files over the size limit",
+			entries: []entry{
+				{name: "a.html", typeflag: tar.TypeReg, content: strings.Repeat("a", 600)},
+				{name: "b.html", typeflag: tar.TypeReg, content: strings.Repeat("b", 600)},
+			},
+			maxBytes: 1000,
+			wantErr:  "exceeds the limit of 1000 bytes",
+		},
+		{
+			name: "hard links over the size limit",
+			entries: []entry{
+				{name: "a.html", typeflag: tar.TypeReg, content: strings.Repeat("a", 600)},
+				{name: "b.html", typeflag: tar.TypeLink, linkname: "a.html"},
+			},
+			maxBytes: 1000,
+			wantErr:  "exceeds the limit of 1000 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, e := range tt.entries {
+				hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644, Size: int64(len(e.content))}
+				if e.typeflag != tar.TypeReg {
+					hdr.Size = 0
+				}
+				if err := tw.WriteHeader(hdr); err != nil {
+					t.Fatal(err)
+				}
+				if e.typeflag == tar.TypeReg {
+					_, _ = tw.Write([]byte(e.content))
+				}
+			}
+			_ = tw.Close()
+
+			destDir := filepath.Join(t.TempDir(), "content")
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			err := extractTar(&buf, destDir, false, &extractLimit{maxBytes: tt.maxBytes})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractTar() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractTar() error = %v", err)
+			}
+			tt.check(t, destDir)
+		})
+	}
+}
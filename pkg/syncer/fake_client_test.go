@@ -3,8 +3,11 @@ package syncer
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -21,6 +24,9 @@ type fakeDynamicClient struct {
 	activeSites []string
 	// lastPatch captures the last patch data for testing
 	lastPatch []byte
+	// patches captures all patches in order
+	patches [][]byte
+	mu      sync.Mutex
 }
 
 func (f *fakeDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
@@ -93,7 +99,10 @@ func (f *fakeNamespaceableResource) Watch(ctx context.Context, opts metav1.ListO
 
 func (f *fakeNamespaceableResource) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
 	if f.client != nil {
+		f.client.mu.Lock()
 		f.client.lastPatch = data
+		f.client.patches = append(f.client.patches, data)
+		f.client.mu.Unlock()
 	}
 	return &unstructured.Unstructured{}, nil
 }
@@ -112,7 +121,49 @@ type siteSpec struct {
 	namespace string
 	repo      string
 	branch    string
+	tag       string
+	semver    string
 	path      string
+	interval  string
+	secret    string
+}
+
+// toUnstructured converts the site into a StaticSite object with defaults applied
+func (site siteSpec) toUnstructured() unstructured.Unstructured {
+	branch := site.branch
+	if branch == "" {
+		branch = "main"
+	}
+	path := site.path
+	if path == "" {
+		path = "/"
+	}
+	spec := map[string]interface{}{
+		"repo":   site.repo,
+		"branch": branch,
+		"path":   path,
+	}
+	if site.tag != "" {
+		spec["tag"] = site.tag
+	}
+	if site.semver != "" {
+		spec["tagSelector"] = map[string]interface{}{"semver": site.semver}
+	}
+	if site.interval != "" {
+		spec["syncInterval"] = site.interval
+	}
+	if site.secret != "" {
+		spec["secretRef"] = map[string]interface{}{"name": site.secret}
+	}
+	return unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":      site.name,
+				"namespace": site.namespace,
+			},
+			"spec": spec,
+		},
+	}
 }
 
 // fakeDynamicClientWithSites is a fake dynamic client that returns sites with full specs
@@ -120,6 +171,9 @@ type fakeDynamicClientWithSites struct {
 	sites     []siteSpec
 	getError  bool
 	lastPatch []byte
+	// patched records the names of all patched sites, in order
+	patched []string
+	mu      sync.Mutex
 }
 
 func (f *fakeDynamicClientWithSites) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
@@ -138,27 +192,7 @@ func (f *fakeResourceWithSites) Namespace(ns string) dynamic.ResourceInterface {
 func (f *fakeResourceWithSites) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
 	items := make([]unstructured.Unstructured, len(f.client.sites))
 	for i, site := range f.client.sites {
-		branch := site.branch
-		if branch == "" {
-			branch = "main"
-		}
-		path := site.path
-		if path == "" {
-			path = "/"
-		}
-		items[i] = unstructured.Unstructured{
-			Object: map[string]interface{}{
-				"metadata": map[string]interface{}{
-					"name":      site.name,
-					"namespace": site.namespace,
-				},
-				"spec": map[string]interface{}{
-					"repo":   site.repo,
-					"branch": branch,
-					"path":   path,
-				},
-			},
-		}
+		items[i] = site.toUnstructured()
 	}
 	return &unstructured.UnstructuredList{Items: items}, nil
 }
@@ -169,27 +203,8 @@ func (f *fakeResourceWithSites) Get(ctx context.Context, name string, opts metav
 	}
 	for _, site := range f.client.sites {
 		if site.name == name && (f.namespace == "" || site.namespace == f.namespace) {
-			branch := site.branch
-			if branch == "" {
-				branch = "main"
-			}
-			path := site.path
-			if path == "" {
-				path = "/"
-			}
-			return &unstructured.Unstructured{
-				Object: map[string]interface{}{
-					"metadata": map[string]interface{}{
-						"name":      site.name,
-						"namespace": site.namespace,
-					},
-					"spec": map[string]interface{}{
-						"repo":   site.repo,
-						"branch": branch,
-						"path":   path,
-					},
-				},
-			}, nil
+			obj := site.toUnstructured()
+			return &obj, nil
 		}
 	}
 	return nil, fmt.Errorf("not found")
@@ -220,7 +235,10 @@ func (f *fakeResourceWithSites) Watch(ctx context.Context, opts metav1.ListOptio
 }
 
 func (f *fakeResourceWithSites) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	f.client.mu.Lock()
+	defer f.client.mu.Unlock()
 	f.client.lastPatch = data
+	f.client.patched = append(f.client.patched, name)
 	return &unstructured.Unstructured{}, nil
 }
 
@@ -235,19 +253,24 @@ func (f *fakeResourceWithSites) ApplyStatus(ctx context.Context, name string, ob
 // fakeDynamicClientWithToken is a fake dynamic client that returns sites with a syncToken
 type fakeDynamicClientWithToken struct {
 	token string
+	// spec replaces the default spec with a repo
+	spec map[string]interface{}
+	// lastPatch captures the last patch data for testing
+	lastPatch []byte
 }
 
 func (f *fakeDynamicClientWithToken) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
-	return &fakeResourceWithToken{token: f.token}
+	return &fakeResourceWithToken{token: f.token, client: f}
 }
 
 type fakeResourceWithToken struct {
 	token     string
 	namespace string
+	client    *fakeDynamicClientWithToken
 }
 
 func (f *fakeResourceWithToken) Namespace(ns string) dynamic.ResourceInterface {
-	return &fakeResourceWithToken{token: f.token, namespace: ns}
+	return &fakeResourceWithToken{token: f.token, namespace: ns, client: f.client}
 }
 
 func (f *fakeResourceWithToken) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
@@ -255,15 +278,19 @@ func (f *fakeResourceWithToken) List(ctx context.Context, opts metav1.ListOption
 }
 
 func (f *fakeResourceWithToken) Get(ctx context.Context, name string, opts metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	spec := map[string]interface{}{
+		"repo": "https://example.com/repo.git",
+	}
+	if f.client != nil && f.client.spec != nil {
+		spec = f.client.spec
+	}
 	return &unstructured.Unstructured{
 		Object: map[string]interface{}{
 			"metadata": map[string]interface{}{
 				"name":      name,
 				"namespace": f.namespace,
 			},
-			"spec": map[string]interface{}{
-				"repo": "https://example.com/repo.git",
-			},
+			"spec": spec,
 			"status": map[string]interface{}{
 				"syncToken": f.token,
 			},
@@ -296,6 +323,9 @@ func (f *fakeResourceWithToken) Watch(ctx context.Context, opts metav1.ListOptio
 }
 
 func (f *fakeResourceWithToken) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if f.client != nil {
+		f.client.lastPatch = data
+	}
 	return &unstructured.Unstructured{}, nil
 }
 
@@ -533,3 +563,45 @@ func newTestSecret(namespace, name string, data map[string][]byte) *corev1.Secre
 		Data: data,
 	}
 }
+
+// conflictingDynamicClient answers the first patches with a conflict, like
+// the API server does for a patch with an outdated resourceVersion. Every
+// conflict stands for another write and bumps the resourceVersion.
+type conflictingDynamicClient struct {
+	fakeDynamicClient
+	conflicts int
+	version   int
+}
+
+func (f *conflictingDynamicClient) Resource(resource schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &conflictingResource{fakeNamespaceableResource: fakeNamespaceableResource{client: &f.fakeDynamicClient}, conflicting: f}
+}
+
+type conflictingResource struct {
+	fakeNamespaceableResource
+	conflicting *conflictingDynamicClient
+}
+
+func (f *conflictingResource) Namespace(ns string) dynamic.ResourceInterface {
+	r := *f
+	r.namespace = ns
+	return &r
+}
+
+func (f *conflictingResource) Get(ctx context.Context, name string, opts metav1.GetOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	obj, err := f.fakeNamespaceableResource.Get(ctx, name, opts, subresources...)
+	if err != nil {
+		return nil, err
+	}
+	obj.SetResourceVersion(strconv.Itoa(f.conflicting.version))
+	return obj, nil
+}
+
+func (f *conflictingResource) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	if f.conflicting.conflicts > 0 {
+		f.conflicting.conflicts--
+		f.conflicting.version++
+		return nil, apierrors.NewConflict(staticSiteGVR.GroupResource(), name, fmt.Errorf("the object has been modified"))
+	}
+	return f.fakeNamespaceableResource.Patch(ctx, name, pt, data, opts, subresources...)
+}
@@ -5,15 +5,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -21,6 +22,7 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -55,31 +57,86 @@ type Syncer struct {
 	// AllowedHosts is a list of allowed Git hosts (SSRF protection).
 	// This field is mandatory - startup will fail if empty.
 	AllowedHosts []string
+
+	// KeepReleases is the number of previous releases kept per site for
+	// rollbacks, in addition to the current one
+	KeepReleases int
+
+	// SyncWorkers is the number of sites synced in parallel (default: DefaultSyncWorkers)
+	SyncWorkers int
+
+	// MaxSyncsPerHost limits parallel syncs against the same Git host,
+	// to stay below rate limits. 0 means no limit.
+	MaxSyncsPerHost int
+
+	// MaxLFSSize limits the total size of the Git LFS objects of a site in
+	// bytes. 0 means no limit.
+	MaxLFSSize int64
+
+	// MaxExtractSize limits the size of the content unpacked for a site
+	// from an archive, OCI artifact, upload or S3 bucket in bytes. 0 means
+	// no limit.
+	MaxExtractSize int64
+
+	// MaxUploadSize limits the size of a compressed upload to the deploy
+	// endpoint and of a downloaded archive in bytes. 0 means no limit.
+	MaxUploadSize int64
+
+	// BuildNamespace is the namespace the build Jobs of sites with
+	// spec.build run in
+	BuildNamespace string
+
+	// BuildVolumeClaim is the PersistentVolumeClaim of SitesRoot, which build
+	// Jobs mount their workspace from. Empty disables builds.
+	BuildVolumeClaim string
+
+	// GitCABundle holds PEM certificates trusted for HTTPS requests to Git
+	// and other source hosts, in addition to the system roots
+	GitCABundle []byte
+
+	// GitProxy is the URL of the HTTP proxy requests to Git and other source
+	// hosts go through. Empty uses HTTPS_PROXY and HTTP_PROXY.
+	GitProxy string
+
+	// Informer caches all StaticSites (see StartInformer). If nil, sites
+	// are listed from the API server.
+	Informer cache.SharedIndexInformer
+
+	limits syncLimits
+
+	transports transportCache
+
+	githubTokens githubTokenCache
+
+	stores sync.Map // store directory -> *objectStore
+
+	// buildPollInterval is how often a running build Job is checked
+	// (default: defaultBuildPollInterval)
+	buildPollInterval time.Duration
 }
 
 // validateRepoURL checks if the repo URL is allowed (SSRF protection)
 func (s *Syncer) validateRepoURL(repoURL string) error {
-	// Defensive check - AllowedHosts should never be empty at runtime
-	// since main() validates this at startup
-	if len(s.AllowedHosts) == 0 {
-		return fmt.Errorf("internal error: AllowedHosts not configured")
-	}
-
-	parsed, err := url.Parse(repoURL)
+	remote, err := parseRemoteURL(repoURL)
 	if err != nil {
 		return fmt.Errorf("invalid URL: %w", err)
 	}
 
-	// Only allow HTTP(S)
-	if parsed.Scheme != "http" && parsed.Scheme != "https" {
-		return fmt.Errorf("unsupported scheme: %s (only http/https allowed)", parsed.Scheme)
+	// Only allow HTTP(S) and SSH
+	if remote.Scheme != "http" && remote.Scheme != "https" && remote.Scheme != "ssh" {
+		return fmt.Errorf("unsupported scheme: %s (only http/https/ssh allowed)", remote.Scheme)
 	}
 
-	// Check host against allowlist
-	host := strings.ToLower(parsed.Host)
-	// Remove port if present
-	if colonIdx := strings.LastIndex(host, ":"); colonIdx != -1 {
-		host = host[:colonIdx]
+	// Check host against allowlist, for SSH just like for HTTP(S)
+	return s.validateHost(remote.Host)
+}
+
+// validateHost checks a lowercase host name against AllowedHosts
+func (s *Syncer) validateHost(host string) error {
+	// Defensive check - AllowedHosts should never be empty at runtime
+	// since main() validates this at startup
+	if len(s.AllowedHosts) == 0 {
+		return fmt.Errorf("internal error: AllowedHosts not configured")
 	}
 
 	for _, allowed := range s.AllowedHosts {
@@ -109,35 +166,45 @@ func (s *Syncer) SyncAll(ctx context.Context) error {
 	logger := log.FromContext(ctx)
 
 	// Load all StaticSites from all namespaces
-	list, err := s.DynamicClient.Resource(staticSiteGVR).Namespace("").List(ctx, metav1.ListOptions{})
+	sites, err := s.listSites(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list StaticSites: %w", err)
+		return err
 	}
 
-	logger.Info("Starting sync", "count", len(list.Items))
+	logger.Info("Starting sync", "count", len(sites))
 
-	for _, item := range list.Items {
-		site := &staticSiteData{}
-		if err := site.fromUnstructured(&item); err != nil {
-			logger.Error(err, "Failed to parse StaticSite", "name", item.GetName())
-			continue
-		}
+	// Sites of the same repo share fetches made during this sync
+	ctx = withFetchedSince(ctx, time.Now())
 
-		if err := s.syncSite(ctx, site); err != nil {
-			logger.Error(err, "Failed to sync site", "name", site.Name)
-			s.updateStatus(ctx, site, "Error", err.Error(), "")
-			continue
-		}
+	// Sync up to SyncWorkers sites in parallel
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, s.workers())
+	for _, site := range sites {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(site *staticSiteData) {
+			defer func() { <-slots; wg.Done() }()
+			s.syncAndReport(ctx, site)
+		}(site)
 	}
+	wg.Wait()
 
 	return nil
 }
 
+// syncAndReport synchronizes a site and records failures in its status
+func (s *Syncer) syncAndReport(ctx context.Context, site *staticSiteData) {
+	if err := s.syncSite(ctx, site); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to sync site", "name", site.Name)
+		s.updateStatus(ctx, site, "Error", err.Error(), "")
+	}
+}
+
 // SyncOne synchronizes a single site (for webhooks)
 func (s *Syncer) SyncOne(ctx context.Context, namespace, name string) error {
 	logger := log.FromContext(ctx)
 	
-	item, err := s.DynamicClient.Resource(staticSiteGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	item, err := s.getSiteObject(ctx, namespace, name)
 	if err != nil {
 		return fmt.Errorf("failed to get StaticSite %s/%s: %w", namespace, name, err)
 	}
@@ -151,174 +218,370 @@ func (s *Syncer) SyncOne(ctx context.Context, namespace, name string) error {
 	return s.syncSite(ctx, site)
 }
 
-// syncSite synchronizes a single site
-func (s *Syncer) syncSite(ctx context.Context, site *staticSiteData) error {
+// syncSiteLocked synchronizes a single site. The caller must hold the site lock.
+func (s *Syncer) syncSiteLocked(ctx context.Context, site *staticSiteData) error {
 	logger := log.FromContext(ctx)
 
+	// Content held back by the publish schedule or a freeze window may be
+	// due by now
+	if err := s.publishDue(ctx, site); err != nil {
+		return fmt.Errorf("failed to publish held release: %w", err)
+	}
+
+	if site.OCI != nil {
+		return s.syncOCI(ctx, site)
+	}
+	if site.Archive != nil {
+		return s.syncArchive(ctx, site)
+	}
+	if site.S3 != nil {
+		return s.syncS3(ctx, site)
+	}
+	if site.Upload {
+		return s.syncUpload(ctx, site)
+	}
+
 	// SSRF protection: validate repo URL
 	if err := s.validateRepoURL(site.Repo); err != nil {
 		return fmt.Errorf("repo URL validation failed: %w", err)
 	}
 
-	// Target directory for the repo
-	// With subpath: clone to .repos/<name>, symlink to <name>
-	// Without subpath: clone directly to <name>
-	var destDir string
-	hasSubpath := site.Path != "" && site.Path != "/"
-	if hasSubpath {
-		destDir = filepath.Join(s.SitesRoot, ".repos", site.Name)
-	} else {
-		destDir = filepath.Join(s.SitesRoot, site.Name)
+	// Respect the per-host limit of parallel syncs
+	release, err := s.acquireHost(ctx, repoHost(site.Repo))
+	if err != nil {
+		return err
 	}
-	
-	// Git auth if available
-	var auth *http.BasicAuth
-	if site.SecretRef != nil {
-		password, err := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, site.SecretRef.Key)
-		if err != nil {
-			return fmt.Errorf("failed to get git credentials: %w", err)
-		}
-		// Get username from secret, default to "git" if not present
-		username, _ := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, "username")
-		if username == "" {
-			username = "git"
+	defer release()
+
+	if site.Revision != "" && !plumbing.IsHash(site.Revision) {
+		return fmt.Errorf("invalid revision %q: must be a full 40-character commit SHA", site.Revision)
+	}
+
+	// The checkout lives in .repos/<dir>; what gets served is an immutable
+	// copy in .releases/<dir>/<commit>, linked from /sites/<dir>, where
+	// <dir> is the namespace-qualified directory name of the site
+	destDir := s.repoDir(site.dirName())
+
+	// The object store isn't pruned while the sync uses it
+	store := s.objectStore(s.storeDir(site.Namespace, site.Repo))
+	store.inUse.RLock()
+	defer store.inUse.RUnlock()
+
+	// Git auth if available, CA bundle and proxy
+	access, err := s.gitAccess(ctx, site)
+	if err != nil {
+		return err
+	}
+
+	// A checkout of another repo or branch is replaced by a fresh clone.
+	// This has to happen first, selectTag lists the tags of the checkout's
+	// origin.
+	if reason := checkoutChange(destDir, site); reason != "" {
+		logger.Info("Checkout source changed, cloning again", "site", site.Name, "reason", reason)
+		if err := os.RemoveAll(destDir); err != nil {
+			return fmt.Errorf("failed to remove outdated checkout: %w", err)
 		}
-		auth = &http.BasicAuth{
-			Username: username,
-			Password: password,
+	}
+
+	// A checkout damaged e.g. by a crash during a clone or reset is moved
+	// aside and cloned again
+	if _, err := os.Lstat(destDir); err == nil {
+		if damage := checkoutDamage(destDir); damage != nil {
+			if err := s.repairCheckout(ctx, site, damage); err != nil {
+				return err
+			}
 		}
 	}
 
-	var commitHash string
+	// Checkouts cloned before sites of a repo shared its objects have a
+	// copy of their own; they're cloned again from the store once
+	if _, err := os.Stat(filepath.Join(destDir, ".git")); err == nil && checkoutStore(destDir) == "" {
+		logger.Info("Checkout has its own objects, cloning again from the object store", "site", site.Name)
+		if err := os.RemoveAll(destDir); err != nil {
+			return fmt.Errorf("failed to remove standalone checkout: %w", err)
+		}
+	}
 
-	// Check if repo already exists
-	if _, err := os.Stat(filepath.Join(destDir, ".git")); os.IsNotExist(err) {
-		// Clone
-		logger.Info("Cloning repository", "repo", site.Repo, "dest", destDir)
-		
-		cloneOpts := &git.CloneOptions{
-			URL:           site.Repo,
-			ReferenceName: plumbing.NewBranchReferenceName(site.Branch),
-			SingleBranch:  true,
-			Depth:         1, // Shallow clone
-			Progress:      os.Stdout,
+	// Sites tracking tags deploy the highest matching tag like a pinned tag
+	message := "Synced successfully"
+	if site.tracksTags() {
+		tag, err := s.selectTag(ctx, destDir, site, access)
+		if err != nil {
+			return fmt.Errorf("failed to select tag: %w", err)
 		}
-		if auth != nil {
-			cloneOpts.Auth = auth
+		logger.Info("Selected tag", "site", site.Name, "tag", tag, "selector", site.TagSelector.String())
+
+		selected := *site
+		selected.Tag = tag
+		site = &selected
+		message = fmt.Sprintf("Synced tag %s", tag)
+	}
+
+	// The site's ref is fetched into the object store shared by the sites
+	// of the repo in the namespace, the checkout reads from it
+	_, err = os.Stat(filepath.Join(destDir, ".git"))
+	clone := os.IsNotExist(err)
+	if clone {
+		logger.Info("Cloning repository", "repo", site.Repo, "ref", site.ref(), "dest", destDir)
+	} else {
+		logger.Info("Pulling repository", "repo", site.Repo, "ref", site.ref(), "dest", destDir)
+	}
+
+	commitHash, err := s.checkoutFromStore(ctx, destDir, site, access)
+	if err != nil && clone {
+		return fmt.Errorf("git clone failed: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := recordCheckoutSource(destDir, site); err != nil {
+		return fmt.Errorf("failed to record checkout source: %w", err)
+	}
+
+	// Submodules are opt-in; each one is validated like the site's repo
+	if site.Submodules {
+		if err := s.updateSubmodules(ctx, destDir, site, access); err != nil {
+			return fmt.Errorf("failed to update submodules: %w", err)
 		}
+	} else if err := clearSubmodules(destDir); err != nil {
+		return fmt.Errorf("failed to remove submodules: %w", err)
+	}
+
+	// Everything that needs the Git host is done; a pending build must not
+	// keep other sites of the host from syncing
+	release()
 
-		repo, err := git.PlainClone(destDir, false, cloneOpts)
+	// Publish the (sub)directory as a new release and swap it in atomically
+	// e.g. /sites/team-a--mysite -> .releases/team-a--mysite/<commit>
+	content := func() (string, error) {
+		contentDir, err := resolveSubpath(destDir, site.Path)
 		if err != nil {
-			return fmt.Errorf("git clone failed: %w", err)
+			return "", fmt.Errorf("failed to setup subpath: %w", err)
 		}
+		// LFS pointers are replaced with their objects, unless the commit
+		// has been published before
+		if err := s.fetchLFSObjects(ctx, site, destDir, contentDir, access); err != nil {
+			return "", fmt.Errorf("failed to fetch Git LFS objects: %w", err)
+		}
+		return contentDir, nil
+	}
+	return s.publishSite(ctx, site, commitHash, message, content)
+}
 
-		head, err := repo.Head()
-		if err != nil {
-			logger.V(1).Info("Failed to get HEAD after clone", "error", err)
+// publishSite makes release the active release of a site and reports the
+// sync in the site's status. content provides the directory to build the
+// release from; it is only called if the release doesn't exist yet or was
+// built with another layout. A rolled back site keeps its release until a
+// new release shows up; a new release waits for the site's publish schedule
+// and freeze windows.
+func (s *Syncer) publishSite(ctx context.Context, site *staticSiteData, release, message string, content func() (string, error)) error {
+	logger := log.FromContext(ctx)
+
+	if held := s.rollbackHold(site.dirName()); held != "" {
+		if held == release {
+			current := s.currentRelease(site.dirName())
+			logger.Info("Site is rolled back, skipping publish", "site", site.Name, "commit", shortHash(release), "active", shortHash(current))
+			s.updateStatus(ctx, site, "Ready", fmt.Sprintf("Rolled back to %s, waiting for a new commit", shortHash(current)), shortHash(current))
+			return nil
 		}
-		if head != nil {
-			commitHash = head.Hash().String()[:8]
+		if err := s.clearRollbackHold(site.dirName()); err != nil {
+			return fmt.Errorf("failed to clear rollback: %w", err)
 		}
-	} else {
-		// Pull (using fetch + reset to handle force-pushed branches)
-		logger.Info("Pulling repository", "repo", site.Repo, "dest", destDir)
+	}
 
-		hash, err := s.pullRepo(ctx, destDir, site, auth)
-		if err != nil {
+	// A release built with another path, submodule or build setting is
+	// rebuilt
+	_, err := os.Stat(filepath.Join(s.releasesDir(site.dirName()), release))
+	published := err == nil
+	relayout := published && s.layoutChanged(site.dirName(), site)
+
+	var contentDir string
+	if !published || relayout {
+		if contentDir, err = content(); err != nil {
 			return err
 		}
-		commitHash = hash
+		if site.Build != nil {
+			output, cleanup, err := s.runBuild(ctx, site, release, contentDir)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+			contentDir = output
+		}
 	}
 
-	// If a subpath is defined, create symlink
-	// e.g. /sites/mysite -> /sites/.repos/mysite/dist
-	if hasSubpath {
-		if err := s.setupSubpath(site.Name, destDir, site.Path); err != nil {
-			return fmt.Errorf("failed to setup subpath: %w", err)
+	// New content may have to wait for its time to go live
+	if release != s.currentRelease(site.dirName()) {
+		held, err := s.holdRelease(ctx, site, release, message, contentDir, relayout)
+		if err != nil || held {
+			return err
 		}
 	}
 
+	if relayout {
+		logger.Info("Site layout changed, rebuilding release", "site", site.Name, "commit", shortHash(release))
+		err = s.replaceRelease(site.dirName(), contentDir, release)
+	} else {
+		err = s.publishRelease(site.dirName(), contentDir, release)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish release: %w", err)
+	}
+	if err := s.recordReleaseLayout(site.dirName(), site, release); err != nil {
+		return fmt.Errorf("failed to record release layout: %w", err)
+	}
+	// Content held back before is superseded
+	if err := s.clearPendingRelease(ctx, site); err != nil {
+		return err
+	}
+
 	// Update status
-	s.updateStatus(ctx, site, "Ready", "Synced successfully", commitHash)
-	
-	logger.Info("Sync complete", "site", site.Name, "commit", commitHash)
+	s.updateStatus(ctx, site, "Ready", message, shortHash(release))
+
+	logger.Info("Sync complete", "site", site.Name, "commit", shortHash(release))
 	return nil
 }
 
-// pullRepo fetches and resets to the latest remote commit.
-// This handles non-fast-forward updates (force-pushed branches) by using
-// fetch + hard reset instead of pull, which fails on divergent histories.
-func (s *Syncer) pullRepo(ctx context.Context, destDir string, site *staticSiteData, auth *http.BasicAuth) (string, error) {
-	repo, err := git.PlainOpen(destDir)
+// gitAuth returns the credentials for the site's repo, or nil if the site
+// has no secretRef. SSH repos always need one, see sshAuth. For HTTP(S) the
+// Secret holds GitHub App credentials, a bearer token or a password.
+func (s *Syncer) gitAuth(ctx context.Context, site *staticSiteData) (transport.AuthMethod, error) {
+	remote, err := parseRemoteURL(site.Repo)
 	if err != nil {
-		return "", fmt.Errorf("failed to open repo: %w", err)
+		return nil, err
+	}
+	if remote.Scheme == "ssh" {
+		return s.sshAuth(ctx, site, remote)
 	}
 
-	// Fetch the remote branch
-	fetchOpts := &git.FetchOptions{
-		RemoteName: "origin",
-		RefSpecs:   []config.RefSpec{config.RefSpec("+refs/heads/" + site.Branch + ":refs/remotes/origin/" + site.Branch)},
-		Depth:      1,
-		Force:      true,
+	if site.SecretRef == nil {
+		return nil, nil
 	}
-	if auth != nil {
-		fetchOpts.Auth = auth
+	secret, err := s.ClientSet.CoreV1().Secrets(site.Namespace).Get(ctx, site.SecretRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(secret.Data[githubAppIDKey]) > 0:
+		app, err := parseGitHubApp(secret)
+		if err != nil {
+			return nil, err
+		}
+		caBundle, err := s.caBundle(ctx, site.Namespace, site.SecretRef)
+		if err != nil {
+			return nil, err
+		}
+		token, err := s.githubAppToken(ctx, app, githubAPIURL(remote), caBundle)
+		if err != nil {
+			return nil, err
+		}
+		return &http.BasicAuth{Username: githubTokenUsername, Password: token}, nil
+	case len(secret.Data[bearerTokenKey]) > 0:
+		return &http.TokenAuth{Token: strings.TrimSpace(string(secret.Data[bearerTokenKey]))}, nil
 	}
 
-	err = repo.Fetch(fetchOpts)
-	if err != nil && err != git.NoErrAlreadyUpToDate {
-		return "", fmt.Errorf("git fetch failed: %w", err)
+	password, err := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, site.SecretRef.Key)
+	if err != nil {
+		return nil, err
+	}
+	// Get username from secret, default to "git" if not present
+	username, _ := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, "username")
+	if username == "" {
+		username = "git"
 	}
+	return &http.BasicAuth{
+		Username: username,
+		Password: password,
+	}, nil
+}
 
-	// Get the fetched commit hash
-	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", site.Branch), true)
+// peelTag returns the commit an annotated tag points to; annotated tags
+// point to a tag object, not to the commit. Other hashes are returned as is.
+func peelTag(repo *git.Repository, hash plumbing.Hash, site *staticSiteData) (plumbing.Hash, error) {
+	tag, err := repo.TagObject(hash)
 	if err != nil {
-		return "", fmt.Errorf("failed to get remote reference: %w", err)
+		return hash, nil
 	}
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("tag %s does not point to a commit: %w", site.Tag, err)
+	}
+	return commit.Hash, nil
+}
 
-	// Hard reset worktree to the fetched commit
+// resetWorktree hard resets the worktree to commit. With sparseDirs, only
+// the files below them are materialized (sparse checkout), anything else is
+// removed from the worktree; without, the whole tree is checked out.
+func resetWorktree(repo *git.Repository, commit plumbing.Hash, sparseDirs []string) error {
 	worktree, err := repo.Worktree()
 	if err != nil {
-		return "", fmt.Errorf("failed to get worktree: %w", err)
+		return fmt.Errorf("failed to get worktree: %w", err)
 	}
 
-	err = worktree.Reset(&git.ResetOptions{
-		Commit: remoteRef.Hash(),
+	// go-git keeps the skip flags of an earlier sparse checkout and never
+	// removes files that become skipped, so every reset starts from a full
+	// index and cleans up what the new dirs leave out
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	materialized := make(map[string]bool, len(idx.Entries))
+	for _, e := range idx.Entries {
+		if !e.SkipWorktree {
+			materialized[e.Name] = true
+		}
+		e.SkipWorktree = false
+	}
+	if err := repo.Storer.SetIndex(idx); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	err = worktree.ResetSparsely(&git.ResetOptions{
+		Commit: commit,
 		Mode:   git.HardReset,
-	})
+	}, sparseDirs)
 	if err != nil {
-		return "", fmt.Errorf("git reset failed: %w", err)
+		return fmt.Errorf("git reset failed: %w", err)
 	}
 
-	return remoteRef.Hash().String()[:8], nil
+	if len(sparseDirs) == 0 || len(materialized) == 0 {
+		return nil
+	}
+	if idx, err = repo.Storer.Index(); err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+	for _, e := range idx.Entries {
+		if e.SkipWorktree && materialized[e.Name] {
+			if err := removeWorktreeFile(worktree.Filesystem.Root(), e.Name); err != nil {
+				return fmt.Errorf("failed to remove %s from sparse checkout: %w", e.Name, err)
+			}
+		}
+	}
+	return nil
 }
 
-// setupSubpath creates a symlink for subpaths
-// The repo is cloned to .repos/<name> and a symlink from
-// /sites/<name> -> /sites/.repos/<name>/<subpath> is created
-func (s *Syncer) setupSubpath(siteName, repoDir, subpath string) error {
-	// Normalize subpath (remove leading /)
-	subpath = filepath.Clean(subpath)
-	subpath = strings.TrimPrefix(subpath, "/")
-
-	// Source directory: the cloned repo + subpath
-	srcDir := filepath.Join(repoDir, subpath)
-
-	// Check if subpath exists
-	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
-		return fmt.Errorf("subpath %q does not exist in repository", subpath)
+// removeWorktreeFile removes a file of the worktree and the directories it
+// leaves empty
+func removeWorktreeFile(root, name string) error {
+	file := filepath.Join(root, filepath.FromSlash(name))
+	if err := removePathOrSymlink(file); err != nil {
+		return err
 	}
-
-	// Symlink path: /sites/<name> (where nginx expects the files)
-	linkPath := filepath.Join(s.SitesRoot, siteName)
-
-	// Remove old symlink or directory if present
-	if err := removePathOrSymlink(linkPath); err != nil {
-		return fmt.Errorf("failed to remove existing path %s: %w", linkPath, err)
+	for dir := filepath.Dir(file); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			// Not empty (or already gone)
+			return nil
+		}
 	}
+	return nil
+}
 
-	// Create symlink
-	return os.Symlink(srcDir, linkPath)
+// shortHash abbreviates a commit hash for status and log output
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
 }
 
 // getSecretValue reads a value from a Kubernetes Secret
@@ -382,14 +645,101 @@ func (s *Syncer) updateStatus(ctx context.Context, site *staticSiteData, phase,
 
 // staticSiteData is a simplified structure for the Syncer
 type staticSiteData struct {
-	Name      string
-	Namespace string
-	Repo      string
-	Branch    string
-	Path      string
+	Name         string
+	Namespace    string
+	UID          types.UID
+	Repo         string
+	Branch       string
+	Tag          string
+	TagSelector  *tagSelector
+	Revision     string
+	Path         string
+	SecretRef    *secretRef
+	SyncInterval string
+	Submodules   bool
+	// OCI is set for sites whose content comes from an OCI artifact
+	// instead of Repo
+	OCI *ociSource
+	// Archive is set for sites whose content comes from a downloaded
+	// archive instead of Repo
+	Archive *archiveSource
+	// S3 is set for sites whose content is mirrored from a bucket instead
+	// of Repo
+	S3 *s3Source
+	// Upload is set for sites whose content is deployed by uploads
+	Upload bool
+	// Build is set for sites whose content is built before publishing
+	Build *buildSpec
+	// PublishSchedule and FreezeWindows hold new content back until it
+	// may go live
+	PublishSchedule *publishSchedule
+	FreezeWindows   []freezeWindow
+	// Verification names the Secret with the keys commits must be signed
+	// with before they are checked out
+	Verification *secretRef
+}
+
+// ociSource is the OCI artifact of a site
+type ociSource struct {
+	Image     string
+	Digest    string
+	SecretRef *secretRef
+}
+
+// archiveSource is the archive download of a site
+type archiveSource struct {
+	URL    string
+	SHA256 string
+}
+
+// s3Source is the bucket prefix a site is mirrored from
+type s3Source struct {
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
 	SecretRef *secretRef
 }
 
+// ref describes what the site tracks, for logging
+func (s *staticSiteData) ref() string {
+	switch {
+	case s.Revision != "":
+		return "revision " + s.Revision
+	case s.Tag != "":
+		return "tag " + s.Tag
+	default:
+		return "branch " + s.Branch
+	}
+}
+
+// followsBranch reports whether the site deploys the tip of its branch,
+// as opposed to a pinned tag or commit or the highest matching tag
+func (s *staticSiteData) followsBranch() bool {
+	return s.Revision == "" && s.Tag == "" && s.TagSelector == nil
+}
+
+// tracksTags reports whether the tag to deploy is selected by TagSelector
+func (s *staticSiteData) tracksTags() bool {
+	return s.Revision == "" && s.Tag == "" && s.TagSelector != nil
+}
+
+// sparseDirs returns what a checkout of the site materializes: the served
+// subpath, plus the root .gitattributes and .gitmodules for Git LFS and
+// submodules. nil means the whole tree.
+func (s *staticSiteData) sparseDirs() []string {
+	subpath := strings.Trim(path.Clean("/"+s.Path), "/")
+	if subpath == "" {
+		return nil
+	}
+	return []string{subpath + "/", ".gitattributes", ".gitmodules"}
+}
+
+// dirName returns the namespace-qualified directory name of the site
+func (s *staticSiteData) dirName() string {
+	return siteDirName(s.Namespace, s.Name)
+}
+
 type secretRef struct {
 	Name string
 	Key  string
@@ -398,6 +748,7 @@ type secretRef struct {
 func (s *staticSiteData) fromUnstructured(u *unstructured.Unstructured) error {
 	s.Name = u.GetName()
 	s.Namespace = u.GetNamespace()
+	s.UID = u.GetUID()
 
 	spec, ok := u.Object["spec"].(map[string]interface{})
 	if !ok {
@@ -406,7 +757,11 @@ func (s *staticSiteData) fromUnstructured(u *unstructured.Unstructured) error {
 
 	s.Repo, _ = spec["repo"].(string)
 	s.Branch, _ = spec["branch"].(string)
+	s.Tag, _ = spec["tag"].(string)
+	s.Revision, _ = spec["revision"].(string)
 	s.Path, _ = spec["path"].(string)
+	s.SyncInterval, _ = spec["syncInterval"].(string)
+	s.Submodules, _ = spec["submodules"].(bool)
 
 	if s.Branch == "" {
 		s.Branch = "main"
@@ -415,6 +770,12 @@ func (s *staticSiteData) fromUnstructured(u *unstructured.Unstructured) error {
 		s.Path = "/"
 	}
 
+	if selectorMap, ok := spec["tagSelector"].(map[string]interface{}); ok {
+		s.TagSelector = &tagSelector{}
+		s.TagSelector.Semver, _ = selectorMap["semver"].(string)
+		s.TagSelector.Pattern, _ = selectorMap["pattern"].(string)
+	}
+
 	if secretRefMap, ok := spec["secretRef"].(map[string]interface{}); ok {
 		name, nameOK := secretRefMap["name"].(string)
 		if !nameOK {
@@ -426,36 +787,92 @@ func (s *staticSiteData) fromUnstructured(u *unstructured.Unstructured) error {
 		}
 	}
 
-	return nil
-}
+	if ociMap, ok, _ := unstructured.NestedMap(spec, "source", "oci"); ok {
+		s.OCI = &ociSource{}
+		s.OCI.Image, _ = ociMap["image"].(string)
+		s.OCI.Digest, _ = ociMap["digest"].(string)
+		if refMap, ok := ociMap["secretRef"].(map[string]interface{}); ok {
+			name, nameOK := refMap["name"].(string)
+			if !nameOK {
+				return fmt.Errorf("source.oci.secretRef.name is required and must be a string")
+			}
+			s.OCI.SecretRef = &secretRef{Name: name}
+		}
+	}
 
-// RunLoop starts the sync loop
-func (s *Syncer) RunLoop(ctx context.Context) {
-	logger := log.FromContext(ctx)
+	if archiveMap, ok, _ := unstructured.NestedMap(spec, "source", "archive"); ok {
+		s.Archive = &archiveSource{}
+		s.Archive.URL, _ = archiveMap["url"].(string)
+		s.Archive.SHA256, _ = archiveMap["sha256"].(string)
+	}
+
+	if s3Map, ok, _ := unstructured.NestedMap(spec, "source", "s3"); ok {
+		s.S3 = &s3Source{}
+		s.S3.Endpoint, _ = s3Map["endpoint"].(string)
+		s.S3.Bucket, _ = s3Map["bucket"].(string)
+		s.S3.Prefix, _ = s3Map["prefix"].(string)
+		s.S3.Region, _ = s3Map["region"].(string)
+		if refMap, ok := s3Map["secretRef"].(map[string]interface{}); ok {
+			name, nameOK := refMap["name"].(string)
+			if !nameOK {
+				return fmt.Errorf("source.s3.secretRef.name is required and must be a string")
+			}
+			s.S3.SecretRef = &secretRef{Name: name}
+		}
+	}
+
+	if _, ok, _ := unstructured.NestedMap(spec, "source", "upload"); ok {
+		s.Upload = true
+	}
+
+	if buildMap, ok, _ := unstructured.NestedMap(spec, "build"); ok {
+		s.Build = &buildSpec{}
+		s.Build.Image, _ = buildMap["image"].(string)
+		s.Build.Command, _, _ = unstructured.NestedStringSlice(buildMap, "command")
+		s.Build.OutputDir, _ = buildMap["outputDir"].(string)
+		s.Build.Timeout, _ = buildMap["timeout"].(string)
+	}
 
-	ticker := time.NewTicker(s.DefaultInterval)
-	defer ticker.Stop()
+	if refMap, ok, _ := unstructured.NestedMap(spec, "verification", "secretRef"); ok {
+		name, nameOK := refMap["name"].(string)
+		if !nameOK {
+			return fmt.Errorf("verification.secretRef.name is required and must be a string")
+		}
+		s.Verification = &secretRef{Name: name}
+	}
 
-	// Initial sync
-	if err := s.SyncAll(ctx); err != nil {
-		logger.Error(err, "Initial sync failed")
+	if scheduleMap, ok, _ := unstructured.NestedMap(spec, "publishSchedule"); ok {
+		s.PublishSchedule = &publishSchedule{}
+		s.PublishSchedule.Cron, _ = scheduleMap["cron"].(string)
+		s.PublishSchedule.TimeZone, _ = scheduleMap["timeZone"].(string)
+		if publishAt, ok := scheduleMap["publishAt"].(string); ok {
+			t, err := time.Parse(time.RFC3339, publishAt)
+			if err != nil {
+				return fmt.Errorf("invalid publishSchedule.publishAt: %w", err)
+			}
+			s.PublishSchedule.PublishAt = t
+		}
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			logger.Info("Syncer stopped")
-			return
-		case <-ticker.C:
-			if err := s.SyncAll(ctx); err != nil {
-				logger.Error(err, "Sync failed")
+	if windows, ok, _ := unstructured.NestedSlice(spec, "freezeWindows"); ok {
+		for i, item := range windows {
+			windowMap, _ := item.(map[string]interface{})
+			start, _ := windowMap["start"].(string)
+			end, _ := windowMap["end"].(string)
+			w := freezeWindow{}
+			w.Reason, _ = windowMap["reason"].(string)
+			var err error
+			if w.Start, err = time.Parse(time.RFC3339, start); err != nil {
+				return fmt.Errorf("invalid freezeWindows[%d].start: %w", i, err)
 			}
-			// Cleanup after each sync
-			if err := s.Cleanup(ctx); err != nil {
-				logger.Error(err, "Cleanup failed")
+			if w.End, err = time.Parse(time.RFC3339, end); err != nil {
+				return fmt.Errorf("invalid freezeWindows[%d].end: %w", i, err)
 			}
+			s.FreezeWindows = append(s.FreezeWindows, w)
 		}
 	}
+
+	return nil
 }
 
 // Cleanup removes directories of deleted sites
@@ -463,15 +880,18 @@ func (s *Syncer) Cleanup(ctx context.Context) error {
 	logger := log.FromContext(ctx)
 
 	// Load all StaticSites
-	list, err := s.DynamicClient.Resource(staticSiteGVR).Namespace("").List(ctx, metav1.ListOptions{})
+	items, err := s.siteObjects(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to list StaticSites: %w", err)
+		return err
 	}
 
-	// Set with all active site names
+	// Set with the directory names of all active sites, and the namespaces
+	// of each site name for content of older versions under the bare name
 	activeSites := make(map[string]bool)
-	for _, item := range list.Items {
-		activeSites[item.GetName()] = true
+	namespaces := make(map[string][]string)
+	for _, item := range items {
+		activeSites[siteDirName(item.GetNamespace(), item.GetName())] = true
+		namespaces[item.GetName()] = append(namespaces[item.GetName()], item.GetNamespace())
 	}
 
 	// Iterate through directories in /sites
@@ -483,13 +903,14 @@ func (s *Syncer) Cleanup(ctx context.Context) error {
 	for _, entry := range entries {
 		name := entry.Name()
 
-		// Skip .repos directory (handled separately)
-		if name == ".repos" {
+		// Skip internal directories like .repos and .releases (handled separately)
+		if strings.HasPrefix(name, ".") {
 			continue
 		}
 
-		// Check if site still exists
-		if !activeSites[name] {
+		// Check if site still exists; legacy content is served until the
+		// site has a release of its own
+		if !activeSites[name] && !s.legacyContentPending(name, namespaces) {
 			sitePath := filepath.Join(s.SitesRoot, name)
 			logger.Info("Removing orphaned site directory", "name", name)
 
@@ -499,40 +920,85 @@ func (s *Syncer) Cleanup(ctx context.Context) error {
 		}
 	}
 
-	// Clean up .repos directories
-	reposDir := filepath.Join(s.SitesRoot, ".repos")
-	if entries, err := os.ReadDir(reposDir); err == nil {
+	// Clean up .repos, .releases, .mirrors, .builds and .quarantine directories
+	for _, internal := range []string{reposDirName, releasesDirName, mirrorsDirName, buildsDirName, quarantineDirName} {
+		internalDir := filepath.Join(s.SitesRoot, internal)
+		entries, err := os.ReadDir(internalDir)
+		if err != nil {
+			continue
+		}
 		for _, entry := range entries {
 			name := entry.Name()
+			if internal == reposDirName && s.legacyContentPending(name, namespaces) {
+				continue
+			}
 			if !activeSites[name] {
-				repoPath := filepath.Join(reposDir, name)
-				logger.Info("Removing orphaned repo directory", "name", name)
-				if err := os.RemoveAll(repoPath); err != nil {
-					logger.Error(err, "Failed to remove orphaned repo", "path", repoPath)
+				path := filepath.Join(internalDir, name)
+				logger.Info("Removing orphaned directory", "path", path)
+				if err := os.RemoveAll(path); err != nil {
+					logger.Error(err, "Failed to remove orphaned directory", "path", path)
 				}
 			}
 		}
 	}
 
+	// Object stores in .objects go with the last checkout linked to them;
+	// the others drop what their checkouts don't need anymore
+	if err := s.removeUnusedStores(ctx); err != nil {
+		logger.Error(err, "Failed to remove unused object stores")
+	}
+	s.pruneStores(ctx)
+
 	return nil
 }
 
 // DeleteSite deletes a specific site (for webhook calls)
-func (s *Syncer) DeleteSite(ctx context.Context, name string) error {
+func (s *Syncer) DeleteSite(ctx context.Context, namespace, name string) error {
 	logger := log.FromContext(ctx)
-	logger.Info("Deleting site", "name", name)
+	logger.Info("Deleting site", "namespace", namespace, "name", name)
+
+	dir := siteDirName(namespace, name)
 
 	// Remove symlink/directory in /sites
-	sitePath := filepath.Join(s.SitesRoot, name)
+	sitePath := filepath.Join(s.SitesRoot, dir)
 	if err := removePathOrSymlink(sitePath); err != nil {
 		return fmt.Errorf("failed to remove site path %s: %w", sitePath, err)
 	}
 
 	// Remove repo directory in .repos
-	repoPath := filepath.Join(s.SitesRoot, ".repos", name)
+	repoPath := s.repoDir(dir)
 	if err := removePathOrSymlink(repoPath); err != nil {
 		return fmt.Errorf("failed to remove repo path %s: %w", repoPath, err)
 	}
 
+	// Remove all releases in .releases
+	releasesPath := s.releasesDir(dir)
+	if err := removePathOrSymlink(releasesPath); err != nil {
+		return fmt.Errorf("failed to remove releases path %s: %w", releasesPath, err)
+	}
+
+	// Remove a bucket mirror in .mirrors
+	mirrorPath := s.mirrorDir(dir)
+	if err := removePathOrSymlink(mirrorPath); err != nil {
+		return fmt.Errorf("failed to remove mirror path %s: %w", mirrorPath, err)
+	}
+
+	// Remove leftover build workspaces in .builds
+	buildsPath := filepath.Join(s.SitesRoot, buildsDirName, dir)
+	if err := removePathOrSymlink(buildsPath); err != nil {
+		return fmt.Errorf("failed to remove builds path %s: %w", buildsPath, err)
+	}
+
+	// Remove a quarantined checkout in .quarantine
+	quarantinePath := filepath.Join(s.SitesRoot, quarantineDirName, dir)
+	if err := removePathOrSymlink(quarantinePath); err != nil {
+		return fmt.Errorf("failed to remove quarantine path %s: %w", quarantinePath, err)
+	}
+
+	// Remove the object store in .objects if no other site uses it
+	if err := s.removeUnusedStores(ctx); err != nil {
+		return fmt.Errorf("failed to remove unused object stores: %w", err)
+	}
+
 	return nil
 }
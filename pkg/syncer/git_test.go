@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -67,9 +69,39 @@ func TestValidateRepoURL(t *testing.T) {
 			wantErr:      true,
 		},
 		{
-			name:         "reject ssh scheme",
+			name:         "ssh scheme allowed",
 			allowedHosts: []string{"github.com"},
 			repoURL:      "ssh://git@github.com/example/repo.git",
+			wantErr:      false,
+		},
+		{
+			name:         "scp-style ssh allowed",
+			allowedHosts: []string{"github.com"},
+			repoURL:      "git@github.com:example/repo.git",
+			wantErr:      false,
+		},
+		{
+			name:         "ssh host not in allowlist",
+			allowedHosts: []string{"github.com"},
+			repoURL:      "ssh://git@gitlab.com:2222/example/repo.git",
+			wantErr:      true,
+		},
+		{
+			name:         "scp-style host not in allowlist",
+			allowedHosts: []string{"github.com"},
+			repoURL:      "git@internal.example.com:example/repo.git",
+			wantErr:      true,
+		},
+		{
+			name:         "reject git scheme",
+			allowedHosts: []string{"github.com"},
+			repoURL:      "git://github.com/example/repo.git",
+			wantErr:      true,
+		},
+		{
+			name:         "reject local path",
+			allowedHosts: []string{"github.com"},
+			repoURL:      "/srv/git/repo.git",
 			wantErr:      true,
 		},
 		{
@@ -114,17 +146,19 @@ func TestStaticSiteDataFromUnstructured(t *testing.T) {
 					"namespace": "pages",
 				},
 				"spec": map[string]interface{}{
-					"repo":   "https://github.com/example/repo.git",
-					"branch": "main",
-					"path":   "/dist",
+					"repo":         "https://github.com/example/repo.git",
+					"branch":       "main",
+					"path":         "/dist",
+					"syncInterval": "30s",
 				},
 			},
 			want: staticSiteData{
-				Name:      "test-site",
-				Namespace: "pages",
-				Repo:      "https://github.com/example/repo.git",
-				Branch:    "main",
-				Path:      "/dist",
+				Name:         "test-site",
+				Namespace:    "pages",
+				Repo:         "https://github.com/example/repo.git",
+				Branch:       "main",
+				Path:         "/dist",
+				SyncInterval: "30s",
 			},
 			wantErr: false,
 		},
@@ -148,6 +182,54 @@ func TestStaticSiteDataFromUnstructured(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "pinned to tag and revision",
+			obj: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":      "test-site",
+					"namespace": "pages",
+				},
+				"spec": map[string]interface{}{
+					"repo":     "https://github.com/example/repo.git",
+					"tag":      "v1.0.0",
+					"revision": "0123456789abcdef0123456789abcdef01234567",
+				},
+			},
+			want: staticSiteData{
+				Name:      "test-site",
+				Namespace: "pages",
+				Repo:      "https://github.com/example/repo.git",
+				Branch:    "main",
+				Tag:       "v1.0.0",
+				Revision:  "0123456789abcdef0123456789abcdef01234567",
+				Path:      "/",
+			},
+			wantErr: false,
+		},
+		{
+			name: "with tag selector",
+			obj: map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"name":      "test-site",
+					"namespace": "pages",
+				},
+				"spec": map[string]interface{}{
+					"repo": "https://github.com/example/repo.git",
+					"tagSelector": map[string]interface{}{
+						"semver": ">=1.2.0 <2.0.0",
+					},
+				},
+			},
+			want: staticSiteData{
+				Name:        "test-site",
+				Namespace:   "pages",
+				Repo:        "https://github.com/example/repo.git",
+				Branch:      "main",
+				TagSelector: &tagSelector{Semver: ">=1.2.0 <2.0.0"},
+				Path:        "/",
+			},
+			wantErr: false,
+		},
 		{
 			name: "with secret ref",
 			obj: map[string]interface{}{
@@ -273,122 +355,36 @@ func TestStaticSiteDataFromUnstructured(t *testing.T) {
 	}
 }
 
-func TestSetupSubpath(t *testing.T) {
-	// Create temp directory
-	tmpDir, err := os.MkdirTemp("", "syncer-test-*")
-	if err != nil {
-		t.Fatalf("failed to create temp dir: %v", err)
-	}
-	defer func() { _ = os.RemoveAll(tmpDir) }()
-
-	s := &Syncer{SitesRoot: tmpDir}
+func TestResolveSubpath(t *testing.T) {
+	repoDir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(repoDir, "dist"), 0755)
+	_ = os.MkdirAll(filepath.Join(repoDir, "public"), 0755)
+	_ = os.WriteFile(filepath.Join(repoDir, "README.md"), []byte("readme"), 0644)
 
 	tests := []struct {
-		name      string
-		siteName  string
-		subpath   string
-		setup     func() string // returns repoDir
-		wantErr   bool
-		checkLink bool
+		name    string
+		subpath string
+		want    string
+		wantErr bool
 	}{
-		{
-			name:     "creates symlink for valid subpath",
-			siteName: "mysite",
-			subpath:  "dist",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "mysite")
-				_ = os.MkdirAll(filepath.Join(repoDir, "dist"), 0755)
-				return repoDir
-			},
-			wantErr:   false,
-			checkLink: true,
-		},
-		{
-			name:     "subpath with leading slash",
-			siteName: "site2",
-			subpath:  "/public",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "site2")
-				_ = os.MkdirAll(filepath.Join(repoDir, "public"), 0755)
-				return repoDir
-			},
-			wantErr:   false,
-			checkLink: true,
-		},
-		{
-			name:     "error on non-existent subpath",
-			siteName: "badsite",
-			subpath:  "nonexistent",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "badsite")
-				_ = os.MkdirAll(repoDir, 0755)
-				return repoDir
-			},
-			wantErr:   true,
-			checkLink: false,
-		},
-		{
-			name:     "replaces existing symlink",
-			siteName: "replace",
-			subpath:  "new",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "replace")
-				_ = os.MkdirAll(filepath.Join(repoDir, "old"), 0755)
-				_ = os.MkdirAll(filepath.Join(repoDir, "new"), 0755)
-				// Create old symlink
-				linkPath := filepath.Join(tmpDir, "replace")
-				_ = os.Symlink(filepath.Join(repoDir, "old"), linkPath)
-				return repoDir
-			},
-			wantErr:   false,
-			checkLink: true,
-		},
-		{
-			name:     "handles root path (just slash)",
-			siteName: "rootsite",
-			subpath:  "/",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "rootsite")
-				_ = os.MkdirAll(repoDir, 0755)
-				return repoDir
-			},
-			wantErr:   false,
-			checkLink: true,
-		},
-		{
-			name:     "handles empty subpath as root",
-			siteName: "emptysite",
-			subpath:  "",
-			setup: func() string {
-				repoDir := filepath.Join(tmpDir, ".repos", "emptysite")
-				_ = os.MkdirAll(repoDir, 0755)
-				return repoDir
-			},
-			wantErr:   false,
-			checkLink: true,
-		},
+		{name: "valid subpath", subpath: "dist", want: filepath.Join(repoDir, "dist")},
+		{name: "subpath with leading slash", subpath: "/public", want: filepath.Join(repoDir, "public")},
+		{name: "root path (just slash)", subpath: "/", want: repoDir},
+		{name: "empty subpath as root", subpath: "", want: repoDir},
+		{name: "parent traversal stays inside repo", subpath: "/../dist", want: filepath.Join(repoDir, "dist")},
+		{name: "non-existent subpath", subpath: "nonexistent", wantErr: true},
+		{name: "subpath is a file", subpath: "README.md", wantErr: true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			repoDir := tt.setup()
-			err := s.setupSubpath(tt.siteName, repoDir, tt.subpath)
-
+			got, err := resolveSubpath(repoDir, tt.subpath)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("setupSubpath() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("resolveSubpath() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-
-			if tt.checkLink {
-				linkPath := filepath.Join(tmpDir, tt.siteName)
-				info, err := os.Lstat(linkPath)
-				if err != nil {
-					t.Errorf("symlink not created: %v", err)
-					return
-				}
-				if info.Mode()&os.ModeSymlink == 0 {
-					t.Errorf("expected symlink, got %v", info.Mode())
-				}
+			if got != tt.want {
+				t.Errorf("resolveSubpath() = %q, want %q", got, tt.want)
 			}
 		})
 	}
@@ -519,17 +515,26 @@ func TestDeleteSite(t *testing.T) {
 			name:     "delete directory",
 			siteName: "dir-site",
 			setup: func() {
-				_ = os.MkdirAll(filepath.Join(tmpDir, "dir-site", "subdir"), 0755)
-				_ = os.WriteFile(filepath.Join(tmpDir, "dir-site", "index.html"), []byte("test"), 0644)
+				_ = os.MkdirAll(filepath.Join(tmpDir, "default--dir-site", "subdir"), 0755)
+				_ = os.WriteFile(filepath.Join(tmpDir, "default--dir-site", "index.html"), []byte("test"), 0644)
 			},
 		},
 		{
 			name:     "delete symlink and repo",
 			siteName: "link-site",
 			setup: func() {
-				repoDir := filepath.Join(tmpDir, ".repos", "link-site")
+				repoDir := filepath.Join(tmpDir, ".repos", "default--link-site")
 				_ = os.MkdirAll(filepath.Join(repoDir, "dist"), 0755)
-				_ = os.Symlink(filepath.Join(repoDir, "dist"), filepath.Join(tmpDir, "link-site"))
+				_ = os.Symlink(filepath.Join(repoDir, "dist"), filepath.Join(tmpDir, "default--link-site"))
+			},
+		},
+		{
+			name:     "delete symlink and releases",
+			siteName: "release-site",
+			setup: func() {
+				releaseDir := filepath.Join(tmpDir, ".releases", "default--release-site", "abc123")
+				_ = os.MkdirAll(releaseDir, 0755)
+				_ = os.Symlink(filepath.Join(".releases", "default--release-site", "abc123"), filepath.Join(tmpDir, "default--release-site"))
 			},
 		},
 		{
@@ -543,23 +548,29 @@ func TestDeleteSite(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.setup()
 
-			err := s.DeleteSite(ctx, tt.siteName)
+			err := s.DeleteSite(ctx, "default", tt.siteName)
 			if err != nil {
 				t.Errorf("DeleteSite() error = %v", err)
 				return
 			}
 
 			// Prüfen dass Site-Pfad nicht mehr existiert
-			sitePath := filepath.Join(tmpDir, tt.siteName)
+			dir := siteDirName("default", tt.siteName)
+			sitePath := filepath.Join(tmpDir, dir)
 			if _, err := os.Lstat(sitePath); !os.IsNotExist(err) {
 				t.Errorf("site path still exists: %s", sitePath)
 			}
 
 			// Prüfen dass Repo-Pfad nicht mehr existiert
-			repoPath := filepath.Join(tmpDir, ".repos", tt.siteName)
+			repoPath := filepath.Join(tmpDir, ".repos", dir)
 			if _, err := os.Stat(repoPath); !os.IsNotExist(err) {
 				t.Errorf("repo path still exists: %s", repoPath)
 			}
+
+			releasesPath := filepath.Join(tmpDir, ".releases", dir)
+			if _, err := os.Stat(releasesPath); !os.IsNotExist(err) {
+				t.Errorf("releases path still exists: %s", releasesPath)
+			}
 		})
 	}
 }
@@ -670,10 +681,16 @@ func TestCleanup(t *testing.T) {
 	defer func() { _ = os.RemoveAll(tmpDir) }()
 
 	// Setup: Create some site directories
-	_ = os.MkdirAll(filepath.Join(tmpDir, "active-site"), 0755)
+	_ = os.MkdirAll(filepath.Join(tmpDir, "default--active-site"), 0755)
 	_ = os.MkdirAll(filepath.Join(tmpDir, "orphan-site"), 0755)
-	_ = os.MkdirAll(filepath.Join(tmpDir, ".repos", "active-site"), 0755)
+	_ = os.MkdirAll(filepath.Join(tmpDir, ".repos", "default--active-site"), 0755)
 	_ = os.MkdirAll(filepath.Join(tmpDir, ".repos", "orphan-repo"), 0755)
+	_ = os.MkdirAll(filepath.Join(tmpDir, ".releases", "default--active-site", "abc123"), 0755)
+
+	// Same name in another namespace, and content of the legacy layout
+	_ = os.MkdirAll(filepath.Join(tmpDir, "other--active-site"), 0755)
+	_ = os.MkdirAll(filepath.Join(tmpDir, ".repos", "active-site"), 0755)
+	_ = os.MkdirAll(filepath.Join(tmpDir, ".releases", "orphan-site", "abc123"), 0755)
 
 	// Symlink for orphan
 	_ = os.MkdirAll(filepath.Join(tmpDir, ".repos", "orphan-link", "dist"), 0755)
@@ -695,7 +712,7 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// active-site should still exist
-	if _, err := os.Stat(filepath.Join(tmpDir, "active-site")); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(tmpDir, "default--active-site")); os.IsNotExist(err) {
 		t.Error("active-site was deleted but should exist")
 	}
 
@@ -715,9 +732,27 @@ func TestCleanup(t *testing.T) {
 	}
 
 	// .repos/active-site should still exist
-	if _, err := os.Stat(filepath.Join(tmpDir, ".repos", "active-site")); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(tmpDir, ".repos", "default--active-site")); os.IsNotExist(err) {
 		t.Error(".repos/active-site was deleted but should exist")
 	}
+
+	// .releases/orphan-site should be deleted, .releases/active-site kept
+	if _, err := os.Stat(filepath.Join(tmpDir, ".releases", "orphan-site")); !os.IsNotExist(err) {
+		t.Error(".releases/orphan-site still exists but should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ".releases", "default--active-site")); os.IsNotExist(err) {
+		t.Error(".releases/active-site was deleted but should exist")
+	}
+
+	// A site of the same name in another namespace does not keep its content
+	if _, err := os.Stat(filepath.Join(tmpDir, "other--active-site")); !os.IsNotExist(err) {
+		t.Error("other--active-site still exists but should be deleted")
+	}
+
+	// Leftovers of the legacy layout are removed
+	if _, err := os.Stat(filepath.Join(tmpDir, ".repos", "active-site")); !os.IsNotExist(err) {
+		t.Error("legacy .repos/active-site still exists but should be deleted")
+	}
 }
 
 func TestGetSecretValue(t *testing.T) {
@@ -882,7 +917,7 @@ func TestSyncSite_PullFailure(t *testing.T) {
 	defer func() { _ = os.RemoveAll(tmpDir) }()
 
 	// Create a fake .git directory to simulate an existing repo
-	siteDir := filepath.Join(tmpDir, "test-site")
+	siteDir := filepath.Join(tmpDir, ".repos", "default--test-site")
 	gitDir := filepath.Join(siteDir, ".git")
 	if err := os.MkdirAll(gitDir, 0755); err != nil {
 		t.Fatalf("failed to create fake git dir: %v", err)
@@ -909,8 +944,8 @@ func TestSyncSite_PullFailure(t *testing.T) {
 	if err == nil {
 		t.Error("expected error for pull failure, got nil")
 	}
-	// The error could be "failed to open repo" since it's not a real git repo
-	if !strings.Contains(err.Error(), "failed to open repo") && !strings.Contains(err.Error(), "git fetch failed") {
+	// The fake git repo is unusable, so it is cloned again
+	if !strings.Contains(err.Error(), "git clone failed") {
 		t.Errorf("unexpected error message: %v", err)
 	}
 }
@@ -923,7 +958,7 @@ func TestSyncSite_SubpathNotExist(t *testing.T) {
 	defer func() { _ = os.RemoveAll(tmpDir) }()
 
 	// Create a minimal git repo structure without the subpath
-	repoDir := filepath.Join(tmpDir, ".repos", "test-site")
+	repoDir := filepath.Join(tmpDir, ".repos", "default--test-site")
 	gitDir := filepath.Join(repoDir, ".git")
 	if err := os.MkdirAll(gitDir, 0755); err != nil {
 		t.Fatalf("failed to create git dir: %v", err)
@@ -960,8 +995,9 @@ func TestSyncSite_SubpathNotExist(t *testing.T) {
 	if err == nil {
 		t.Error("expected error for nonexistent subpath, got nil")
 	}
-	// Either we get a subpath error or a pull error (since fake repo can't pull)
-	if !strings.Contains(err.Error(), "subpath") && !strings.Contains(err.Error(), "git fetch failed") {
+	// Either we get a subpath error or a clone error (the fake repo has no
+	// HEAD, so it is cloned again)
+	if !strings.Contains(err.Error(), "subpath") && !strings.Contains(err.Error(), "git clone failed") {
 		t.Errorf("unexpected error message: %v", err)
 	}
 }
@@ -1276,7 +1312,7 @@ func TestSyncSite_CorruptedRepo(t *testing.T) {
 	defer func() { _ = os.RemoveAll(tmpDir) }()
 
 	// Create a corrupted git repo - valid enough to open but fails on operations
-	siteDir := filepath.Join(tmpDir, "test-site")
+	siteDir := filepath.Join(tmpDir, ".repos", "default--test-site")
 	gitDir := filepath.Join(siteDir, ".git")
 	if err := os.MkdirAll(gitDir, 0755); err != nil {
 		t.Fatalf("failed to create git dir: %v", err)
@@ -1315,14 +1351,17 @@ func TestSyncSite_CorruptedRepo(t *testing.T) {
 	ctx := context.Background()
 	err = s.syncSite(ctx, site)
 
-	// Corrupted repo should fail during pull operation
+	// The corrupted repo is quarantined and cloned again, which fails
+	// since the remote doesn't exist
 	if err == nil {
 		t.Error("expected error for corrupted repo, got nil")
 	}
-	// The error should be git pull related since the repo has no valid remote
-	if !strings.Contains(err.Error(), "git fetch failed") {
+	if !strings.Contains(err.Error(), "git clone failed") {
 		t.Errorf("unexpected error message: %v", err)
 	}
+	if _, err := os.Stat(filepath.Join(tmpDir, quarantineDirName, "default--test-site", ".git", "HEAD")); err != nil {
+		t.Errorf("corrupted repo not quarantined: %v", err)
+	}
 }
 
 func TestCleanup_ReadDirError(t *testing.T) {
@@ -1348,147 +1387,72 @@ func TestCleanup_ReadDirError(t *testing.T) {
 
 func TestSyncSite_NonFastForwardUpdate(t *testing.T) {
 	// This test simulates a force-pushed branch scenario:
-	// 1. Create a local git repo (simulating remote)
-	// 2. Clone it to sites directory
-	// 3. Make a new divergent commit in the "remote" (simulate force push)
-	// 4. Syncer should successfully sync to the new commit
-
-	tmpDir, err := os.MkdirTemp("", "syncer-nff-test-*")
-	if err != nil {
-		t.Fatalf("failed to create temp dir: %v", err)
-	}
-	defer func() { _ = os.RemoveAll(tmpDir) }()
+	// 1. Serve a git repo (the remote) and sync it
+	// 2. Replace the deployed commit in the remote with a divergent one
+	// 3. Syncer should successfully sync to the new commit
+	root, baseURL := newTestGitServer(t)
+	remoteRepo, commit1 := newServedRepo(t, root, "repo.git", map[string]string{"index.html": "<h1>Version 1</h1>"})
+	deployed := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "<h1>Version 2</h1>"}, "Update")
 
-	// Create the "remote" repo
-	remoteDir := filepath.Join(tmpDir, "remote")
-	if err := os.MkdirAll(remoteDir, 0755); err != nil {
-		t.Fatalf("failed to create remote dir: %v", err)
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
 	}
-
-	// Initialize a git repo with an initial commit
-	remoteRepo, err := git.PlainInit(remoteDir, false)
-	if err != nil {
-		t.Fatalf("failed to init remote repo: %v", err)
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      baseURL + "/repo.git",
+		Branch:    "master",
+		Path:      "/",
 	}
 
-	// Create initial file
-	indexPath := filepath.Join(remoteDir, "index.html")
-	if err := os.WriteFile(indexPath, []byte("<h1>Version 1</h1>"), 0644); err != nil {
-		t.Fatalf("failed to create index.html: %v", err)
+	ctx := context.Background()
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("initial syncSite() error = %v", err)
 	}
-
-	// Stage and commit
-	remoteWorktree, err := remoteRepo.Worktree()
+	siteDir := s.repoDir("default--test-site")
+	checkout, err := openCheckout(siteDir)
 	if err != nil {
-		t.Fatalf("failed to get remote worktree: %v", err)
-	}
-	if _, err := remoteWorktree.Add("index.html"); err != nil {
-		t.Fatalf("failed to add file: %v", err)
+		t.Fatalf("failed to open checkout: %v", err)
 	}
-	commit1, err := remoteWorktree.Commit("Initial commit", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "Test",
-			Email: "test@example.com",
-			When:  time.Now(),
-		},
-	})
+	head, err := checkout.Head()
 	if err != nil {
-		t.Fatalf("failed to create initial commit: %v", err)
-	}
-
-	// Create syncer sites directory
-	sitesDir := filepath.Join(tmpDir, "sites")
-	if err := os.MkdirAll(sitesDir, 0755); err != nil {
-		t.Fatalf("failed to create sites dir: %v", err)
-	}
-
-	// Clone to sites directory (simulating initial sync)
-	siteDir := filepath.Join(sitesDir, "test-site")
-	cloneOpts := &git.CloneOptions{
-		URL:           remoteDir,
-		ReferenceName: plumbing.Master,
-		SingleBranch:  true,
-		Depth:         1,
+		t.Fatalf("failed to get HEAD: %v", err)
 	}
-	clonedRepo, err := git.PlainClone(siteDir, false, cloneOpts)
-	if err != nil {
-		t.Fatalf("failed to clone repo: %v", err)
+	if head.Hash() != deployed {
+		t.Fatalf("expected HEAD to be %s, got %s", deployed, head.Hash())
 	}
 
-	// Verify we're at commit1
-	head, err := clonedRepo.Head()
+	// Now simulate a force push: reset the remote to the first commit and
+	// create a divergent commit
+	remoteWorktree, err := remoteRepo.Worktree()
 	if err != nil {
-		t.Fatalf("failed to get HEAD: %v", err)
-	}
-	if head.Hash() != commit1 {
-		t.Fatalf("expected HEAD to be %s, got %s", commit1, head.Hash())
+		t.Fatalf("failed to get remote worktree: %v", err)
 	}
-
-	// Now simulate a force push: reset the remote and create a divergent commit
-	// First reset to commit1, then make a different change
 	if err := remoteWorktree.Reset(&git.ResetOptions{
 		Mode:   git.HardReset,
 		Commit: commit1,
 	}); err != nil {
 		t.Fatalf("failed to reset: %v", err)
 	}
-
-	// Make a different change that creates a new history
-	if err := os.WriteFile(indexPath, []byte("<h1>Version 2 - Rebased</h1>"), 0644); err != nil {
-		t.Fatalf("failed to update index.html: %v", err)
-	}
-	if _, err := remoteWorktree.Add("index.html"); err != nil {
-		t.Fatalf("failed to add rebased file: %v", err)
-	}
-	commit2, err := remoteWorktree.Commit("Rebased commit", &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "Test",
-			Email: "test@example.com",
-			When:  time.Now().Add(time.Second), // Different timestamp for different hash
-		},
-	})
-	if err != nil {
-		t.Fatalf("failed to create rebased commit: %v", err)
-	}
-
-	// Verify commit2 is different from commit1
-	if commit1 == commit2 {
-		t.Fatal("commit1 and commit2 should be different")
-	}
-
-	// Now try to sync using the syncer's pull logic
-	// This is where the current implementation fails with "non-fast-forward update"
-	s := &Syncer{
-		SitesRoot:     sitesDir,
-		AllowedHosts:  []string{"example.com"}, // Not used for local path
-		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
-		ClientSet:     newFakeClientset(),
+	commit2 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "<h1>Version 2 - Rebased</h1>"}, "Rebased commit")
+	if commit2 == deployed {
+		t.Fatal("rebased commit should differ from the deployed one")
 	}
 
-	site := &staticSiteData{
-		Name:      "test-site",
-		Namespace: "default",
-		Repo:      remoteDir, // Local path works with go-git
-		Branch:    "master",
-		Path:      "/",
-	}
-
-	ctx := context.Background()
-
-	// Call pullRepo directly - we need to test the pull logic
-	_, err = s.pullRepo(ctx, siteDir, site, nil)
-
-	// Current implementation fails here with "non-fast-forward update"
-	if err != nil {
-		t.Errorf("pullRepo failed on non-fast-forward update: %v", err)
+	// A plain pull fails here with "non-fast-forward update"
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Errorf("syncSite() failed on non-fast-forward update: %v", err)
 	}
 
 	// Verify we're now at commit2
-	clonedRepo, err = git.PlainOpen(siteDir)
+	checkout, err = openCheckout(siteDir)
 	if err != nil {
-		t.Fatalf("failed to reopen repo: %v", err)
+		t.Fatalf("failed to reopen checkout: %v", err)
 	}
-	head, err = clonedRepo.Head()
+	head, err = checkout.Head()
 	if err != nil {
 		t.Fatalf("failed to get HEAD after sync: %v", err)
 	}
@@ -1514,7 +1478,7 @@ func TestSyncSite_PullWithAuth(t *testing.T) {
 	defer func() { _ = os.RemoveAll(tmpDir) }()
 
 	// Create a valid non-bare git repo structure
-	siteDir := filepath.Join(tmpDir, "test-site")
+	siteDir := filepath.Join(tmpDir, ".repos", "default--test-site")
 	gitDir := filepath.Join(siteDir, ".git")
 	if err := os.MkdirAll(gitDir, 0755); err != nil {
 		t.Fatalf("failed to create git dir: %v", err)
@@ -1561,13 +1525,13 @@ func TestSyncSite_PullWithAuth(t *testing.T) {
 	ctx := context.Background()
 	err = s.syncSite(ctx, site)
 
-	// We expect a pull failure since it's not a real remote,
-	// but the auth with username should have been set up
+	// We expect a clone failure since it's not a real remote (the repo has
+	// no HEAD, so it is cloned again), but the auth with username should
+	// have been set up
 	if err == nil {
-		t.Error("expected pull error, got nil")
+		t.Error("expected clone error, got nil")
 	}
-	// The error should be git pull related
-	if !strings.Contains(err.Error(), "git fetch failed") {
+	if !strings.Contains(err.Error(), "git clone failed") {
 		t.Errorf("unexpected error message: %v", err)
 	}
 }
@@ -1590,7 +1554,7 @@ func TestDeleteSite_RemoveError(t *testing.T) {
 	ctx := context.Background()
 
 	// Test successful deletion of non-existent site (should not error)
-	err = s.DeleteSite(ctx, "nonexistent-site")
+	err = s.DeleteSite(ctx, "default", "nonexistent-site")
 	if err != nil {
 		t.Errorf("DeleteSite() for non-existent site: error = %v, want nil", err)
 	}
@@ -1670,3 +1634,360 @@ func TestRunLoop_InitialSyncError(t *testing.T) {
 		t.Error("RunLoop did not exit after context cancellation")
 	}
 }
+
+func TestSyncSite_PinnedRevision(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+	commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v2"}, "Update")
+
+	fakeClient := &fakeDynamicClient{activeSites: []string{"test-site"}}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+		Revision:  commit1.String(),
+		Path:      "/",
+	}
+
+	ctx := context.Background()
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want %q", got, "v1")
+	}
+	if s.currentRelease("default--test-site") != commit1.String() {
+		t.Errorf("current release = %q, want %q", s.currentRelease("default--test-site"), commit1)
+	}
+	if !strings.Contains(string(fakeClient.lastPatch), commit1.String()[:8]) {
+		t.Errorf("status patch does not contain commit %s: %s", commit1.String()[:8], fakeClient.lastPatch)
+	}
+
+	// New commits on the branch don't move a pinned site
+	commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v3"}, "Another update")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() second call error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+		t.Errorf("index.html after branch update = %q, want %q", got, "v1")
+	}
+}
+
+func TestSyncSite_PinnedRevisionNotYetFetched(t *testing.T) {
+	repoURL, remoteRepo, _ := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+
+	// The pinned commit only exists on the remote, on a different branch
+	wt, err := remoteRepo.Worktree()
+	if err != nil {
+		t.Fatalf("failed to get worktree: %v", err)
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("release"), Create: true}); err != nil {
+		t.Fatalf("failed to create branch: %v", err)
+	}
+	pinned := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "release"}, "Release")
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+		Revision:  pinned.String(),
+		Path:      "/",
+	}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "release" {
+		t.Errorf("index.html = %q, want %q", got, "release")
+	}
+}
+
+func TestSyncSite_PinnedRevisionNotFound(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+		Revision:  "0123456789abcdef0123456789abcdef01234567",
+		Path:      "/",
+	}
+
+	err := s.syncSite(context.Background(), site)
+	if err == nil {
+		t.Fatal("expected error for unknown revision, got nil")
+	}
+	if !strings.Contains(err.Error(), "not found in repository") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestSyncSite_InvalidRevision(t *testing.T) {
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"example.com"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      "https://example.com/repo.git",
+		Branch:    "main",
+		Revision:  "abc123",
+		Path:      "/",
+	}
+
+	err := s.syncSite(context.Background(), site)
+	if err == nil {
+		t.Fatal("expected error for abbreviated revision, got nil")
+	}
+	if !strings.Contains(err.Error(), "full 40-character commit SHA") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+	if _, err := os.Stat(s.repoDir("default--test-site")); !os.IsNotExist(err) {
+		t.Error("invalid revision should not create a checkout")
+	}
+}
+
+func TestSyncSite_PinnedTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		annotated bool
+	}{
+		{name: "lightweight tag", annotated: false},
+		{name: "annotated tag", annotated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+			createTag := func(hash plumbing.Hash) {
+				t.Helper()
+				var opts *git.CreateTagOptions
+				if tt.annotated {
+					opts = &git.CreateTagOptions{
+						Tagger:  &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+						Message: "Release",
+					}
+				}
+				if _, err := remoteRepo.CreateTag("v1.0.0", hash, opts); err != nil {
+					t.Fatalf("failed to create tag: %v", err)
+				}
+			}
+			createTag(commit1)
+			commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v2"}, "Update")
+
+			fakeClient := &fakeDynamicClient{activeSites: []string{"test-site"}}
+			s := &Syncer{
+				SitesRoot:     t.TempDir(),
+				AllowedHosts:  []string{"127.0.0.1"},
+				DynamicClient: fakeClient,
+				ClientSet:     newFakeClientset(),
+			}
+
+			site := &staticSiteData{
+				Name:      "test-site",
+				Namespace: "default",
+				Repo:      repoURL,
+				Branch:    "master",
+				Tag:       "v1.0.0",
+				Path:      "/",
+			}
+
+			ctx := context.Background()
+			if err := s.syncSite(ctx, site); err != nil {
+				t.Fatalf("syncSite() error = %v", err)
+			}
+			if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+				t.Errorf("index.html = %q, want %q", got, "v1")
+			}
+			if !strings.Contains(string(fakeClient.lastPatch), commit1.String()[:8]) {
+				t.Errorf("status patch does not contain commit %s: %s", commit1.String()[:8], fakeClient.lastPatch)
+			}
+
+			// Moving the tag moves the site
+			commit3 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v3"}, "Another update")
+			if err := remoteRepo.DeleteTag("v1.0.0"); err != nil {
+				t.Fatalf("failed to delete tag: %v", err)
+			}
+			createTag(commit3)
+
+			if err := s.syncSite(ctx, site); err != nil {
+				t.Fatalf("syncSite() second call error = %v", err)
+			}
+			if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v3" {
+				t.Errorf("index.html after moving tag = %q, want %q", got, "v3")
+			}
+			if s.currentRelease("default--test-site") != commit3.String() {
+				t.Errorf("current release = %q, want %q", s.currentRelease("default--test-site"), commit3)
+			}
+		})
+	}
+}
+
+// worktreeFiles lists the files of a checkout, without .git
+func worktreeFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to list checkout: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestSyncSite_SparseCheckout(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	remote, _ := newServedRepo(t, root, "monorepo.git", map[string]string{
+		".gitattributes":      "*.bin binary\n",
+		"README.md":           "readme",
+		"dist/index.html":     "v1",
+		"dist/css/site.css":   "css",
+		"distribution/x.html": "not dist",
+		"src/app/big.bin":     "big",
+	})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "test-site", Namespace: "default", Repo: baseURL + "/monorepo.git", Branch: "master", Path: "/dist"}
+	repoDir := s.repoDir("default--test-site")
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	want := []string{".gitattributes", "dist/css/site.css", "dist/index.html"}
+	if got := worktreeFiles(t, repoDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkout = %v, want %v", got, want)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+
+	// Updates stay sparse
+	commitTestFiles(t, remote, map[string]string{"dist/index.html": "v2", "src/app/new.bin": "new"}, "Update")
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("second syncSite() error = %v", err)
+	}
+	if got := worktreeFiles(t, repoDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkout after update = %v, want %v", got, want)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v2" {
+		t.Errorf("index.html after update = %q, want v2", got)
+	}
+
+	// The whole tree comes back when the site serves the repo root
+	site.Path = "/"
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() for / error = %v", err)
+	}
+	want = []string{".gitattributes", "README.md", "dist/css/site.css", "dist/index.html", "distribution/x.html", "src/app/big.bin", "src/app/new.bin"}
+	if got := worktreeFiles(t, repoDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("full checkout = %v, want %v", got, want)
+	}
+
+	// ...and goes again when it is narrowed down
+	site.Path = "/src/app"
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() for /src/app error = %v", err)
+	}
+	want = []string{".gitattributes", "src/app/big.bin", "src/app/new.bin"}
+	if got := worktreeFiles(t, repoDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("narrowed checkout = %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "dist")); !os.IsNotExist(err) {
+		t.Error("empty directories of the old subpath were left behind")
+	}
+}
+
+func TestSyncSite_SparseCheckoutPinnedRevision(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	_, commit := newServedRepo(t, root, "monorepo.git", map[string]string{
+		"dist/index.html": "pinned",
+		"src/main.go":     "package main",
+	})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "test-site", Namespace: "default", Repo: baseURL + "/monorepo.git", Revision: commit.String(), Path: "/dist/"}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := worktreeFiles(t, s.repoDir("default--test-site")); !reflect.DeepEqual(got, []string{"dist/index.html"}) {
+		t.Errorf("checkout = %v, want only dist", got)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "pinned" {
+		t.Errorf("index.html = %q, want pinned", got)
+	}
+}
+
+func TestSparseDirs(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"", nil},
+		{"/", nil},
+		{"/dist", []string{"dist/", ".gitattributes", ".gitmodules"}},
+		{"/dist/", []string{"dist/", ".gitattributes", ".gitmodules"}},
+		{"docs/public", []string{"docs/public/", ".gitattributes", ".gitmodules"}},
+		{"/../dist", []string{"dist/", ".gitattributes", ".gitmodules"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			site := &staticSiteData{Path: tt.path}
+			if got := site.sparseDirs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sparseDirs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
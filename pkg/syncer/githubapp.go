@@ -0,0 +1,203 @@
+// Package syncer - GitHub App authentication
+package syncer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// githubAppIDKey, githubAppInstallationIDKey and githubAppPrivateKeyKey
+	// are the Secret keys of GitHub App credentials. A Secret with an app ID
+	// authenticates with installation tokens of the app.
+	githubAppIDKey             = "githubAppID"
+	githubAppInstallationIDKey = "githubAppInstallationID"
+	githubAppPrivateKeyKey     = "githubAppPrivateKey"
+
+	// bearerTokenKey is the Secret key of a token sent as bearer token,
+	// e.g. for Azure DevOps
+	bearerTokenKey = "bearerToken"
+
+	// githubTokenUsername is the user Git authenticates as with an
+	// installation token
+	githubTokenUsername = "x-access-token"
+
+	// githubJWTLifetime is how long the JWT an installation token is
+	// requested with is valid. GitHub accepts at most 10 minutes.
+	githubJWTLifetime = 9 * time.Minute
+
+	// githubTokenRefreshMargin is how long before it expires an installation
+	// token is replaced, so it doesn't expire during a sync
+	githubTokenRefreshMargin = 5 * time.Minute
+)
+
+// githubApp are the credentials of a GitHub App installation
+type githubApp struct {
+	appID          string
+	installationID string
+	privateKey     *rsa.PrivateKey
+	// keyPEM is the private key as stored, part of the cache key
+	keyPEM []byte
+}
+
+// installationToken is a cached installation token of a GitHub App
+type installationToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// githubTokenCache holds the installation tokens minted by the Syncer
+type githubTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]installationToken
+}
+
+// parseGitHubApp reads GitHub App credentials from a Secret
+func parseGitHubApp(secret *corev1.Secret) (*githubApp, error) {
+	app := &githubApp{
+		appID:          strings.TrimSpace(string(secret.Data[githubAppIDKey])),
+		installationID: strings.TrimSpace(string(secret.Data[githubAppInstallationIDKey])),
+		keyPEM:         secret.Data[githubAppPrivateKeyKey],
+	}
+	if app.installationID == "" {
+		return nil, fmt.Errorf("key %s not found in secret %s", githubAppInstallationIDKey, secret.Name)
+	}
+	for _, r := range app.installationID {
+		if r < '0' || r > '9' {
+			return nil, fmt.Errorf("invalid %s %q in secret %s", githubAppInstallationIDKey, app.installationID, secret.Name)
+		}
+	}
+	if len(app.keyPEM) == 0 {
+		return nil, fmt.Errorf("key %s not found in secret %s", githubAppPrivateKeyKey, secret.Name)
+	}
+
+	block, _ := pem.Decode(app.keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid %s in secret %s: no PEM block", githubAppPrivateKeyKey, secret.Name)
+	}
+	// GitHub hands out PKCS #1 keys, converted ones are PKCS #8
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); err8 != nil || !ok {
+			return nil, fmt.Errorf("invalid %s in secret %s: not an RSA private key", githubAppPrivateKeyKey, secret.Name)
+		}
+	}
+	app.privateKey = key
+	return app, nil
+}
+
+// githubAPIURL returns the REST API of the GitHub host of a repo:
+// api.github.com for github.com, /api/v3 on GitHub Enterprise Server
+func githubAPIURL(remote *remoteURL) string {
+	if remote.Host == "github.com" {
+		return "https://api.github.com"
+	}
+	host := remote.Host
+	if remote.Port != "" {
+		host = net.JoinHostPort(remote.Host, remote.Port)
+	}
+	return remote.Scheme + "://" + host + "/api/v3"
+}
+
+// jwt returns a JSON Web Token signed with the app's private key, which
+// authenticates as the app itself
+func (a *githubApp) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// Backdated against clock drift, as GitHub recommends
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubJWTLifetime).Unix(),
+		"iss": a.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, a.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// githubAppToken returns an installation token of the app for the GitHub
+// host at apiURL. Tokens are cached until shortly before they expire; the
+// cache key includes the private key, so only holders of the key get a
+// cached token.
+func (s *Syncer) githubAppToken(ctx context.Context, app *githubApp, apiURL string, caBundle []byte) (string, error) {
+	keyHash := sha256.Sum256(app.keyPEM)
+	cacheKey := strings.Join([]string{apiURL, app.appID, app.installationID, hex.EncodeToString(keyHash[:])}, "\n")
+
+	s.githubTokens.mu.Lock()
+	cached, ok := s.githubTokens.tokens[cacheKey]
+	s.githubTokens.mu.Unlock()
+	if ok && time.Until(cached.expiresAt) > githubTokenRefreshMargin {
+		return cached.token, nil
+	}
+
+	jwt, err := app.jwt(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL+"/app/installations/"+app.installationID+"/access_tokens", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	client, err := s.httpClient(caBundle)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("GitHub App token request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+		Message   string    `json:"message"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result)
+	if resp.StatusCode != http.StatusCreated {
+		if result.Message != "" {
+			return "", fmt.Errorf("GitHub App token request failed: %s: %s", resp.Status, result.Message)
+		}
+		return "", fmt.Errorf("GitHub App token request failed: %s", resp.Status)
+	}
+	if err != nil || result.Token == "" {
+		return "", fmt.Errorf("invalid GitHub App token response")
+	}
+
+	s.githubTokens.mu.Lock()
+	if s.githubTokens.tokens == nil {
+		s.githubTokens.tokens = map[string]installationToken{}
+	}
+	s.githubTokens.tokens[cacheKey] = installationToken{token: result.Token, expiresAt: result.ExpiresAt}
+	s.githubTokens.mu.Unlock()
+	return result.Token, nil
+}
@@ -0,0 +1,286 @@
+package syncer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGitHubServer is a fake GitHub host: it mints installation tokens for
+// one app installation and serves Git repos to holders of a valid token
+type testGitHubServer struct {
+	*httptest.Server
+	root string
+
+	mu      sync.Mutex
+	key     *rsa.PublicKey
+	minted  int
+	current string
+}
+
+func newTestGitHubServer(t *testing.T, key *rsa.PublicKey) *testGitHubServer {
+	t.Helper()
+
+	root, git := newGitHTTPBackend(t)
+	g := &testGitHubServer{root: root, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v3/app/installations/{id}/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "4711" || r.Header.Get("Accept") != "application/vnd.github+json" {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		if !g.validJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"A JSON web token could not be decoded"}`))
+			return
+		}
+		g.mu.Lock()
+		g.minted++
+		g.current = "ghs_token" + string(rune('0'+g.minted))
+		token := g.current
+		g.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token":      token,
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		g.mu.Lock()
+		valid := user == githubTokenUsername && password != "" && password == g.current
+		g.mu.Unlock()
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Basic realm="GitHub"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		git.ServeHTTP(w, r)
+	})
+	g.Server = httptest.NewServer(mux)
+	t.Cleanup(g.Close)
+	return g
+}
+
+// validJWT checks a JWT like GitHub does: RS256 signed by the app's key,
+// issued by app 123 and valid for at most 10 minutes
+func (g *testGitHubServer) validJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if string(header) != `{"alg":"RS256","typ":"JWT"}` {
+		return false
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(g.key, crypto.SHA256, digest[:], signature) != nil {
+		return false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims struct {
+		IAT int64  `json:"iat"`
+		EXP int64  `json:"exp"`
+		ISS string `json:"iss"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.ISS != "123" {
+		return false
+	}
+	now := time.Now().Unix()
+	return claims.IAT <= now && claims.EXP > now && claims.EXP-claims.IAT <= 600
+}
+
+func (g *testGitHubServer) mintedTokens() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.minted
+}
+
+func newRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func TestSyncSite_GitHubApp(t *testing.T) {
+	key, keyPEM := newRSAKey(t)
+	_, otherPEM := newRSAKey(t)
+	srv := newTestGitHubServer(t, &key.PublicKey)
+	remote, _ := newServedRepo(t, srv.root, "org/site.git", map[string]string{"index.html": "v1"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet: newFakeClientset(
+			newTestSecret("default", "github-app", map[string][]byte{
+				githubAppIDKey:             []byte("123"),
+				githubAppInstallationIDKey: []byte("4711"),
+				githubAppPrivateKeyKey:     keyPEM,
+			}),
+			newTestSecret("default", "stolen-ids", map[string][]byte{
+				githubAppIDKey:             []byte("123"),
+				githubAppInstallationIDKey: []byte("4711"),
+				githubAppPrivateKeyKey:     otherPEM,
+			}),
+		),
+	}
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Repo: srv.URL + "/org/site.git", Branch: "master",
+		SecretRef: &secretRef{Name: "github-app"},
+	}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+
+	// The installation token is reused while it is valid...
+	commitTestFiles(t, remote, map[string]string{"index.html": "v2"}, "Update")
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("second syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v2" {
+		t.Errorf("index.html = %q, want v2", got)
+	}
+	if srv.mintedTokens() != 1 {
+		t.Errorf("minted tokens = %d, want 1", srv.mintedTokens())
+	}
+
+	// ...and replaced shortly before it expires
+	s.githubTokens.mu.Lock()
+	for k, token := range s.githubTokens.tokens {
+		token.expiresAt = time.Now().Add(time.Minute)
+		s.githubTokens.tokens[k] = token
+	}
+	s.githubTokens.mu.Unlock()
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with expiring token error = %v", err)
+	}
+	if srv.mintedTokens() != 2 {
+		t.Errorf("minted tokens = %d, want 2", srv.mintedTokens())
+	}
+
+	// The cached token is only handed out with the app's private key
+	site.SecretRef = &secretRef{Name: "stolen-ids"}
+	err := s.syncSite(context.Background(), site)
+	if err == nil || !strings.Contains(err.Error(), "A JSON web token could not be decoded") {
+		t.Errorf("syncSite() with another key error = %v", err)
+	}
+}
+
+func TestSyncSite_BearerToken(t *testing.T) {
+	root, git := newGitHTTPBackend(t)
+	newServedRepo(t, root, "site.git", map[string]string{"index.html": "bearer"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer eyJ0eXAi.token" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		git.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet: newFakeClientset(newTestSecret("default", "token", map[string][]byte{
+			bearerTokenKey: []byte("eyJ0eXAi.token\n"),
+		})),
+	}
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Repo: srv.URL + "/site.git", Branch: "master",
+		SecretRef: &secretRef{Name: "token"},
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "bearer" {
+		t.Errorf("index.html = %q, want bearer", got)
+	}
+}
+
+func TestParseGitHubApp(t *testing.T) {
+	key, keyPEM := newRSAKey(t)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8PEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		wantErr string
+	}{
+		{"PKCS #1 key", map[string]string{"installation": "4711", "key": string(keyPEM)}, ""},
+		{"PKCS #8 key", map[string]string{"installation": "4711", "key": string(pkcs8PEM)}, ""},
+		{"no installation", map[string]string{"key": string(keyPEM)}, "githubAppInstallationID not found"},
+		{"invalid installation", map[string]string{"installation": "../../users", "key": string(keyPEM)}, "invalid githubAppInstallationID"},
+		{"no key", map[string]string{"installation": "4711"}, "githubAppPrivateKey not found"},
+		{"invalid key", map[string]string{"installation": "4711", "key": "ssh-ed25519 AAAA"}, "no PEM block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := newTestSecret("default", "app", map[string][]byte{
+				githubAppIDKey:             []byte("123"),
+				githubAppInstallationIDKey: []byte(tt.data["installation"]),
+				githubAppPrivateKeyKey:     []byte(tt.data["key"]),
+			})
+			app, err := parseGitHubApp(secret)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseGitHubApp() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseGitHubApp() error = %v", err)
+			}
+			if !app.privateKey.Equal(key) {
+				t.Error("parseGitHubApp() returned another key")
+			}
+		})
+	}
+}
+
+func TestGitHubAPIURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/org/repo.git":          "https://api.github.com",
+		"https://github.example.com/org/repo.git":  "https://github.example.com/api/v3",
+		"https://github.example.com:8443/org/repo": "https://github.example.com:8443/api/v3",
+		"http://127.0.0.1:3000/org/repo.git":       "http://127.0.0.1:3000/api/v3",
+	}
+	for repo, want := range tests {
+		remote, err := parseRemoteURL(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := githubAPIURL(remote); got != want {
+			t.Errorf("githubAPIURL(%s) = %s, want %s", repo, got, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Package syncer - StaticSite informer
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// repoIndex is the informer index of StaticSites by spec.repo, used to
+// resolve webhooks without listing all sites
+const repoIndex = "repo"
+
+// repoIndexFunc indexes StaticSites by their repo URL
+func repoIndexFunc(obj interface{}) ([]string, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil
+	}
+	repo, _, _ := unstructured.NestedString(u.Object, "spec", "repo")
+	if repo == "" {
+		return nil, nil
+	}
+	return []string{repo}, nil
+}
+
+// StartInformer starts watching StaticSites and waits until the cache is
+// filled. Afterwards the syncer reads sites from the cache instead of the
+// API server, and the sync loop reacts to spec changes immediately.
+func (s *Syncer) StartInformer(ctx context.Context) error {
+	informer := dynamicinformer.NewFilteredDynamicInformer(
+		s.DynamicClient, staticSiteGVR, "", 0,
+		cache.Indexers{
+			cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
+			repoIndex:            repoIndexFunc,
+		},
+		nil,
+	).Informer()
+
+	go informer.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to sync StaticSite cache")
+	}
+
+	s.Informer = informer
+	return nil
+}
+
+// siteEvent tells the sync loop about a site change seen by the informer
+type siteEvent struct {
+	site *staticSiteData
+	key  string
+	// specChanged is set for updates of the spec of a known site
+	specChanged bool
+	deleted     bool
+}
+
+// watchSites registers an informer event handler that sends site changes
+// to events until ctx is done. New sites and spec changes are sent; status
+// updates (including the ones made by the syncer itself) are ignored.
+func (s *Syncer) watchSites(ctx context.Context, events chan<- siteEvent) (cache.ResourceEventHandlerRegistration, error) {
+	logger := log.FromContext(ctx)
+
+	send := func(ev siteEvent) {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	}
+
+	upsert := func(obj interface{}, specChanged bool) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		site := &staticSiteData{}
+		if err := site.fromUnstructured(u); err != nil {
+			logger.Error(err, "Failed to parse StaticSite", "name", u.GetName())
+			return
+		}
+		send(siteEvent{site: site, key: siteKey(site.Namespace, site.Name), specChanged: specChanged})
+	}
+
+	return s.Informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			upsert(obj, false)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if specChanged(oldObj, newObj) {
+				upsert(newObj, true)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			u, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return
+			}
+			send(siteEvent{key: siteKey(u.GetNamespace(), u.GetName()), deleted: true})
+		},
+	})
+}
+
+// specChanged reports whether the spec of a StaticSite differs between two versions
+func specChanged(oldObj, newObj interface{}) bool {
+	oldU, ok1 := oldObj.(*unstructured.Unstructured)
+	newU, ok2 := newObj.(*unstructured.Unstructured)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return !reflect.DeepEqual(oldU.Object["spec"], newU.Object["spec"])
+}
+
+// sitesByRepo returns the StaticSites with the given repo URL. With an
+// informer they are looked up in the repo index, otherwise all sites are
+// listed and the caller filters them.
+func (s *Syncer) sitesByRepo(ctx context.Context, repoURL string) ([]*unstructured.Unstructured, error) {
+	if s.Informer == nil {
+		return s.siteObjects(ctx)
+	}
+
+	objs, err := s.Informer.GetIndexer().ByIndex(repoIndex, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			items = append(items, u)
+		}
+	}
+	return items, nil
+}
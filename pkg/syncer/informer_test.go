@@ -0,0 +1,205 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// newStaticSite returns a StaticSite object for the fake dynamic client
+func newStaticSite(namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "pages.kup6s.com/v1beta1",
+			"kind":       "StaticSite",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+// newFakeStaticSiteClient returns a fake dynamic client serving StaticSites
+func newFakeStaticSiteClient(objs ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+		runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{staticSiteGVR: "StaticSiteList"},
+		objs...,
+	)
+}
+
+// startTestInformer starts the informer of s and stops it when the test ends
+func startTestInformer(t *testing.T, s *Syncer) context.Context {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.StartInformer(ctx); err != nil {
+		t.Fatalf("StartInformer() error = %v", err)
+	}
+	return ctx
+}
+
+func TestStartInformer_ReadsSitesFromCache(t *testing.T) {
+	client := newFakeStaticSiteClient(
+		newStaticSite("team-a", "docs", map[string]interface{}{"repo": "https://github.com/a/docs.git"}),
+		newStaticSite("team-b", "blog", map[string]interface{}{"repo": "https://github.com/b/blog.git"}),
+	)
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client}
+	ctx := startTestInformer(t, s)
+
+	sites, err := s.listSites(ctx)
+	if err != nil {
+		t.Fatalf("listSites() error = %v", err)
+	}
+	if len(sites) != 2 {
+		t.Fatalf("listSites() returned %d sites, want 2", len(sites))
+	}
+
+	// The API server is not asked again
+	client.ClearActions()
+	if _, err := s.listSites(ctx); err != nil {
+		t.Fatalf("listSites() error = %v", err)
+	}
+	if _, err := s.getSiteObject(ctx, "team-a", "docs"); err != nil {
+		t.Fatalf("getSiteObject() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got %v", actions)
+	}
+}
+
+func TestCleanup_UsesInformerCache(t *testing.T) {
+	client := newFakeStaticSiteClient(
+		newStaticSite("default", "active", map[string]interface{}{"repo": "https://github.com/a/active.git"}),
+	)
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client}
+	ctx := startTestInformer(t, s)
+
+	for _, name := range []string{"default--active", "orphan"} {
+		if err := os.MkdirAll(filepath.Join(s.SitesRoot, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, "default--active")); err != nil {
+		t.Error("active site was removed")
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, "orphan")); !os.IsNotExist(err) {
+		t.Error("orphaned site was not removed")
+	}
+}
+
+func TestSitesByRepo_UsesIndex(t *testing.T) {
+	client := newFakeStaticSiteClient(
+		newStaticSite("default", "one", map[string]interface{}{"repo": "https://github.com/user/repo.git"}),
+		newStaticSite("other", "two", map[string]interface{}{"repo": "https://github.com/user/repo.git"}),
+		newStaticSite("default", "three", map[string]interface{}{"repo": "https://github.com/user/other.git"}),
+	)
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client}
+	ctx := startTestInformer(t, s)
+
+	items, err := s.sitesByRepo(ctx, "https://github.com/user/repo.git")
+	if err != nil {
+		t.Fatalf("sitesByRepo() error = %v", err)
+	}
+	names := map[string]bool{}
+	for _, item := range items {
+		names[item.GetName()] = true
+	}
+	if len(items) != 2 || !names["one"] || !names["two"] {
+		t.Errorf("sitesByRepo() = %v, want one and two", names)
+	}
+
+	items, err = s.sitesByRepo(ctx, "https://github.com/user/unknown.git")
+	if err != nil {
+		t.Fatalf("sitesByRepo() error = %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("sitesByRepo() returned %d sites for unknown repo", len(items))
+	}
+}
+
+func TestSpecChanged(t *testing.T) {
+	old := newStaticSite("default", "site", map[string]interface{}{"repo": "https://github.com/user/repo.git"})
+
+	statusOnly := old.DeepCopy()
+	statusOnly.Object["status"] = map[string]interface{}{"phase": "Ready", "lastCommit": "abc12345"}
+	if specChanged(old, statusOnly) {
+		t.Error("status update reported as spec change")
+	}
+
+	branchChange := old.DeepCopy()
+	branchChange.Object["spec"].(map[string]interface{})["branch"] = "develop"
+	if !specChanged(old, branchChange) {
+		t.Error("branch change not reported as spec change")
+	}
+}
+
+func TestRunLoop_SyncsOnSiteEvents(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+	commit2 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v2"}, "Update")
+
+	client := newFakeStaticSiteClient()
+	s := &Syncer{
+		SitesRoot:       t.TempDir(),
+		AllowedHosts:    []string{"127.0.0.1"},
+		DynamicClient:   client,
+		ClientSet:       newFakeClientset(),
+		DefaultInterval: time.Hour,
+	}
+	ctx := startTestInformer(t, s)
+
+	loopCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.RunLoop(loopCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForRelease := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.currentRelease("default--site") != want && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if got := s.currentRelease("default--site"); got != want {
+			t.Fatalf("current release = %q, want %q", got, want)
+		}
+	}
+
+	// A new site is synced without waiting for the next rescan
+	site := newStaticSite("default", "site", map[string]interface{}{
+		"repo":   repoURL,
+		"branch": "master",
+	})
+	created, err := client.Resource(staticSiteGVR).Namespace("default").Create(ctx, site, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create site: %v", err)
+	}
+	waitForRelease(commit2.String())
+
+	// So is a spec change
+	created.Object["spec"].(map[string]interface{})["revision"] = commit1.String()
+	if _, err := client.Resource(staticSiteGVR).Namespace("default").Update(ctx, created, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update site: %v", err)
+	}
+	waitForRelease(commit1.String())
+}
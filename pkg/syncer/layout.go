@@ -0,0 +1,136 @@
+// Package syncer - migration of the on-disk layout
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// MigrateLayout publishes the content of sites synced by older versions as
+// the first release of their namespace-qualified directory. Older versions
+// cloned a site without subpath directly into /sites/<name>; sites with a
+// subpath were cloned into .repos/<name> and /sites/<name> linked to the
+// subpath in the checkout.
+//
+// A legacy directory is only migrated if exactly one StaticSite has that
+// name; otherwise there is no telling whose content it is, and the sites are
+// synced from scratch. The legacy /sites/<name> is pointed at the new
+// release, so routes of a not yet updated operator keep working until the
+// next Cleanup removes it. The checkouts themselves are not moved, the next
+// sync clones them again from the shared object store.
+func (s *Syncer) MigrateLayout(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	items, err := s.siteObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	namespaces := make(map[string][]string)
+	activeDirs := make(map[string]bool)
+	for _, item := range items {
+		namespaces[item.GetName()] = append(namespaces[item.GetName()], item.GetNamespace())
+		activeDirs[siteDirName(item.GetNamespace(), item.GetName())] = true
+	}
+
+	for name, nss := range namespaces {
+		// A legacy name that is also the directory of a site is not legacy
+		if activeDirs[name] {
+			continue
+		}
+		checkoutDir, contentDir, ok := s.legacyCheckout(name)
+		if !ok {
+			continue
+		}
+		if len(nss) != 1 {
+			logger.Info("Not migrating legacy site directory, name is used in several namespaces", "name", name, "namespaces", nss)
+			continue
+		}
+		dir := siteDirName(nss[0], name)
+		if s.currentRelease(dir) != "" {
+			continue
+		}
+		if err := s.migrateSite(dir, name, checkoutDir, contentDir); err != nil {
+			logger.Error(err, "Failed to migrate site directory", "namespace", nss[0], "name", name)
+			continue
+		}
+		logger.Info("Migrated site directory", "name", name, "dir", dir)
+	}
+
+	return nil
+}
+
+// legacyCheckout returns the checkout an older version synced a site into
+// and the directory it served from it: /sites/<name> itself, or the subpath
+// of .repos/<name> that /sites/<name> links to
+func (s *Syncer) legacyCheckout(name string) (checkoutDir, contentDir string, ok bool) {
+	linkPath := filepath.Join(s.SitesRoot, name)
+	info, err := os.Lstat(linkPath)
+	if err != nil {
+		return "", "", false
+	}
+
+	checkoutDir = linkPath
+	if info.Mode()&os.ModeSymlink != 0 {
+		checkoutDir = s.repoDir(name)
+		root, err := filepath.EvalSymlinks(checkoutDir)
+		if err != nil || !resolvesInside(root, linkPath) {
+			return "", "", false
+		}
+	}
+	if _, err := os.Stat(filepath.Join(checkoutDir, ".git")); err != nil {
+		return "", "", false
+	}
+	contentDir, err = filepath.EvalSymlinks(linkPath)
+	if err != nil {
+		return "", "", false
+	}
+	return checkoutDir, contentDir, true
+}
+
+// migrateSite publishes contentDir, served from the legacy checkout, as the
+// release of the checked out commit in the site's directory dir and points
+// the legacy /sites/<name> at it
+func (s *Syncer) migrateSite(dir, name, checkoutDir, contentDir string) error {
+	repo, err := git.PlainOpen(checkoutDir)
+	if err != nil {
+		return fmt.Errorf("failed to open legacy checkout: %w", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to read HEAD of legacy checkout: %w", err)
+	}
+	commit := head.Hash().String()
+
+	if err := s.publishRelease(dir, contentDir, commit); err != nil {
+		return err
+	}
+	releaseDir := filepath.Join(s.releasesDir(dir), commit)
+	if err := s.activateRelease(name, releaseDir); err != nil {
+		return fmt.Errorf("failed to update legacy link: %w", err)
+	}
+	return nil
+}
+
+// legacyContentPending reports whether name is the legacy checkout of a
+// site that has no release in its namespace-qualified directory yet. Its
+// content is still served from there and must not be cleaned up.
+func (s *Syncer) legacyContentPending(name string, namespaces map[string][]string) bool {
+	if len(namespaces[name]) == 0 {
+		return false
+	}
+	if _, _, ok := s.legacyCheckout(name); !ok {
+		return false
+	}
+	for _, namespace := range namespaces[name] {
+		if s.currentRelease(siteDirName(namespace, name)) == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// makeLegacySite creates a site like older versions synced it: cloned
+// directly into /sites/<name>, or with subpath cloned into .repos/<name> and
+// /sites/<name> linked to the subpath
+func makeLegacySite(t *testing.T, s *Syncer, name, subpath string) plumbing.Hash {
+	t.Helper()
+
+	remoteDir, _, hash := newTestRemote(t, map[string]string{
+		"index.html":      "root " + name,
+		"dist/index.html": "dist " + name,
+	})
+	checkoutDir := filepath.Join(s.SitesRoot, name)
+	if subpath != "" {
+		checkoutDir = s.repoDir(name)
+	}
+	if _, err := git.PlainClone(checkoutDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatalf("failed to create legacy checkout: %v", err)
+	}
+	if subpath != "" {
+		if err := os.Symlink(filepath.Join(checkoutDir, subpath), filepath.Join(s.SitesRoot, name)); err != nil {
+			t.Fatalf("failed to link legacy subpath: %v", err)
+		}
+	}
+	return hash
+}
+
+func TestMigrateLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		subpath string
+		want    string
+	}{
+		{name: "checkout in site directory", want: "root docs"},
+		{name: "checkout with subpath", subpath: "dist", want: "dist docs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Syncer{
+				SitesRoot: t.TempDir(),
+				DynamicClient: &fakeDynamicClientWithSites{
+					sites: []siteSpec{{name: "docs", namespace: "team-a", repo: "https://github.com/a/docs.git"}},
+				},
+			}
+			hash := makeLegacySite(t, s, "docs", tt.subpath)
+
+			if err := s.MigrateLayout(context.Background()); err != nil {
+				t.Fatalf("MigrateLayout() error = %v", err)
+			}
+
+			// The served content is the first release of the site
+			if got := s.currentRelease("team-a--docs"); got != hash.String() {
+				t.Errorf("current release = %q, want %s", got, hash)
+			}
+			if got := readSiteFile(t, s, "team-a--docs", "index.html"); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if _, err := os.Stat(filepath.Join(s.SitesRoot, "team-a--docs", ".git")); !os.IsNotExist(err) {
+				t.Error("release contains the .git directory")
+			}
+
+			// The legacy name keeps serving until Cleanup removes it
+			if got := readSiteFile(t, s, "docs", "index.html"); got != tt.want {
+				t.Errorf("legacy content = %q, want %q", got, tt.want)
+			}
+			if err := s.Cleanup(context.Background()); err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			for _, legacy := range []string{filepath.Join(s.SitesRoot, "docs"), s.repoDir("docs")} {
+				if _, err := os.Lstat(legacy); !os.IsNotExist(err) {
+					t.Errorf("%s not removed by Cleanup", legacy)
+				}
+			}
+			if got := readSiteFile(t, s, "team-a--docs", "index.html"); got != tt.want {
+				t.Errorf("content after Cleanup = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateLayout_AmbiguousName(t *testing.T) {
+	s := &Syncer{
+		SitesRoot: t.TempDir(),
+		DynamicClient: &fakeDynamicClientWithSites{
+			sites: []siteSpec{
+				{name: "docs", namespace: "team-a", repo: "https://github.com/a/docs.git"},
+				{name: "docs", namespace: "team-b", repo: "https://github.com/b/docs.git"},
+			},
+		},
+	}
+	hash := makeLegacySite(t, s, "docs", "dist")
+
+	if err := s.MigrateLayout(context.Background()); err != nil {
+		t.Fatalf("MigrateLayout() error = %v", err)
+	}
+
+	// Nobody can tell whose content it is; both sites sync from scratch
+	for _, dir := range []string{"team-a--docs", "team-b--docs"} {
+		if s.currentRelease(dir) != "" {
+			t.Errorf("legacy release was activated for %s", dir)
+		}
+	}
+
+	// The legacy content is served until both sites have a release
+	makeTestRelease(t, s, "team-a--docs", hash.String(), time.Hour)
+	if err := s.activateRelease("team-a--docs", filepath.Join(s.releasesDir("team-a--docs"), hash.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "docs", "index.html"); got != "dist docs" {
+		t.Errorf("legacy content after Cleanup = %q, want dist docs", got)
+	}
+}
+
+func TestMigrateLayout_KeepsNewContent(t *testing.T) {
+	s := &Syncer{
+		SitesRoot: t.TempDir(),
+		DynamicClient: &fakeDynamicClientWithSites{
+			sites: []siteSpec{{name: "docs", namespace: "default", repo: "https://github.com/a/docs.git"}},
+		},
+	}
+	makeLegacySite(t, s, "docs", "")
+	makeTestRelease(t, s, "default--docs", "new", time.Hour)
+	if err := s.activateRelease("default--docs", filepath.Join(s.releasesDir("default--docs"), "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.MigrateLayout(context.Background()); err != nil {
+		t.Fatalf("MigrateLayout() error = %v", err)
+	}
+
+	if got := s.currentRelease("default--docs"); got != "new" {
+		t.Errorf("current release = %q, want new", got)
+	}
+	releases, err := s.listReleases("default--docs")
+	if err != nil {
+		t.Fatalf("listReleases() error = %v", err)
+	}
+	if len(releases) != 1 || releases[0] != "new" {
+		t.Errorf("releases = %v, want [new]", releases)
+	}
+}
@@ -0,0 +1,429 @@
+// Package syncer - Git LFS objects
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultMaxLFSSize is the default limit for the Git LFS objects of a site
+	DefaultMaxLFSSize = 1 << 30
+
+	// lfsPointerMaxSize is the largest pointer file Git LFS writes
+	lfsPointerMaxSize = 1024
+
+	// lfsBatchSize is the number of objects requested per batch API call
+	lfsBatchSize = 100
+
+	// lfsMediaType is the content type of the LFS batch API
+	lfsMediaType = "application/vnd.git-lfs+json"
+)
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// lfsPointer is a parsed Git LFS pointer file
+type lfsPointer struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// parseLFSPointer parses the content of a pointer file. ok is false for
+// anything that is not a valid pointer, e.g. an already downloaded object.
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	var p lfsPointer
+	if len(content) > lfsPointerMaxSize {
+		return p, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	first := true
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			return p, false
+		}
+		if first {
+			if key != "version" || !strings.HasPrefix(value, "https://git-lfs.github.com/spec/") {
+				return p, false
+			}
+			first = false
+			continue
+		}
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if !ok || !lfsOIDPattern.MatchString(oid) {
+				return p, false
+			}
+			p.OID = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return p, false
+			}
+			p.Size = size
+		}
+	}
+	return p, p.OID != "" && !first
+}
+
+// lfsFile is a pointer file in the worktree
+type lfsFile struct {
+	Path    string
+	Pointer lfsPointer
+}
+
+// findLFSPointers returns the pointer files below contentDir that
+// .gitattributes assigns to the lfs filter
+func findLFSPointers(repo *git.Repository, repoDir, contentDir string) ([]lfsFile, error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	patterns, err := gitattributes.ReadPatterns(worktree.Filesystem, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .gitattributes: %w", err)
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	matcher := gitattributes.NewMatcher(patterns)
+
+	var files []lfsFile
+	err = filepath.Walk(contentDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == ".git" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || info.Size() > lfsPointerMaxSize {
+			return nil
+		}
+
+		rel, err := filepath.Rel(repoDir, path)
+		if err != nil {
+			return err
+		}
+		attrs, _ := matcher.Match(strings.Split(filepath.ToSlash(rel), "/"), []string{"filter"})
+		if filter, ok := attrs["filter"]; !ok || filter.Value() != "lfs" {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if pointer, ok := parseLFSPointer(content); ok {
+			files = append(files, lfsFile{Path: path, Pointer: pointer})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// lfsEndpoint returns the LFS API URL of a repo, following the Git LFS
+// default of <repo>.git/info/lfs. SSH repos use the HTTPS endpoint of the
+// same host, like git-lfs does without git-lfs-authenticate.
+func lfsEndpoint(repoURL string) (*url.URL, error) {
+	if !strings.Contains(repoURL, "://") {
+		if m := scpLikeURL.FindStringSubmatch(repoURL); m != nil {
+			repoURL = "ssh://" + m[1] + "@" + m[2] + "/" + m[3]
+		}
+	}
+	endpoint, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	switch endpoint.Scheme {
+	case "http", "https":
+	case "ssh":
+		endpoint.Scheme = "https"
+		endpoint.Host = endpoint.Hostname()
+	default:
+		return nil, fmt.Errorf("Git LFS is not supported for %s repos", endpoint.Scheme)
+	}
+	endpoint.User = nil
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	if !strings.HasSuffix(endpoint.Path, ".git") {
+		endpoint.Path += ".git"
+	}
+	endpoint.Path += "/info/lfs"
+	return endpoint, nil
+}
+
+// lfsObjectsDir returns the object cache of a checkout, laid out like the
+// one of git-lfs
+func lfsObjectsDir(repoDir string) string {
+	return filepath.Join(repoDir, ".git", "lfs", "objects")
+}
+
+// lfsObjectPath returns the cache path of an object
+func lfsObjectPath(repoDir, oid string) string {
+	return filepath.Join(lfsObjectsDir(repoDir), oid[0:2], oid[2:4], oid)
+}
+
+// fetchLFSObjects replaces the LFS pointer files below contentDir with their
+// objects. Objects are downloaded through the batch API with the site's
+// credentials and cached in the checkout, so every object is only downloaded
+// once. Sites whose objects exceed MaxLFSSize fail to sync.
+func (s *Syncer) fetchLFSObjects(ctx context.Context, site *staticSiteData, repoDir, contentDir string, access *gitAccess) error {
+	logger := log.FromContext(ctx)
+
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open repo: %w", err)
+	}
+	files, err := findLFSPointers(repo, repoDir, contentDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Objects are deduplicated by content
+	objects := make(map[string]lfsPointer)
+	var total int64
+	for _, f := range files {
+		if _, ok := objects[f.Pointer.OID]; !ok {
+			objects[f.Pointer.OID] = f.Pointer
+			total += f.Pointer.Size
+		}
+	}
+	if s.MaxLFSSize > 0 && total > s.MaxLFSSize {
+		return fmt.Errorf("LFS objects total %d bytes, exceeding the limit of %d bytes", total, s.MaxLFSSize)
+	}
+
+	var missing []lfsPointer
+	for _, p := range objects {
+		if info, err := os.Stat(lfsObjectPath(repoDir, p.OID)); err != nil || info.Size() != p.Size {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		logger.Info("Downloading LFS objects", "site", site.Name, "count", len(missing))
+		if err := s.downloadLFSObjects(ctx, site.Repo, repoDir, missing, access); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err := smudgeLFSFile(repoDir, f); err != nil {
+			return fmt.Errorf("failed to replace pointer %s: %w", f.Path, err)
+		}
+	}
+
+	return pruneLFSObjects(repoDir, objects)
+}
+
+// lfsBatchRequest is the request body of the batch API
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []lfsPointer `json:"objects"`
+}
+
+// lfsBatchResponse is the response body of the batch API
+type lfsBatchResponse struct {
+	Objects []struct {
+		lfsPointer
+		Actions struct {
+			Download *lfsAction `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+}
+
+// lfsAction tells where to download an object from
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// downloadLFSObjects requests download actions for objects from the LFS
+// server of repoURL and stores the objects in the cache. Download URLs and
+// redirects must point to allowed hosts.
+func (s *Syncer) downloadLFSObjects(ctx context.Context, repoURL, repoDir string, objects []lfsPointer, access *gitAccess) error {
+	endpoint, err := lfsEndpoint(repoURL)
+	if err != nil {
+		return err
+	}
+	httpAuth, _ := access.auth.(githttp.AuthMethod)
+	client, err := s.fetchClient(access.caBundle)
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(objects); start += lfsBatchSize {
+		batch := objects[start:min(start+lfsBatchSize, len(objects))]
+
+		body, err := json.Marshal(lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}, Objects: batch})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String()+"/objects/batch", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", lfsMediaType)
+		req.Header.Set("Content-Type", lfsMediaType)
+		if httpAuth != nil {
+			httpAuth.SetAuth(req)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("LFS batch request failed: %w", err)
+		}
+		var result lfsBatchResponse
+		err = json.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&result)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("LFS batch request failed: %s", resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid LFS batch response: %w", err)
+		}
+
+		for _, obj := range result.Objects {
+			if obj.Error != nil {
+				return fmt.Errorf("LFS object %s: %s (%d)", obj.OID, obj.Error.Message, obj.Error.Code)
+			}
+			if obj.Actions.Download == nil {
+				return fmt.Errorf("LFS object %s: no download action", obj.OID)
+			}
+			if !lfsOIDPattern.MatchString(obj.OID) {
+				return fmt.Errorf("invalid LFS object id %q", obj.OID)
+			}
+			var pointer lfsPointer
+			for _, p := range batch {
+				if p.OID == obj.OID {
+					pointer = p
+				}
+			}
+			if pointer.OID == "" {
+				return fmt.Errorf("LFS object %s was not requested", obj.OID)
+			}
+			href, err := s.validateFetchURL(obj.Actions.Download.Href)
+			if err != nil {
+				return fmt.Errorf("LFS object %s: %w", pointer.OID, err)
+			}
+			if err := downloadLFSObject(ctx, client, endpoint, href, repoDir, pointer, obj.Actions.Download.Header, httpAuth); err != nil {
+				return fmt.Errorf("failed to download LFS object %s: %w", pointer.OID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// downloadLFSObject downloads a single object and verifies its size and hash
+// before it is moved into the cache. The site's credentials are only sent to
+// the LFS server itself, never to storage hosts it redirects to.
+func downloadLFSObject(ctx context.Context, client *http.Client, endpoint, href *url.URL, repoDir string, pointer lfsPointer, header map[string]string, httpAuth githttp.AuthMethod) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, href.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if httpAuth != nil && req.Header.Get("Authorization") == "" && href.Host == endpoint.Host {
+		httpAuth.SetAuth(req)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	objectPath := lfsObjectPath(repoDir, pointer.OID)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(objectPath), "."+pointer.OID+"-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	// Read one byte more than announced to detect oversized objects
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, pointer.Size+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n != pointer.Size {
+		return fmt.Errorf("size mismatch: got %d bytes, want %d", n, pointer.Size)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != pointer.OID {
+		return fmt.Errorf("checksum mismatch: got %s", got)
+	}
+	return os.Rename(tmp.Name(), objectPath)
+}
+
+// smudgeLFSFile replaces a pointer file with the cached object
+func smudgeLFSFile(repoDir string, f lfsFile) error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	tmp := f.Path + ".lfs-tmp"
+	if err := copyFile(lfsObjectPath(repoDir, f.Pointer.OID), tmp, info.Mode().Perm()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneLFSObjects removes cached objects the current commit doesn't use, so
+// the cache stays within MaxLFSSize
+func pruneLFSObjects(repoDir string, keep map[string]lfsPointer) error {
+	return filepath.Walk(lfsObjectsDir(repoDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if _, ok := keep[info.Name()]; !ok {
+				return os.Remove(path)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,556 @@
+// Package syncer - OCI artifacts as content source
+package syncer
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// ociTitleAnnotation names the file an ORAS artifact layer holds
+	ociTitleAnnotation = "org.opencontainers.image.title"
+
+	// orasUnpackAnnotation marks an ORAS layer holding a packed directory
+	orasUnpackAnnotation = "io.deis.oras.content.unpack"
+
+	// ociManifestMaxSize limits manifests read from a registry
+	ociManifestMaxSize = 4 << 20
+)
+
+var (
+	ociReferencePattern = regexp.MustCompile(`^([a-z0-9.-]+)(?::([0-9]+))?/([a-z0-9._/-]+?)(?::([A-Za-z0-9_][A-Za-z0-9._-]{0,127}))?$`)
+	ociDigestPattern    = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+// ociReference is a parsed image reference like registry.example.com/team/site:v1
+type ociReference struct {
+	Host       string
+	Port       string
+	Repository string
+	Tag        string
+}
+
+// parseOCIReference parses an image reference. The tag defaults to latest.
+func parseOCIReference(image string) (*ociReference, error) {
+	m := ociReferencePattern.FindStringSubmatch(image)
+	if m == nil {
+		return nil, fmt.Errorf("invalid image reference %q", image)
+	}
+	ref := &ociReference{Host: m[1], Port: m[2], Repository: m[3], Tag: m[4]}
+	if ref.Tag == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// registry returns host[:port] of the registry
+func (r *ociReference) registry() string {
+	if r.Port == "" {
+		return r.Host
+	}
+	return net.JoinHostPort(r.Host, r.Port)
+}
+
+// baseURL returns the URL of the registry API. Like Docker, registries on
+// loopback addresses are spoken to over plain HTTP.
+func (r *ociReference) baseURL() string {
+	return registryScheme(r.Host) + "://" + r.registry()
+}
+
+// registryScheme returns the scheme used to reach host
+func registryScheme(host string) string {
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		return "http"
+	}
+	return "https"
+}
+
+// ociDescriptor points to a manifest or blob
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest is an image manifest or an index of manifests
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// registryClient talks to one repository of a registry, following the
+// token authentication of the distribution spec
+type registryClient struct {
+	syncer   *Syncer
+	http     *http.Client
+	ref      *ociReference
+	username string
+	password string
+	token    string
+}
+
+// do sends a request to the registry API. A 401 response is answered once
+// with the credentials or a token the registry asks for.
+func (c *registryClient) do(ctx context.Context, path string, accept []string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.ref.baseURL()+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case c.username != "":
+			req.SetBasicAuth(c.username, c.password)
+		}
+		return c.http.Do(req)
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.token != "" {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	_ = resp.Body.Close()
+
+	scheme, params := parseAuthChallenge(challenge)
+	switch {
+	case strings.EqualFold(scheme, "bearer"):
+		if err := c.fetchToken(ctx, params); err != nil {
+			return nil, err
+		}
+	case strings.EqualFold(scheme, "basic") && c.username != "":
+		// The credentials were sent already
+		return nil, fmt.Errorf("registry rejected the credentials")
+	default:
+		return nil, fmt.Errorf("registry requires authentication")
+	}
+	return send()
+}
+
+// fetchToken gets a pull token from the token service named in a bearer
+// challenge. The token service must be on an allowed host as well.
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	if realm.Scheme != "https" && realm.Scheme != registryScheme(realm.Hostname()) {
+		return fmt.Errorf("token realm %s must use https", realm)
+	}
+	if err := c.syncer.validateHost(strings.ToLower(realm.Hostname())); err != nil {
+		return fmt.Errorf("token service: %w", err)
+	}
+
+	query := realm.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return fmt.Errorf("invalid token response: %w", err)
+	}
+	c.token = result.Token
+	if c.token == "" {
+		c.token = result.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("token response contains no token")
+	}
+	return nil
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.example.com/token",service="registry"
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
+
+// fetchManifest returns the manifest for reference, a tag or digest, and
+// its digest. An index is resolved to the single manifest it contains
+// besides attestations; the returned digest is the one of the index.
+func (c *registryClient) fetchManifest(ctx context.Context, reference string) (*ociManifest, string, error) {
+	manifest, digest, err := c.getManifest(ctx, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	if manifest.MediaType != ociIndexMediaType && manifest.MediaType != dockerManifestListMediaType {
+		return manifest, digest, nil
+	}
+
+	var candidates []ociDescriptor
+	for _, m := range manifest.Manifests {
+		if m.Platform == nil || m.Platform.OS != "unknown" {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) != 1 {
+		return nil, "", fmt.Errorf("index %s holds %d manifests, expected one", shortHash(digest), len(candidates))
+	}
+	manifest, _, err = c.getManifest(ctx, candidates[0].Digest)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, digest, nil
+}
+
+// getManifest fetches and parses one manifest, verifying its digest when
+// reference is a digest
+func (c *registryClient) getManifest(ctx context.Context, reference string) (*ociManifest, string, error) {
+	resp, err := c.do(ctx, "/v2/"+c.ref.Repository+"/manifests/"+reference,
+		[]string{ociManifestMediaType, ociIndexMediaType, dockerManifestMediaType, dockerManifestListMediaType})
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to get manifest %s: %s", reference, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ociManifestMaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > ociManifestMaxSize {
+		return nil, "", fmt.Errorf("manifest %s is too large", reference)
+	}
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if ociDigestPattern.MatchString(reference) && digest != reference {
+		return nil, "", fmt.Errorf("manifest digest mismatch: got %s, want %s", digest, reference)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &manifest, digest, nil
+}
+
+// fetchBlob streams a blob to fn and verifies its size and digest once fn
+// has consumed it
+func (c *registryClient) fetchBlob(ctx context.Context, desc ociDescriptor, fn func(io.Reader) error) error {
+	if !ociDigestPattern.MatchString(desc.Digest) {
+		return fmt.Errorf("unsupported blob digest %q", desc.Digest)
+	}
+	resp, err := c.do(ctx, "/v2/"+c.ref.Repository+"/blobs/"+desc.Digest, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get blob %s: %s", desc.Digest, resp.Status)
+	}
+
+	// Read one byte more than announced to detect oversized blobs
+	verifier := &digestReader{r: io.LimitReader(resp.Body, desc.Size+1), hash: sha256.New()}
+	if err := fn(verifier); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, verifier); err != nil {
+		return err
+	}
+	if verifier.n != desc.Size {
+		return fmt.Errorf("blob %s: size mismatch: got %d bytes, want %d", desc.Digest, verifier.n, desc.Size)
+	}
+	if got := "sha256:" + hex.EncodeToString(verifier.hash.Sum(nil)); got != desc.Digest {
+		return fmt.Errorf("blob %s: checksum mismatch: got %s", desc.Digest, got)
+	}
+	return nil
+}
+
+// digestReader hashes and counts what is read through it
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.n += int64(n)
+	return n, err
+}
+
+// ociClient returns a registry client for the site's artifact, with the
+// credentials of its pull Secret
+func (s *Syncer) ociClient(ctx context.Context, site *staticSiteData) (*registryClient, error) {
+	ref, err := parseOCIReference(site.OCI.Image)
+	if err != nil {
+		return nil, err
+	}
+	client := &registryClient{syncer: s, ref: ref}
+	if site.OCI.SecretRef != nil {
+		client.username, client.password, err = s.ociCredentials(ctx, site.Namespace, site.OCI.SecretRef.Name, ref.registry())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get registry credentials: %w", err)
+		}
+	}
+	caBundle, err := s.caBundle(ctx, site.Namespace, site.OCI.SecretRef)
+	if err != nil {
+		return nil, err
+	}
+	if client.http, err = s.fetchClient(caBundle); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// dockerConfig is the content of a kubernetes.io/dockerconfigjson Secret
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// ociCredentials reads the credentials for registry from a pull Secret:
+// the matching entry of .dockerconfigjson, or the username and password keys
+func (s *Syncer) ociCredentials(ctx context.Context, namespace, name, registry string) (string, string, error) {
+	secret, err := s.ClientSet.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	data, ok := secret.Data[".dockerconfigjson"]
+	if !ok {
+		if len(secret.Data["password"]) == 0 {
+			return "", "", fmt.Errorf("secret %s has neither .dockerconfigjson nor password", name)
+		}
+		return string(secret.Data["username"]), string(secret.Data["password"]), nil
+	}
+
+	var config dockerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("invalid .dockerconfigjson in secret %s: %w", name, err)
+	}
+	for server, entry := range config.Auths {
+		// Entries may be written as URLs, e.g. https://registry.example.com/v1/
+		host := server
+		if u, err := url.Parse(server); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		if !strings.EqualFold(host, registry) {
+			continue
+		}
+		if entry.Auth == "" {
+			return entry.Username, entry.Password, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth for %s in secret %s", server, name)
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return username, password, nil
+	}
+	return "", "", fmt.Errorf("secret %s has no credentials for %s", name, registry)
+}
+
+// unpackOCILayers downloads the layers of manifest into destDir, in order.
+// Layers with a title annotation are ORAS files (or packed directories);
+// other tar layers are image layers with whiteouts.
+func (c *registryClient) unpackOCILayers(ctx context.Context, manifest *ociManifest, destDir string) error {
+	limit := c.syncer.newExtractLimit()
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[ociTitleAnnotation]
+		compressed := strings.HasSuffix(layer.MediaType, "gzip")
+
+		var err error
+		switch {
+		case title != "" && layer.Annotations[orasUnpackAnnotation] == "true":
+			var target string
+			if target, err = localPath(destDir, title); err == nil {
+				err = c.fetchBlob(ctx, layer, func(r io.Reader) error {
+					return extractLayer(r, target, compressed, false, limit)
+				})
+			}
+		case title != "":
+			var target string
+			if target, err = localPath(destDir, title); err == nil && target == destDir {
+				err = fmt.Errorf("invalid title %q", title)
+			}
+			if err == nil {
+				err = ensureParentDirs(destDir, target)
+			}
+			if err == nil {
+				err = c.fetchBlob(ctx, layer, func(r io.Reader) error {
+					if err := limit.entry(); err != nil {
+						return err
+					}
+					return limit.writeFile(target, r, 0644)
+				})
+			}
+		case strings.Contains(layer.MediaType, "tar"):
+			if strings.HasSuffix(layer.MediaType, "zstd") {
+				return fmt.Errorf("layer %s: zstd compression is not supported", layer.Digest)
+			}
+			err = c.fetchBlob(ctx, layer, func(r io.Reader) error {
+				return extractLayer(r, destDir, compressed, true, limit)
+			})
+		default:
+			err = fmt.Errorf("unsupported media type %q", layer.MediaType)
+		}
+		if err != nil {
+			return fmt.Errorf("layer %s: %w", shortHash(strings.TrimPrefix(layer.Digest, "sha256:")), err)
+		}
+	}
+	return nil
+}
+
+// extractLayer unpacks a (gzip compressed) tar layer into destDir
+func extractLayer(r io.Reader, destDir string, compressed, whiteouts bool, limit *extractLimit) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("invalid gzip: %w", err)
+		}
+		defer func() { _ = gz.Close() }()
+		r = gz
+	}
+	return extractTar(r, destDir, whiteouts, limit)
+}
+
+// syncOCI publishes the site's OCI artifact. Releases are named after the
+// manifest digest, so an unchanged artifact is never downloaded again.
+func (s *Syncer) syncOCI(ctx context.Context, site *staticSiteData) error {
+	logger := log.FromContext(ctx)
+
+	ref, err := parseOCIReference(site.OCI.Image)
+	if err != nil {
+		return err
+	}
+	// SSRF protection: the registry must be an allowed host
+	if err := s.validateHost(ref.Host); err != nil {
+		return fmt.Errorf("registry validation failed: %w", err)
+	}
+
+	release, err := s.acquireHost(ctx, ref.Host)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	client, err := s.ociClient(ctx, site)
+	if err != nil {
+		return err
+	}
+	reference := ref.Tag
+	if site.OCI.Digest != "" {
+		reference = site.OCI.Digest
+	}
+	manifest, digest, err := client.fetchManifest(ctx, reference)
+	if err != nil {
+		return err
+	}
+
+	// A Git checkout of a site that moved to OCI is no longer needed
+	if err := os.RemoveAll(s.repoDir(site.dirName())); err != nil {
+		return fmt.Errorf("failed to remove Git checkout: %w", err)
+	}
+
+	releaseName := strings.TrimPrefix(digest, "sha256:")
+	var unpackDir string
+	defer func() {
+		if unpackDir != "" {
+			_ = os.RemoveAll(unpackDir)
+		}
+	}()
+	content := func() (string, error) {
+		logger.Info("Downloading OCI artifact", "site", site.Name, "image", site.OCI.Image, "digest", digest)
+		releasesDir := s.releasesDir(site.dirName())
+		if err := os.MkdirAll(releasesDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create releases directory: %w", err)
+		}
+		// Unpacked like an interrupted release, so leftovers get pruned
+		unpackDir, err = os.MkdirTemp(releasesDir, "."+releaseName+"-oci-")
+		if err != nil {
+			return "", err
+		}
+		if err := client.unpackOCILayers(ctx, manifest, unpackDir); err != nil {
+			return "", fmt.Errorf("failed to unpack OCI artifact: %w", err)
+		}
+		contentDir, err := resolveSubpath(unpackDir, site.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to setup subpath: %w", err)
+		}
+		return contentDir, nil
+	}
+
+	return s.publishSite(ctx, site, releaseName, "Synced successfully", content)
+}
@@ -0,0 +1,457 @@
+package syncer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is an in-memory stand-in for an OCI registry. With a
+// username set it requires a bearer token from its /token endpoint.
+type testRegistry struct {
+	server    *httptest.Server
+	username  string
+	password  string
+	mu        sync.Mutex
+	manifests map[string][]byte // by tag and digest
+	blobs     map[string][]byte // by digest
+}
+
+func newTestRegistry(t *testing.T, username, password string) *testRegistry {
+	t.Helper()
+
+	r := &testRegistry{
+		username:  username,
+		password:  password,
+		manifests: make(map[string][]byte),
+		blobs:     make(map[string][]byte),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// host returns host:port of the registry
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != r.username || pass != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "pull-token"})
+		return
+	}
+	if r.username != "" && req.Header.Get("Authorization") != "Bearer pull-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:site:pull"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if repo, ref, ok := strings.Cut(path, "/manifests/"); ok && repo == "team/site" {
+		if data, ok := r.manifests[ref]; ok {
+			var m ociManifest
+			_ = json.Unmarshal(data, &m)
+			w.Header().Set("Content-Type", m.MediaType)
+			_, _ = w.Write(data)
+			return
+		}
+	}
+	if repo, digest, ok := strings.Cut(path, "/blobs/"); ok && repo == "team/site" {
+		if data, ok := r.blobs[digest]; ok {
+			_, _ = w.Write(data)
+			return
+		}
+	}
+	http.NotFound(w, req)
+}
+
+// addBlob stores a blob and returns its descriptor
+func (r *testRegistry) addBlob(mediaType string, data []byte, annotations map[string]string) ociDescriptor {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	r.mu.Lock()
+	r.blobs[digest] = data
+	r.mu.Unlock()
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data)), Annotations: annotations}
+}
+
+// push stores a manifest with layers under tag and returns its digest
+func (r *testRegistry) push(t *testing.T, tag string, layers ...ociDescriptor) string {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config":        r.addBlob("application/vnd.oci.empty.v1+json", []byte("{}"), nil),
+		"layers":        layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	r.mu.Lock()
+	r.manifests[tag] = data
+	r.manifests[digest] = data
+	r.mu.Unlock()
+	return digest
+}
+
+// tarGz packs files into a gzip compressed tar. Names ending in / are
+// directories, values starting with -> are symlinks.
+func tarGz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		var err error
+		switch {
+		case strings.HasSuffix(name, "/"):
+			err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755})
+		case strings.HasPrefix(content, "->"):
+			err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: strings.TrimPrefix(content, "->")})
+		default:
+			if err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err == nil {
+				_, err = tw.Write([]byte(content))
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newOCITestSyncer returns a syncer that may pull from the test registry
+func newOCITestSyncer(t *testing.T, secrets ...map[string][]byte) *Syncer {
+	t.Helper()
+
+	clientSet := newFakeClientset()
+	if len(secrets) > 0 {
+		clientSet = newFakeClientset(newTestSecret("default", "pull", secrets[0]))
+	}
+	return &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     clientSet,
+	}
+}
+
+func TestSyncSite_OCI(t *testing.T) {
+	reg := newTestRegistry(t, "", "")
+	const layerType = "application/vnd.oci.image.layer.v1.tar+gzip"
+	v1 := reg.push(t, "latest", reg.addBlob(layerType, tarGz(t, map[string]string{
+		"index.html":     "v1",
+		"css/style.css":  "body{}",
+		"dist/":          "",
+		"dist/app.js":    "app",
+		"dist/link.html": "->../index.html",
+	}), nil))
+
+	s := newOCITestSyncer(t)
+	site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", OCI: &ociSource{Image: reg.host() + "/team/site"}}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+	if got := readSiteFile(t, s, "default--site", "css/style.css"); got != "body{}" {
+		t.Errorf("css/style.css = %q", got)
+	}
+	if s.currentRelease("default--site") != strings.TrimPrefix(v1, "sha256:") {
+		t.Errorf("current release = %q, want digest %s", s.currentRelease("default--site"), v1)
+	}
+
+	// A new push of the tag is deployed on the next sync
+	reg.push(t, "latest", reg.addBlob(layerType, tarGz(t, map[string]string{"index.html": "v2"}), nil))
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() after push error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v2" {
+		t.Errorf("index.html after push = %q, want v2", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, "default--site", "css")); !os.IsNotExist(err) {
+		t.Error("content of the previous artifact is still served")
+	}
+
+	// A digest pin wins over the tag
+	site.OCI.Digest = v1
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with digest error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html with digest pin = %q, want v1", got)
+	}
+
+	// Path selects a directory of the artifact
+	site.Path = "/dist"
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with path error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "app.js"); got != "app" {
+		t.Errorf("app.js = %q", got)
+	}
+
+	// Nothing of the download is left behind
+	entries, err := os.ReadDir(s.releasesDir("default--site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("leftover directory %s", entry.Name())
+		}
+	}
+}
+
+func TestSyncSite_GitToOCI(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	newServedRepo(t, root, "site.git", map[string]string{"index.html": "git"})
+	reg := newTestRegistry(t, "", "")
+	reg.push(t, "latest", reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", tarGz(t, map[string]string{"index.html": "oci"}), nil))
+
+	s := newOCITestSyncer(t)
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() from git error = %v", err)
+	}
+
+	site.Repo = ""
+	site.OCI = &ociSource{Image: reg.host() + "/team/site"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() from OCI error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "oci" {
+		t.Errorf("index.html = %q, want oci", got)
+	}
+	if _, err := os.Stat(s.repoDir("default--site")); !os.IsNotExist(err) {
+		t.Error("git checkout kept after switching to an OCI source")
+	}
+}
+
+func TestSyncSite_OCIArtifactLayers(t *testing.T) {
+	reg := newTestRegistry(t, "", "")
+	reg.push(t, "v1",
+		reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip",
+			tarGz(t, map[string]string{"index.html": "base", "old.html": "old", "assets/a.css": "a", "assets/b.css": "b"}), nil),
+		// An image layer deleting files of the layer below
+		reg.addBlob("application/vnd.oci.image.layer.v1.tar",
+			func() []byte {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				for _, name := range []string{".wh.old.html", "assets/.wh..wh..opq"} {
+					_ = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+				}
+				_ = tw.WriteHeader(&tar.Header{Name: "assets/c.css", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+				_, _ = tw.Write([]byte("c"))
+				_ = tw.Close()
+				return buf.Bytes()
+			}(), nil),
+		// ORAS style layers: a single file and a packed directory
+		reg.addBlob("text/plain", []byte("plain file"), map[string]string{ociTitleAnnotation: "robots.txt"}),
+		reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip",
+			tarGz(t, map[string]string{"guide.html": "docs"}),
+			map[string]string{ociTitleAnnotation: "docs", orasUnpackAnnotation: "true"}),
+	)
+
+	s := newOCITestSyncer(t)
+	site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", OCI: &ociSource{Image: reg.host() + "/team/site:v1"}}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"index.html":      "base",
+		"assets/c.css":    "c",
+		"robots.txt":      "plain file",
+		"docs/guide.html": "docs",
+	} {
+		if got := readSiteFile(t, s, "default--site", name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"old.html", "assets/a.css", ".wh.old.html"} {
+		if _, err := os.Lstat(filepath.Join(s.SitesRoot, "default--site", name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists despite whiteout", name)
+		}
+	}
+}
+
+func TestSyncSite_OCIAuth(t *testing.T) {
+	reg := newTestRegistry(t, "robot", "s3cret")
+	reg.push(t, "latest", reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", tarGz(t, map[string]string{"index.html": "private"}), nil))
+
+	dockerConfig := func(user, pass string) map[string][]byte {
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+		return map[string][]byte{".dockerconfigjson": []byte(fmt.Sprintf(`{"auths":{"http://%s":{"auth":"%s"}}}`, reg.host(), auth))}
+	}
+
+	tests := []struct {
+		name    string
+		secret  map[string][]byte
+		wantErr string
+	}{
+		{"dockerconfigjson", dockerConfig("robot", "s3cret"), ""},
+		{"username and password", map[string][]byte{"username": []byte("robot"), "password": []byte("s3cret")}, ""},
+		{"wrong password", dockerConfig("robot", "wrong"), "token request failed"},
+		{"no secret", nil, "token request failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s *Syncer
+			site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", OCI: &ociSource{Image: reg.host() + "/team/site"}}
+			if tt.secret != nil {
+				s = newOCITestSyncer(t, tt.secret)
+				site.OCI.SecretRef = &secretRef{Name: "pull"}
+			} else {
+				s = newOCITestSyncer(t)
+			}
+
+			err := s.syncSite(context.Background(), site)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("syncSite() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("syncSite() error = %v", err)
+			}
+			if got := readSiteFile(t, s, "default--site", "index.html"); got != "private" {
+				t.Errorf("index.html = %q", got)
+			}
+		})
+	}
+}
+
+func TestSyncSite_OCIRejected(t *testing.T) {
+	reg := newTestRegistry(t, "", "")
+	good := reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", tarGz(t, map[string]string{"index.html": "ok"}), nil)
+	reg.push(t, "latest", good)
+
+	tampered := good
+	tampered.Digest = reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", tarGz(t, map[string]string{"index.html": "evil"}), nil).Digest
+	reg.mu.Lock()
+	reg.blobs[tampered.Digest] = reg.blobs[good.Digest]
+	reg.mu.Unlock()
+	reg.push(t, "tampered", tampered)
+
+	reg.push(t, "escape", reg.addBlob("application/vnd.oci.image.layer.v1.tar+gzip", tarGz(t, map[string]string{"../../escape.html": "evil"}), nil))
+
+	// Redirects, e.g. of blobs to a CDN, must stay on allowed hosts
+	localhostURL := strings.Replace(reg.server.URL, "127.0.0.1", "localhost", 1)
+	redirectSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, localhostURL+req.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	t.Cleanup(redirectSrv.Close)
+	redirectHost := strings.TrimPrefix(redirectSrv.URL, "http://")
+
+	tests := []struct {
+		name    string
+		image   string
+		allowed string
+		digest  string
+		wantErr string
+	}{
+		{"registry not allowed", reg.host() + "/team/site", "registry.example.com", "", "not in allowed hosts"},
+		{"blob checksum mismatch", reg.host() + "/team/site:tampered", "127.0.0.1", "", "checksum mismatch"},
+		{"path traversal", reg.host() + "/team/site:escape", "127.0.0.1", "", "invalid path"},
+		{"unknown tag", reg.host() + "/team/site:missing", "127.0.0.1", "", "404"},
+		{"digest mismatch", reg.host() + "/team/site", "127.0.0.1", "sha256:" + strings.Repeat("0", 64), "404"},
+		{"redirect to other host", redirectHost + "/team/site", "127.0.0.1", "", "redirect rejected"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newOCITestSyncer(t)
+			s.AllowedHosts = []string{tt.allowed}
+			site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", OCI: &ociSource{Image: tt.image, Digest: tt.digest}}
+
+			err := s.syncSite(context.Background(), site)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("syncSite() error = %v, want %q", err, tt.wantErr)
+			}
+			if s.currentRelease("default--site") != "" {
+				t.Error("site was published")
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(s.SitesRoot), "escape.html")); !os.IsNotExist(err) {
+				t.Error("file written outside of the sites root")
+			}
+		})
+	}
+}
+
+func TestParseOCIReference(t *testing.T) {
+	tests := []struct {
+		image   string
+		want    ociReference
+		wantErr bool
+	}{
+		{"registry.example.com/team/site:v1", ociReference{Host: "registry.example.com", Repository: "team/site", Tag: "v1"}, false},
+		{"registry.example.com/site", ociReference{Host: "registry.example.com", Repository: "site", Tag: "latest"}, false},
+		{"localhost:5000/a/b/c:1.0.0-rc.1", ociReference{Host: "localhost", Port: "5000", Repository: "a/b/c", Tag: "1.0.0-rc.1"}, false},
+		{"site:latest", ociReference{}, true},
+		{"https://registry.example.com/site", ociReference{}, true},
+		{"Registry.example.com/site", ociReference{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := parseOCIReference(tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseOCIReference() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("parseOCIReference() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/site:pull"`)
+	if scheme != "Bearer" {
+		t.Errorf("scheme = %q", scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:team/site:pull",
+	}
+	for k, v := range want {
+		if params[k] != v {
+			t.Errorf("%s = %q, want %q", k, params[k], v)
+		}
+	}
+}
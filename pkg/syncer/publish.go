@@ -0,0 +1,316 @@
+// Package syncer - publish schedules and freeze windows
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// pendingReleaseFile records the release that is staged but held back
+	// by the publish schedule or a freeze window, inside the site's
+	// releases directory
+	pendingReleaseFile = ".pending.json"
+
+	// OverrideFreezeHeader lets a manual or webhook triggered sync publish
+	// during a freeze window when set to "true"
+	OverrideFreezeHeader = "X-Pages-Override-Freeze"
+)
+
+// errFrozen is returned for deploys during a freeze window
+var errFrozen = errors.New("site is frozen")
+
+// publishSchedule is the publish schedule of a site
+type publishSchedule struct {
+	Cron      string
+	TimeZone  string
+	PublishAt time.Time
+}
+
+// freezeWindow is a period in which a site's content doesn't change
+type freezeWindow struct {
+	Start  time.Time
+	End    time.Time
+	Reason string
+}
+
+// pendingRelease is a staged release waiting to go live
+type pendingRelease struct {
+	Release   string    `json:"release"`
+	Message   string    `json:"message"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// pendingStatus is status.pending of a StaticSite
+type pendingStatus struct {
+	Commit    string `json:"commit"`
+	PublishAt string `json:"publishAt"`
+	Reason    string `json:"reason"`
+}
+
+// overrideFreezeKey marks contexts of syncs that may publish during freezes
+type overrideFreezeKey struct{}
+
+// withFreezeOverride returns ctx for a sync that ignores freeze windows
+func withFreezeOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overrideFreezeKey{}, true)
+}
+
+// freezeOverridden reports whether a sync may publish during freeze windows
+func freezeOverridden(ctx context.Context) bool {
+	override, _ := ctx.Value(overrideFreezeKey{}).(bool)
+	return override
+}
+
+// overrideRequested reports whether a request asks to publish during freeze
+// windows
+func overrideRequested(r *http.Request) bool {
+	return r.Header.Get(OverrideFreezeHeader) == "true"
+}
+
+// holdsReleases reports whether new content of the site may have to wait
+func (s *staticSiteData) holdsReleases() bool {
+	return s.PublishSchedule != nil || len(s.FreezeWindows) > 0
+}
+
+// goLiveTime returns when content fetched at fetched may go live, at the
+// earliest now, and why it waits until then. Freeze windows are skipped
+// with ignoreFreeze.
+func (s *staticSiteData) goLiveTime(fetched, now time.Time, ignoreFreeze bool) (time.Time, string, error) {
+	goLive, reason := now, ""
+
+	var cron *cronSchedule
+	if p := s.PublishSchedule; p != nil {
+		switch {
+		case p.Cron != "":
+			loc, err := time.LoadLocation(p.TimeZone)
+			if err != nil {
+				return time.Time{}, "", fmt.Errorf("invalid publish schedule time zone %q: %w", p.TimeZone, err)
+			}
+			if cron, err = parseCron(p.Cron, loc); err != nil {
+				return time.Time{}, "", err
+			}
+			tick := cron.next(fetched)
+			if tick.IsZero() {
+				return time.Time{}, "", fmt.Errorf("publish schedule %q never matches", p.Cron)
+			}
+			if tick.After(goLive) {
+				goLive, reason = tick, fmt.Sprintf("publish schedule %q", p.Cron)
+			}
+		case p.PublishAt.After(goLive):
+			goLive, reason = p.PublishAt, "publishAt"
+		}
+	}
+	if ignoreFreeze {
+		return goLive, reason, nil
+	}
+
+	// Windows may overlap or follow each other, so move on until the time
+	// is outside of all of them
+	for moved := true; moved; {
+		moved = false
+		for _, w := range s.FreezeWindows {
+			if goLive.Before(w.Start) || !goLive.Before(w.End) {
+				continue
+			}
+			goLive, moved = w.End, true
+			reason = "freeze window"
+			if w.Reason != "" {
+				reason += ": " + w.Reason
+			}
+			if cron != nil {
+				if goLive = cron.atOrAfter(w.End); goLive.IsZero() {
+					return time.Time{}, "", fmt.Errorf("publish schedule %q never matches", s.PublishSchedule.Cron)
+				}
+			}
+		}
+	}
+	return goLive, reason, nil
+}
+
+// checkFreeze returns errFrozen if content can't go live right now because
+// of a freeze window, unless the freeze is overridden
+func (s *staticSiteData) checkFreeze(ctx context.Context) error {
+	if freezeOverridden(ctx) || len(s.FreezeWindows) == 0 {
+		return nil
+	}
+	now := time.Now()
+	site := *s
+	site.PublishSchedule = nil
+	goLive, reason, err := site.goLiveTime(now, now, false)
+	if err != nil {
+		return err
+	}
+	if goLive.After(now) {
+		return fmt.Errorf("%w until %s (%s)", errFrozen, goLive.UTC().Format(time.RFC3339), reason)
+	}
+	return nil
+}
+
+// pendingRelease returns the held release of a site, or nil if none
+func (s *Syncer) pendingRelease(siteDir string) *pendingRelease {
+	data, err := os.ReadFile(filepath.Join(s.releasesDir(siteDir), pendingReleaseFile))
+	if err != nil {
+		return nil
+	}
+	var pending pendingRelease
+	if err := json.Unmarshal(data, &pending); err != nil || pending.Release == "" {
+		return nil
+	}
+	return &pending
+}
+
+// holdRelease stages release instead of publishing it if the site's publish
+// schedule or a freeze window doesn't let it go live yet. contentDir is the
+// content to stage, or "" if the release exists already; rebuild replaces
+// an existing release. Returns whether the release is held.
+func (s *Syncer) holdRelease(ctx context.Context, site *staticSiteData, release, message, contentDir string, rebuild bool) (bool, error) {
+	logger := log.FromContext(ctx)
+
+	if !site.holdsReleases() {
+		return false, nil
+	}
+	dir := site.dirName()
+
+	// The schedule counts from when a commit was first seen
+	now := time.Now()
+	fetched := now
+	if pending := s.pendingRelease(dir); pending != nil && pending.Release == release {
+		fetched = pending.FetchedAt
+	}
+	goLive, reason, err := site.goLiveTime(fetched, now, freezeOverridden(ctx))
+	if err != nil {
+		return false, err
+	}
+	if !goLive.After(now) {
+		return false, nil
+	}
+
+	if contentDir != "" {
+		if rebuild {
+			if err := os.RemoveAll(filepath.Join(s.releasesDir(dir), release)); err != nil {
+				return false, fmt.Errorf("failed to remove outdated release: %w", err)
+			}
+		}
+		if err := s.stageRelease(dir, contentDir, release); err != nil {
+			return false, fmt.Errorf("failed to stage release: %w", err)
+		}
+		if err := s.recordReleaseLayout(dir, site, release); err != nil {
+			return false, fmt.Errorf("failed to record release layout: %w", err)
+		}
+	}
+	pending := pendingRelease{Release: release, Message: message, FetchedAt: fetched}
+	if err := writeJSONFile(filepath.Join(s.releasesDir(dir), pendingReleaseFile), pending); err != nil {
+		return false, fmt.Errorf("failed to record pending release: %w", err)
+	}
+
+	publishAt := goLive.UTC().Format(time.RFC3339)
+	s.updatePendingStatus(ctx, site, &pendingStatus{Commit: shortHash(release), PublishAt: publishAt, Reason: reason})
+	current := s.currentRelease(dir)
+	phase := "Ready"
+	if current == "" {
+		phase = "Pending"
+	}
+	s.updateStatus(ctx, site, phase, fmt.Sprintf("%s goes live at %s (%s)", shortHash(release), publishAt, reason), shortHash(current))
+
+	logger.Info("Holding release", "site", site.Name, "commit", shortHash(release), "publishAt", publishAt, "reason", reason)
+	return true, nil
+}
+
+// publishDue publishes the held release of a site once its time has come.
+// It runs before a sync fetches anything, so content waiting for a
+// schedule goes live even if the source changed again in the meantime.
+func (s *Syncer) publishDue(ctx context.Context, site *staticSiteData) error {
+	logger := log.FromContext(ctx)
+
+	dir := site.dirName()
+	pending := s.pendingRelease(dir)
+	if pending == nil {
+		return nil
+	}
+	now := time.Now()
+	goLive, _, err := site.goLiveTime(pending.FetchedAt, now, freezeOverridden(ctx))
+	if err != nil {
+		return err
+	}
+	if goLive.After(now) {
+		return nil
+	}
+
+	releaseDir := filepath.Join(s.releasesDir(dir), pending.Release)
+	if _, err := os.Stat(releaseDir); err != nil {
+		// Nothing left to publish, the sync stages the content again
+		return s.clearPendingRelease(ctx, site)
+	}
+	// A scheduled release is a new commit, it ends a rollback
+	if err := s.clearRollbackHold(dir); err != nil {
+		return fmt.Errorf("failed to clear rollback: %w", err)
+	}
+	if err := s.activateRelease(dir, releaseDir); err != nil {
+		return fmt.Errorf("failed to activate release: %w", err)
+	}
+	if err := s.clearPendingRelease(ctx, site); err != nil {
+		return err
+	}
+	if err := s.pruneReleases(dir, pending.Release); err != nil {
+		return err
+	}
+
+	s.updateStatus(ctx, site, "Ready", pending.Message, shortHash(pending.Release))
+	logger.Info("Published held release", "site", site.Name, "commit", shortHash(pending.Release))
+	return nil
+}
+
+// clearPendingRelease forgets the held release of a site, e.g. when newer
+// content went live
+func (s *Syncer) clearPendingRelease(ctx context.Context, site *staticSiteData) error {
+	err := os.Remove(filepath.Join(s.releasesDir(site.dirName()), pendingReleaseFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to clear pending release: %w", err)
+	}
+	s.updatePendingStatus(ctx, site, nil)
+	return nil
+}
+
+// pendingPublishTime returns when the held release of a site goes live, or
+// the zero time if there is none
+func (s *Syncer) pendingPublishTime(site *staticSiteData) time.Time {
+	pending := s.pendingRelease(site.dirName())
+	if pending == nil {
+		return time.Time{}
+	}
+	goLive, _, err := site.goLiveTime(pending.FetchedAt, time.Now(), false)
+	if err != nil {
+		return time.Time{}
+	}
+	return goLive
+}
+
+// updatePendingStatus sets status.pending of a site; nil removes it
+func (s *Syncer) updatePendingStatus(ctx context.Context, site *staticSiteData, status *pendingStatus) {
+	patch := map[string]interface{}{"status": map[string]interface{}{"pending": status}}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to marshal pending status patch", "site", site.Name)
+		return
+	}
+	_, err = s.DynamicClient.Resource(staticSiteGVR).
+		Namespace(site.Namespace).
+		Patch(ctx, site.Name, types.MergePatchType, patchBytes, metav1.PatchOptions{}, "status")
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update pending status", "site", site.Name)
+	}
+}
@@ -0,0 +1,275 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	t.Helper()
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestGoLiveTime(t *testing.T) {
+	launch := freezeWindow{
+		Start:  mustParseTime(t, "2026-03-02T08:00:00Z"),
+		End:    mustParseTime(t, "2026-03-02T12:00:00Z"),
+		Reason: "Product launch",
+	}
+	followUp := freezeWindow{
+		Start: mustParseTime(t, "2026-03-02T11:00:00Z"),
+		End:   mustParseTime(t, "2026-03-02T13:30:00Z"),
+	}
+
+	tests := []struct {
+		name         string
+		schedule     *publishSchedule
+		windows      []freezeWindow
+		fetched      string
+		now          string
+		ignoreFreeze bool
+		want         string
+		wantReason   string
+	}{
+		{
+			name:    "no schedule",
+			fetched: "2026-03-02T07:00:00Z", now: "2026-03-02T07:00:00Z",
+			want: "2026-03-02T07:00:00Z",
+		},
+		{
+			name:     "publishAt ahead",
+			schedule: &publishSchedule{PublishAt: mustParseTime(t, "2026-03-02T09:00:00Z")},
+			fetched:  "2026-03-02T07:00:00Z", now: "2026-03-02T07:00:00Z",
+			want: "2026-03-02T09:00:00Z", wantReason: "publishAt",
+		},
+		{
+			name:     "publishAt passed",
+			schedule: &publishSchedule{PublishAt: mustParseTime(t, "2026-03-02T06:00:00Z")},
+			fetched:  "2026-03-02T07:00:00Z", now: "2026-03-02T07:00:00Z",
+			want: "2026-03-02T07:00:00Z",
+		},
+		{
+			name:     "next cron match",
+			schedule: &publishSchedule{Cron: "0 9 * * *", TimeZone: "Europe/Berlin"},
+			fetched:  "2026-03-02T07:00:00Z", now: "2026-03-02T07:00:00Z",
+			want: "2026-03-02T08:00:00Z", wantReason: `publish schedule "0 9 * * *"`,
+		},
+		{
+			name:     "cron match missed by the sync",
+			schedule: &publishSchedule{Cron: "0 9 * * *", TimeZone: "Europe/Berlin"},
+			fetched:  "2026-03-02T07:00:00Z", now: "2026-03-02T08:03:00Z",
+			want: "2026-03-02T08:03:00Z",
+		},
+		{
+			name:    "in freeze window",
+			windows: []freezeWindow{launch},
+			fetched: "2026-03-02T09:00:00Z", now: "2026-03-02T09:00:00Z",
+			want: "2026-03-02T12:00:00Z", wantReason: "freeze window: Product launch",
+		},
+		{
+			name:    "overlapping freeze windows",
+			windows: []freezeWindow{followUp, launch},
+			fetched: "2026-03-02T09:00:00Z", now: "2026-03-02T09:00:00Z",
+			want: "2026-03-02T13:30:00Z", wantReason: "freeze window",
+		},
+		{
+			name:     "cron match after freeze window",
+			schedule: &publishSchedule{Cron: "0 * * * *"},
+			windows:  []freezeWindow{followUp},
+			fetched:  "2026-03-02T10:30:00Z", now: "2026-03-02T10:30:00Z",
+			want: "2026-03-02T14:00:00Z", wantReason: "freeze window",
+		},
+		{
+			name:     "freeze overridden",
+			schedule: &publishSchedule{PublishAt: mustParseTime(t, "2026-03-02T10:00:00Z")},
+			windows:  []freezeWindow{launch},
+			fetched:  "2026-03-02T09:00:00Z", now: "2026-03-02T09:00:00Z", ignoreFreeze: true,
+			want: "2026-03-02T10:00:00Z", wantReason: "publishAt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := &staticSiteData{PublishSchedule: tt.schedule, FreezeWindows: tt.windows}
+			got, reason, err := site.goLiveTime(mustParseTime(t, tt.fetched), mustParseTime(t, tt.now), tt.ignoreFreeze)
+			if err != nil {
+				t.Fatalf("goLiveTime() error = %v", err)
+			}
+			if got.UTC().Format(time.RFC3339) != tt.want || reason != tt.wantReason {
+				t.Errorf("goLiveTime() = %s (%q), want %s (%q)", got.UTC().Format(time.RFC3339), reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestSyncSite_PublishSchedule(t *testing.T) {
+	v1 := tarGz(t, map[string]string{"index.html": "v1"})
+	srv := newTestArchiveServer(t, v1)
+
+	s := newArchiveTestSyncer(t)
+	client := s.DynamicClient.(*fakeDynamicClient)
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Archive:         &archiveSource{URL: srv.server.URL + "/site.tar.gz"},
+		PublishSchedule: &publishSchedule{PublishAt: time.Now().Add(time.Hour)},
+	}
+
+	// Fetched and staged, but nothing is served before publishAt
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if s.currentRelease("default--site") != "" {
+		t.Fatal("site was published before publishAt")
+	}
+	if pending := s.pendingRelease("default--site"); pending == nil || pending.Release != sha256Hex(v1) {
+		t.Fatalf("pending release = %+v", pending)
+	}
+	if patch := string(client.lastPatch); !strings.Contains(patch, `"phase":"Pending"`) || !strings.Contains(patch, "goes live at") {
+		t.Errorf("status patch = %s", patch)
+	}
+	if !patchesContain(client, `"pending":{"commit":"`+sha256Hex(v1)[:8]) {
+		t.Error("pending commit not reported in status")
+	}
+	if !s.pendingPublishTime(site).Equal(site.PublishSchedule.PublishAt) {
+		t.Errorf("pendingPublishTime() = %s", s.pendingPublishTime(site))
+	}
+
+	// Once publishAt has passed the staged release goes live
+	site.PublishSchedule.PublishAt = time.Now().Add(-time.Minute)
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() after publishAt error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+	if s.pendingRelease("default--site") != nil || !patchesContain(client, `"pending":null`) {
+		t.Error("pending release not cleared")
+	}
+	if srv.count() != 1 {
+		t.Errorf("downloads = %d, want 1", srv.count())
+	}
+}
+
+func TestSyncSite_FreezeWindow(t *testing.T) {
+	v1 := tarGz(t, map[string]string{"index.html": "v1"})
+	srv := newTestArchiveServer(t, v1)
+
+	s := newArchiveTestSyncer(t)
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Archive: &archiveSource{URL: srv.server.URL + "/site.tar.gz"},
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	// During the freeze new content waits, the served content stays
+	site.FreezeWindows = []freezeWindow{{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour), Reason: "Elections"}}
+	v2 := tarGz(t, map[string]string{"index.html": "v2"})
+	srv.set(v2)
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() during freeze error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html during freeze = %q, want v1", got)
+	}
+	if pending := s.pendingRelease("default--site"); pending == nil || pending.Release != sha256Hex(v2) {
+		t.Fatalf("pending release = %+v", pending)
+	}
+
+	// Pruning keeps the held release
+	s.KeepReleases = 0
+	if err := s.pruneReleases("default--site", s.currentRelease("default--site")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The override publishes anyway
+	if err := s.syncSite(withFreezeOverride(context.Background()), site); err != nil {
+		t.Fatalf("syncSite() with override error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v2" {
+		t.Errorf("index.html after override = %q, want v2", got)
+	}
+	if s.pendingRelease("default--site") != nil {
+		t.Error("pending release not cleared")
+	}
+}
+
+func TestDeployEndpoint_Frozen(t *testing.T) {
+	w, client := newUploadTestServer(t)
+	client.spec["freezeWindows"] = []interface{}{map[string]interface{}{
+		"start":  time.Now().Add(-time.Hour).UTC().Format(time.RFC3339),
+		"end":    time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		"reason": "Product launch",
+	}}
+	upload := tarGz(t, map[string]string{"public/index.html": "v1"})
+
+	rr := deployRequest(w, "", "secret-token", upload)
+	if rr.Code != http.StatusLocked || !strings.Contains(rr.Body.String(), "Product launch") {
+		t.Fatalf("deploy during freeze = %d %s", rr.Code, rr.Body.String())
+	}
+	if w.Syncer.currentRelease("default--mysite") != "" {
+		t.Error("site was published during freeze")
+	}
+
+	req := httptest.NewRequest("PUT", "/deploy/default/mysite", bytes.NewReader(upload))
+	req.Header.Set("X-API-Key", "secret-token")
+	req.Header.Set(OverrideFreezeHeader, "true")
+	rr = httptest.NewRecorder()
+	w.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("deploy with override = %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPublishScheduleFromUnstructured(t *testing.T) {
+	site := &staticSiteData{}
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "site", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"repo":            "https://example.com/repo.git",
+			"publishSchedule": map[string]interface{}{"cron": "0 9 * * 1-5", "timeZone": "Europe/Berlin"},
+			"freezeWindows": []interface{}{map[string]interface{}{
+				"start":  "2026-11-03T00:00:00Z",
+				"end":    "2026-11-04T12:00:00+01:00",
+				"reason": "Elections",
+			}},
+		},
+	}}
+	if err := site.fromUnstructured(u); err != nil {
+		t.Fatal(err)
+	}
+	if site.PublishSchedule == nil || site.PublishSchedule.Cron != "0 9 * * 1-5" || site.PublishSchedule.TimeZone != "Europe/Berlin" {
+		t.Errorf("PublishSchedule = %+v", site.PublishSchedule)
+	}
+	if len(site.FreezeWindows) != 1 || site.FreezeWindows[0].Reason != "Elections" ||
+		!site.FreezeWindows[0].End.Equal(mustParseTime(t, "2026-11-04T11:00:00Z")) {
+		t.Errorf("FreezeWindows = %+v", site.FreezeWindows)
+	}
+
+	u.Object["spec"].(map[string]interface{})["freezeWindows"] = []interface{}{map[string]interface{}{"start": "tomorrow"}}
+	if err := (&staticSiteData{}).fromUnstructured(u); err == nil {
+		t.Error("invalid freeze window accepted")
+	}
+}
+
+func patchesContain(client *fakeDynamicClient, s string) bool {
+	for _, patch := range client.patches {
+		if strings.Contains(string(patch), s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,513 @@
+// Package syncer - atomic release directories
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// reposDirName holds the Git checkouts, one per site
+	reposDirName = ".repos"
+
+	// releasesDirName holds the immutable release directories, one set per site
+	releasesDirName = ".releases"
+
+	// mirrorsDirName holds the local copies of S3 buckets, one per site
+	mirrorsDirName = ".mirrors"
+
+	// rollbackHoldFile marks a site as rolled back. It contains the commit
+	// that was rolled away from; syncs keep the rolled back release until a
+	// different commit shows up.
+	rollbackHoldFile = ".rollback"
+
+	// DefaultKeepReleases is the default number of previous releases kept per site
+	DefaultKeepReleases = 3
+)
+
+var (
+	// errReleaseNotFound is returned when a rollback target does not exist
+	errReleaseNotFound = errors.New("release not found")
+
+	// errAmbiguousRelease is returned when a commit prefix matches more
+	// than one release
+	errAmbiguousRelease = errors.New("commit is ambiguous")
+
+	// errOutdatedRelease is returned when a rollback target was built with
+	// another path, submodule or build setting than the site has now
+	errOutdatedRelease = errors.New("release was built with another layout")
+)
+
+// siteDirName returns the directory name of a site below SitesRoot, .repos
+// and .releases. It follows the operator's resource naming, so sites with the
+// same name in different namespaces never share content.
+// Format: {namespace}--{name}, e.g., "customer-ns--my-site"
+func siteDirName(namespace, name string) string {
+	return namespace + "--" + name
+}
+
+// repoDir returns the directory of the Git checkout for a site
+func (s *Syncer) repoDir(siteDir string) string {
+	return filepath.Join(s.SitesRoot, reposDirName, siteDir)
+}
+
+// mirrorDir returns the directory of the bucket mirror for a site
+func (s *Syncer) mirrorDir(siteDir string) string {
+	return filepath.Join(s.SitesRoot, mirrorsDirName, siteDir)
+}
+
+// releasesDir returns the directory holding all releases of a site
+func (s *Syncer) releasesDir(siteDir string) string {
+	return filepath.Join(s.SitesRoot, releasesDirName, siteDir)
+}
+
+// resolveSubpath returns the directory inside the checkout that gets served.
+// An empty subpath or "/" serves the whole repository.
+func resolveSubpath(repoDir, subpath string) (string, error) {
+	// Normalize subpath (remove leading /)
+	subpath = filepath.Clean("/" + subpath)
+	subpath = strings.TrimPrefix(subpath, "/")
+
+	srcDir := filepath.Join(repoDir, subpath)
+	info, err := os.Stat(srcDir)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("subpath %q does not exist in repository", subpath)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("subpath %q is not a directory", subpath)
+	}
+	return srcDir, nil
+}
+
+// publishRelease materializes srcDir as the immutable release <commit> and
+// atomically points /sites/<dir> at it. Older releases are pruned afterwards.
+//
+// The release is built in a temporary directory and renamed into place, so a
+// release directory is either complete or absent. Visitors therefore always
+// see one consistent version of the site, never a mix of two commits.
+func (s *Syncer) publishRelease(siteDir, srcDir, commit string) error {
+	if err := s.stageRelease(siteDir, srcDir, commit); err != nil {
+		return err
+	}
+
+	releaseDir := filepath.Join(s.releasesDir(siteDir), commit)
+	if err := s.activateRelease(siteDir, releaseDir); err != nil {
+		return fmt.Errorf("failed to activate release: %w", err)
+	}
+
+	return s.pruneReleases(siteDir, commit)
+}
+
+// stageRelease materializes srcDir as the immutable release <commit>
+// without activating it. An existing release is kept.
+func (s *Syncer) stageRelease(siteDir, srcDir, commit string) error {
+	if commit == "" {
+		return fmt.Errorf("cannot publish release without commit")
+	}
+
+	releasesDir := s.releasesDir(siteDir)
+	if err := os.MkdirAll(releasesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create releases directory: %w", err)
+	}
+
+	releaseDir := filepath.Join(releasesDir, commit)
+	if _, err := os.Stat(releaseDir); !os.IsNotExist(err) {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(releasesDir, "."+commit+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary release directory: %w", err)
+	}
+	if err := copyTree(srcDir, tmpDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to materialize release: %w", err)
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := os.Rename(tmpDir, releaseDir); err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to finalize release: %w", err)
+	}
+	// The modification time orders releases for pruning and rollback
+	now := time.Now()
+	return os.Chtimes(releaseDir, now, now)
+}
+
+// replaceRelease rebuilds the existing release <commit> from srcDir, e.g.
+// after the site's path changed. Releases are immutable once linked, so the
+// new content is served from a temporary release while the old one is
+// removed and rebuilt; publishRelease prunes the temporary release.
+func (s *Syncer) replaceRelease(siteDir, srcDir, commit string) error {
+	if commit == "" {
+		return fmt.Errorf("cannot publish release without commit")
+	}
+
+	releasesDir := s.releasesDir(siteDir)
+	interimDir, err := os.MkdirTemp(releasesDir, "."+commit+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary release directory: %w", err)
+	}
+	if err := copyTree(srcDir, interimDir); err != nil {
+		_ = os.RemoveAll(interimDir)
+		return fmt.Errorf("failed to materialize release: %w", err)
+	}
+	if err := os.Chmod(interimDir, 0755); err != nil {
+		_ = os.RemoveAll(interimDir)
+		return err
+	}
+	if err := s.activateRelease(siteDir, interimDir); err != nil {
+		_ = os.RemoveAll(interimDir)
+		return fmt.Errorf("failed to activate release: %w", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(releasesDir, commit)); err != nil {
+		return fmt.Errorf("failed to remove outdated release: %w", err)
+	}
+	return s.publishRelease(siteDir, srcDir, commit)
+}
+
+// activateRelease atomically swaps the /sites/<dir> symlink to releaseDir.
+// A new symlink is created next to the old one and renamed over it, which is
+// atomic on POSIX filesystems. The link target is relative to SitesRoot so
+// the syncer and nginx may mount the volume at different paths.
+func (s *Syncer) activateRelease(siteDir, releaseDir string) error {
+	linkPath := filepath.Join(s.SitesRoot, siteDir)
+
+	target, err := filepath.Rel(s.SitesRoot, releaseDir)
+	if err != nil {
+		return err
+	}
+
+	tmpLink := filepath.Join(s.SitesRoot, "."+siteDir+".tmp")
+	if err := removePathOrSymlink(tmpLink); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return err
+	}
+
+	// A real directory cannot be replaced by rename. This only happens for
+	// sites cloned by older versions directly into /sites/<dir>.
+	if info, err := os.Lstat(linkPath); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		if err := os.RemoveAll(linkPath); err != nil {
+			_ = os.Remove(tmpLink)
+			return fmt.Errorf("failed to remove legacy site directory %s: %w", linkPath, err)
+		}
+	}
+
+	if err := os.Rename(tmpLink, linkPath); err != nil {
+		_ = os.Remove(tmpLink)
+		return err
+	}
+	return nil
+}
+
+// pruneReleases removes leftovers of interrupted builds and all releases
+// except the current one, a held one and the KeepReleases most recent
+// previous ones.
+func (s *Syncer) pruneReleases(siteDir, current string) error {
+	releasesDir := s.releasesDir(siteDir)
+	entries, err := os.ReadDir(releasesDir)
+	if err != nil {
+		return fmt.Errorf("failed to read releases directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") {
+			if err := os.RemoveAll(filepath.Join(releasesDir, entry.Name())); err != nil {
+				return fmt.Errorf("failed to remove interrupted release %s: %w", entry.Name(), err)
+			}
+		}
+	}
+
+	releases, err := s.listReleases(siteDir)
+	if err != nil {
+		return err
+	}
+
+	held := ""
+	if pending := s.pendingRelease(siteDir); pending != nil {
+		held = pending.Release
+	}
+
+	kept := 0
+	for _, release := range releases {
+		if release == current || release == held {
+			continue
+		}
+		if kept < s.KeepReleases {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(releasesDir, release)); err != nil {
+			return fmt.Errorf("failed to prune release %s: %w", release, err)
+		}
+	}
+	return nil
+}
+
+// removeReleasesBefore removes the releases of a site staged before since,
+// except the active one. They were built with another layout.
+func (s *Syncer) removeReleasesBefore(siteDir string, since time.Time) error {
+	releases, err := s.listReleases(siteDir)
+	if err != nil {
+		return err
+	}
+	current := s.currentRelease(siteDir)
+	for _, release := range releases {
+		if release == current || !s.releaseBefore(siteDir, release, since) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(s.releasesDir(siteDir), release)); err != nil {
+			return fmt.Errorf("failed to remove outdated release %s: %w", release, err)
+		}
+	}
+	return nil
+}
+
+// releaseBefore reports whether release was staged before since
+func (s *Syncer) releaseBefore(siteDir, release string, since time.Time) bool {
+	info, err := os.Stat(filepath.Join(s.releasesDir(siteDir), release))
+	return err == nil && info.ModTime().Before(since)
+}
+
+// listReleases returns the finished releases of a site, newest first
+func (s *Syncer) listReleases(siteDir string) ([]string, error) {
+	entries, err := os.ReadDir(s.releasesDir(siteDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read releases directory: %w", err)
+	}
+
+	type release struct {
+		name    string
+		modTime time.Time
+	}
+	var releases []release
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, release{name: entry.Name(), modTime: info.ModTime()})
+	}
+
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].modTime.After(releases[j].modTime)
+	})
+
+	names := make([]string, len(releases))
+	for i, r := range releases {
+		names[i] = r.name
+	}
+	return names, nil
+}
+
+// currentRelease returns the release /sites/<dir> points to, or "" if none
+func (s *Syncer) currentRelease(siteDir string) string {
+	target, err := os.Readlink(filepath.Join(s.SitesRoot, siteDir))
+	if err != nil {
+		return ""
+	}
+	if filepath.Dir(target) != filepath.Join(releasesDirName, siteDir) {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// rollbackHold returns the commit a site was rolled back from, or "" if the
+// site is not rolled back
+func (s *Syncer) rollbackHold(siteDir string) string {
+	content, err := os.ReadFile(filepath.Join(s.releasesDir(siteDir), rollbackHoldFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// clearRollbackHold lets syncs publish the tracked ref again
+func (s *Syncer) clearRollbackHold(siteDir string) error {
+	err := os.Remove(filepath.Join(s.releasesDir(siteDir), rollbackHoldFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Rollback points a site at an earlier release. If target is empty the
+// newest release older than the current one is used, otherwise target is
+// a (prefix of a) commit hash. Only releases on disk are considered, so a
+// rollback works without access to the Git host. Releases built with an
+// earlier path, submodule or build setting are not rolled back to.
+//
+// The rolled back release stays active until a new commit is synced.
+// Returns the commit of the activated release.
+func (s *Syncer) Rollback(ctx context.Context, namespace, name, target string) (string, error) {
+	logger := log.FromContext(ctx)
+
+	// Don't race with a sync publishing a release
+	lock := s.siteLock(namespace, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dir := siteDirName(namespace, name)
+	releases, err := s.listReleases(dir)
+	if err != nil {
+		return "", err
+	}
+
+	current := s.currentRelease(dir)
+	since := s.layoutSince(dir)
+	release := ""
+	if target == "" {
+		// Releases are sorted newest first; pick the first one after current
+		passedCurrent := current == ""
+		for _, r := range releases {
+			if r == current {
+				passedCurrent = true
+				continue
+			}
+			if passedCurrent && !s.releaseBefore(dir, r, since) {
+				release = r
+				break
+			}
+		}
+		if release == "" {
+			return "", fmt.Errorf("%w: no release older than %s", errReleaseNotFound, shortHash(current))
+		}
+	} else {
+		for _, r := range releases {
+			if strings.HasPrefix(r, target) {
+				if release != "" {
+					return "", fmt.Errorf("%w: %q matches more than one release", errAmbiguousRelease, target)
+				}
+				release = r
+			}
+		}
+		if release == "" {
+			return "", fmt.Errorf("%w: %s", errReleaseNotFound, target)
+		}
+		if release != current && s.releaseBefore(dir, release, since) {
+			return "", fmt.Errorf("%w: %s", errOutdatedRelease, shortHash(release))
+		}
+	}
+
+	// Remember the commit we rolled away from. Repeated rollbacks keep the
+	// original one, so syncs hold until the tracked ref actually changes.
+	if s.rollbackHold(dir) == "" && current != "" && release != current {
+		holdPath := filepath.Join(s.releasesDir(dir), rollbackHoldFile)
+		if err := os.WriteFile(holdPath, []byte(current+"\n"), 0644); err != nil {
+			return "", fmt.Errorf("failed to record rollback: %w", err)
+		}
+	}
+
+	if err := s.activateRelease(dir, filepath.Join(s.releasesDir(dir), release)); err != nil {
+		return "", fmt.Errorf("failed to activate release: %w", err)
+	}
+
+	logger.Info("Rolled back site", "namespace", namespace, "name", name, "from", shortHash(current), "to", shortHash(release))
+
+	site := &staticSiteData{Name: name, Namespace: namespace}
+	s.updateStatus(ctx, site, "Ready", fmt.Sprintf("Rolled back to %s", shortHash(release)), shortHash(release))
+
+	return release, nil
+}
+
+// copyTree copies the content of srcDir into dstDir, skipping .git.
+// Symlinks are copied as symlinks, not followed. Symlinks leading out of
+// srcDir are dropped, the web server would follow them.
+func copyTree(srcDir, dstDir string) error {
+	root, err := filepath.EvalSymlinks(srcDir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if info.Name() == ".git" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dst := filepath.Join(dstDir, rel)
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if !linkInside(srcDir, path, target) || !resolvesInside(root, path) {
+				return nil
+			}
+			return os.Symlink(target, dst)
+		case info.IsDir():
+			return os.Mkdir(dst, 0755)
+		case info.Mode().IsRegular():
+			return copyFile(path, dst, info.Mode().Perm())
+		default:
+			// Sockets, devices etc. have no place in a static site
+			return nil
+		}
+	})
+}
+
+// resolvesInside reports whether the symlink at path resolves to an
+// existing file below root. Unlike linkInside this also catches links
+// that leave root through other symlinks.
+func resolvesInside(root, path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, resolved)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// copyFile copies a single regular file
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,594 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newTestRemote creates a local Git repository acting as remote, with one
+// commit containing files on branch master
+func newTestRemote(t *testing.T, files map[string]string) (string, *git.Repository, plumbing.Hash) {
+	t.Helper()
+
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	repo, err := git.PlainInit(remoteDir, false)
+	if err != nil {
+		t.Fatalf("failed to init remote repo: %v", err)
+	}
+	hash := commitTestFiles(t, repo, files, "Initial commit")
+	return remoteDir, repo, hash
+}
+
+// commitTestFiles writes files into the worktree of repo and commits them
+func commitTestFiles(t *testing.T, repo *git.Repository, files map[string]string, message string) plumbing.Hash {
+	t.Helper()
+	return commitTestFilesWith(t, repo, files, message, &git.CommitOptions{})
+}
+
+// commitTestFilesWith commits files like commitTestFiles with opts, e.g.
+// to sign the commit
+func commitTestFilesWith(t *testing.T, repo *git.Repository, files map[string]string, message string, opts *git.CommitOptions) plumbing.Hash {
+	t.Helper()
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("failed to get worktree: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(wt.Filesystem.Root(), name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create dir for %s: %v", name, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			t.Fatalf("failed to add %s: %v", name, err)
+		}
+	}
+	opts.Author = &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()}
+	hash, err := wt.Commit(message, opts)
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	return hash
+}
+
+// newTestGitServer serves the repositories below its root directory over
+// HTTP with git http-backend. It returns the root and the base URL.
+func newTestGitServer(t *testing.T) (string, string) {
+	t.Helper()
+
+	root, handler := newGitHTTPBackend(t)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return root, srv.URL
+}
+
+// newGitHTTPBackend returns a git http-backend handler for the repositories
+// below a new root directory
+func newGitHTTPBackend(t *testing.T) (string, http.Handler) {
+	t.Helper()
+
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not installed")
+	}
+	root := t.TempDir()
+	return root, &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+}
+
+// newServedRepo creates a repository named name below the root of a test
+// Git server and commits files to it
+func newServedRepo(t *testing.T, root, name string, files map[string]string) (*git.Repository, plumbing.Hash) {
+	t.Helper()
+
+	repo, err := git.PlainInit(filepath.Join(root, name), false)
+	if err != nil {
+		t.Fatalf("failed to init %s: %v", name, err)
+	}
+	return repo, commitTestFiles(t, repo, files, "Initial commit")
+}
+
+// newServedTestRemote creates a repository with files like newTestRemote
+// and serves it over HTTP. It returns the repo URL for sites.
+func newServedTestRemote(t *testing.T, files map[string]string) (string, *git.Repository, plumbing.Hash) {
+	t.Helper()
+
+	root, baseURL := newTestGitServer(t)
+	repo, hash := newServedRepo(t, root, "repo.git", files)
+	return baseURL + "/repo.git", repo, hash
+}
+
+// readSiteFile reads a file through the /sites/<name> symlink like nginx does
+func readSiteFile(t *testing.T, s *Syncer, siteName, name string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(s.SitesRoot, siteName, name))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	return string(content)
+}
+
+func TestPublishRelease(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir()}
+
+	srcDir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(srcDir, ".git", "objects"), 0755)
+	_ = os.WriteFile(filepath.Join(srcDir, ".git", "config"), []byte("[remote]"), 0644)
+	_ = os.MkdirAll(filepath.Join(srcDir, "css"), 0755)
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("v1"), 0644)
+	_ = os.WriteFile(filepath.Join(srcDir, "css", "style.css"), []byte("body{}"), 0644)
+	_ = os.Symlink("index.html", filepath.Join(srcDir, "home.html"))
+
+	if err := s.publishRelease("mysite", srcDir, "commit1"); err != nil {
+		t.Fatalf("publishRelease() error = %v", err)
+	}
+
+	linkPath := filepath.Join(s.SitesRoot, "mysite")
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		t.Fatalf("site is not a symlink: %v", err)
+	}
+	if want := filepath.Join(".releases", "mysite", "commit1"); target != want {
+		t.Errorf("symlink target = %q, want %q", target, want)
+	}
+	if got := readSiteFile(t, s, "mysite", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want %q", got, "v1")
+	}
+	if got := readSiteFile(t, s, "mysite", "css/style.css"); got != "body{}" {
+		t.Errorf("css/style.css = %q, want %q", got, "body{}")
+	}
+	if got := readSiteFile(t, s, "mysite", "home.html"); got != "v1" {
+		t.Errorf("home.html (symlink) = %q, want %q", got, "v1")
+	}
+	if _, err := os.Stat(filepath.Join(linkPath, ".git")); !os.IsNotExist(err) {
+		t.Error(".git was copied into the release")
+	}
+
+	// Changing the source must not affect the published release
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("v2"), 0644)
+	if got := readSiteFile(t, s, "mysite", "index.html"); got != "v1" {
+		t.Errorf("release changed with source: index.html = %q", got)
+	}
+
+	// Publishing a new commit swaps the link and prunes the old release
+	if err := s.publishRelease("mysite", srcDir, "commit2"); err != nil {
+		t.Fatalf("publishRelease() second call error = %v", err)
+	}
+	if got := readSiteFile(t, s, "mysite", "index.html"); got != "v2" {
+		t.Errorf("index.html after swap = %q, want %q", got, "v2")
+	}
+	if _, err := os.Stat(filepath.Join(s.releasesDir("mysite"), "commit1")); !os.IsNotExist(err) {
+		t.Error("old release was not pruned")
+	}
+	if _, err := os.Lstat(filepath.Join(s.SitesRoot, ".mysite.tmp")); !os.IsNotExist(err) {
+		t.Error("temporary symlink left behind")
+	}
+}
+
+func TestPublishRelease_SameCommitIsNoop(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir()}
+
+	srcDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("v1"), 0644)
+
+	if err := s.publishRelease("mysite", srcDir, "commit1"); err != nil {
+		t.Fatalf("publishRelease() error = %v", err)
+	}
+
+	// An existing release is immutable and is not rebuilt
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("changed"), 0644)
+	if err := s.publishRelease("mysite", srcDir, "commit1"); err != nil {
+		t.Fatalf("publishRelease() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "mysite", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want %q", got, "v1")
+	}
+}
+
+func TestPublishRelease_ReplacesLegacyDirectory(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir()}
+
+	// Older versions cloned directly into /sites/<name>
+	legacyDir := filepath.Join(s.SitesRoot, "mysite")
+	_ = os.MkdirAll(filepath.Join(legacyDir, ".git"), 0755)
+	_ = os.WriteFile(filepath.Join(legacyDir, "index.html"), []byte("legacy"), 0644)
+
+	srcDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("release"), 0644)
+
+	if err := s.publishRelease("mysite", srcDir, "commit1"); err != nil {
+		t.Fatalf("publishRelease() error = %v", err)
+	}
+
+	info, err := os.Lstat(legacyDir)
+	if err != nil {
+		t.Fatalf("site path missing: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected symlink, got %v", info.Mode())
+	}
+	if got := readSiteFile(t, s, "mysite", "index.html"); got != "release" {
+		t.Errorf("index.html = %q, want %q", got, "release")
+	}
+}
+
+func TestPublishRelease_PrunesInterruptedBuilds(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir()}
+
+	leftover := filepath.Join(s.releasesDir("mysite"), ".commit0-123")
+	_ = os.MkdirAll(leftover, 0755)
+
+	srcDir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(srcDir, "index.html"), []byte("v1"), 0644)
+
+	if err := s.publishRelease("mysite", srcDir, "commit1"); err != nil {
+		t.Fatalf("publishRelease() error = %v", err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("interrupted build was not pruned")
+	}
+}
+
+func TestPublishRelease_EmptyCommit(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir()}
+
+	if err := s.publishRelease("mysite", t.TempDir(), ""); err == nil {
+		t.Error("expected error for empty commit, got nil")
+	}
+}
+
+func TestSyncSite_PublishesRelease(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{
+		"README.md":       "readme",
+		"dist/index.html": "<h1>Version 1</h1>",
+	})
+
+	fakeClient := &fakeDynamicClient{activeSites: []string{"test-site"}}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+		Path:      "/dist",
+	}
+
+	ctx := context.Background()
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "<h1>Version 1</h1>" {
+		t.Errorf("index.html = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.releasesDir("default--test-site"), commit1.String())); err != nil {
+		t.Errorf("release for %s missing: %v", commit1, err)
+	}
+
+	commit2 := commitTestFiles(t, remoteRepo, map[string]string{"dist/index.html": "<h1>Version 2</h1>"}, "Update")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() second call error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "<h1>Version 2</h1>" {
+		t.Errorf("index.html after update = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.releasesDir("default--test-site"), commit2.String())); err != nil {
+		t.Errorf("release for %s missing: %v", commit2, err)
+	}
+	if !strings.Contains(string(fakeClient.lastPatch), commit2.String()[:8]) {
+		t.Errorf("status patch does not contain commit %s: %s", commit2.String()[:8], fakeClient.lastPatch)
+	}
+}
+
+func TestSyncSite_DoesNotPublishGitMetadata(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{
+		"index.html":        "home",
+		"vendor/lib/.git":   "gitdir: ../../.git/modules/lib",
+		"vendor/lib/lib.js": "lib",
+	})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+
+	// No subpath: the whole repository is served
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	siteDir := filepath.Join(s.SitesRoot, "default--test-site")
+	for _, path := range []string{".git", ".git/config", "vendor/lib/.git"} {
+		if _, err := os.Stat(filepath.Join(siteDir, path)); !os.IsNotExist(err) {
+			t.Errorf("%s is served", path)
+		}
+	}
+	if got := readSiteFile(t, s, "default--test-site", "vendor/lib/lib.js"); got != "lib" {
+		t.Errorf("vendor/lib/lib.js = %q", got)
+	}
+
+	// The checkout with the remote URL lives outside of any site directory
+	if _, err := os.Stat(filepath.Join(s.repoDir("default--test-site"), ".git", "config")); err != nil {
+		t.Errorf("checkout missing: %v", err)
+	}
+}
+
+func TestSyncSite_DropsSymlinksLeavingTheRelease(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	remote, _ := newServedRepo(t, root, "site.git", map[string]string{
+		"secret.txt":      "secret",
+		"docs/index.html": "home",
+		"docs/a/.keep":    "",
+	})
+	links := map[string]string{
+		"docs/home.html":   "index.html",
+		"docs/a/sub":       "..",
+		"docs/config":      "../../../.repos/default--site/.git/config",
+		"docs/passwd":      "/etc/passwd",
+		"docs/up":          "..",
+		"docs/via-sub.txt": "a/sub/../secret.txt",
+	}
+	wt, err := remote.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(wt.Filesystem.Root(), name)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commitTestFiles(t, remote, map[string]string{}, "Add links")
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/docs"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	siteDir := filepath.Join(s.SitesRoot, "default--site")
+	for _, name := range []string{"config", "passwd", "up", "via-sub.txt"} {
+		if _, err := os.Lstat(filepath.Join(siteDir, name)); !os.IsNotExist(err) {
+			t.Errorf("symlink %s leaving the release is published", name)
+		}
+	}
+	if got := readSiteFile(t, s, "default--site", "home.html"); got != "home" {
+		t.Errorf("home.html = %q, want home", got)
+	}
+	if got := readSiteFile(t, s, "default--site", "a/sub/index.html"); got != "home" {
+		t.Errorf("a/sub/index.html = %q, want home", got)
+	}
+}
+
+// makeTestRelease creates a finished release with the given age
+func makeTestRelease(t *testing.T, s *Syncer, siteName, commit string, age time.Duration) {
+	t.Helper()
+
+	releaseDir := filepath.Join(s.releasesDir(siteName), commit)
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatalf("failed to create release: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(releaseDir, "index.html"), []byte(commit), 0644); err != nil {
+		t.Fatalf("failed to write release content: %v", err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(releaseDir, mtime, mtime); err != nil {
+		t.Fatalf("failed to set release time: %v", err)
+	}
+}
+
+func TestPruneReleases_KeepsPrevious(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir(), KeepReleases: 2}
+
+	makeTestRelease(t, s, "mysite", "c1", 4*time.Hour)
+	makeTestRelease(t, s, "mysite", "c2", 3*time.Hour)
+	makeTestRelease(t, s, "mysite", "c3", 2*time.Hour)
+	makeTestRelease(t, s, "mysite", "c4", 1*time.Hour)
+
+	if err := s.pruneReleases("mysite", "c4"); err != nil {
+		t.Fatalf("pruneReleases() error = %v", err)
+	}
+
+	releases, err := s.listReleases("mysite")
+	if err != nil {
+		t.Fatalf("listReleases() error = %v", err)
+	}
+	want := []string{"c4", "c3", "c2"}
+	if strings.Join(releases, ",") != strings.Join(want, ",") {
+		t.Errorf("releases = %v, want %v", releases, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		wantCommit string
+		wantErr    bool
+	}{
+		{name: "previous release", target: "", wantCommit: "bbbb2222"},
+		{name: "by commit prefix", target: "aaaa", wantCommit: "aaaa1111"},
+		{name: "current release", target: "cccc3333", wantCommit: "cccc3333"},
+		{name: "unknown commit", target: "ffff", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClient := &fakeDynamicClient{activeSites: []string{"mysite"}}
+			s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: fakeClient}
+
+			makeTestRelease(t, s, "default--mysite", "aaaa1111", 3*time.Hour)
+			makeTestRelease(t, s, "default--mysite", "bbbb2222", 2*time.Hour)
+			makeTestRelease(t, s, "default--mysite", "cccc3333", 1*time.Hour)
+			if err := s.activateRelease("default--mysite", filepath.Join(s.releasesDir("default--mysite"), "cccc3333")); err != nil {
+				t.Fatalf("activateRelease() error = %v", err)
+			}
+
+			got, err := s.Rollback(context.Background(), "default", "mysite", tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if s.currentRelease("default--mysite") != "cccc3333" {
+					t.Errorf("failed rollback changed current release to %s", s.currentRelease("default--mysite"))
+				}
+				return
+			}
+			if got != tt.wantCommit {
+				t.Errorf("Rollback() = %q, want %q", got, tt.wantCommit)
+			}
+			if current := s.currentRelease("default--mysite"); current != tt.wantCommit {
+				t.Errorf("current release = %q, want %q", current, tt.wantCommit)
+			}
+			if got := readSiteFile(t, s, "default--mysite", "index.html"); got != tt.wantCommit {
+				t.Errorf("served content = %q, want %q", got, tt.wantCommit)
+			}
+			if !strings.Contains(string(fakeClient.lastPatch), tt.wantCommit) {
+				t.Errorf("status patch does not contain %s: %s", tt.wantCommit, fakeClient.lastPatch)
+			}
+		})
+	}
+}
+
+func TestRollback_WalksBackwards(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: &fakeDynamicClient{}}
+
+	makeTestRelease(t, s, "default--mysite", "c1", 3*time.Hour)
+	makeTestRelease(t, s, "default--mysite", "c2", 2*time.Hour)
+	makeTestRelease(t, s, "default--mysite", "c3", 1*time.Hour)
+	_ = s.activateRelease("default--mysite", filepath.Join(s.releasesDir("default--mysite"), "c3"))
+
+	ctx := context.Background()
+	for _, want := range []string{"c2", "c1"} {
+		got, err := s.Rollback(ctx, "default", "mysite", "")
+		if err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("Rollback() = %q, want %q", got, want)
+		}
+	}
+
+	if _, err := s.Rollback(ctx, "default", "mysite", ""); err == nil {
+		t.Error("expected error when no older release exists, got nil")
+	}
+
+	// The hold keeps the commit that was live before the first rollback
+	if held := s.rollbackHold("default--mysite"); held != "c3" {
+		t.Errorf("rollbackHold() = %q, want %q", held, "c3")
+	}
+}
+
+func TestRollback_AmbiguousCommit(t *testing.T) {
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: &fakeDynamicClient{}}
+
+	makeTestRelease(t, s, "default--mysite", "abc111", 2*time.Hour)
+	makeTestRelease(t, s, "default--mysite", "abc222", 1*time.Hour)
+
+	if _, err := s.Rollback(context.Background(), "default", "mysite", "abc"); !errors.Is(err, errAmbiguousRelease) {
+		t.Errorf("Rollback() error = %v, want errAmbiguousRelease", err)
+	}
+}
+
+func TestSyncSite_RollbackHoldsUntilNewCommit(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+		KeepReleases:  DefaultKeepReleases,
+	}
+
+	site := &staticSiteData{
+		Name:      "test-site",
+		Namespace: "default",
+		Repo:      repoURL,
+		Branch:    "master",
+		Path:      "/",
+	}
+
+	ctx := context.Background()
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	// Make sure the second release is strictly newer
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(filepath.Join(s.releasesDir("default--test-site"), commit1.String()), old, old)
+
+	commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v2"}, "Broken build")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v2" {
+		t.Fatalf("index.html = %q, want v2", got)
+	}
+
+	if _, err := s.Rollback(ctx, "default", "test-site", ""); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+		t.Fatalf("index.html after rollback = %q, want v1", got)
+	}
+
+	// Syncing the unchanged branch keeps the rollback
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v1" {
+		t.Errorf("index.html after sync of unchanged branch = %q, want v1", got)
+	}
+
+	// A new commit ends the rollback
+	commitTestFiles(t, remoteRepo, map[string]string{"index.html": "v3"}, "Fix")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "v3" {
+		t.Errorf("index.html after new commit = %q, want v3", got)
+	}
+	if held := s.rollbackHold("default--test-site"); held != "" {
+		t.Errorf("rollback hold not cleared: %q", held)
+	}
+}
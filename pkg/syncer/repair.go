@@ -0,0 +1,168 @@
+// Package syncer - repair of damaged checkouts
+package syncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	pagesv1 "github.com/kup6s/pages/pkg/apis/v1beta1"
+)
+
+const (
+	// quarantineDirName holds the last damaged checkout of each site
+	quarantineDirName = ".quarantine"
+
+	// eventReportingController names the syncer in events
+	eventReportingController = "pages.kup6s.com/syncer"
+)
+
+// checkoutDamage returns why the checkout in repoDir is unusable, or nil if
+// it can be pulled. A crash during a clone or reset can leave a checkout
+// without HEAD, with missing objects or with a truncated index.
+func checkoutDamage(repoDir string) error {
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open repo: %w", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("missing HEAD: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("unreadable commit %s: %w", shortHash(head.Hash().String()), err)
+	}
+	if _, err := commit.Tree(); err != nil {
+		return fmt.Errorf("unreadable tree of commit %s: %w", shortHash(head.Hash().String()), err)
+	}
+	if _, err := repo.Storer.Index(); err != nil {
+		return fmt.Errorf("broken index: %w", err)
+	}
+	return nil
+}
+
+// repairCheckout moves the damaged checkout of a site to .quarantine, where
+// it replaces the one of an earlier repair, so the site is cloned again.
+// The repair is reported as event and as Repaired condition of the site.
+func (s *Syncer) repairCheckout(ctx context.Context, site *staticSiteData, damage error) error {
+	logger := log.FromContext(ctx)
+	logger.Info("Checkout is damaged, cloning again", "site", site.Name, "damage", damage.Error())
+
+	quarantineDir := filepath.Join(s.SitesRoot, quarantineDirName, site.dirName())
+	if err := os.MkdirAll(filepath.Dir(quarantineDir), 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.RemoveAll(quarantineDir); err != nil {
+		return fmt.Errorf("failed to remove previous quarantine: %w", err)
+	}
+	if err := os.Rename(s.repoDir(site.dirName()), quarantineDir); err != nil {
+		return fmt.Errorf("failed to quarantine damaged checkout: %w", err)
+	}
+
+	message := fmt.Sprintf("Checkout was damaged (%v) and is cloned again; the damaged copy is kept in %s", damage, filepath.Join(quarantineDirName, site.dirName()))
+	s.recordEvent(ctx, site, corev1.EventTypeWarning, "CheckoutRepaired", "Reclone", message)
+	s.setCondition(ctx, site, metav1.Condition{
+		Type:    pagesv1.ConditionRepaired,
+		Status:  metav1.ConditionTrue,
+		Reason:  "CheckoutDamaged",
+		Message: message,
+	})
+	return nil
+}
+
+// recordEvent creates an event for the site. Failures are only logged,
+// events are informational.
+func (s *Syncer) recordEvent(ctx context.Context, site *staticSiteData, eventType, reason, action, note string) {
+	instance, _ := os.Hostname()
+	if instance == "" {
+		instance = "syncer"
+	}
+	event := &eventsv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: site.Name + ".",
+			Namespace:    site.Namespace,
+		},
+		EventTime:           metav1.NowMicro(),
+		ReportingController: eventReportingController,
+		ReportingInstance:   instance,
+		Action:              action,
+		Reason:              reason,
+		Type:                eventType,
+		Note:                note,
+		Regarding: corev1.ObjectReference{
+			APIVersion: pagesv1.GroupVersion.String(),
+			Kind:       "StaticSite",
+			Namespace:  site.Namespace,
+			Name:       site.Name,
+			UID:        site.UID,
+		},
+	}
+	if _, err := s.ClientSet.EventsV1().Events(site.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to record event", "site", site.Name, "reason", reason)
+	}
+}
+
+// setCondition adds or replaces a condition in the site's status. The
+// status is patched with all conditions, since a merge patch replaces lists.
+// A condition that didn't change is left alone.
+func (s *Syncer) setCondition(ctx context.Context, site *staticSiteData, condition metav1.Condition) {
+	condition.LastTransitionTime = metav1.NewTime(time.Now().Truncate(time.Second))
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		return s.patchCondition(ctx, site, condition)
+	})
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to update condition", "site", site.Name, "type", condition.Type)
+	}
+}
+
+// patchCondition reads the conditions of the site and patches them with
+// condition. The patch carries the resourceVersion that was read, so a
+// concurrent status update makes it fail with a conflict instead of being
+// overwritten.
+func (s *Syncer) patchCondition(ctx context.Context, site *staticSiteData, condition metav1.Condition) error {
+	obj, err := s.DynamicClient.Resource(staticSiteGVR).Namespace(site.Namespace).Get(ctx, site.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get site: %w", err)
+	}
+	existing, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+
+	conditions := []interface{}{}
+	for _, c := range existing {
+		m, ok := c.(map[string]interface{})
+		if ok && m["type"] == condition.Type {
+			// Repeated on every sync, an unchanged condition isn't patched
+			if m["status"] == string(condition.Status) && m["reason"] == condition.Reason && m["message"] == condition.Message {
+				return nil
+			}
+			continue
+		}
+		conditions = append(conditions, c)
+	}
+	conditions = append(conditions, condition)
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": obj.GetResourceVersion()},
+		"status":   map[string]interface{}{"conditions": conditions},
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = s.DynamicClient.Resource(staticSiteGVR).
+		Namespace(site.Namespace).
+		Patch(ctx, site.Name, types.MergePatchType, patchBytes, metav1.PatchOptions{}, "status")
+	return err
+}
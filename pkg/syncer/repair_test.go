@@ -0,0 +1,189 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	pagesv1 "github.com/kup6s/pages/pkg/apis/v1beta1"
+)
+
+func TestCheckoutDamage(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(t *testing.T, repoDir string)
+		wantErr string
+	}{
+		{"healthy", func(*testing.T, string) {}, ""},
+		{"no .git", func(t *testing.T, repoDir string) {
+			if err := os.RemoveAll(filepath.Join(repoDir, ".git")); err != nil {
+				t.Fatal(err)
+			}
+		}, "failed to open repo"},
+		{"no HEAD", func(t *testing.T, repoDir string) {
+			if err := os.WriteFile(filepath.Join(repoDir, ".git", "HEAD"), []byte("ref: refs/heads/missing\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "missing HEAD"},
+		{"missing objects", func(t *testing.T, repoDir string) {
+			objects := filepath.Join(repoDir, ".git", "objects")
+			if err := os.RemoveAll(objects); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(objects, "pack"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, "unreadable commit"},
+		{"truncated index", func(t *testing.T, repoDir string) {
+			if err := os.WriteFile(filepath.Join(repoDir, ".git", "index"), []byte("DIRC\x00"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, "broken index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.html": "home"})
+			s := &Syncer{
+				SitesRoot:     t.TempDir(),
+				AllowedHosts:  []string{"127.0.0.1"},
+				DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+				ClientSet:     newFakeClientset(),
+			}
+			site := &staticSiteData{Name: "site", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/"}
+			if err := s.syncSite(context.Background(), site); err != nil {
+				t.Fatalf("syncSite() error = %v", err)
+			}
+			repoDir := s.repoDir("default--site")
+			tt.damage(t, repoDir)
+
+			err := checkoutDamage(repoDir)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkoutDamage() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkoutDamage() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncSite_RepairsDamagedCheckout(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	_, commit := newServedRepo(t, root, "site.git", map[string]string{"index.html": "home"})
+
+	dynamicClient := &fakeDynamicClient{activeSites: []string{"site"}}
+	clientSet := newFakeClientset()
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: dynamicClient,
+		ClientSet:     clientSet,
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	// A crash during a reset left a truncated index behind
+	repoDir := s.repoDir("default--site")
+	if err := os.WriteFile(filepath.Join(repoDir, ".git", "index"), []byte("DIRC\x00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with damaged checkout error = %v", err)
+	}
+	if err := checkoutDamage(repoDir); err != nil {
+		t.Errorf("checkout still damaged: %v", err)
+	}
+	if s.currentRelease("default--site") != commit.String() {
+		t.Errorf("current release = %q, want %q", s.currentRelease("default--site"), commit)
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, quarantineDirName, "default--site", ".git", "index")); err != nil {
+		t.Errorf("damaged checkout not quarantined: %v", err)
+	}
+
+	events, err := clientSet.EventsV1().Events("default").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != "CheckoutRepaired" || events.Items[0].Regarding.Name != "site" {
+		t.Errorf("events = %+v, want one CheckoutRepaired event", events.Items)
+	}
+
+	// The final status patch reports the sync; look at the condition patch
+	// by repairing once more
+	if err := os.WriteFile(filepath.Join(repoDir, ".git", "HEAD"), []byte("ref: refs/heads/missing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repairCheckout(context.Background(), site, checkoutDamage(repoDir)); err != nil {
+		t.Fatalf("repairCheckout() error = %v", err)
+	}
+	patch := string(dynamicClient.lastPatch)
+	if !strings.Contains(patch, `"type":"Repaired"`) || !strings.Contains(patch, "missing HEAD") {
+		t.Errorf("condition patch = %s", patch)
+	}
+
+	// Quarantined checkouts go away with the site
+	if err := s.DeleteSite(context.Background(), "default", "site"); err != nil {
+		t.Fatalf("DeleteSite() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, quarantineDirName, "default--site")); !os.IsNotExist(err) {
+		t.Error("quarantined checkout not removed with the site")
+	}
+}
+
+func TestSyncSite_UnreachableRemoteIsNotRepaired(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	newServedRepo(t, root, "repo.git", map[string]string{"index.html": "home"})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/repo.git", Branch: "master", Path: "/"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "repo.git")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.syncSite(context.Background(), site); err == nil {
+		t.Fatal("syncSite() succeeded without a remote")
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, quarantineDirName)); !os.IsNotExist(err) {
+		t.Error("healthy checkout was quarantined after a fetch error")
+	}
+}
+
+func TestSetCondition_RetriesOnConflict(t *testing.T) {
+	client := &conflictingDynamicClient{conflicts: 2, version: 1}
+	s := &Syncer{SitesRoot: t.TempDir(), DynamicClient: client}
+	site := &staticSiteData{Name: "site", Namespace: "default"}
+
+	s.setCondition(context.Background(), site, metav1.Condition{
+		Type:    pagesv1.ConditionRepaired,
+		Status:  metav1.ConditionTrue,
+		Reason:  "CheckoutDamaged",
+		Message: "missing HEAD",
+	})
+
+	// Each attempt reads the site again and patches its resourceVersion
+	if len(client.patches) != 1 {
+		t.Fatalf("patches = %d, want 1 after two conflicts", len(client.patches))
+	}
+	patch := string(client.lastPatch)
+	if !strings.Contains(patch, `"resourceVersion":"3"`) || !strings.Contains(patch, `"type":"Repaired"`) {
+		t.Errorf("condition patch = %s", patch)
+	}
+}
@@ -0,0 +1,492 @@
+// Package syncer - S3-compatible buckets as site content
+package syncer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// s3ContentDir holds the mirrored objects inside a site's mirror
+	s3ContentDir = "content"
+
+	// s3ObjectsFile records the ETags of the mirrored objects
+	s3ObjectsFile = "objects.json"
+
+	// defaultS3Region is used for signing when the site sets no region
+	defaultS3Region = "us-east-1"
+
+	// emptyPayloadHash is the SHA-256 of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxS3Response limits list and error responses read into memory
+	maxS3Response = 16 << 20
+)
+
+// s3Object is an object listed below the site's prefix
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+// s3Mirror records which object versions the mirror of a site holds
+type s3Mirror struct {
+	Endpoint string            `json:"endpoint"`
+	Bucket   string            `json:"bucket"`
+	Prefix   string            `json:"prefix"`
+	Objects  map[string]string `json:"objects"` // file path -> ETag
+}
+
+// s3Client reads a bucket with path-style requests, signed with AWS
+// Signature Version 4 if credentials are set
+type s3Client struct {
+	http      *http.Client
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// s3Client returns a client for the site's bucket. The endpoint must be on
+// an allowed host.
+func (s *Syncer) s3Client(ctx context.Context, site *staticSiteData) (*s3Client, error) {
+	endpoint, err := s.validateFetchURL(site.S3.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint validation failed: %w", err)
+	}
+	c := &s3Client{
+		endpoint: endpoint,
+		bucket:   site.S3.Bucket,
+		region:   site.S3.Region,
+	}
+	if c.region == "" {
+		c.region = defaultS3Region
+	}
+	if site.S3.SecretRef != nil {
+		if c.accessKey, err = s.getSecretValue(ctx, site.Namespace, site.S3.SecretRef.Name, "accessKeyID"); err != nil {
+			return nil, fmt.Errorf("failed to get S3 credentials: %w", err)
+		}
+		if c.secretKey, err = s.getSecretValue(ctx, site.Namespace, site.S3.SecretRef.Name, "secretAccessKey"); err != nil {
+			return nil, fmt.Errorf("failed to get S3 credentials: %w", err)
+		}
+	}
+	caBundle, err := s.caBundle(ctx, site.Namespace, site.S3.SecretRef)
+	if err != nil {
+		return nil, err
+	}
+	if c.http, err = s.fetchClient(caBundle); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// get requests an object, or lists the bucket if key is empty
+func (c *s3Client) get(ctx context.Context, key string, query url.Values) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// Sent exactly as signed
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.accessKey != "" {
+		signS3Request(req, c.accessKey, c.secretKey, c.region, time.Now())
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		var s3Err struct {
+			Code string `xml:"Code"`
+		}
+		_ = xml.NewDecoder(io.LimitReader(resp.Body, maxS3Response)).Decode(&s3Err)
+		if s3Err.Code != "" {
+			return nil, fmt.Errorf("S3 request failed: %s (%s)", resp.Status, s3Err.Code)
+		}
+		return nil, fmt.Errorf("S3 request failed: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// listObjects returns all objects below prefix
+func (c *s3Client) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.get(ctx, "", query)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(io.LimitReader(resp.Body, maxS3Response)).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 list response: %w", err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// getObject downloads an object to target. The file is replaced atomically,
+// so the mirror never holds a partial object. An object larger than listed
+// is rejected; the downloaded bytes count against limit.
+func (c *s3Client) getObject(ctx context.Context, obj s3Object, target string, limit *extractLimit) error {
+	resp, err := c.get(ctx, obj.Key, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	// The release is named after the listed ETags, so the content must match
+	if etag := resp.Header.Get("ETag"); etag != "" && strings.Trim(etag, `"`) != strings.Trim(obj.ETag, `"`) {
+		return fmt.Errorf("object %s changed during sync", obj.Key)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(target), ".s3-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	n, err := io.Copy(f, io.LimitReader(resp.Body, obj.Size+1))
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to download %s: %w", obj.Key, err)
+	}
+	if n > obj.Size {
+		_ = f.Close()
+		return fmt.Errorf("object %s is larger than the listed %d bytes", obj.Key, obj.Size)
+	}
+	if err := limit.add(n); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), target)
+}
+
+// signS3Request adds an AWS Signature Version 4 to a GET request without
+// body. The request's path and query must already be canonical.
+func signS3Request(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + emptyPayloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, as
+// required for signing. Slashes are kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name, as required for
+// signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Files maps the listed objects to file paths below the prefix. Folder
+// markers (keys ending in /) are skipped.
+func s3Files(prefix string, objects []s3Object) map[string]s3Object {
+	files := make(map[string]s3Object, len(objects))
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		path := strings.TrimLeft(strings.TrimPrefix(obj.Key, prefix), "/")
+		if path != "" {
+			files[path] = obj
+		}
+	}
+	return files
+}
+
+// checkBucketSize applies the limit for unpacked content to the listed
+// files, so a bucket can't fill the sites volume
+func (s *Syncer) checkBucketSize(files map[string]s3Object) error {
+	limit := s.newExtractLimit()
+	for _, obj := range files {
+		if err := limit.entry(); err != nil {
+			return err
+		}
+		if err := limit.add(obj.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// s3ReleaseName derives a release name from the listed files and their
+// ETags, so an unchanged bucket maps to the published release
+func s3ReleaseName(files map[string]s3Object) string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	hash := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hash, "%s\x00%s\n", path, strings.Trim(files[path].ETag, `"`))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// updateMirror brings the site's mirror in line with the listed files. Only
+// objects with a new ETag are downloaded; files no longer listed are
+// removed. Returns the directory holding the files.
+func (s *Syncer) updateMirror(ctx context.Context, site *staticSiteData, client *s3Client, files map[string]s3Object) (string, error) {
+	limit := s.newExtractLimit()
+	logger := log.FromContext(ctx)
+
+	mirrorDir := s.mirrorDir(site.dirName())
+	contentDir := filepath.Join(mirrorDir, s3ContentDir)
+	stateFile := filepath.Join(mirrorDir, s3ObjectsFile)
+
+	var state s3Mirror
+	if data, err := os.ReadFile(stateFile); err == nil {
+		_ = json.Unmarshal(data, &state)
+	}
+	if state.Endpoint != site.S3.Endpoint || state.Bucket != site.S3.Bucket || state.Prefix != site.S3.Prefix || state.Objects == nil {
+		// A mirror of another bucket or prefix is of no use
+		if err := os.RemoveAll(mirrorDir); err != nil {
+			return "", fmt.Errorf("failed to remove mirror: %w", err)
+		}
+		state = s3Mirror{Endpoint: site.S3.Endpoint, Bucket: site.S3.Bucket, Prefix: site.S3.Prefix, Objects: map[string]string{}}
+	}
+	if err := os.MkdirAll(contentDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create mirror: %w", err)
+	}
+
+	if err := removeUnlisted(contentDir, files, state.Objects); err != nil {
+		return "", fmt.Errorf("failed to remove deleted objects: %w", err)
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	downloaded := 0
+	var syncErr error
+	for _, path := range paths {
+		obj := files[path]
+		target, err := localPath(contentDir, path)
+		if err != nil {
+			syncErr = fmt.Errorf("object %s: %w", obj.Key, err)
+			break
+		}
+		if info, err := os.Lstat(target); err == nil && info.Mode().IsRegular() && state.Objects[path] == obj.ETag {
+			continue
+		}
+		if err := ensureParentDirs(contentDir, target); err != nil {
+			syncErr = err
+			break
+		}
+		delete(state.Objects, path)
+		if err := client.getObject(ctx, obj, target, limit); err != nil {
+			syncErr = err
+			break
+		}
+		state.Objects[path] = obj.ETag
+		downloaded++
+	}
+
+	// Progress is kept, so a failed sync resumes where it stopped
+	if err := writeJSONFile(stateFile, state); err != nil && syncErr == nil {
+		syncErr = fmt.Errorf("failed to record mirrored objects: %w", err)
+	}
+	if syncErr != nil {
+		return "", syncErr
+	}
+	logger.Info("Mirrored bucket", "site", site.Name, "bucket", site.S3.Bucket, "objects", len(files), "downloaded", downloaded)
+	return contentDir, nil
+}
+
+// removeUnlisted removes files of the mirror that are not listed anymore,
+// and the directories left empty
+func removeUnlisted(contentDir string, files map[string]s3Object, mirrored map[string]string) error {
+	var dirs []string
+	err := filepath.WalkDir(contentDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == contentDir {
+			return nil
+		}
+		rel, err := filepath.Rel(contentDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+		if _, ok := files[rel]; !ok || !d.Type().IsRegular() {
+			delete(mirrored, rel)
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Deepest first; directories that still hold files stay
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+	return nil
+}
+
+// syncS3 publishes the objects below the site's bucket prefix. The objects
+// are mirrored into .mirrors, downloading only changed ones; releases are
+// named after the listed keys and ETags.
+func (s *Syncer) syncS3(ctx context.Context, site *staticSiteData) error {
+	client, err := s.s3Client(ctx, site)
+	if err != nil {
+		return err
+	}
+
+	release, err := s.acquireHost(ctx, strings.ToLower(client.endpoint.Hostname()))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// A Git checkout of a site that moved to S3 is no longer needed
+	if err := os.RemoveAll(s.repoDir(site.dirName())); err != nil {
+		return fmt.Errorf("failed to remove Git checkout: %w", err)
+	}
+
+	objects, err := client.listObjects(ctx, site.S3.Prefix)
+	if err != nil {
+		return err
+	}
+	files := s3Files(site.S3.Prefix, objects)
+	if len(files) == 0 {
+		return fmt.Errorf("no objects found in bucket %s below prefix %q", site.S3.Bucket, site.S3.Prefix)
+	}
+	if err := s.checkBucketSize(files); err != nil {
+		return fmt.Errorf("bucket %s below prefix %q: %w", site.S3.Bucket, site.S3.Prefix, err)
+	}
+
+	content := func() (string, error) {
+		mirror, err := s.updateMirror(ctx, site, client, files)
+		if err != nil {
+			return "", err
+		}
+		contentDir, err := resolveSubpath(mirror, site.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to setup subpath: %w", err)
+		}
+		return contentDir, nil
+	}
+	return s.publishSite(ctx, site, s3ReleaseName(files), "Synced successfully", content)
+}
@@ -0,0 +1,450 @@
+// Package syncer - per-site sync scheduling
+package syncer
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// MinSyncInterval is the lower bound for spec.syncInterval, so a single
+	// site cannot make the syncer hammer its Git host
+	MinSyncInterval = 10 * time.Second
+
+	// siteRescanInterval is the maximum time until new, changed and deleted
+	// sites are noticed by the sync loop
+	siteRescanInterval = time.Minute
+
+	// hostRetryDelay is how long due sites wait when their Git host is at
+	// its limit of parallel syncs
+	hostRetryDelay = time.Second
+)
+
+// scheduledSite is a site in the sync schedule
+type scheduledSite struct {
+	key      string
+	site     *staticSiteData
+	interval time.Duration
+	due      time.Time
+	lastSync time.Time
+
+	// resync requests another sync right after the running one
+	resync bool
+
+	// index in the heap, maintained by siteQueue
+	index int
+}
+
+// siteQueue is a priority queue of sites ordered by their next due time
+type siteQueue []*scheduledSite
+
+func (q siteQueue) Len() int           { return len(q) }
+func (q siteQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q siteQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *siteQueue) Push(x any) {
+	entry := x.(*scheduledSite)
+	entry.index = len(*q)
+	*q = append(*q, entry)
+}
+
+func (q *siteQueue) Pop() any {
+	old := *q
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*q = old[:n-1]
+	return entry
+}
+
+// schedule keeps track of when each site is due for its next sync
+type schedule struct {
+	queue   siteQueue
+	entries map[string]*scheduledSite
+}
+
+func newSchedule() *schedule {
+	return &schedule{entries: make(map[string]*scheduledSite)}
+}
+
+// siteKey identifies a site across namespaces
+func siteKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// update replaces the set of scheduled sites. New sites are due immediately,
+// known sites keep their schedule with the (possibly changed) interval
+// applied, and sites that no longer exist are dropped.
+func (sc *schedule) update(sites []*staticSiteData, intervalOf func(*staticSiteData) time.Duration, now time.Time) {
+	seen := make(map[string]bool, len(sites))
+	for _, site := range sites {
+		seen[siteKey(site.Namespace, site.Name)] = true
+		sc.upsert(site, intervalOf(site), now, false)
+	}
+
+	for key := range sc.entries {
+		if !seen[key] {
+			sc.remove(key)
+		}
+	}
+}
+
+// upsert adds a site or updates a known one. New sites are due immediately,
+// known sites only if syncNow is set; otherwise they keep their schedule
+// with the (possibly changed) interval applied.
+func (sc *schedule) upsert(site *staticSiteData, interval time.Duration, now time.Time, syncNow bool) {
+	key := siteKey(site.Namespace, site.Name)
+
+	entry, ok := sc.entries[key]
+	if !ok {
+		entry = &scheduledSite{key: key, site: site, interval: interval, due: now}
+		sc.entries[key] = entry
+		heap.Push(&sc.queue, entry)
+		return
+	}
+
+	entry.site = site
+	due := entry.due
+	if interval != entry.interval {
+		entry.interval = interval
+		if !entry.lastSync.IsZero() {
+			due = entry.lastSync.Add(interval)
+		}
+	}
+	if syncNow && due.After(now) {
+		due = now
+	}
+
+	// Sites being synced right now are rescheduled in done. A sync
+	// requested meanwhile must not get lost, so it is remembered.
+	if entry.index < 0 {
+		entry.resync = entry.resync || syncNow
+		return
+	}
+	if !due.Equal(entry.due) {
+		entry.due = due
+		heap.Fix(&sc.queue, entry.index)
+	}
+}
+
+// remove drops a site from the schedule
+func (sc *schedule) remove(key string) {
+	entry, ok := sc.entries[key]
+	if !ok {
+		return
+	}
+	if entry.index >= 0 {
+		heap.Remove(&sc.queue, entry.index)
+	}
+	delete(sc.entries, key)
+}
+
+// popDue removes and returns the next site due at now, or nil if none is due.
+// The site must be handed back with done after syncing.
+func (sc *schedule) popDue(now time.Time) *scheduledSite {
+	if len(sc.queue) == 0 || sc.queue[0].due.After(now) {
+		return nil
+	}
+	return heap.Pop(&sc.queue).(*scheduledSite)
+}
+
+// done reschedules a site popped by popDue one interval after its sync.
+// Sites removed by update in the meantime are not rescheduled.
+func (sc *schedule) done(entry *scheduledSite, now time.Time) {
+	if sc.entries[entry.key] != entry {
+		return
+	}
+	entry.lastSync = now
+	entry.due = now.Add(entry.interval)
+	if entry.resync {
+		// The spec changed during the sync, the synced version may be outdated
+		entry.due = now
+		entry.resync = false
+	}
+	heap.Push(&sc.queue, entry)
+}
+
+// wake makes a queued site due at t if that is before its next sync, e.g.
+// when a held release goes live. Sites being synced and a zero t are
+// ignored.
+func (sc *schedule) wake(key string, t time.Time) {
+	entry, ok := sc.entries[key]
+	if !ok || entry.index < 0 || t.IsZero() || !t.Before(entry.due) {
+		return
+	}
+	entry.due = t
+	heap.Fix(&sc.queue, entry.index)
+}
+
+// requeue puts a site popped by popDue back without changing its due time
+func (sc *schedule) requeue(entry *scheduledSite) {
+	if sc.entries[entry.key] != entry {
+		return
+	}
+	heap.Push(&sc.queue, entry)
+}
+
+// nextDue returns the due time of the next site, and false if nothing is scheduled
+func (sc *schedule) nextDue() (time.Time, bool) {
+	if len(sc.queue) == 0 {
+		return time.Time{}, false
+	}
+	return sc.queue[0].due, true
+}
+
+// syncInterval returns how often a site is synced: spec.syncInterval if set
+// and valid, DefaultInterval otherwise, but never more often than MinSyncInterval
+func (s *Syncer) syncInterval(site *staticSiteData) time.Duration {
+	interval := s.DefaultInterval
+	if site.SyncInterval != "" {
+		parsed, err := time.ParseDuration(site.SyncInterval)
+		if err == nil && parsed > 0 {
+			interval = parsed
+		}
+	}
+	if interval < MinSyncInterval {
+		interval = MinSyncInterval
+	}
+	return interval
+}
+
+// siteObjects returns all StaticSites, from the informer cache if available
+func (s *Syncer) siteObjects(ctx context.Context) ([]*unstructured.Unstructured, error) {
+	if s.Informer != nil {
+		objs := s.Informer.GetStore().List()
+		items := make([]*unstructured.Unstructured, 0, len(objs))
+		for _, obj := range objs {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				items = append(items, u)
+			}
+		}
+		return items, nil
+	}
+
+	list, err := s.DynamicClient.Resource(staticSiteGVR).Namespace("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list StaticSites: %w", err)
+	}
+	items := make([]*unstructured.Unstructured, len(list.Items))
+	for i := range list.Items {
+		items[i] = &list.Items[i]
+	}
+	return items, nil
+}
+
+// getSiteObject returns a single StaticSite, from the informer cache if
+// available. Sites created moments ago may not be cached yet, those are
+// read from the API server.
+func (s *Syncer) getSiteObject(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error) {
+	if s.Informer != nil {
+		obj, exists, err := s.Informer.GetIndexer().GetByKey(namespace + "/" + name)
+		if err == nil && exists {
+			if u, ok := obj.(*unstructured.Unstructured); ok {
+				return u, nil
+			}
+		}
+	}
+	return s.DynamicClient.Resource(staticSiteGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// listSites loads and parses all StaticSites. Sites that fail to parse are
+// logged and skipped.
+func (s *Syncer) listSites(ctx context.Context) ([]*staticSiteData, error) {
+	logger := log.FromContext(ctx)
+
+	items, err := s.siteObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sites := make([]*staticSiteData, 0, len(items))
+	for _, item := range items {
+		site := &staticSiteData{}
+		if err := site.fromUnstructured(item); err != nil {
+			logger.Error(err, "Failed to parse StaticSite", "name", item.GetName())
+			continue
+		}
+		sites = append(sites, site)
+	}
+	return sites, nil
+}
+
+// RunLoop starts the sync loop. Every site is synced on its own interval
+// (spec.syncInterval) by a pool of SyncWorkers workers; the list of sites is
+// refreshed regularly and directories of deleted sites are cleaned up
+// afterwards.
+func (s *Syncer) RunLoop(ctx context.Context) {
+	logger := log.FromContext(ctx)
+
+	sched := newSchedule()
+	rescan := func() error {
+		sites, err := s.listSites(ctx)
+		if err != nil {
+			return err
+		}
+		sched.update(sites, s.syncInterval, time.Now())
+		// Held releases go live on time, not with the next regular sync.
+		// This also catches releases held by webhook triggered syncs.
+		for _, site := range sites {
+			sched.wake(siteKey(site.Namespace, site.Name), s.pendingPublishTime(site))
+		}
+		return nil
+	}
+
+	// Initial sync: all sites are due right away
+	if err := rescan(); err != nil {
+		logger.Error(err, "Initial sync failed")
+	}
+
+	// With an informer, new sites and spec changes are synced right away;
+	// rescans only act as a safety net
+	events := make(chan siteEvent, 64)
+	if s.Informer != nil {
+		registration, err := s.watchSites(ctx, events)
+		if err != nil {
+			logger.Error(err, "Failed to watch StaticSites")
+		} else {
+			defer func() { _ = s.Informer.RemoveEventHandler(registration) }()
+		}
+	}
+
+	rescanInterval := siteRescanInterval
+	if s.DefaultInterval > 0 && s.DefaultInterval < rescanInterval {
+		rescanInterval = s.DefaultInterval
+	}
+	rescanTicker := time.NewTicker(rescanInterval)
+	defer rescanTicker.Stop()
+
+	// Workers sync the sites handed out by the loop below, which owns the
+	// schedule. results is buffered so workers never block on it.
+	workers := s.workers()
+	jobs := make(chan *scheduledSite)
+	results := make(chan *scheduledSite, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				s.syncScheduled(ctx, entry.site)
+				results <- entry
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	inFlight := 0
+	for {
+		// Hand out due sites while workers are free. Sites whose Git host
+		// is at its limit wait, so they don't block a worker.
+		var waiting []*scheduledSite
+		for inFlight < workers && ctx.Err() == nil {
+			entry := sched.popDue(time.Now())
+			if entry == nil {
+				break
+			}
+			if s.hostBusy(entry.site.host()) {
+				waiting = append(waiting, entry)
+				continue
+			}
+			jobs <- entry
+			inFlight++
+		}
+		for _, entry := range waiting {
+			sched.requeue(entry)
+		}
+
+		// Sleep until the next site is due; finished syncs and rescans wake
+		// us up as well
+		wait := rescanInterval
+		if inFlight < workers {
+			if due, ok := sched.nextDue(); ok {
+				wait = time.Until(due)
+			}
+			if len(waiting) > 0 && wait < hostRetryDelay {
+				wait = hostRetryDelay
+			}
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			logger.Info("Syncer stopped")
+			return
+		case entry := <-results:
+			inFlight--
+			now := time.Now()
+			sched.done(entry, now)
+			if publishAt := s.pendingPublishTime(entry.site); publishAt.After(now) {
+				sched.wake(entry.key, publishAt)
+			}
+		case ev := <-events:
+			if ev.deleted {
+				sched.remove(ev.key)
+				// Take the site offline right away
+				if err := s.Cleanup(ctx); err != nil {
+					logger.Error(err, "Cleanup failed")
+				}
+				continue
+			}
+			if ev.specChanged {
+				logger.Info("StaticSite changed, scheduling sync", "name", ev.site.Name, "namespace", ev.site.Namespace)
+			}
+			sched.upsert(ev.site, s.syncInterval(ev.site), time.Now(), ev.specChanged)
+		case <-rescanTicker.C:
+			if err := rescan(); err != nil {
+				logger.Error(err, "Sync failed")
+				continue
+			}
+			// Cleanup after each rescan
+			if err := s.Cleanup(ctx); err != nil {
+				logger.Error(err, "Cleanup failed")
+			}
+		case <-timer.C:
+		}
+	}
+}
+
+// syncScheduled runs a scheduled sync. Sites already being synced (e.g. by
+// a webhook) are skipped, they are rescheduled as if synced. Fetches other
+// sites of the repo made shortly before are used, up to half the site's
+// interval old.
+func (s *Syncer) syncScheduled(ctx context.Context, site *staticSiteData) {
+	logger := log.FromContext(ctx)
+
+	ctx = withFetchedSince(ctx, time.Now().Add(-min(sharedFetchMaxAge, s.syncInterval(site)/2)))
+	synced, err := s.trySyncSite(ctx, site)
+	if !synced {
+		logger.Info("Site is already being synced, skipping", "name", site.Name)
+		return
+	}
+	if err != nil {
+		logger.Error(err, "Failed to sync site", "name", site.Name)
+		s.updateStatus(ctx, site, "Error", err.Error(), "")
+	}
+}
@@ -0,0 +1,236 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSyncInterval(t *testing.T) {
+	s := &Syncer{DefaultInterval: 5 * time.Minute}
+
+	tests := []struct {
+		name     string
+		interval string
+		want     time.Duration
+	}{
+		{name: "not set", interval: "", want: 5 * time.Minute},
+		{name: "seconds", interval: "30s", want: 30 * time.Second},
+		{name: "daily", interval: "24h", want: 24 * time.Hour},
+		{name: "invalid", interval: "daily", want: 5 * time.Minute},
+		{name: "negative", interval: "-1m", want: 5 * time.Minute},
+		{name: "below minimum", interval: "1s", want: MinSyncInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.syncInterval(&staticSiteData{SyncInterval: tt.interval})
+			if got != tt.want {
+				t.Errorf("syncInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fixedIntervals returns an interval function reading spec.syncInterval
+// without defaults or lower bound
+func fixedIntervals(site *staticSiteData) time.Duration {
+	d, _ := time.ParseDuration(site.SyncInterval)
+	return d
+}
+
+func TestSchedule_PerSiteIntervals(t *testing.T) {
+	sched := newSchedule()
+	start := time.Now()
+
+	sched.update([]*staticSiteData{
+		{Namespace: "default", Name: "news", SyncInterval: "30s"},
+		{Namespace: "default", Name: "archive", SyncInterval: "24h"},
+	}, fixedIntervals, start)
+
+	// New sites are due right away
+	first := sched.popDue(start)
+	second := sched.popDue(start)
+	if first == nil || second == nil {
+		t.Fatal("expected both sites to be due initially")
+	}
+	if sched.popDue(start) != nil {
+		t.Error("expected no more due sites")
+	}
+	sched.done(first, start)
+	sched.done(second, start)
+
+	// Only the news site becomes due within the next hour
+	synced := map[string]int{}
+	for now := start; now.Before(start.Add(time.Hour)); now = now.Add(time.Second) {
+		for entry := sched.popDue(now); entry != nil; entry = sched.popDue(now) {
+			synced[entry.site.Name]++
+			sched.done(entry, now)
+		}
+	}
+	if synced["news"] != 119 {
+		t.Errorf("news synced %d times, want 119", synced["news"])
+	}
+	if synced["archive"] != 0 {
+		t.Errorf("archive synced %d times, want 0", synced["archive"])
+	}
+
+	due, ok := sched.nextDue()
+	if !ok {
+		t.Fatal("nextDue() returned nothing")
+	}
+	if want := start.Add(time.Hour); !due.Equal(want) {
+		t.Errorf("nextDue() = %v, want %v", due, want)
+	}
+}
+
+func TestSchedule_UpdateChangesInterval(t *testing.T) {
+	sched := newSchedule()
+	start := time.Now()
+
+	site := &staticSiteData{Namespace: "default", Name: "site", SyncInterval: "1h"}
+	sched.update([]*staticSiteData{site}, fixedIntervals, start)
+	sched.done(sched.popDue(start), start)
+
+	// Shortening the interval pulls the next sync forward
+	changed := &staticSiteData{Namespace: "default", Name: "site", SyncInterval: "1m"}
+	sched.update([]*staticSiteData{changed}, fixedIntervals, start.Add(10*time.Second))
+
+	if entry := sched.popDue(start.Add(59 * time.Second)); entry != nil {
+		t.Error("site due before its new interval")
+	}
+	entry := sched.popDue(start.Add(time.Minute))
+	if entry == nil {
+		t.Fatal("site not due after its new interval")
+	}
+	if entry.site != changed {
+		t.Error("schedule did not pick up the updated site")
+	}
+}
+
+func TestSchedule_UpdateRemovesSites(t *testing.T) {
+	sched := newSchedule()
+	now := time.Now()
+
+	sched.update([]*staticSiteData{
+		{Namespace: "a", Name: "site"},
+		{Namespace: "b", Name: "site"},
+	}, fixedIntervals, now)
+
+	// Same name in another namespace is a different site
+	if len(sched.entries) != 2 {
+		t.Fatalf("scheduled %d sites, want 2", len(sched.entries))
+	}
+
+	popped := sched.popDue(now)
+	sched.update(nil, fixedIntervals, now)
+	if len(sched.queue) != 0 || len(sched.entries) != 0 {
+		t.Errorf("sites not removed: queue=%d entries=%d", len(sched.queue), len(sched.entries))
+	}
+
+	// A site deleted while it was syncing is not rescheduled
+	sched.done(popped, now)
+	if _, ok := sched.nextDue(); ok {
+		t.Error("deleted site was rescheduled")
+	}
+}
+
+func TestRunLoop_SyncsEachSiteOnItsInterval(t *testing.T) {
+	fakeClient := &fakeDynamicClientWithSites{
+		sites: []siteSpec{
+			// Repos on a host that is not allowed fail fast and report an error status
+			{name: "news", namespace: "default", repo: "https://blocked.example.org/news.git", interval: "30s"},
+			{name: "archive", namespace: "default", repo: "https://blocked.example.org/archive.git", interval: "24h"},
+		},
+	}
+
+	s := &Syncer{
+		SitesRoot:       t.TempDir(),
+		AllowedHosts:    []string{"github.com"},
+		DynamicClient:   fakeClient,
+		ClientSet:       newFakeClientset(),
+		DefaultInterval: 20 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.RunLoop(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunLoop did not exit after context cancellation")
+	}
+
+	// Both sites are synced once on startup; the site list is refreshed
+	// several times, but no site is due again yet
+	synced := map[string]int{}
+	for _, name := range fakeClient.patched {
+		synced[name]++
+	}
+	if synced["news"] != 1 || synced["archive"] != 1 {
+		t.Errorf("synced = %v, want each site exactly once", synced)
+	}
+}
+
+func TestSchedule_UpsertSyncNow(t *testing.T) {
+	sched := newSchedule()
+	start := time.Now()
+
+	site := &staticSiteData{Namespace: "default", Name: "site"}
+	sched.upsert(site, time.Hour, start, false)
+	sched.done(sched.popDue(start), start)
+
+	// Without syncNow a known site keeps its schedule
+	sched.upsert(site, time.Hour, start.Add(time.Second), false)
+	if entry := sched.popDue(start.Add(time.Second)); entry != nil {
+		t.Fatal("site due again without syncNow")
+	}
+
+	// A spec change makes it due right away
+	sched.upsert(site, time.Hour, start.Add(2*time.Second), true)
+	entry := sched.popDue(start.Add(2 * time.Second))
+	if entry == nil {
+		t.Fatal("site not due after syncNow")
+	}
+
+	// A spec change during the sync triggers another one afterwards
+	sched.upsert(site, time.Hour, start.Add(3*time.Second), true)
+	sched.done(entry, start.Add(4*time.Second))
+	if sched.popDue(start.Add(4*time.Second)) == nil {
+		t.Error("spec change during sync got lost")
+	}
+}
+
+func TestSchedule_Wake(t *testing.T) {
+	sched := newSchedule()
+	start := time.Now()
+
+	site := &staticSiteData{Namespace: "default", Name: "site"}
+	sched.upsert(site, time.Hour, start, false)
+	entry := sched.popDue(start)
+
+	// Sites being synced are left alone
+	sched.wake(entry.key, start.Add(time.Minute))
+	sched.done(entry, start)
+	if due, _ := sched.nextDue(); !due.Equal(start.Add(time.Hour)) {
+		t.Fatalf("due = %s, want one interval after the sync", due)
+	}
+
+	// A held release going live before the next sync makes the site due
+	sched.wake(entry.key, start.Add(10*time.Minute))
+	if due, _ := sched.nextDue(); !due.Equal(start.Add(10 * time.Minute)) {
+		t.Errorf("due after wake = %s, want the publish time", due)
+	}
+
+	// A later one doesn't postpone the sync
+	sched.wake(entry.key, start.Add(2*time.Hour))
+	if due, _ := sched.nextDue(); !due.Equal(start.Add(10 * time.Minute)) {
+		t.Errorf("due after later wake = %s", due)
+	}
+}
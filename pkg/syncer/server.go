@@ -8,6 +8,7 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -56,8 +57,34 @@ func (w *WebhookServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			http.Error(rw, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if overrideRequested(r) {
+			ctx = withFreezeOverride(ctx)
+		}
 		w.handleSync(ctx, rw, r, namespace, name)
 
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "rollback":
+		// POST /rollback/{namespace}/{name}[?commit=<sha>] - requires X-API-Key
+		namespace := parts[1]
+		name := parts[2]
+		if !w.validateSiteToken(ctx, r, namespace, name) {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.handleRollback(ctx, rw, r, namespace, name)
+
+	case r.Method == "PUT" && len(parts) == 3 && parts[0] == "deploy":
+		// PUT /deploy/{namespace}/{name}[?revision=<label>] - requires X-API-Key
+		namespace := parts[1]
+		name := parts[2]
+		if !w.validateSiteToken(ctx, r, namespace, name) {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if overrideRequested(r) {
+			ctx = withFreezeOverride(ctx)
+		}
+		w.handleDeploy(ctx, rw, r, namespace, name)
+
 	case r.Method == "POST" && path == "webhook/forgejo":
 		// Forgejo/Gitea Webhook
 		w.handleForgejoWebhook(ctx, rw, r)
@@ -96,12 +123,73 @@ func (w *WebhookServer) handleSync(ctx context.Context, rw http.ResponseWriter,
 	_, _ = fmt.Fprintf(rw, "Synced %s/%s", namespace, name)
 }
 
+// handleRollback points a site at an earlier release.
+// Without the commit query parameter, the previous release is used.
+func (w *WebhookServer) handleRollback(ctx context.Context, rw http.ResponseWriter, r *http.Request, namespace, name string) {
+	logger := log.FromContext(ctx)
+	commit := r.URL.Query().Get("commit")
+	logger.Info("Rollback triggered", "namespace", namespace, "name", name, "commit", commit)
+
+	release, err := w.Syncer.Rollback(ctx, namespace, name, commit)
+	if err != nil {
+		logger.Error(err, "Rollback failed", "namespace", namespace, "name", name)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errReleaseNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errAmbiguousRelease):
+			status = http.StatusBadRequest
+		case errors.Is(err, errOutdatedRelease):
+			status = http.StatusConflict
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(rw, "Rolled back %s/%s to %s", namespace, name, shortHash(release))
+}
+
+// handleDeploy publishes an uploaded .tar.gz as the content of a site
+func (w *WebhookServer) handleDeploy(ctx context.Context, rw http.ResponseWriter, r *http.Request, namespace, name string) {
+	logger := log.FromContext(ctx)
+	revision := r.URL.Query().Get("revision")
+	logger.Info("Deploy triggered", "namespace", namespace, "name", name, "revision", revision)
+
+	body := r.Body
+	if w.Syncer.MaxUploadSize > 0 {
+		body = http.MaxBytesReader(rw, r.Body, w.Syncer.MaxUploadSize)
+	}
+
+	revision, err := w.Syncer.Deploy(ctx, namespace, name, revision, body)
+	if err != nil {
+		logger.Error(err, "Deploy failed", "namespace", namespace, "name", name)
+		var tooLarge *http.MaxBytesError
+		status := http.StatusInternalServerError
+		switch {
+		case errors.As(err, &tooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errNotUploadSite):
+			status = http.StatusConflict
+		case errors.Is(err, errInvalidUpload):
+			status = http.StatusBadRequest
+		case errors.Is(err, errFrozen):
+			status = http.StatusLocked
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(rw, "Deployed %s/%s at %s", namespace, name, revision)
+}
+
 // handleDelete deletes the files of a site
 func (w *WebhookServer) handleDelete(ctx context.Context, rw http.ResponseWriter, namespace, name string) {
 	logger := log.FromContext(ctx)
 	logger.Info("Delete triggered", "namespace", namespace, "name", name)
 
-	if err := w.Syncer.DeleteSite(ctx, name); err != nil {
+	if err := w.Syncer.DeleteSite(ctx, namespace, name); err != nil {
 		logger.Error(err, "Delete failed", "namespace", namespace, "name", name)
 		http.Error(rw, err.Error(), http.StatusInternalServerError)
 		return
@@ -163,9 +251,19 @@ type WebhookPayload struct {
 	Repository struct {
 		FullName string `json:"full_name"`
 		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
 	} `json:"repository"`
 }
 
+// repoURLs returns the URLs a site may use for the pushed repository
+func (p *WebhookPayload) repoURLs() []string {
+	urls := []string{p.Repository.CloneURL}
+	if p.Repository.SSHURL != "" {
+		urls = append(urls, p.Repository.SSHURL)
+	}
+	return urls
+}
+
 // handleForgejoWebhook processes Forgejo/Gitea webhooks
 func (w *WebhookServer) handleForgejoWebhook(ctx context.Context, rw http.ResponseWriter, r *http.Request) {
 	logger := log.FromContext(ctx)
@@ -189,6 +287,10 @@ func (w *WebhookServer) handleForgejoWebhook(ctx context.Context, rw http.Respon
 			return
 		}
 	}
+	// Only signed webhooks may publish during a freeze
+	if w.WebhookSecret != "" && overrideRequested(r) {
+		ctx = withFreezeOverride(ctx)
+	}
 
 	var payload WebhookPayload
 	if err := json.Unmarshal(body, &payload); err != nil {
@@ -201,16 +303,18 @@ func (w *WebhookServer) handleForgejoWebhook(ctx context.Context, rw http.Respon
 		"ref", payload.Ref,
 	)
 
-	// Extract branch from ref (refs/heads/main -> main)
+	// Extract branch from ref (refs/heads/main -> main), tag refs stay as they are
 	branch := strings.TrimPrefix(payload.Ref, "refs/heads/")
 
 	// Find and sync all sites with this repo URL
 	// This is somewhat inefficient but simple
 	// Alternative: Annotation on the site with webhook ID
-	if err := w.syncByRepo(ctx, payload.Repository.CloneURL, branch); err != nil {
-		logger.Error(err, "Webhook sync failed")
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+	for _, repoURL := range payload.repoURLs() {
+		if err := w.syncByRepo(ctx, repoURL, branch); err != nil {
+			logger.Error(err, "Webhook sync failed")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	rw.WriteHeader(http.StatusOK)
@@ -245,6 +349,10 @@ func (w *WebhookServer) handleGitHubWebhook(ctx context.Context, rw http.Respons
 			return
 		}
 	}
+	// Only signed webhooks may publish during a freeze
+	if w.WebhookSecret != "" && overrideRequested(r) {
+		ctx = withFreezeOverride(ctx)
+	}
 
 	var payload WebhookPayload
 	if err := json.Unmarshal(body, &payload); err != nil {
@@ -259,35 +367,47 @@ func (w *WebhookServer) handleGitHubWebhook(ctx context.Context, rw http.Respons
 
 	branch := strings.TrimPrefix(payload.Ref, "refs/heads/")
 
-	if err := w.syncByRepo(ctx, payload.Repository.CloneURL, branch); err != nil {
-		logger.Error(err, "Webhook sync failed")
-		http.Error(rw, err.Error(), http.StatusInternalServerError)
-		return
+	for _, repoURL := range payload.repoURLs() {
+		if err := w.syncByRepo(ctx, repoURL, branch); err != nil {
+			logger.Error(err, "Webhook sync failed")
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	rw.WriteHeader(http.StatusOK)
 	_, _ = fmt.Fprint(rw, "ok")
 }
 
-// syncByRepo finds all sites with a repo URL and syncs them
+// syncByRepo finds all sites with a repo URL and syncs them.
+// branch is the pushed branch name, or the full ref (refs/tags/...) for tag pushes.
 func (w *WebhookServer) syncByRepo(ctx context.Context, repoURL, branch string) error {
 	logger := log.FromContext(ctx)
+	isTagPush := strings.HasPrefix(branch, "refs/tags/")
+
+	// Sites of the repo share fetches made after the push was reported
+	ctx = withFetchedSince(ctx, time.Now())
 
-	// Load all StaticSites
-	list, err := w.Syncer.DynamicClient.Resource(staticSiteGVR).Namespace("").List(ctx, metav1.ListOptions{})
+	// Load the StaticSites using this repo
+	items, err := w.Syncer.sitesByRepo(ctx, repoURL)
 	if err != nil {
 		return err
 	}
 
 	synced := 0
-	for _, item := range list.Items {
+	for _, item := range items {
 		site := &staticSiteData{}
-		if err := site.fromUnstructured(&item); err != nil {
+		if err := site.fromUnstructured(item); err != nil {
 			continue
 		}
 
-		// Check if repo and branch match
-		if site.Repo == repoURL && site.Branch == branch {
+		// Check if repo and branch match. Sites pinned to a tag or revision
+		// don't follow branch pushes; sites tracking tags follow tag pushes.
+		matches := site.Branch == branch && site.followsBranch()
+		if isTagPush {
+			matches = site.tracksTags()
+		}
+		if site.Repo == repoURL && matches {
 			logger.Info("Syncing site from webhook", "name", site.Name)
 			if err := w.Syncer.syncSite(ctx, site); err != nil {
 				logger.Error(err, "Failed to sync", "name", site.Name)
@@ -13,6 +13,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestValidateWebhookSignature(t *testing.T) {
@@ -549,6 +551,39 @@ func TestHandleGitHubWebhook_ValidPush(t *testing.T) {
 	}
 }
 
+func TestHandleGitHubWebhook_SSHSite(t *testing.T) {
+	fakeClient := &fakeDynamicClientWithSites{
+		sites: []siteSpec{
+			{name: "mysite", namespace: "default", repo: "git@github.com:user/repo.git", branch: "main", secret: "deploy-key"},
+		},
+	}
+	clientSet := fake.NewClientset()
+
+	w := &WebhookServer{
+		Syncer: &Syncer{
+			SitesRoot:     t.TempDir(),
+			AllowedHosts:  []string{"github.com"},
+			DynamicClient: fakeClient,
+			ClientSet:     clientSet,
+		},
+	}
+
+	payload := `{"ref": "refs/heads/main", "repository": {"full_name": "user/repo", "clone_url": "https://github.com/user/repo.git", "ssh_url": "git@github.com:user/repo.git"}}`
+	req := httptest.NewRequest("POST", "/webhook/github", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", "push")
+	rr := httptest.NewRecorder()
+
+	w.handleGitHubWebhook(req.Context(), rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	// The site is found by the SSH URL and its deploy key is looked up
+	if len(clientSet.Actions()) == 0 {
+		t.Error("site using the SSH URL was not synced")
+	}
+}
+
 func TestHandleGitHubWebhook_InvalidSignature(t *testing.T) {
 	w := &WebhookServer{
 		WebhookSecret: "mysecret",
@@ -622,6 +657,77 @@ func TestSyncByRepo_NoMatchingSites(t *testing.T) {
 	}
 }
 
+func TestSyncByRepo_SkipsPinnedSites(t *testing.T) {
+	repoURL, remoteRepo, commit := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+	if _, err := remoteRepo.CreateTag("v1.0.0", commit, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	fakeClient := &fakeDynamicClientWithSites{
+		sites: []siteSpec{
+			{name: "tracking", namespace: "default", repo: repoURL, branch: "master"},
+			{name: "pinned", namespace: "default", repo: repoURL, branch: "master", tag: "v1.0.0"},
+		},
+	}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+	}
+
+	w := &WebhookServer{Syncer: s}
+	if err := w.syncByRepo(context.Background(), repoURL, "master"); err != nil {
+		t.Fatalf("syncByRepo() error = %v", err)
+	}
+
+	if s.currentRelease("default--tracking") != commit.String() {
+		t.Errorf("tracking site was not synced")
+	}
+	if s.currentRelease("default--pinned") != "" {
+		t.Errorf("pinned site was synced by a branch push")
+	}
+}
+
+func TestSyncByRepo_TagPush(t *testing.T) {
+	repoURL, remoteRepo, commit := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+	if _, err := remoteRepo.CreateTag("v1.0.0", commit, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	fakeClient := &fakeDynamicClientWithSites{
+		sites: []siteSpec{
+			{name: "tracking", namespace: "default", repo: repoURL, branch: "master"},
+			{name: "released", namespace: "default", repo: repoURL, semver: "^1"},
+		},
+	}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+	}
+
+	w := &WebhookServer{Syncer: s}
+	ctx := context.Background()
+
+	// A branch push doesn't deploy sites tracking tags
+	if err := w.syncByRepo(ctx, repoURL, "master"); err != nil {
+		t.Fatalf("syncByRepo() error = %v", err)
+	}
+	if s.currentRelease("default--released") != "" {
+		t.Errorf("site tracking tags was synced by a branch push")
+	}
+
+	// A tag push deploys them, and only them
+	if err := w.syncByRepo(ctx, repoURL, "refs/tags/v1.0.0"); err != nil {
+		t.Fatalf("syncByRepo() error = %v", err)
+	}
+	if s.currentRelease("default--released") != commit.String() {
+		t.Errorf("site tracking tags was not synced by a tag push")
+	}
+}
+
 func TestHandleGitHubWebhook_InvalidPayload(t *testing.T) {
 	w := &WebhookServer{
 		Syncer: &Syncer{},
@@ -764,7 +870,7 @@ func TestHandleDelete_Error(t *testing.T) {
 	// Create a read-only directory that will cause deletion to fail
 	tmpDir := t.TempDir()
 	sitesDir := filepath.Join(tmpDir, "sites")
-	siteDir := filepath.Join(sitesDir, "mysite")
+	siteDir := filepath.Join(sitesDir, "default--mysite")
 
 	if err := os.MkdirAll(siteDir, 0o755); err != nil {
 		t.Fatalf("failed to create site dir: %v", err)
@@ -884,3 +990,62 @@ func TestHandleGitHubWebhook_BranchMismatch(t *testing.T) {
 		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
 	}
 }
+
+func TestRollbackEndpointRequiresAuth(t *testing.T) {
+	w := &WebhookServer{
+		Syncer: &Syncer{
+			DynamicClient: &fakeDynamicClientWithToken{token: "secret-token"},
+		},
+	}
+
+	req := httptest.NewRequest("POST", "/rollback/default/mysite", nil)
+	req.Header.Set("X-API-Key", "wrong-token")
+	rr := httptest.NewRecorder()
+
+	w.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRollbackEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "previous release", query: "", wantStatus: http.StatusOK, wantBody: "Rolled back default/mysite to aaaa1111"},
+		{name: "specific commit", query: "?commit=aaaa", wantStatus: http.StatusOK, wantBody: "to aaaa1111"},
+		{name: "unknown commit", query: "?commit=ffff", wantStatus: http.StatusNotFound, wantBody: "release not found"},
+		{name: "ambiguous commit", query: "?commit=bbbb", wantStatus: http.StatusBadRequest, wantBody: "commit is ambiguous"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Syncer{
+				SitesRoot:     t.TempDir(),
+				DynamicClient: &fakeDynamicClientWithToken{token: "secret-token"},
+			}
+			makeTestRelease(t, s, "default--mysite", "bbbb3333", 3*time.Hour)
+			makeTestRelease(t, s, "default--mysite", "aaaa1111", 2*time.Hour)
+			makeTestRelease(t, s, "default--mysite", "bbbb2222", 1*time.Hour)
+			_ = s.activateRelease("default--mysite", filepath.Join(s.releasesDir("default--mysite"), "bbbb2222"))
+
+			w := &WebhookServer{Syncer: s}
+			req := httptest.NewRequest("POST", "/rollback/default/mysite"+tt.query, nil)
+			req.Header.Set("X-API-Key", "secret-token")
+			rr := httptest.NewRecorder()
+
+			w.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body: %s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want to contain %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Package syncer - source records of checkouts and releases
+package syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+const (
+	// checkoutSourceFile records what a checkout was cloned from, inside .git
+	checkoutSourceFile = "pages-source.json"
+
+	// releaseLayoutFile records the layout the releases of a site are built
+	// with, inside the site's releases directory
+	releaseLayoutFile = ".layout.json"
+)
+
+// checkoutSource is what a checkout in .repos was cloned from
+type checkoutSource struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// releaseLayout is the part of a site's spec that determines what of a
+// commit ends up in its release
+type releaseLayout struct {
+	Path       string `json:"path"`
+	Submodules bool   `json:"submodules,omitempty"`
+	Build      string `json:"build,omitempty"`
+}
+
+// layoutRecord is the content of the layout file: the layout and when the
+// first release built with it was staged. Releases staged before were
+// built with another layout.
+type layoutRecord struct {
+	releaseLayout
+	Since time.Time `json:"since,omitempty"`
+}
+
+// siteLayout returns the release layout of a site
+func siteLayout(site *staticSiteData) releaseLayout {
+	subpath := strings.Trim(path.Clean("/"+site.Path), "/")
+	layout := releaseLayout{Path: "/" + subpath, Submodules: site.Submodules}
+	if site.Build != nil {
+		layout.Build = site.Build.key()
+	}
+	return layout
+}
+
+// checkoutChange returns why the checkout in repoDir can't be reused for
+// the site, or "" if it can. A checkout of another repo would keep fetching
+// from its old origin, one of another branch keeps the old branch's objects.
+//
+// Checkouts from before source records were kept are compared by the URL
+// of their origin remote.
+func checkoutChange(repoDir string, site *staticSiteData) string {
+	var recorded checkoutSource
+	data, err := os.ReadFile(filepath.Join(repoDir, ".git", checkoutSourceFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return "unreadable source record"
+		}
+	case os.IsNotExist(err):
+		recorded.Repo = legacyOriginURL(repoDir)
+	default:
+		return ""
+	}
+
+	switch {
+	case recorded.Repo != "" && recorded.Repo != site.Repo:
+		return fmt.Sprintf("repo changed from %s", recorded.Repo)
+	case recorded.Branch != "" && recorded.Branch != site.Branch && site.followsBranch():
+		return fmt.Sprintf("branch changed from %s", recorded.Branch)
+	}
+	return ""
+}
+
+// legacyOriginURL returns the origin URL of a checkout without source
+// record, or "" if it isn't a remote URL the syncer could have cloned from
+func legacyOriginURL(repoDir string) string {
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return ""
+	}
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err != nil || len(remote.Config().URLs) != 1 {
+		return ""
+	}
+	origin := remote.Config().URLs[0]
+	if parsed, err := parseRemoteURL(origin); err != nil || parsed.Host == "" {
+		return ""
+	}
+	return origin
+}
+
+// recordCheckoutSource notes what the checkout in repoDir was synced from
+func recordCheckoutSource(repoDir string, site *staticSiteData) error {
+	return writeJSONFile(filepath.Join(repoDir, ".git", checkoutSourceFile), checkoutSource{Repo: site.Repo, Branch: site.Branch})
+}
+
+// layoutChanged reports whether the releases of a site were built with
+// another path, submodule or build setting. Sites without a record are
+// assumed to be up to date.
+func (s *Syncer) layoutChanged(siteDir string, site *staticSiteData) bool {
+	recorded, err := s.readLayout(siteDir)
+	if os.IsNotExist(err) {
+		return false
+	}
+	return err != nil || recorded.releaseLayout != siteLayout(site)
+}
+
+// readLayout returns the layout record of a site's releases
+func (s *Syncer) readLayout(siteDir string) (*layoutRecord, error) {
+	data, err := os.ReadFile(filepath.Join(s.releasesDir(siteDir), releaseLayoutFile))
+	if err != nil {
+		return nil, err
+	}
+	var recorded layoutRecord
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, err
+	}
+	return &recorded, nil
+}
+
+// layoutSince returns when the first release with the site's current
+// layout was staged, or the zero time if that's unknown
+func (s *Syncer) layoutSince(siteDir string) time.Time {
+	recorded, err := s.readLayout(siteDir)
+	if err != nil {
+		return time.Time{}
+	}
+	return recorded.Since
+}
+
+// recordReleaseLayout notes the layout the site's releases are built with,
+// release being the latest one. If the layout changed, the releases built
+// with the old one are removed, except the active one.
+func (s *Syncer) recordReleaseLayout(siteDir string, site *staticSiteData, release string) error {
+	record := layoutRecord{releaseLayout: siteLayout(site)}
+	previous, err := s.readLayout(siteDir)
+	switch {
+	case err == nil && previous.releaseLayout == record.releaseLayout:
+		record.Since = previous.Since
+	case err == nil || !os.IsNotExist(err):
+		info, err := os.Stat(filepath.Join(s.releasesDir(siteDir), release))
+		if err != nil {
+			return err
+		}
+		record.Since = info.ModTime()
+	}
+	if err := writeJSONFile(filepath.Join(s.releasesDir(siteDir), releaseLayoutFile), record); err != nil {
+		return err
+	}
+	if record.Since.IsZero() || (previous != nil && record.Since.Equal(previous.Since)) {
+		return nil
+	}
+	return s.removeReleasesBefore(siteDir, record.Since)
+}
+
+// writeJSONFile writes v encoded as JSON to the file name
+func writeJSONFile(name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
@@ -0,0 +1,253 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+func TestSyncSite_RepoChange(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	newServedRepo(t, root, "old.git", map[string]string{"index.html": "old", "stale.html": "stale"})
+	_, newCommit := newServedRepo(t, root, "new.git", map[string]string{"index.html": "new"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/old.git", Branch: "master"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	site.Repo = baseURL + "/new.git"
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() after repo change error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "new" {
+		t.Errorf("index.html = %q, want new", got)
+	}
+	if s.currentRelease("default--site") != newCommit.String() {
+		t.Errorf("current release = %q, want %q", s.currentRelease("default--site"), newCommit)
+	}
+	if _, err := os.Stat(filepath.Join(s.repoDir("default--site"), "stale.html")); !os.IsNotExist(err) {
+		t.Error("checkout still contains files of the old repo")
+	}
+
+	repo, err := git.PlainOpen(s.repoDir("default--site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := remote.Config().URLs; len(urls) != 1 || urls[0] != site.Repo {
+		t.Errorf("origin = %v, want %s", urls, site.Repo)
+	}
+}
+
+func TestSyncSite_PathChange(t *testing.T) {
+	repoURL, _, commit := newServedTestRemote(t, map[string]string{
+		"index.html":      "root",
+		"docs/index.html": "docs",
+	})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/"}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/", "root"},
+		{"/docs", "docs"},
+		{"docs/", "docs"},
+		{"/", "root"},
+	} {
+		site.Path = tt.path
+		if err := s.syncSite(context.Background(), site); err != nil {
+			t.Fatalf("syncSite() with path %q error = %v", tt.path, err)
+		}
+		// The same commit is republished with the new layout
+		if got := readSiteFile(t, s, "default--site", "index.html"); got != tt.want {
+			t.Errorf("path %q: index.html = %q, want %q", tt.path, got, tt.want)
+		}
+		if s.currentRelease("default--site") != commit.String() {
+			t.Errorf("path %q: current release = %q, want %q", tt.path, s.currentRelease("default--site"), commit)
+		}
+		releases, err := s.listReleases("default--site")
+		if err != nil || len(releases) != 1 {
+			t.Errorf("path %q: releases = %v, %v, want only the current one", tt.path, releases, err)
+		}
+	}
+}
+
+func TestSyncSite_RollbackAfterPathChange(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{
+		"index.html":      "root v1",
+		"docs/index.html": "docs v1",
+	})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+		KeepReleases:  DefaultKeepReleases,
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/"}
+	ctx := context.Background()
+
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	// Make sure the second release is strictly newer
+	old := time.Now().Add(-3 * time.Hour)
+	_ = os.Chtimes(filepath.Join(s.releasesDir("default--site"), commit1.String()), old, old)
+	commit2 := commitTestFiles(t, remoteRepo, map[string]string{
+		"index.html":      "root v2",
+		"docs/index.html": "docs v2",
+	}, "v2")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	// The current release is rebuilt with the new path, the earlier one is
+	// dropped instead of being served with the old layout
+	site.Path = "/docs"
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() after path change error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "docs v2" {
+		t.Fatalf("index.html = %q, want docs v2", got)
+	}
+	if _, err := s.Rollback(ctx, "default", "site", ""); !errors.Is(err, errReleaseNotFound) {
+		t.Errorf("Rollback() error = %v, want errReleaseNotFound", err)
+	}
+	if _, err := s.Rollback(ctx, "default", "site", commit1.String()); !errors.Is(err, errReleaseNotFound) {
+		t.Errorf("Rollback(%s) error = %v, want errReleaseNotFound", shortHash(commit1.String()), err)
+	}
+
+	// A release left over with the old layout is not rolled back to
+	makeTestRelease(t, s, "default--site", "stale", 2*time.Hour)
+	if _, err := s.Rollback(ctx, "default", "site", "stale"); !errors.Is(err, errOutdatedRelease) {
+		t.Errorf("Rollback(stale) error = %v, want errOutdatedRelease", err)
+	}
+	if _, err := s.Rollback(ctx, "default", "site", ""); !errors.Is(err, errReleaseNotFound) {
+		t.Errorf("Rollback() with stale release error = %v, want errReleaseNotFound", err)
+	}
+
+	// Releases built after the change can be rolled back to
+	commitTestFiles(t, remoteRepo, map[string]string{"docs/index.html": "docs v3"}, "v3")
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	got, err := s.Rollback(ctx, "default", "site", "")
+	if err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	if got != commit2.String() {
+		t.Errorf("Rollback() = %q, want %s", got, commit2)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "docs v2" {
+		t.Errorf("index.html after rollback = %q, want docs v2", got)
+	}
+}
+
+func TestCheckoutChange(t *testing.T) {
+	site := &staticSiteData{Repo: "https://github.com/org/site.git", Branch: "main"}
+
+	tests := []struct {
+		name   string
+		record string
+		origin string
+		tag    string
+		want   string
+	}{
+		{"same source", `{"repo":"https://github.com/org/site.git","branch":"main"}`, "", "", ""},
+		{"repo changed", `{"repo":"https://github.com/org/old.git","branch":"main"}`, "", "", "repo changed"},
+		{"branch changed", `{"repo":"https://github.com/org/site.git","branch":"develop"}`, "", "", "branch changed"},
+		{"branch changed for tag", `{"repo":"https://github.com/org/site.git","branch":"develop"}`, "", "v1.0.0", ""},
+		{"unreadable record", `{`, "", "", "unreadable"},
+		{"legacy with same origin", "", "https://github.com/org/site.git", "", ""},
+		{"legacy with other origin", "", "https://github.com/org/old.git", "", "repo changed"},
+		{"legacy with local origin", "", "/srv/site.git", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repoDir := t.TempDir()
+			repo, err := git.PlainInit(repoDir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.origin != "" {
+				if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{tt.origin}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.record != "" {
+				if err := os.WriteFile(filepath.Join(repoDir, ".git", checkoutSourceFile), []byte(tt.record), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := *site
+			s.Tag = tt.tag
+			got := checkoutChange(repoDir, &s)
+			if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("checkoutChange() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSite_RecordsSource(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.html": "home"})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: repoURL, Branch: "master", Path: "/"}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := checkoutChange(s.repoDir("default--site"), site); got != "" {
+		t.Errorf("checkoutChange() after sync = %q", got)
+	}
+	if s.layoutChanged("default--site", site) {
+		t.Error("layoutChanged() after sync = true")
+	}
+
+	moved := *site
+	moved.Repo = "https://github.com/test/moved.git"
+	if got := checkoutChange(s.repoDir("default--site"), &moved); !strings.Contains(got, "repo changed") {
+		t.Errorf("checkoutChange() for moved repo = %q", got)
+	}
+	moved = *site
+	moved.Submodules = true
+	if !s.layoutChanged("default--site", &moved) {
+		t.Error("layoutChanged() after enabling submodules = false")
+	}
+
+	// The records live outside of what is served
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, "default--site", releaseLayoutFile)); !os.IsNotExist(err) {
+		t.Error("layout record is served")
+	}
+}
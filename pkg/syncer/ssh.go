@@ -0,0 +1,117 @@
+// Package syncer - SSH transport
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+const (
+	// sshPrivateKeyKey is the Secret key holding the SSH private key, as in
+	// Secrets of type kubernetes.io/ssh-auth
+	sshPrivateKeyKey = "ssh-privatekey"
+
+	// knownHostsKey is the Secret key holding the known_hosts entries for
+	// the Git host. Host keys are always verified.
+	knownHostsKey = "known_hosts"
+)
+
+// scpLikeURL matches scp-style SSH URLs like git@github.com:org/repo.git
+var scpLikeURL = regexp.MustCompile(`^([A-Za-z0-9._-]+)@([A-Za-z0-9.-]+):([^/].*)$`)
+
+// remoteURL is a parsed repo URL
+type remoteURL struct {
+	// Scheme is http, https or ssh (also for scp-style URLs)
+	Scheme string
+	User   string
+	// Host is lowercase and without port
+	Host string
+	Port string
+}
+
+// parseRemoteURL parses http(s), ssh:// and scp-style repo URLs
+func parseRemoteURL(repo string) (*remoteURL, error) {
+	if !strings.Contains(repo, "://") {
+		if m := scpLikeURL.FindStringSubmatch(repo); m != nil {
+			return &remoteURL{Scheme: "ssh", User: m[1], Host: strings.ToLower(m[2])}, nil
+		}
+	}
+
+	parsed, err := url.Parse(repo)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteURL{
+		Scheme: strings.ToLower(parsed.Scheme),
+		User:   parsed.User.Username(),
+		Host:   strings.ToLower(parsed.Hostname()),
+		Port:   parsed.Port(),
+	}, nil
+}
+
+// sshAuth returns the SSH credentials for a site. The private key and the
+// known_hosts entries both come from the site's secret; a repo whose host
+// key is not listed there is never contacted.
+func (s *Syncer) sshAuth(ctx context.Context, site *staticSiteData, remote *remoteURL) (transport.AuthMethod, error) {
+	if site.SecretRef == nil {
+		return nil, fmt.Errorf("SSH repos require a secretRef with %s and %s", sshPrivateKeyKey, knownHostsKey)
+	}
+
+	privateKey, err := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, sshPrivateKeyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SSH private key: %w", err)
+	}
+	knownHosts, err := s.getSecretValue(ctx, site.Namespace, site.SecretRef.Name, knownHostsKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get known_hosts, host key verification is mandatory: %w", err)
+	}
+
+	user := remote.User
+	if user == "" {
+		user = "git"
+	}
+	auth, err := gitssh.NewPublicKeys(user, []byte(privateKey), "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH private key: %w", err)
+	}
+
+	// knownhosts only reads files; the content is loaded right away, so the
+	// file does not need to outlive this function
+	file, err := os.CreateTemp("", "known_hosts-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = os.Remove(file.Name()) }()
+	if _, err := file.WriteString(knownHosts); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	db, err := gitssh.NewKnownHostsDb(file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("invalid known_hosts: %w", err)
+	}
+
+	port := remote.Port
+	if port == "" {
+		port = "22"
+	}
+	algorithms := db.HostKeyAlgorithms(net.JoinHostPort(remote.Host, port))
+	if len(algorithms) == 0 {
+		return nil, fmt.Errorf("known_hosts has no entry for %s", remote.Host)
+	}
+
+	auth.HostKeyCallback = db.HostKeyCallback()
+	auth.HostKeyAlgorithms = algorithms
+	return auth, nil
+}
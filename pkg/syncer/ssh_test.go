@@ -0,0 +1,325 @@
+package syncer
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseRemoteURL(t *testing.T) {
+	tests := []struct {
+		repo string
+		want remoteURL
+	}{
+		{"https://github.com/user/repo.git", remoteURL{Scheme: "https", Host: "github.com"}},
+		{"https://Git.Example.com:8443/repo.git", remoteURL{Scheme: "https", Host: "git.example.com", Port: "8443"}},
+		{"ssh://git@github.com/user/repo.git", remoteURL{Scheme: "ssh", User: "git", Host: "github.com"}},
+		{"ssh://deploy@git.example.com:2222/repo.git", remoteURL{Scheme: "ssh", User: "deploy", Host: "git.example.com", Port: "2222"}},
+		{"git@GitHub.com:user/repo.git", remoteURL{Scheme: "ssh", User: "git", Host: "github.com"}},
+		{"file:///srv/repo.git", remoteURL{Scheme: "file"}},
+		{"/srv/repo.git", remoteURL{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			got, err := parseRemoteURL(tt.repo)
+			if err != nil {
+				t.Fatalf("parseRemoteURL() error = %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseRemoteURL() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestSSHKey returns a PEM encoded ed25519 private key and its public key
+func newTestSSHKey(t *testing.T) ([]byte, ssh.PublicKey) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return pem.EncodeToMemory(block), signer.PublicKey()
+}
+
+// knownHostsLine returns a known_hosts entry for host (host:port for non-22 ports)
+func knownHostsLine(host string, key ssh.PublicKey) string {
+	if h, port, err := net.SplitHostPort(host); err == nil && port != "22" {
+		host = fmt.Sprintf("[%s]:%s", h, port)
+	}
+	return host + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestSSHAuth(t *testing.T) {
+	privateKey, _ := newTestSSHKey(t)
+	_, hostKey := newTestSSHKey(t)
+	_, otherKey := newTestSSHKey(t)
+
+	tests := []struct {
+		name       string
+		repo       string
+		secretRef  *secretRef
+		data       map[string][]byte
+		wantUser   string
+		verifyHost string
+		wantErr    string
+	}{
+		{
+			name:       "scp-style URL",
+			repo:       "git@git.example.com:org/repo.git",
+			secretRef:  &secretRef{Name: "deploy-key"},
+			data:       map[string][]byte{"ssh-privatekey": privateKey, "known_hosts": []byte(knownHostsLine("git.example.com", hostKey))},
+			wantUser:   "git",
+			verifyHost: "git.example.com:22",
+		},
+		{
+			name:       "ssh URL with user and port",
+			repo:       "ssh://deploy@git.example.com:2222/repo.git",
+			secretRef:  &secretRef{Name: "deploy-key"},
+			data:       map[string][]byte{"ssh-privatekey": privateKey, "known_hosts": []byte(knownHostsLine("git.example.com:2222", hostKey))},
+			wantUser:   "deploy",
+			verifyHost: "git.example.com:2222",
+		},
+		{
+			name:    "no secretRef",
+			repo:    "git@git.example.com:org/repo.git",
+			wantErr: "require a secretRef",
+		},
+		{
+			name:      "no known_hosts",
+			repo:      "git@git.example.com:org/repo.git",
+			secretRef: &secretRef{Name: "deploy-key"},
+			data:      map[string][]byte{"ssh-privatekey": privateKey},
+			wantErr:   "host key verification is mandatory",
+		},
+		{
+			name:      "host missing in known_hosts",
+			repo:      "git@git.example.com:org/repo.git",
+			secretRef: &secretRef{Name: "deploy-key"},
+			data:      map[string][]byte{"ssh-privatekey": privateKey, "known_hosts": []byte(knownHostsLine("github.com", hostKey))},
+			wantErr:   "no entry for git.example.com",
+		},
+		{
+			name:      "invalid private key",
+			repo:      "git@git.example.com:org/repo.git",
+			secretRef: &secretRef{Name: "deploy-key"},
+			data:      map[string][]byte{"ssh-privatekey": []byte("not a key"), "known_hosts": []byte(knownHostsLine("git.example.com", hostKey))},
+			wantErr:   "invalid SSH private key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var secrets []*corev1.Secret
+			if tt.data != nil {
+				secrets = append(secrets, newTestSecret("default", "deploy-key", tt.data))
+			}
+			s := &Syncer{ClientSet: newFakeClientset(secrets...)}
+			site := &staticSiteData{Name: "site", Namespace: "default", Repo: tt.repo, SecretRef: tt.secretRef}
+
+			auth, err := s.gitAuth(context.Background(), site)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("gitAuth() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("gitAuth() error = %v", err)
+			}
+
+			keys, ok := auth.(*gitssh.PublicKeys)
+			if !ok {
+				t.Fatalf("gitAuth() = %T, want *ssh.PublicKeys", auth)
+			}
+			if keys.User != tt.wantUser {
+				t.Errorf("user = %q, want %q", keys.User, tt.wantUser)
+			}
+			if len(keys.HostKeyAlgorithms) == 0 {
+				t.Error("host key algorithms not restricted to known_hosts")
+			}
+
+			addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+			if err := keys.HostKeyCallback(tt.verifyHost, addr, hostKey); err != nil {
+				t.Errorf("known host key rejected: %v", err)
+			}
+			if err := keys.HostKeyCallback(tt.verifyHost, addr, otherKey); err == nil {
+				t.Error("unknown host key accepted")
+			}
+		})
+	}
+}
+
+// newTestSSHServer serves git-upload-pack for local repositories over SSH on
+// 127.0.0.1. It accepts any client key and returns its address and host key.
+func newTestSSHServer(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(conn, config)
+		}
+	}()
+
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+// serveTestSSHConn runs "git-upload-pack '<path>'" exec requests of one connection
+func serveTestSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer func() { _ = channel.Close() }()
+			for req := range requests {
+				if req.Type != "exec" || len(req.Payload) < 4 {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				command := string(req.Payload[4:])
+				path, ok := strings.CutPrefix(command, "git-upload-pack ")
+				if !ok {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+
+				cmd := exec.Command("git-upload-pack", strings.Trim(path, "'"))
+				cmd.Stdin = channel
+				cmd.Stdout = channel
+				cmd.Stderr = channel.Stderr()
+				status := uint32(0)
+				if err := cmd.Run(); err != nil {
+					status = 1
+				}
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, status)
+				_, _ = channel.SendRequest("exit-status", false, payload)
+				return
+			}
+		}()
+	}
+}
+
+func TestSyncSite_SSH(t *testing.T) {
+	remoteDir, _, commit := newTestRemote(t, map[string]string{"index.html": "over ssh"})
+	addr, hostKey := newTestSSHServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	privateKey, _ := newTestSSHKey(t)
+	_, wrongKey := newTestSSHKey(t)
+
+	site := &staticSiteData{
+		Name:      "site",
+		Namespace: "default",
+		Repo:      fmt.Sprintf("ssh://git@127.0.0.1:%s%s", port, remoteDir),
+		Branch:    "master",
+		SecretRef: &secretRef{Name: "deploy-key"},
+	}
+
+	t.Run("known host", func(t *testing.T) {
+		s := &Syncer{
+			SitesRoot:     t.TempDir(),
+			AllowedHosts:  []string{"127.0.0.1"},
+			DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+			ClientSet: newFakeClientset(newTestSecret("default", "deploy-key", map[string][]byte{
+				"ssh-privatekey": privateKey,
+				"known_hosts":    []byte(knownHostsLine(addr, hostKey)),
+			})),
+		}
+		if err := s.syncSite(context.Background(), site); err != nil {
+			t.Fatalf("syncSite() error = %v", err)
+		}
+		if got := readSiteFile(t, s, "default--site", "index.html"); got != "over ssh" {
+			t.Errorf("index.html = %q", got)
+		}
+		if s.currentRelease("default--site") != commit.String() {
+			t.Errorf("current release = %q, want %q", s.currentRelease("default--site"), commit)
+		}
+	})
+
+	t.Run("host key mismatch", func(t *testing.T) {
+		s := &Syncer{
+			SitesRoot:     t.TempDir(),
+			AllowedHosts:  []string{"127.0.0.1"},
+			DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+			ClientSet: newFakeClientset(newTestSecret("default", "deploy-key", map[string][]byte{
+				"ssh-privatekey": privateKey,
+				"known_hosts":    []byte(knownHostsLine(addr, wrongKey)),
+			})),
+		}
+		err := s.syncSite(context.Background(), site)
+		if err == nil {
+			t.Fatal("syncSite() succeeded with a wrong host key")
+		}
+		if s.currentRelease("default--site") != "" {
+			t.Error("site was published despite host key mismatch")
+		}
+	})
+
+	t.Run("host not allowed", func(t *testing.T) {
+		s := &Syncer{
+			SitesRoot:     t.TempDir(),
+			AllowedHosts:  []string{"github.com"},
+			DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+			ClientSet:     newFakeClientset(),
+		}
+		err := s.syncSite(context.Background(), site)
+		if err == nil || !strings.Contains(err.Error(), "not in allowed hosts") {
+			t.Errorf("syncSite() error = %v, want allowlist rejection", err)
+		}
+	})
+}
@@ -0,0 +1,626 @@
+// Package syncer - object stores shared by the checkouts of one repo
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// objectStoresDirName holds the bare repositories the checkouts in
+	// .repos read their objects from, one per namespace and repo URL
+	objectStoresDirName = ".objects"
+
+	// sharedFetchMaxAge is how old a fetch of another site may be for a
+	// scheduled sync to use it instead of fetching again
+	sharedFetchMaxAge = time.Minute
+
+	// unshallowDepth asks for the whole history, the depth git fetch
+	// --unshallow uses
+	unshallowDepth = 0x7fffffff
+
+	// storePruneInterval is how often Cleanup drops the objects of a store
+	// no checkout needs anymore, e.g. commits of force-pushed branches
+	storePruneInterval = 24 * time.Hour
+
+	// storePackWindow is the delta window used when repacking a store
+	storePackWindow = 10
+)
+
+// objectStore serializes the fetches into one store and remembers when
+// each of its refs was fetched. Syncs of the store's sites hold inUse for
+// reading; the store is only pruned while no sync uses its objects.
+type objectStore struct {
+	mu      sync.Mutex
+	fetched map[plumbing.ReferenceName]time.Time
+	inUse   sync.RWMutex
+	pruned  time.Time
+}
+
+// sharedStorage is the storage of a checkout linked to an object store:
+// HEAD, index and config are the checkout's own, objects are read from the
+// store
+type sharedStorage struct {
+	*filesystem.Storage
+	objects *filesystem.Storage
+}
+
+func (s *sharedStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	return s.objects.EncodedObject(t, h)
+}
+
+func (s *sharedStorage) HasEncodedObject(h plumbing.Hash) error {
+	return s.objects.HasEncodedObject(h)
+}
+
+func (s *sharedStorage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	return s.objects.EncodedObjectSize(h)
+}
+
+func (s *sharedStorage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	return s.objects.IterEncodedObjects(t)
+}
+
+// fetchedSinceKey marks contexts of syncs that may use earlier fetches of
+// other sites
+type fetchedSinceKey struct{}
+
+// withFetchedSince returns ctx for syncs that may use fetches into the
+// object store that started at since or later
+func withFetchedSince(ctx context.Context, since time.Time) context.Context {
+	return context.WithValue(ctx, fetchedSinceKey{}, since)
+}
+
+// fetchedSince returns the oldest fetch a sync may use; ok is false if it
+// may only use fetches that started after it asked for one
+func fetchedSince(ctx context.Context) (time.Time, bool) {
+	since, ok := ctx.Value(fetchedSinceKey{}).(time.Time)
+	return since, ok
+}
+
+// storeDir returns the object store of a repo for the sites of a namespace.
+// Sites of different namespaces never share objects: a site could publish
+// commits another namespace fetched with credentials it doesn't have.
+func (s *Syncer) storeDir(namespace, repoURL string) string {
+	sum := sha256.Sum256([]byte(repoURL))
+	return filepath.Join(s.storesDir(), namespace+"--"+hex.EncodeToString(sum[:8]))
+}
+
+// storesDir returns the absolute path of .objects; checkouts refer to
+// their store by absolute path
+func (s *Syncer) storesDir() string {
+	dir := filepath.Join(s.SitesRoot, objectStoresDirName)
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+// objectStore returns the fetch state of the store in storeDir
+func (s *Syncer) objectStore(storeDir string) *objectStore {
+	store, _ := s.stores.LoadOrStore(storeDir, &objectStore{})
+	return store.(*objectStore)
+}
+
+// checkoutStore returns the object store the checkout in repoDir is linked
+// to, or "" if it has its own objects
+func checkoutStore(repoDir string) string {
+	data, err := os.ReadFile(filepath.Join(repoDir, ".git", "objects", "info", "alternates"))
+	if err != nil {
+		return ""
+	}
+	objects, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	if objects == "" {
+		return ""
+	}
+	return filepath.Dir(objects)
+}
+
+// openCheckout opens the checkout in repoDir. A checkout linked to an
+// object store reads its objects from the store.
+func openCheckout(repoDir string) (*git.Repository, error) {
+	storeDir := checkoutStore(repoDir)
+	if storeDir == "" {
+		return git.PlainOpen(repoDir)
+	}
+	storage := &sharedStorage{
+		Storage: filesystem.NewStorage(osfs.New(filepath.Join(repoDir, ".git")), cache.NewObjectLRUDefault()),
+		objects: filesystem.NewStorage(osfs.New(storeDir), cache.NewObjectLRUDefault()),
+	}
+	return git.Open(storage, osfs.New(repoDir))
+}
+
+// linkCheckout creates an empty checkout of repoURL in repoDir that reads
+// its objects from the store in storeDir. The store is recorded as Git
+// alternate, so the git CLI can read the checkout as well.
+func linkCheckout(repoDir, storeDir, repoURL string) error {
+	repo, err := git.PlainInit(repoDir, false)
+	if err != nil {
+		return err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{repoURL}})
+	if err == nil {
+		info := filepath.Join(repoDir, ".git", "objects", "info")
+		if err = os.MkdirAll(info, 0755); err == nil {
+			err = os.WriteFile(filepath.Join(info, "alternates"), []byte(filepath.Join(storeDir, "objects")+"\n"), 0644)
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(repoDir)
+	}
+	return err
+}
+
+// openStore opens the object store in storeDir, creating it if needed. A
+// store that can't be opened, e.g. after a crash during its creation, is
+// created again.
+func openStore(storeDir, repoURL string) (*git.Repository, error) {
+	repo, err := git.PlainOpen(storeDir)
+	if err == nil {
+		return repo, nil
+	}
+	if err := os.RemoveAll(storeDir); err != nil {
+		return nil, err
+	}
+	repo, err = git.PlainInit(storeDir, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{repoURL}}); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// storeRef returns the ref of the store the site's branch, tag or pinned
+// revision is fetched into
+func storeRef(site *staticSiteData) plumbing.ReferenceName {
+	switch {
+	case site.Revision != "":
+		return plumbing.ReferenceName("refs/pages/revisions/" + site.Revision)
+	case site.Tag != "":
+		return plumbing.NewTagReferenceName(site.Tag)
+	default:
+		return plumbing.NewBranchReferenceName(site.Branch)
+	}
+}
+
+// fetchStore fetches the site's ref into the object store of its repo and
+// returns the commit to check out. Syncs of sites using the same ref share
+// a fetch if it started after they asked for one, or since the time in ctx
+// (see withFetchedSince). A missing checkout in repoDir is created linked
+// to the store; this happens under the store's lock, so removeUnusedStores
+// doesn't remove the store in between.
+func (s *Syncer) fetchStore(ctx context.Context, repoDir string, site *staticSiteData, access *gitAccess) (plumbing.Hash, error) {
+	since, ok := fetchedSince(ctx)
+	if !ok {
+		since = time.Now()
+	}
+
+	storeDir := s.storeDir(site.Namespace, site.Repo)
+	store := s.objectStore(storeDir)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	repo, err := openStore(storeDir, site.Repo)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to open object store: %w", err)
+	}
+
+	var commit plumbing.Hash
+	if site.Revision != "" {
+		commit, err = s.fetchStoreRevision(ctx, repo, site, access)
+	} else {
+		commit, err = s.fetchStoreRef(ctx, store, repo, site, access, since)
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := os.Stat(filepath.Join(repoDir, ".git")); os.IsNotExist(err) {
+		if err := linkCheckout(repoDir, storeDir, site.Repo); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to create checkout: %w", err)
+		}
+	}
+	return commit, nil
+}
+
+// fetchStoreRef fetches a branch or tag into the store, unless it was
+// fetched since since, and returns the commit it points to
+func (s *Syncer) fetchStoreRef(ctx context.Context, store *objectStore, repo *git.Repository, site *staticSiteData, access *gitAccess, since time.Time) (plumbing.Hash, error) {
+	ref := storeRef(site)
+	if fetched, ok := store.fetched[ref]; !ok || fetched.Before(since) {
+		started := time.Now()
+		err := repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName:   "origin",
+			RefSpecs:     []config.RefSpec{config.RefSpec("+" + ref.String() + ":" + ref.String())},
+			Depth:        1,
+			Force:        true,
+			Auth:         access.auth,
+			CABundle:     access.caBundle,
+			ProxyOptions: access.proxyOptions(site.Repo),
+		})
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return plumbing.ZeroHash, fmt.Errorf("git fetch failed: %w", err)
+		}
+		if store.fetched == nil {
+			store.fetched = map[plumbing.ReferenceName]time.Time{}
+		}
+		store.fetched[ref] = started
+	} else {
+		log.FromContext(ctx).Info("Using earlier fetch", "site", site.Name, "ref", ref.Short(), "fetched", fetched.Format(time.RFC3339))
+	}
+
+	fetched, err := repo.Reference(ref, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to get remote reference: %w", err)
+	}
+	return peelTag(repo, fetched.Hash(), site)
+}
+
+// fetchStoreRevision makes sure the pinned commit is in the store. The
+// commit is fetched by its SHA; servers that don't allow that get a full
+// fetch of all branches and tags instead, which also deepens the shallow
+// history other sites fetched (like git fetch --unshallow).
+func (s *Syncer) fetchStoreRevision(ctx context.Context, repo *git.Repository, site *staticSiteData, access *gitAccess) (plumbing.Hash, error) {
+	commit := plumbing.NewHash(site.Revision)
+	if _, err := repo.CommitObject(commit); err == nil {
+		return commit, nil
+	}
+
+	fetchOpts := &git.FetchOptions{
+		RemoteName:   "origin",
+		RefSpecs:     []config.RefSpec{config.RefSpec(site.Revision + ":" + storeRef(site).String())},
+		Depth:        1,
+		Force:        true,
+		Auth:         access.auth,
+		CABundle:     access.caBundle,
+		ProxyOptions: access.proxyOptions(site.Repo),
+	}
+	err := repo.FetchContext(ctx, fetchOpts)
+	if err == git.ErrExactSHA1NotSupported {
+		fetchOpts.RefSpecs = []config.RefSpec{
+			"+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*",
+		}
+		fetchOpts.Depth = unshallowDepth
+		err = repo.FetchContext(ctx, fetchOpts)
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, fmt.Errorf("git fetch failed: %w", err)
+	}
+
+	if _, err := repo.CommitObject(commit); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("revision %s not found in repository: %w", site.Revision, err)
+	}
+	return commit, nil
+}
+
+// checkoutFromStore fetches the site's ref into the object store of its
+// repo and resets the site's checkout to it, creating the checkout if
+// needed. Returns the checked out commit.
+func (s *Syncer) checkoutFromStore(ctx context.Context, repoDir string, site *staticSiteData, access *gitAccess) (string, error) {
+	_, err := os.Stat(filepath.Join(repoDir, ".git"))
+	created := os.IsNotExist(err)
+
+	commit, err := s.fetchStore(ctx, repoDir, site, access)
+	if err != nil {
+		return "", err
+	}
+	err = s.resetCheckout(ctx, repoDir, site, commit)
+	if err != nil && created {
+		// Don't leave an empty checkout behind, it has no HEAD yet
+		_ = os.RemoveAll(repoDir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return commit.String(), nil
+}
+
+// resetCheckout moves the checkout in repoDir to commit once its signature
+// is verified. Checkouts linked to a store are on a detached HEAD.
+func (s *Syncer) resetCheckout(ctx context.Context, repoDir string, site *staticSiteData, commit plumbing.Hash) error {
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open repo: %w", err)
+	}
+	if err := s.verifyCommit(ctx, repo, site, commit); err != nil {
+		return err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, commit)); err != nil {
+		return fmt.Errorf("failed to set HEAD: %w", err)
+	}
+	return resetWorktree(repo, commit, site.sparseDirs())
+}
+
+// removeUnusedStores removes the object stores no checkout in .repos is
+// linked to anymore, e.g. after the last site of a repo was deleted
+func (s *Syncer) removeUnusedStores(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+
+	entries, err := os.ReadDir(s.storesDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	used := s.usedStores()
+	for _, entry := range entries {
+		storeDir := filepath.Join(s.storesDir(), entry.Name())
+		if used[storeDir] {
+			continue
+		}
+
+		// A sync may have linked a checkout since
+		var err error
+		store := s.objectStore(storeDir)
+		store.mu.Lock()
+		if !s.usedStores()[storeDir] {
+			logger.Info("Removing unused object store", "path", storeDir)
+			err = os.RemoveAll(storeDir)
+			store.fetched = nil
+		}
+		store.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to remove object store %s: %w", storeDir, err)
+		}
+	}
+	return nil
+}
+
+// usedStores returns the object stores the checkouts in .repos are linked to
+func (s *Syncer) usedStores() map[string]bool {
+	used := map[string]bool{}
+	for storeDir := range s.storeCheckouts() {
+		used[storeDir] = true
+	}
+	return used
+}
+
+// storeCheckouts returns the checkouts in .repos by the object store they
+// are linked to
+func (s *Syncer) storeCheckouts() map[string][]string {
+	checkouts := map[string][]string{}
+	reposDir := filepath.Join(s.SitesRoot, reposDirName)
+	entries, _ := os.ReadDir(reposDir)
+	for _, entry := range entries {
+		repoDir := filepath.Join(reposDir, entry.Name())
+		if storeDir := checkoutStore(repoDir); storeDir != "" {
+			checkouts[storeDir] = append(checkouts[storeDir], repoDir)
+		}
+	}
+	return checkouts
+}
+
+// pruneStores prunes the object stores not pruned for storePruneInterval.
+// Stores that a sync is using are left for the next Cleanup.
+func (s *Syncer) pruneStores(ctx context.Context) {
+	logger := log.FromContext(ctx)
+
+	for storeDir, checkouts := range s.storeCheckouts() {
+		store := s.objectStore(storeDir)
+		if time.Since(store.pruned) < storePruneInterval || !store.inUse.TryLock() {
+			continue
+		}
+		store.mu.Lock()
+		pruned, err := pruneStore(storeDir, checkouts, store)
+		if err == nil {
+			store.pruned = time.Now()
+		}
+		store.mu.Unlock()
+		store.inUse.Unlock()
+
+		if err != nil {
+			logger.Error(err, "Failed to prune object store", "path", storeDir)
+		} else if pruned {
+			logger.Info("Pruned object store", "path", storeDir)
+		}
+	}
+}
+
+// pruneStore keeps only the objects of the store in storeDir that the
+// checkouts linked to it need: refs not pointing to the commit of a
+// checkout are removed (the next sync fetches them again), and the objects
+// reachable from the checkouts' commits are repacked into one pack. Reports
+// whether anything was dropped.
+func pruneStore(storeDir string, checkouts []string, store *objectStore) (bool, error) {
+	heads := map[plumbing.Hash]bool{}
+	for _, repoDir := range checkouts {
+		checkout, err := openCheckout(repoDir)
+		if err != nil {
+			return false, fmt.Errorf("failed to open checkout %s: %w", repoDir, err)
+		}
+		head, err := checkout.Head()
+		if err != nil {
+			return false, fmt.Errorf("failed to read HEAD of %s: %w", repoDir, err)
+		}
+		heads[head.Hash()] = true
+	}
+
+	repo, err := git.PlainOpen(storeDir)
+	if err != nil {
+		return false, err
+	}
+	walker := &reachableObjects{storer: repo.Storer, seen: map[plumbing.Hash]bool{}}
+	for head := range heads {
+		if err := walker.walk(head); err != nil {
+			return false, err
+		}
+	}
+
+	// Refs of sites that moved on, e.g. to another tag, are dropped
+	refs, err := repo.References()
+	if err != nil {
+		return false, err
+	}
+	var stale []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		commit := ref.Hash()
+		if tag, err := repo.TagObject(commit); err == nil {
+			commit = tag.Target
+		}
+		if heads[commit] {
+			walker.seen[ref.Hash()] = true
+			return nil
+		}
+		stale = append(stale, ref.Name())
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, name := range stale {
+		if err := repo.Storer.RemoveReference(name); err != nil {
+			return false, err
+		}
+		delete(store.fetched, name)
+	}
+
+	packer, ok := repo.Storer.(storer.PackedObjectStorer)
+	if !ok {
+		return false, fmt.Errorf("object store does not support packs")
+	}
+	loose, ok := repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		return false, fmt.Errorf("object store does not support loose objects")
+	}
+	packs, err := packer.ObjectPacks()
+	if err != nil {
+		return false, err
+	}
+	var looseObjects []plumbing.Hash
+	if err := loose.ForEachObjectHash(func(h plumbing.Hash) error {
+		looseObjects = append(looseObjects, h)
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	// Nothing was fetched since the last repack
+	if len(stale) == 0 && len(packs) <= 1 && len(looseObjects) == 0 {
+		return false, nil
+	}
+
+	hashes := make([]plumbing.Hash, 0, len(walker.seen))
+	for h := range walker.seen {
+		hashes = append(hashes, h)
+	}
+	w, err := repo.Storer.(storer.PackfileWriter).PackfileWriter()
+	if err != nil {
+		return false, err
+	}
+	packHash, err := packfile.NewEncoder(w, repo.Storer, false).Encode(hashes, storePackWindow)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to repack: %w", err)
+	}
+	for _, pack := range packs {
+		if pack == packHash {
+			continue
+		}
+		if err := packer.DeleteOldObjectPackAndIndex(pack, time.Time{}); err != nil {
+			return false, err
+		}
+	}
+	for _, h := range looseObjects {
+		if err := loose.DeleteLooseObject(h); err != nil {
+			return false, err
+		}
+	}
+
+	// Commits cut off by shallow fetches may be gone now
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return false, err
+	}
+	kept := shallow[:0]
+	for _, commit := range shallow {
+		if walker.seen[commit] {
+			kept = append(kept, commit)
+		}
+	}
+	if len(kept) != len(shallow) {
+		if err := repo.Storer.SetShallow(kept); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// reachableObjects collects the objects reachable from commits. Parents
+// beyond a shallow fetch and submodule commits are not in the store and
+// are skipped.
+type reachableObjects struct {
+	storer storer.EncodedObjectStorer
+	seen   map[plumbing.Hash]bool
+}
+
+func (r *reachableObjects) walk(h plumbing.Hash) error {
+	if r.seen[h] {
+		return nil
+	}
+	obj, err := object.GetObject(r.storer, h)
+	if err == plumbing.ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.seen[h] = true
+
+	switch obj := obj.(type) {
+	case *object.Commit:
+		if err := r.walk(obj.TreeHash); err != nil {
+			return err
+		}
+		for _, parent := range obj.ParentHashes {
+			if err := r.walk(parent); err != nil {
+				return err
+			}
+		}
+	case *object.Tree:
+		for _, entry := range obj.Entries {
+			switch entry.Mode {
+			case filemode.Submodule:
+			case filemode.Dir:
+				if err := r.walk(entry.Hash); err != nil {
+					return err
+				}
+			default:
+				// Blobs aren't read, only looked up
+				if err := r.storer.HasEncodedObject(entry.Hash); err == nil {
+					r.seen[entry.Hash] = true
+				}
+			}
+		}
+	case *object.Tag:
+		return r.walk(obj.Target)
+	}
+	return nil
+}
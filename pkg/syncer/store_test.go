@@ -0,0 +1,352 @@
+package syncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// newCountingGitServer serves repositories like newTestGitServer and counts
+// the fetches, i.e. ref advertisements of git-upload-pack
+func newCountingGitServer(t *testing.T) (string, string, *atomic.Int32) {
+	t.Helper()
+
+	var fetches atomic.Int32
+	root, handler := newGitHTTPBackend(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-upload-pack" {
+			fetches.Add(1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return root, srv.URL, &fetches
+}
+
+// packFiles returns the pack files in the object directory of a repository
+func packFiles(t *testing.T, gitDir string) []string {
+	t.Helper()
+
+	packs, err := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.pack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packs
+}
+
+func TestSyncSite_SharedObjectStore(t *testing.T) {
+	root, baseURL, fetches := newCountingGitServer(t)
+	remote, _ := newServedRepo(t, root, "docs.git", map[string]string{"docs/index.html": "docs v1", "blog/index.html": "blog v1"})
+	next := commitTestFiles(t, remote, map[string]string{"docs/index.html": "docs next"}, "Next")
+	if err := remote.Storer.SetReference(plumbing.NewHashReference("refs/heads/next", next)); err != nil {
+		t.Fatal(err)
+	}
+	commitTestFiles(t, remote, map[string]string{"docs/index.html": "docs v2"}, "Update")
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"docs", "blog", "preview"}},
+		ClientSet:     newFakeClientset(),
+	}
+	repo := baseURL + "/docs.git"
+	sites := []*staticSiteData{
+		{Name: "docs", Namespace: "default", Repo: repo, Branch: "master", Path: "/docs"},
+		{Name: "blog", Namespace: "default", Repo: repo, Branch: "master", Path: "/blog"},
+		{Name: "preview", Namespace: "default", Repo: repo, Branch: "next", Path: "/docs"},
+	}
+
+	// One fetch per branch for all sites of the repo
+	ctx := withFetchedSince(context.Background(), time.Now())
+	for _, site := range sites {
+		if err := s.syncSite(ctx, site); err != nil {
+			t.Fatalf("syncSite(%s) error = %v", site.Name, err)
+		}
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("fetches = %d, want 2", got)
+	}
+	for site, want := range map[string]string{"default--docs": "docs v2", "default--blog": "blog v1", "default--preview": "docs next"} {
+		if got := readSiteFile(t, s, site, "index.html"); got != want {
+			t.Errorf("%s index.html = %q, want %q", site, got, want)
+		}
+	}
+
+	// The objects exist once, in the store
+	storeDir := s.storeDir("default", repo)
+	if len(packFiles(t, storeDir)) == 0 {
+		t.Fatal("object store has no packs")
+	}
+	for _, site := range sites {
+		repoDir := s.repoDir(site.dirName())
+		if got := checkoutStore(repoDir); got != storeDir {
+			t.Errorf("%s is linked to %q, want %q", site.Name, got, storeDir)
+		}
+		if packs := packFiles(t, filepath.Join(repoDir, ".git")); len(packs) != 0 {
+			t.Errorf("%s has objects of its own: %v", site.Name, packs)
+		}
+	}
+
+	// Without an earlier fetch to use, every sync fetches
+	commitTestFiles(t, remote, map[string]string{"docs/index.html": "docs v3"}, "Update")
+	if err := s.syncSite(context.Background(), sites[0]); err != nil {
+		t.Fatalf("syncSite() after update error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--docs", "index.html"); got != "docs v3" {
+		t.Errorf("index.html after update = %q, want docs v3", got)
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("fetches = %d, want 3", got)
+	}
+
+	// Other namespaces get a store of their own
+	other := &staticSiteData{Name: "docs", Namespace: "other", Repo: repo, Branch: "master", Path: "/docs"}
+	if err := s.syncSite(ctx, other); err != nil {
+		t.Fatalf("syncSite() in other namespace error = %v", err)
+	}
+	otherStore := s.storeDir("other", repo)
+	if otherStore == storeDir || checkoutStore(s.repoDir("other--docs")) != otherStore {
+		t.Errorf("site of another namespace uses store %q", checkoutStore(s.repoDir("other--docs")))
+	}
+
+	// A store goes with the last site using it
+	for i, site := range sites {
+		if err := s.DeleteSite(context.Background(), site.Namespace, site.Name); err != nil {
+			t.Fatalf("DeleteSite(%s) error = %v", site.Name, err)
+		}
+		_, err := os.Stat(storeDir)
+		if last := i == len(sites)-1; last != os.IsNotExist(err) {
+			t.Errorf("after deleting %s: store exists = %v", site.Name, err == nil)
+		}
+	}
+	if _, err := os.Stat(otherStore); err != nil {
+		t.Errorf("store of the other namespace was removed: %v", err)
+	}
+}
+
+func TestSyncSite_SharedObjectStoreTagsAndRevisions(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	remote, v1 := newServedRepo(t, root, "site.git", map[string]string{"index.html": "v1"})
+	if _, err := remote.CreateTag("v1.0.0", v1, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+		Message: "Release",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	commitTestFiles(t, remote, map[string]string{"index.html": "v2"}, "Update")
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"tagged", "pinned", "tracking"}},
+		ClientSet:     newFakeClientset(),
+	}
+	repo := baseURL + "/site.git"
+	tests := []struct {
+		site *staticSiteData
+		want string
+	}{
+		{&staticSiteData{Name: "tagged", Namespace: "default", Repo: repo, Tag: "v1.0.0"}, "v1"},
+		{&staticSiteData{Name: "pinned", Namespace: "default", Repo: repo, Revision: v1.String()}, "v1"},
+		{&staticSiteData{Name: "tracking", Namespace: "default", Repo: repo, Branch: "master"}, "v2"},
+	}
+	for _, tt := range tests {
+		if err := s.syncSite(context.Background(), tt.site); err != nil {
+			t.Fatalf("syncSite(%s) error = %v", tt.site.Name, err)
+		}
+		if got := readSiteFile(t, s, tt.site.dirName(), "index.html"); got != tt.want {
+			t.Errorf("%s index.html = %q, want %q", tt.site.Name, got, tt.want)
+		}
+		if checkoutStore(s.repoDir(tt.site.dirName())) != s.storeDir("default", repo) {
+			t.Errorf("%s is not linked to the store", tt.site.Name)
+		}
+	}
+	if s.currentRelease("default--tagged") != v1.String() {
+		t.Errorf("annotated tag released as %q, want the commit %s", s.currentRelease("default--tagged"), v1)
+	}
+}
+
+func TestSyncSite_SharedObjectStoreRevisionBehindShallowBranch(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	remote, v1 := newServedRepo(t, root, "site.git", map[string]string{"index.html": "v1"})
+	commitTestFiles(t, remote, map[string]string{"index.html": "v2"}, "Update")
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	// The store only has the tip of the branch; the test server doesn't
+	// serve commits by SHA, so the history is fetched
+	site.Revision = v1.String()
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with revision error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+}
+
+func TestCleanup_PrunesObjectStore(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	remote, v1 := newServedRepo(t, root, "site.git", map[string]string{"index.html": "v1"})
+	v2 := commitTestFiles(t, remote, map[string]string{"index.html": "v2"}, "Update")
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+
+	// Force push of a commit replacing v2
+	wt, err := remote.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: v1, Mode: git.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	rewritten := commitTestFiles(t, remote, map[string]string{"index.html": "v2 rewritten"}, "Update")
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() after force push error = %v", err)
+	}
+
+	// A ref of a revision the site was pinned to before
+	storeDir := s.storeDir("default", site.Repo)
+	store, err := git.PlainOpen(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := plumbing.ReferenceName("refs/pages/revisions/" + v2.String())
+	if err := store.Storer.SetReference(plumbing.NewHashReference(pinned, v2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(packFiles(t, storeDir)) < 2 {
+		t.Fatalf("store has %d packs, want one per fetch", len(packFiles(t, storeDir)))
+	}
+
+	// Not while a sync uses the store
+	s.objectStore(storeDir).inUse.RLock()
+	if err := s.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	s.objectStore(storeDir).inUse.RUnlock()
+	if _, err := store.CommitObject(v2); err != nil {
+		t.Errorf("store in use was pruned: %v", err)
+	}
+
+	if err := s.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	store, err = git.PlainOpen(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CommitObject(v2); err == nil {
+		t.Error("force-pushed commit was kept")
+	}
+	if _, err := store.Reference(pinned, false); err == nil {
+		t.Error("stale revision ref was kept")
+	}
+	if _, err := store.CommitObject(rewritten); err != nil {
+		t.Errorf("commit of the checkout was pruned: %v", err)
+	}
+	if packs := packFiles(t, storeDir); len(packs) != 1 {
+		t.Errorf("store has %d packs after pruning, want 1", len(packs))
+	}
+	if err := checkoutDamage(s.repoDir("default--site")); err != nil {
+		t.Errorf("checkout damaged by pruning: %v", err)
+	}
+
+	// The pruned store keeps fetching
+	commitTestFiles(t, remote, map[string]string{"index.html": "v3"}, "Update")
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() after pruning error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v3" {
+		t.Errorf("index.html = %q, want v3", got)
+	}
+}
+
+func TestSyncSite_StandaloneCheckoutIsLinked(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+	newServedRepo(t, root, "site.git", map[string]string{"index.html": "home"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Path: "/"}
+
+	// A checkout cloned before object stores were shared
+	repoDir := s.repoDir("default--site")
+	if _, err := git.PlainClone(repoDir, false, &git.CloneOptions{URL: site.Repo}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if checkoutStore(repoDir) != s.storeDir("default", site.Repo) {
+		t.Error("standalone checkout was not replaced by a linked one")
+	}
+	if packs := packFiles(t, filepath.Join(repoDir, ".git")); len(packs) != 0 {
+		t.Errorf("checkout kept its own objects: %v", packs)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "home" {
+		t.Errorf("index.html = %q, want home", got)
+	}
+
+	// Checkouts with another origin, e.g. set up by hand from a local
+	// mirror, are cloned from the store as well
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	if _, err := git.PlainClone(mirror, true, &git.CloneOptions{URL: site.Repo}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(repoDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.PlainClone(repoDir, false, &git.CloneOptions{URL: mirror}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() of mirror checkout error = %v", err)
+	}
+	if checkoutStore(repoDir) != s.storeDir("default", site.Repo) {
+		t.Error("checkout of a mirror was not replaced by a linked one")
+	}
+
+	// A lost store counts as damage of the checkout, both are recreated
+	if err := os.RemoveAll(s.storeDir("default", site.Repo)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() without store error = %v", err)
+	}
+	if err := checkoutDamage(repoDir); err != nil {
+		t.Errorf("checkout still damaged: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package syncer - Git submodules
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// updateSubmodules checks out the submodules of the checkout in repoDir at
+// the commits recorded by the site's repo, recursively. Every submodule URL
+// must pass validateRepoURL like the site's repo itself.
+func (s *Syncer) updateSubmodules(ctx context.Context, repoDir string, site *staticSiteData, access *gitAccess) error {
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open repo: %w", err)
+	}
+	subpath := strings.Trim(path.Clean("/"+site.Path), "/")
+	return s.updateRepoSubmodules(ctx, repo, site.Repo, site.Repo, subpath, access, int(git.DefaultSubmoduleRecursionDepth))
+}
+
+// updateRepoSubmodules updates the submodules of repo, whose remote is
+// parentURL. Relative submodule URLs are resolved against parentURL.
+// Submodules that neither contain nor lie below subpath are skipped, they
+// are outside of the (sparse) checkout.
+func (s *Syncer) updateRepoSubmodules(ctx context.Context, repo *git.Repository, siteURL, parentURL, subpath string, access *gitAccess, depth int) error {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	modules, err := readGitmodules(worktree.Filesystem.Root())
+	if err != nil || len(modules.Submodules) == 0 {
+		return err
+	}
+	if depth == 0 {
+		return fmt.Errorf("submodules nested too deeply")
+	}
+
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return fmt.Errorf("failed to read submodules: %w", err)
+	}
+
+	for _, sub := range submodules {
+		name := sub.Config().Name
+		module := modules.Submodules[name]
+		if module == nil {
+			continue
+		}
+		// Names and paths end up in file paths below the checkout
+		if !filepath.IsLocal(name) || !filepath.IsLocal(module.Path) {
+			return fmt.Errorf("submodule %q: invalid path %q", name, module.Path)
+		}
+		if !pathOverlaps(module.Path, subpath) {
+			continue
+		}
+
+		// The URL in .gitmodules is authoritative, the one recorded when the
+		// submodule was initialized may be outdated
+		subURL, err := resolveSubmoduleURL(parentURL, module.URL)
+		if err != nil {
+			return fmt.Errorf("submodule %q: invalid URL: %w", name, err)
+		}
+		if err := s.validateRepoURL(subURL); err != nil {
+			return fmt.Errorf("submodule %q: URL validation failed: %w", name, err)
+		}
+		subAuth, err := submoduleAuth(siteURL, subURL, access.auth)
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", name, err)
+		}
+		subAccess := &gitAccess{auth: subAuth, caBundle: access.caBundle, proxy: access.proxy}
+
+		sub.Config().URL = subURL
+		if err := sub.Init(); err != nil && err != git.ErrSubmoduleAlreadyInitialized {
+			return fmt.Errorf("submodule %q: init failed: %w", name, err)
+		}
+		subRepo, err := sub.Repository()
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", name, err)
+		}
+		if err := setOriginURL(subRepo, subURL); err != nil {
+			return fmt.Errorf("submodule %q: %w", name, err)
+		}
+
+		// The submodule update can't fetch with a CA bundle or proxy, so the
+		// recorded commit is fetched here and only checked out by the update
+		status, err := sub.Status()
+		if err != nil {
+			return fmt.Errorf("submodule %q: %w", name, err)
+		}
+		if err := fetchSubmodule(ctx, subRepo, subURL, status.Expected, subAccess); err != nil {
+			return fmt.Errorf("submodule %q: update failed: %w", name, err)
+		}
+		err = sub.UpdateContext(ctx, &git.SubmoduleUpdateOptions{
+			NoFetch:           true,
+			RecurseSubmodules: git.NoRecurseSubmodules,
+		})
+		if err != nil {
+			return fmt.Errorf("submodule %q: update failed: %w", name, err)
+		}
+
+		if err := s.updateRepoSubmodules(ctx, subRepo, siteURL, subURL, "", access, depth-1); err != nil {
+			return fmt.Errorf("submodule %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// pathOverlaps reports whether a submodule at modulePath is part of a
+// checkout of subpath, i.e. one of them contains the other. An empty
+// subpath is the whole tree.
+func pathOverlaps(modulePath, subpath string) bool {
+	modulePath = strings.Trim(path.Clean("/"+modulePath), "/")
+	return subpath == "" || modulePath == subpath ||
+		strings.HasPrefix(modulePath, subpath+"/") || strings.HasPrefix(subpath, modulePath+"/")
+}
+
+// readGitmodules parses the .gitmodules file of a worktree. A worktree
+// without one has no submodules.
+func readGitmodules(worktreeDir string) (*config.Modules, error) {
+	modules := config.NewModules()
+	data, err := os.ReadFile(filepath.Join(worktreeDir, ".gitmodules"))
+	if os.IsNotExist(err) {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := modules.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("invalid .gitmodules: %w", err)
+	}
+	return modules, nil
+}
+
+// resolveSubmoduleURL resolves a submodule URL relative to the URL of its
+// parent repo, like git does for URLs starting with ./ or ../
+func resolveSubmoduleURL(parentURL, subURL string) (string, error) {
+	if !strings.HasPrefix(subURL, "./") && !strings.HasPrefix(subURL, "../") {
+		return subURL, nil
+	}
+
+	if !strings.Contains(parentURL, "://") {
+		if m := scpLikeURL.FindStringSubmatch(parentURL); m != nil {
+			return m[1] + "@" + m[2] + ":" + strings.TrimPrefix(path.Join("/", m[3], subURL), "/"), nil
+		}
+	}
+
+	parsed, err := url.Parse(parentURL)
+	if err != nil {
+		return "", err
+	}
+	parsed.Path = path.Join("/", parsed.Path, subURL)
+	return parsed.String(), nil
+}
+
+// submoduleAuth returns the credentials for a submodule. The site's
+// credentials are only sent to the host of the site's repo; submodules on
+// other HTTP(S) hosts are fetched anonymously. SSH needs pinned host keys,
+// so SSH submodules must live on the host of the site's repo.
+func submoduleAuth(siteURL, subURL string, auth transport.AuthMethod) (transport.AuthMethod, error) {
+	site, err := parseRemoteURL(siteURL)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := parseRemoteURL(subURL)
+	if err != nil {
+		return nil, err
+	}
+
+	sameHost := sub.Host == site.Host && sub.Port == site.Port
+	switch {
+	case sub.Scheme == "ssh" && (site.Scheme != "ssh" || !sameHost):
+		return nil, fmt.Errorf("SSH submodules must be on the host of the site's SSH repo")
+	case sameHost && (sub.Scheme == "ssh") == (site.Scheme == "ssh"):
+		return auth, nil
+	default:
+		return nil, nil
+	}
+}
+
+// fetchSubmodule fetches the branches of a submodule's origin and, if that
+// doesn't bring commit along, commit itself
+func fetchSubmodule(ctx context.Context, repo *git.Repository, repoURL string, commit plumbing.Hash, access *gitAccess) error {
+	fetchOpts := &git.FetchOptions{
+		Depth:        1,
+		Auth:         access.auth,
+		CABundle:     access.caBundle,
+		ProxyOptions: access.proxyOptions(repoURL),
+	}
+	err := repo.FetchContext(ctx, fetchOpts)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	if _, err := repo.CommitObject(commit); err == nil {
+		return nil
+	}
+
+	fetchOpts.RefSpecs = []config.RefSpec{config.RefSpec("+" + commit.String() + ":" + commit.String())}
+	err = repo.FetchContext(ctx, fetchOpts)
+	if err != nil && err != git.NoErrAlreadyUpToDate && err != git.ErrExactSHA1NotSupported {
+		return err
+	}
+	return nil
+}
+
+// setOriginURL points the origin remote of a submodule at repoURL, in case
+// the submodule URL changed since it was initialized
+func setOriginURL(repo *git.Repository, repoURL string) error {
+	remote, err := repo.Remote(git.DefaultRemoteName)
+	if err == nil && len(remote.Config().URLs) == 1 && remote.Config().URLs[0] == repoURL {
+		return nil
+	}
+	if err == nil {
+		if err := repo.DeleteRemote(git.DefaultRemoteName); err != nil {
+			return err
+		}
+	} else if err != git.ErrRemoteNotFound {
+		return err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{repoURL}})
+	return err
+}
+
+// clearSubmodules removes the submodules of a checkout that were checked out
+// while spec.submodules was enabled, leaving empty directories like an
+// uninitialized submodule
+func clearSubmodules(repoDir string) error {
+	repo, err := openCheckout(repoDir)
+	if err != nil {
+		return fmt.Errorf("failed to open repo: %w", err)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Submodules) == 0 {
+		return nil
+	}
+	// The repo config doesn't record paths, only .gitmodules does
+	modules, err := readGitmodules(repoDir)
+	if err != nil {
+		return err
+	}
+
+	for name := range cfg.Submodules {
+		if module := modules.Submodules[name]; module != nil && filepath.IsLocal(module.Path) {
+			dir := filepath.Join(repoDir, module.Path)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+		if filepath.IsLocal(name) {
+			if err := os.RemoveAll(filepath.Join(repoDir, ".git", "modules", name)); err != nil {
+				return err
+			}
+		}
+		delete(cfg.Submodules, name)
+	}
+	return repo.SetConfig(cfg)
+}
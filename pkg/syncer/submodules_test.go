@@ -0,0 +1,273 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// commitTestSubmodule records a submodule at path with url and commit in repo
+func commitTestSubmodule(t *testing.T, repo *git.Repository, path, url string, commit plumbing.Hash) plumbing.Hash {
+	t.Helper()
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := wt.Filesystem.Root()
+
+	modules := fmt.Sprintf("[submodule %q]\n\tpath = %s\n\turl = %s\n", path, path, url)
+	f, err := os.OpenFile(filepath.Join(dir, ".gitmodules"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(modules)
+	_ = f.Close()
+
+	for _, args := range [][]string{
+		{"add", ".gitmodules"},
+		{"update-index", "--add", "--cacheinfo", "160000," + commit.String() + "," + path},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Add submodule " + path},
+	} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head.Hash()
+}
+
+func TestSyncSite_Submodules(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+
+	// site.git -> themes/base (theme.git) -> fonts (fonts.git)
+	_, fontsCommit := newServedRepo(t, root, "fonts.git", map[string]string{"font.txt": "font"})
+	theme, _ := newServedRepo(t, root, "theme.git", map[string]string{"theme.css": "v1"})
+	themeCommit := commitTestSubmodule(t, theme, "fonts", "../fonts.git", fontsCommit)
+	siteRepo, _ := newServedRepo(t, root, "site.git", map[string]string{"index.html": "home"})
+	commitTestSubmodule(t, siteRepo, "themes/base", baseURL+"/theme.git", themeCommit)
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Submodules: true}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "themes/base/theme.css"); got != "v1" {
+		t.Errorf("themes/base/theme.css = %q, want v1", got)
+	}
+	if got := readSiteFile(t, s, "default--site", "themes/base/fonts/font.txt"); got != "font" {
+		t.Errorf("nested submodule content = %q, want font", got)
+	}
+
+	// A new theme commit is deployed once the site's repo records it
+	themeCommit = commitTestFiles(t, theme, map[string]string{"theme.css": "v2"}, "Update theme")
+	wt, _ := siteRepo.Worktree()
+	cmd := exec.Command("git", "-C", wt.Filesystem.Root(), "update-index", "--cacheinfo", "160000,"+themeCommit.String()+",themes/base")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("update-index failed: %v\n%s", err, out)
+	}
+	cmd = exec.Command("git", "-C", wt.Filesystem.Root(), "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "Update theme")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("commit failed: %v\n%s", err, out)
+	}
+
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("second syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "themes/base/theme.css"); got != "v2" {
+		t.Errorf("themes/base/theme.css after update = %q, want v2", got)
+	}
+	if got := readSiteFile(t, s, "default--site", "themes/base/fonts/font.txt"); got != "font" {
+		t.Errorf("nested submodule content after update = %q, want font", got)
+	}
+	for _, path := range []string{"themes/base/.git", "themes/base/fonts/.git"} {
+		if _, err := os.Lstat(filepath.Join(s.SitesRoot, "default--site", path)); !os.IsNotExist(err) {
+			t.Errorf("%s is served", path)
+		}
+	}
+
+	// Turning submodules off empties them in the checkout
+	site.Submodules = false
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() without submodules error = %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.repoDir("default--site"), "themes", "base"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("submodule directory not emptied: %v, %v", entries, err)
+	}
+}
+
+func TestSyncSite_SubmodulesDisabled(t *testing.T) {
+	root, baseURL := newTestGitServer(t)
+
+	_, themeCommit := newServedRepo(t, root, "theme.git", map[string]string{"theme.css": "v1"})
+	siteRepo, _ := newServedRepo(t, root, "site.git", map[string]string{"index.html": "home"})
+	commitTestSubmodule(t, siteRepo, "theme", "https://evil.example.com/theme.git", themeCommit)
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master"}
+
+	// Without spec.submodules the URL is never looked at
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "home" {
+		t.Errorf("index.html = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(s.SitesRoot, "default--site", "theme", "theme.css")); !os.IsNotExist(err) {
+		t.Error("submodule was checked out without spec.submodules")
+	}
+}
+
+func TestSyncSite_SubmoduleValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		module  string
+		url     string
+		wantErr string
+	}{
+		{"host not allowed", "theme", "https://evil.example.com/theme.git", "not in allowed hosts"},
+		{"local path", "theme", "/etc/theme", "unsupported scheme"},
+		{"file URL", "theme", "file:///srv/theme.git", "unsupported scheme"},
+		{"name outside checkout", "../../escape", "../theme.git", "invalid path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, baseURL := newTestGitServer(t)
+			_, themeCommit := newServedRepo(t, root, "theme.git", map[string]string{"theme.css": "v1"})
+			siteRepo, _ := newServedRepo(t, root, "site.git", map[string]string{"index.html": "home"})
+			wt, _ := siteRepo.Worktree()
+			modules := fmt.Sprintf("[submodule %q]\n\tpath = theme\n\turl = %s\n", tt.module, tt.url)
+			if err := os.WriteFile(filepath.Join(wt.Filesystem.Root(), ".gitmodules"), []byte(modules), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wt.Add(".gitmodules"); err != nil {
+				t.Fatal(err)
+			}
+			commitTestSubmodule(t, siteRepo, "theme-ok", "../theme.git", themeCommit)
+
+			s := &Syncer{
+				SitesRoot:     t.TempDir(),
+				AllowedHosts:  []string{"127.0.0.1"},
+				DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+				ClientSet:     newFakeClientset(),
+			}
+			site := &staticSiteData{Name: "site", Namespace: "default", Repo: baseURL + "/site.git", Branch: "master", Submodules: true}
+
+			err := s.syncSite(context.Background(), site)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("syncSite() error = %v, want %q", err, tt.wantErr)
+			}
+			if s.currentRelease("default--site") != "" {
+				t.Error("site was published despite an invalid submodule")
+			}
+		})
+	}
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	tests := []struct {
+		parent string
+		sub    string
+		want   string
+	}{
+		{"https://github.com/org/site.git", "https://github.com/org/theme.git", "https://github.com/org/theme.git"},
+		{"https://github.com/org/site.git", "../theme.git", "https://github.com/org/theme.git"},
+		{"https://github.com/org/site.git", "../../other/theme.git", "https://github.com/other/theme.git"},
+		{"https://github.com/org/site.git", "./theme.git", "https://github.com/org/site.git/theme.git"},
+		{"ssh://git@github.com:2222/org/site.git", "../theme.git", "ssh://git@github.com:2222/org/theme.git"},
+		{"git@github.com:org/site.git", "../theme.git", "git@github.com:org/theme.git"},
+		{"https://github.com/site.git", "../../../theme.git", "https://github.com/theme.git"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sub, func(t *testing.T) {
+			got, err := resolveSubmoduleURL(tt.parent, tt.sub)
+			if err != nil {
+				t.Fatalf("resolveSubmoduleURL() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveSubmoduleURL(%q, %q) = %q, want %q", tt.parent, tt.sub, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathOverlaps(t *testing.T) {
+	tests := []struct {
+		modulePath string
+		subpath    string
+		want       bool
+	}{
+		{"themes/base", "", true},
+		{"themes/base", "themes/base", true},
+		{"dist/theme", "dist", true},
+		{"themes/base", "themes/base/static", true},
+		{"themes/base", "dist", false},
+		{"distribution", "dist", false},
+		{"dist", "distribution", false},
+	}
+
+	for _, tt := range tests {
+		if got := pathOverlaps(tt.modulePath, tt.subpath); got != tt.want {
+			t.Errorf("pathOverlaps(%q, %q) = %v, want %v", tt.modulePath, tt.subpath, got, tt.want)
+		}
+	}
+}
+
+func TestSubmoduleAuth(t *testing.T) {
+	auth := &http.BasicAuth{Username: "git", Password: "token"}
+
+	tests := []struct {
+		name     string
+		site     string
+		sub      string
+		wantAuth bool
+		wantErr  bool
+	}{
+		{"same host", "https://git.example.com/org/site.git", "https://git.example.com/org/theme.git", true, false},
+		{"other host", "https://git.example.com/org/site.git", "https://github.com/org/theme.git", false, false},
+		{"other port", "https://git.example.com/org/site.git", "https://git.example.com:8443/org/theme.git", false, false},
+		{"ssh on same host", "git@git.example.com:org/site.git", "git@git.example.com:org/theme.git", true, false},
+		{"https next to ssh", "git@git.example.com:org/site.git", "https://git.example.com/org/theme.git", false, false},
+		{"ssh on other host", "git@git.example.com:org/site.git", "git@github.com:org/theme.git", false, true},
+		{"ssh next to https", "https://git.example.com/org/site.git", "ssh://git@git.example.com/org/theme.git", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := submoduleAuth(tt.site, tt.sub, auth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("submoduleAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got != nil) != tt.wantAuth {
+				t.Errorf("submoduleAuth() = %v, want credentials: %v", got, tt.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+// Package syncer - tag selection for sites tracking tags
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// tagSelector selects the tag to deploy, see v1beta1.TagSelector
+type tagSelector struct {
+	Semver  string
+	Pattern string
+}
+
+// selectTag lists the remote tags and returns the highest one matching the
+// site's tag selector. An existing checkout is asked through its origin,
+// otherwise the repo URL is queried directly.
+func (s *Syncer) selectTag(ctx context.Context, destDir string, site *staticSiteData, access *gitAccess) (string, error) {
+	var remote *git.Remote
+	if repo, err := openCheckout(destDir); err == nil {
+		remote, err = repo.Remote("origin")
+		if err != nil {
+			return "", fmt.Errorf("failed to get remote: %w", err)
+		}
+	} else {
+		remote = git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: "origin",
+			URLs: []string{site.Repo},
+		})
+	}
+
+	listOpts := &git.ListOptions{
+		Auth:         access.auth,
+		CABundle:     access.caBundle,
+		ProxyOptions: access.proxyOptions(site.Repo),
+	}
+	refs, err := remote.ListContext(ctx, listOpts)
+	if err != nil {
+		return "", fmt.Errorf("failed to list remote tags: %w", err)
+	}
+
+	var tags []string
+	for _, ref := range refs {
+		if ref.Name().IsTag() {
+			tags = append(tags, ref.Name().Short())
+		}
+	}
+
+	tag, err := site.TagSelector.highest(tags)
+	if err != nil {
+		return "", err
+	}
+	if tag == "" {
+		return "", fmt.Errorf("no tag matches %s", site.TagSelector)
+	}
+	return tag, nil
+}
+
+// String describes the selector for status and error messages
+func (t *tagSelector) String() string {
+	if t.Semver != "" {
+		return fmt.Sprintf("semver constraint %q", t.Semver)
+	}
+	return fmt.Sprintf("pattern %q", t.Pattern)
+}
+
+// highest returns the highest tag matching the selector, or "" if none does
+func (t *tagSelector) highest(tags []string) (string, error) {
+	switch {
+	case t.Semver != "" && t.Pattern != "":
+		return "", fmt.Errorf("tagSelector: semver and pattern are mutually exclusive")
+	case t.Semver != "":
+		constraint, err := parseConstraint(t.Semver)
+		if err != nil {
+			return "", fmt.Errorf("tagSelector: %w", err)
+		}
+		best, bestTag := semver{}, ""
+		for _, tag := range tags {
+			v, err := parseSemver(tag)
+			if err != nil || !constraint.matches(v) {
+				continue
+			}
+			if bestTag == "" || v.compare(best) > 0 {
+				best, bestTag = v, tag
+			}
+		}
+		return bestTag, nil
+	case t.Pattern != "":
+		if _, err := path.Match(t.Pattern, ""); err != nil {
+			return "", fmt.Errorf("tagSelector: invalid pattern %q: %w", t.Pattern, err)
+		}
+		bestTag := ""
+		for _, tag := range tags {
+			if ok, _ := path.Match(t.Pattern, tag); !ok {
+				continue
+			}
+			if bestTag == "" || naturalCompare(tag, bestTag) > 0 {
+				bestTag = tag
+			}
+		}
+		return bestTag, nil
+	default:
+		return "", fmt.Errorf("tagSelector: one of semver or pattern is required")
+	}
+}
+
+// semver is a parsed semantic version. Build metadata is dropped as it
+// doesn't take part in precedence.
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseSemver parses MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] with an optional "v" prefix
+func parseSemver(s string) (semver, error) {
+	v, err := parseVersion(s, false)
+	if err != nil {
+		return semver{}, err
+	}
+	return v.semver, nil
+}
+
+// partialVersion is a version in a constraint, where minor and patch may be omitted
+type partialVersion struct {
+	semver
+	parts int
+}
+
+func parseVersion(s string, partial bool) (partialVersion, error) {
+	orig := s
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	var v partialVersion
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.prerelease = strings.Split(s[i+1:], ".")
+		for _, id := range v.prerelease {
+			if id == "" {
+				return v, fmt.Errorf("invalid version %q", orig)
+			}
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 || (!partial && len(parts) != 3) || (v.prerelease != nil && len(parts) != 3) {
+		return v, fmt.Errorf("invalid version %q", orig)
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || (len(p) > 1 && p[0] == '0') {
+			return v, fmt.Errorf("invalid version %q", orig)
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	v.parts = len(parts)
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 following semver precedence rules
+func (v semver) compare(o semver) int {
+	for _, d := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	// A version without prerelease is higher than one with
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		an, aErr := strconv.Atoi(a)
+		bn, bErr := strconv.Atoi(b)
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aErr == nil:
+			// Numeric identifiers have lower precedence
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a, b); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(v.prerelease) - len(o.prerelease))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// comparator is a single condition like ">=1.2.0"
+type comparator struct {
+	op      string
+	version semver
+}
+
+func (c comparator) matches(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default: // "<="
+		return cmp <= 0
+	}
+}
+
+// constraint is a list of alternatives (separated by "||"), each a list of
+// comparators that must all match
+type constraint [][]comparator
+
+// parseConstraint parses constraints like ">=1.2.0 <2.0.0", "~1.4", "^2" or
+// "1.x || >=3.0.0". Comparators are separated by spaces or commas.
+func parseConstraint(s string) (constraint, error) {
+	var c constraint
+	for _, alternative := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(alternative, func(r rune) bool { return r == ' ' || r == ',' })
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid semver constraint %q", s)
+		}
+		var all []comparator
+		for _, field := range fields {
+			comparators, err := parseComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver constraint %q: %w", s, err)
+			}
+			all = append(all, comparators...)
+		}
+		c = append(c, all)
+	}
+	return c, nil
+}
+
+// parseComparator expands one constraint term into plain comparators
+func parseComparator(term string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(term, candidate) {
+			op = candidate
+			break
+		}
+	}
+	raw := strings.TrimPrefix(term, op)
+
+	// "1.x" and "1.*" are shorthands for "1"
+	for _, wildcard := range []string{".x", ".X", ".*"} {
+		for strings.HasSuffix(raw, wildcard) {
+			raw = strings.TrimSuffix(raw, wildcard)
+		}
+	}
+	if raw == "*" || raw == "x" || raw == "X" {
+		if op != "" {
+			return nil, fmt.Errorf("invalid term %q", term)
+		}
+		return []comparator{{op: ">=", version: semver{}}}, nil
+	}
+
+	v, err := parseVersion(raw, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// upper returns the next version after the first n parts
+	upper := func(n int) semver {
+		switch n {
+		case 1:
+			return semver{major: v.major + 1}
+		case 2:
+			return semver{major: v.major, minor: v.minor + 1}
+		default:
+			return semver{major: v.major, minor: v.minor, patch: v.patch + 1}
+		}
+	}
+	lower := comparator{op: ">=", version: v.semver}
+
+	switch op {
+	case "~":
+		// ~1.2.3 := >=1.2.3 <1.3.0, ~1 := >=1.0.0 <2.0.0
+		n := 2
+		if v.parts == 1 {
+			n = 1
+		}
+		return []comparator{lower, {op: "<", version: upper(n)}}, nil
+	case "^":
+		// ^1.2.3 := >=1.2.3 <2.0.0, ^0.2.3 := <0.3.0, ^0.0.3 := <0.0.4
+		n := 1
+		if v.major == 0 && v.parts > 1 {
+			n = 2
+			if v.minor == 0 && v.parts > 2 {
+				n = 3
+			}
+		}
+		return []comparator{lower, {op: "<", version: upper(n)}}, nil
+	case "", "=":
+		if v.parts == 3 {
+			return []comparator{{op: "=", version: v.semver}}, nil
+		}
+		return []comparator{lower, {op: "<", version: upper(v.parts)}}, nil
+	case ">":
+		if v.parts < 3 {
+			// >1.2 means >=1.3.0
+			return []comparator{{op: ">=", version: upper(v.parts)}}, nil
+		}
+	case "<=":
+		if v.parts < 3 {
+			// <=1.2 means <1.3.0
+			return []comparator{{op: "<", version: upper(v.parts)}}, nil
+		}
+	}
+	return []comparator{{op: op, version: v.semver}}, nil
+}
+
+// matches reports whether v satisfies the constraint. Prerelease versions
+// only match alternatives that mention a prerelease of the same
+// MAJOR.MINOR.PATCH, so "^1.2.0" never deploys "1.3.0-rc.1".
+func (c constraint) matches(v semver) bool {
+	for _, all := range c {
+		ok := true
+		prereleaseAllowed := len(v.prerelease) == 0
+		for _, comp := range all {
+			if !comp.matches(v) {
+				ok = false
+				break
+			}
+			cv := comp.version
+			if len(cv.prerelease) > 0 && cv.major == v.major && cv.minor == v.minor && cv.patch == v.patch {
+				prereleaseAllowed = true
+			}
+		}
+		if ok && prereleaseAllowed {
+			return true
+		}
+	}
+	return false
+}
+
+// naturalCompare compares strings with embedded numbers by numeric value,
+// so "release-10" sorts after "release-9"
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		ad, bd := isDigit(a[0]), isDigit(b[0])
+		switch {
+		case ad && bd:
+			an, arest := splitDigits(a)
+			bn, brest := splitDigits(b)
+			// Compare by value: strip leading zeros, longer is bigger
+			at, bt := strings.TrimLeft(an, "0"), strings.TrimLeft(bn, "0")
+			if len(at) != len(bt) {
+				return sign(len(at) - len(bt))
+			}
+			if c := strings.Compare(at, bt); c != 0 {
+				return c
+			}
+			a, b = arest, brest
+		case a[0] != b[0]:
+			return sign(int(a[0]) - int(b[0]))
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return sign(len(a) - len(b))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// splitDigits splits a string into its leading run of digits and the rest
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,271 @@
+package syncer
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.0.0+build.1", "1.0.0", 0},
+		{"1.0.1", "1.0.0", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			a, err := parseSemver(tt.a)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) error = %v", tt.a, err)
+			}
+			b, err := parseSemver(tt.b)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) error = %v", tt.b, err)
+			}
+			if got := a.compare(b); got != tt.want {
+				t.Errorf("compare() = %d, want %d", got, tt.want)
+			}
+			if got := b.compare(a); got != -tt.want {
+				t.Errorf("reverse compare() = %d, want %d", got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSemver_Invalid(t *testing.T) {
+	for _, s := range []string{"", "1", "1.2", "1.2.3.4", "01.2.3", "1.2.x", "release-1.2.3", "1.2.3-", "1.2.3-rc..1"} {
+		if _, err := parseSemver(s); err == nil {
+			t.Errorf("parseSemver(%q) expected error, got nil", s)
+		}
+	}
+}
+
+func TestConstraintMatches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{">=1.2.0 <2.0.0", "1.2.0", true},
+		{">=1.2.0 <2.0.0", "1.9.9", true},
+		{">=1.2.0 <2.0.0", "2.0.0", false},
+		{">=1.2.0 <2.0.0", "1.1.9", false},
+		{">=1.2.0, <2.0.0", "1.5.0", true},
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"!=1.2.3", "1.2.4", true},
+		{">1.2.3", "1.2.3", false},
+		{">1.2", "1.2.9", false},
+		{">1.2", "1.3.0", true},
+		{"<=1.2", "1.2.9", true},
+		{"<=1.2", "1.3.0", false},
+		{"~1.4", "1.4.7", true},
+		{"~1.4", "1.5.0", false},
+		{"~1.4.2", "1.4.1", false},
+		{"~1", "1.9.0", true},
+		{"^1.4", "1.9.0", true},
+		{"^1.4", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.4", false},
+		{"1.x", "1.7.0", true},
+		{"1.x", "2.0.0", false},
+		{"1.2.*", "1.2.5", true},
+		{"*", "3.1.4", true},
+		{"1.x || >=3.0.0", "2.5.0", false},
+		{"1.x || >=3.0.0", "3.0.0", true},
+		{"v1.2.0", "1.2.0", true},
+		// Prereleases only match when the constraint asks for them
+		{"^1.2.0", "1.3.0-rc.1", false},
+		{"*", "1.0.0-rc.1", false},
+		{">=1.3.0-rc.1", "1.3.0-rc.2", true},
+		{">=1.3.0-rc.1", "1.4.0-rc.1", false},
+		{">=1.3.0-rc.1", "1.4.0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			c, err := parseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("parseConstraint(%q) error = %v", tt.constraint, err)
+			}
+			v, err := parseSemver(tt.version)
+			if err != nil {
+				t.Fatalf("parseSemver(%q) error = %v", tt.version, err)
+			}
+			if got := c.matches(v); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConstraint_Invalid(t *testing.T) {
+	for _, s := range []string{"", "||", ">=", "latest", ">=1.2.3.4", ">*", "1.2 ||"} {
+		if _, err := parseConstraint(s); err == nil {
+			t.Errorf("parseConstraint(%q) expected error, got nil", s)
+		}
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"release-9", "release-10", -1},
+		{"release-10", "release-10", 0},
+		{"release-1.10.0", "release-1.9.0", 1},
+		{"release-007", "release-7", 0},
+		{"release-a", "release-b", -1},
+		{"release", "release-1", -1},
+		{"2024-01-15", "2024-01-02", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			if got := naturalCompare(tt.a, tt.b); got != tt.want {
+				t.Errorf("naturalCompare() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagSelectorHighest(t *testing.T) {
+	tags := []string{"v1.0.0", "v1.2.0", "v1.10.1", "v2.0.0-rc.1", "v2.0.0", "release-9", "release-10", "nightly"}
+
+	tests := []struct {
+		name     string
+		selector tagSelector
+		want     string
+		wantErr  string
+	}{
+		{name: "semver range", selector: tagSelector{Semver: ">=1.2.0 <2.0.0"}, want: "v1.10.1"},
+		{name: "semver caret", selector: tagSelector{Semver: "^2"}, want: "v2.0.0"},
+		{name: "semver prerelease", selector: tagSelector{Semver: ">=2.0.0-rc.1 <2.0.0"}, want: "v2.0.0-rc.1"},
+		{name: "semver no match", selector: tagSelector{Semver: ">=3.0.0"}, want: ""},
+		{name: "glob", selector: tagSelector{Pattern: "release-*"}, want: "release-10"},
+		{name: "glob exact", selector: tagSelector{Pattern: "nightly"}, want: "nightly"},
+		{name: "glob no match", selector: tagSelector{Pattern: "stable-*"}, want: ""},
+		{name: "invalid constraint", selector: tagSelector{Semver: "latest"}, wantErr: "invalid semver constraint"},
+		{name: "invalid glob", selector: tagSelector{Pattern: "release-["}, wantErr: "invalid pattern"},
+		{name: "both set", selector: tagSelector{Semver: "^1", Pattern: "release-*"}, wantErr: "mutually exclusive"},
+		{name: "none set", selector: tagSelector{}, wantErr: "required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selector.highest(tags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("highest() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("highest() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("highest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSite_TagSelector(t *testing.T) {
+	repoURL, remoteRepo, commit1 := newServedTestRemote(t, map[string]string{"index.html": "1.0.0"})
+	if _, err := remoteRepo.CreateTag("v1.0.0", commit1, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+	commit2 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "1.1.0"}, "Release 1.1.0")
+	if _, err := remoteRepo.CreateTag("v1.1.0", commit2, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+	commit3 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "2.0.0"}, "Release 2.0.0")
+	if _, err := remoteRepo.CreateTag("v2.0.0", commit3, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	fakeClient := &fakeDynamicClient{activeSites: []string{"test-site"}}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:        "test-site",
+		Namespace:   "default",
+		Repo:        repoURL,
+		Branch:      "master",
+		TagSelector: &tagSelector{Semver: "^1.0.0"},
+		Path:        "/",
+	}
+
+	ctx := context.Background()
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "1.1.0" {
+		t.Errorf("index.html = %q, want %q", got, "1.1.0")
+	}
+	if site.Tag != "" {
+		t.Errorf("syncSite() modified the site, Tag = %q", site.Tag)
+	}
+	if !strings.Contains(string(fakeClient.lastPatch), "Synced tag v1.1.0") {
+		t.Errorf("status patch does not mention the tag: %s", fakeClient.lastPatch)
+	}
+
+	// A new matching tag gets deployed on the next sync
+	commit4 := commitTestFiles(t, remoteRepo, map[string]string{"index.html": "1.2.0"}, "Release 1.2.0")
+	if _, err := remoteRepo.CreateTag("v1.2.0", commit4, nil); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+	if err := s.syncSite(ctx, site); err != nil {
+		t.Fatalf("syncSite() second call error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--test-site", "index.html"); got != "1.2.0" {
+		t.Errorf("index.html after new tag = %q, want %q", got, "1.2.0")
+	}
+}
+
+func TestSyncSite_TagSelectorNoMatch(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"test-site"}},
+		ClientSet:     newFakeClientset(),
+	}
+
+	site := &staticSiteData{
+		Name:        "test-site",
+		Namespace:   "default",
+		Repo:        repoURL,
+		Branch:      "master",
+		TagSelector: &tagSelector{Pattern: "release-*"},
+		Path:        "/",
+	}
+
+	err := s.syncSite(context.Background(), site)
+	if err == nil {
+		t.Fatal("expected error when no tag matches, got nil")
+	}
+	if !strings.Contains(err.Error(), `no tag matches pattern "release-*"`) {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
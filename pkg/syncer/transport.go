@@ -0,0 +1,133 @@
+// Package syncer - CA bundles and proxies for outgoing requests
+package syncer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// caBundleKey is the key of a site's Secret holding additional CA
+// certificates for its source host
+const caBundleKey = "ca.crt"
+
+// gitAccess is what every request to a site's Git remote is made with
+type gitAccess struct {
+	auth transport.AuthMethod
+
+	// caBundle holds PEM certificates trusted in addition to the system roots
+	caBundle []byte
+
+	// proxy is the proxy URL for HTTP(S) remotes, empty for none
+	proxy string
+}
+
+// proxyOptions returns the proxy options for requests to repoURL. SSH
+// remotes are always reached directly.
+func (a *gitAccess) proxyOptions(repoURL string) transport.ProxyOptions {
+	remote, err := parseRemoteURL(repoURL)
+	if a.proxy == "" || err != nil || remote.Scheme == "ssh" {
+		return transport.ProxyOptions{}
+	}
+	return transport.ProxyOptions{URL: a.proxy}
+}
+
+// gitAccess returns the credentials, CA bundle and proxy for the site's repo
+func (s *Syncer) gitAccess(ctx context.Context, site *staticSiteData) (*gitAccess, error) {
+	auth, err := s.gitAuth(ctx, site)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git credentials: %w", err)
+	}
+	caBundle, err := s.caBundle(ctx, site.Namespace, site.SecretRef)
+	if err != nil {
+		return nil, err
+	}
+	return &gitAccess{auth: auth, caBundle: caBundle, proxy: s.GitProxy}, nil
+}
+
+// caBundle returns GitCABundle plus the ca.crt entry of a site's Secret, if
+// it has one
+func (s *Syncer) caBundle(ctx context.Context, namespace string, ref *secretRef) ([]byte, error) {
+	bundle := s.GitCABundle
+	if ref == nil {
+		return bundle, nil
+	}
+	secret, err := s.ClientSet.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA bundle: %w", err)
+	}
+	siteBundle, ok := secret.Data[caBundleKey]
+	if !ok {
+		return bundle, nil
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(siteBundle) {
+		return nil, fmt.Errorf("no certificates in %s of secret %s", caBundleKey, ref.Name)
+	}
+	// A fresh slice, the global bundle is shared
+	return append(append([]byte{}, bundle...), append([]byte("\n"), siteBundle...)...), nil
+}
+
+// transportCache holds the HTTP transports of the CA bundles in use, so
+// connections are reused across requests
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// httpTransport returns the transport for HTTP requests of sites that trust
+// caBundle, through GitProxy. Without either, http.DefaultTransport is used.
+func (s *Syncer) httpTransport(caBundle []byte) (http.RoundTripper, error) {
+	if len(caBundle) == 0 && s.GitProxy == "" {
+		return http.DefaultTransport, nil
+	}
+
+	s.transports.mu.Lock()
+	defer s.transports.mu.Unlock()
+	if t, ok := s.transports.transports[string(caBundle)]; ok {
+		return t, nil
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if len(caBundle) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates in CA bundle")
+		}
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.RootCAs = roots
+	}
+	if s.GitProxy != "" {
+		proxy, err := url.Parse(s.GitProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+
+	if s.transports.transports == nil {
+		s.transports.transports = map[string]*http.Transport{}
+	}
+	s.transports.transports[string(caBundle)] = t
+	return t, nil
+}
+
+// httpClient returns a client for HTTP requests of sites that trust caBundle
+func (s *Syncer) httpClient(caBundle []byte) (*http.Client, error) {
+	t, err := s.httpTransport(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,140 @@
+package syncer
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestGitTLSServer serves the repositories below its root directory over
+// HTTPS with a self-signed certificate. It returns the root, the base URL
+// and the certificate in PEM format.
+func newTestGitTLSServer(t *testing.T) (string, string, []byte) {
+	t.Helper()
+
+	root, handler := newGitHTTPBackend(t)
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	return root, srv.URL, ca
+}
+
+// newTestProxy forwards requests like an HTTP proxy and counts them
+func newTestProxy(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var count atomic.Int32
+	proxy := &httputil.ReverseProxy{Rewrite: func(r *httputil.ProxyRequest) {
+		r.SetURL(&url.URL{Scheme: r.In.URL.Scheme, Host: r.In.URL.Host})
+	}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		count.Add(1)
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+func TestSyncSite_CABundle(t *testing.T) {
+	root, baseURL, ca := newTestGitTLSServer(t)
+	newServedRepo(t, root, "site.git", map[string]string{"index.html": "internal"})
+
+	newSyncer := func(secretData map[string][]byte) *Syncer {
+		return &Syncer{
+			SitesRoot:     t.TempDir(),
+			AllowedHosts:  []string{"127.0.0.1"},
+			DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+			ClientSet:     newFakeClientset(newTestSecret("default", "git", secretData)),
+		}
+	}
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Repo: baseURL + "/site.git", Branch: "master",
+		SecretRef: &secretRef{Name: "git"},
+	}
+
+	// An unknown CA is rejected
+	s := newSyncer(map[string][]byte{"password": []byte("token")})
+	if err := s.syncSite(context.Background(), site); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("syncSite() without CA bundle error = %v", err)
+	}
+
+	// ca.crt in the site's Secret
+	s = newSyncer(map[string][]byte{"password": []byte("token"), "ca.crt": ca})
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with ca.crt error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "internal" {
+		t.Errorf("index.html = %q, want internal", got)
+	}
+
+	// The global bundle, for sites without a Secret as well
+	s = newSyncer(nil)
+	s.GitCABundle = ca
+	anonymous := *site
+	anonymous.SecretRef = nil
+	if err := s.syncSite(context.Background(), &anonymous); err != nil {
+		t.Fatalf("syncSite() with global CA bundle error = %v", err)
+	}
+
+	// ca.crt must hold certificates
+	s = newSyncer(map[string][]byte{"password": []byte("token"), "ca.crt": []byte("not a certificate")})
+	if err := s.syncSite(context.Background(), site); err == nil || !strings.Contains(err.Error(), "no certificates in ca.crt") {
+		t.Errorf("syncSite() with invalid ca.crt error = %v", err)
+	}
+}
+
+func TestSyncSite_GitProxy(t *testing.T) {
+	proxy, requests := newTestProxy(t)
+
+	root, baseURL := newTestGitServer(t)
+	newServedRepo(t, root, "site.git", map[string]string{"index.html": "proxied"})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site", "archive"}},
+		ClientSet:     newFakeClientset(),
+		GitProxy:      proxy.URL,
+	}
+	site := &staticSiteData{Name: "site", Namespace: "default", Path: "/", Repo: baseURL + "/site.git", Branch: "master"}
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "proxied" {
+		t.Errorf("index.html = %q, want proxied", got)
+	}
+	if requests.Load() == 0 {
+		t.Fatal("clone didn't go through the proxy")
+	}
+
+	// Other sources use the proxy as well
+	before := requests.Load()
+	srv := newTestArchiveServer(t, tarGz(t, map[string]string{"index.html": "archive"}))
+	archive := &staticSiteData{Name: "archive", Namespace: "default", Path: "/", Archive: &archiveSource{URL: srv.server.URL + "/site.tar.gz"}}
+	if err := s.syncSite(context.Background(), archive); err != nil {
+		t.Fatalf("syncSite() for archive error = %v", err)
+	}
+	if requests.Load() == before {
+		t.Error("archive download didn't go through the proxy")
+	}
+}
+
+func TestGitAccessProxyOptions(t *testing.T) {
+	access := &gitAccess{proxy: "http://proxy.example.com:3128"}
+	if got := access.proxyOptions("https://example.com/repo.git").URL; got != access.proxy {
+		t.Errorf("proxy for HTTPS = %q", got)
+	}
+	if got := access.proxyOptions("git@example.com:repo.git").URL; got != "" {
+		t.Errorf("proxy for SSH = %q, want none", got)
+	}
+}
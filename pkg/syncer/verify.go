@@ -0,0 +1,288 @@
+// Package syncer - commit signature verification
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/ssh"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	pagesv1 "github.com/kup6s/pages/pkg/apis/v1beta1"
+)
+
+const (
+	// sshSignatureNamespace is the namespace Git signs commits in with SSH keys
+	sshSignatureNamespace = "git"
+
+	// pgpKeyBlockHeader starts an ASCII-armored OpenPGP public key block
+	pgpKeyBlockHeader = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+)
+
+// errUnverified is returned when the commit to check out isn't signed by a
+// trusted key
+var errUnverified = errors.New("commit signature not verified")
+
+// trustedKeys are the keys the commits of a site must be signed with
+type trustedKeys struct {
+	// pgp holds armored OpenPGP key rings
+	pgp []string
+	ssh []trustedSSHKey
+}
+
+// trustedSSHKey is an SSH public key and who it belongs to
+type trustedSSHKey struct {
+	key      ssh.PublicKey
+	identity string
+}
+
+// verifyCommit checks that commit is signed by one of the site's trusted
+// keys before it gets checked out. The result is reported as Verified
+// condition of the site; the signer's identity is in its message.
+func (s *Syncer) verifyCommit(ctx context.Context, repo *git.Repository, site *staticSiteData, commit plumbing.Hash) error {
+	if site.Verification == nil {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+
+	signer, reason, err := s.commitSigner(ctx, repo, site, commit)
+	if err != nil {
+		s.setCondition(ctx, site, metav1.Condition{
+			Type:    pagesv1.ConditionVerified,
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: fmt.Sprintf("Commit %s was not published: %v", shortHash(commit.String()), err),
+		})
+		return fmt.Errorf("refusing to check out commit %s: %w", shortHash(commit.String()), err)
+	}
+
+	s.setCondition(ctx, site, metav1.Condition{
+		Type:    pagesv1.ConditionVerified,
+		Status:  metav1.ConditionTrue,
+		Reason:  "TrustedSignature",
+		Message: fmt.Sprintf("Commit %s is signed by %s", shortHash(commit.String()), signer),
+	})
+	logger.Info("Verified commit signature", "site", site.Name, "commit", shortHash(commit.String()), "signer", signer)
+	return nil
+}
+
+// commitSigner returns who signed commit with one of the site's trusted
+// keys. On failure, reason tells why for the Verified condition.
+func (s *Syncer) commitSigner(ctx context.Context, repo *git.Repository, site *staticSiteData, hash plumbing.Hash) (signer, reason string, err error) {
+	keys, err := s.loadTrustedKeys(ctx, site)
+	if err != nil {
+		return "", "TrustedKeysUnavailable", err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return "", "CommitUnreadable", err
+	}
+
+	signature := strings.TrimSpace(commit.PGPSignature)
+	if signature == "" {
+		return "", "Unsigned", fmt.Errorf("%w: commit is not signed", errUnverified)
+	}
+
+	if strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----") {
+		encoded := &plumbing.MemoryObject{}
+		if err := commit.EncodeWithoutSignature(encoded); err != nil {
+			return "", "CommitUnreadable", err
+		}
+		reader, err := encoded.Reader()
+		if err != nil {
+			return "", "CommitUnreadable", err
+		}
+		message, err := io.ReadAll(reader)
+		if err != nil {
+			return "", "CommitUnreadable", err
+		}
+		key, err := verifySSHSignature(signature, message)
+		if err != nil {
+			return "", "InvalidSignature", fmt.Errorf("%w: %w", errUnverified, err)
+		}
+		for _, trusted := range keys.ssh {
+			if bytes.Equal(trusted.key.Marshal(), key.Marshal()) {
+				return fmt.Sprintf("%s (SSH key %s)", trusted.identity, ssh.FingerprintSHA256(key)), "", nil
+			}
+		}
+		return "", "UnknownKey", fmt.Errorf("%w: signed with unknown SSH key %s", errUnverified, ssh.FingerprintSHA256(key))
+	}
+
+	// Every key ring is tried on its own; an unknown issuer only means the
+	// key is in another one
+	var invalid error
+	for _, keyRing := range keys.pgp {
+		entity, err := commit.Verify(keyRing)
+		if errors.Is(err, pgperrors.ErrUnknownIssuer) {
+			continue
+		}
+		if err != nil {
+			invalid = err
+			continue
+		}
+		identity := entity.PrimaryKey.KeyIdString()
+		if id := entity.PrimaryIdentity(); id != nil {
+			identity = id.Name
+		}
+		return fmt.Sprintf("%s (OpenPGP key %X)", identity, entity.PrimaryKey.Fingerprint), "", nil
+	}
+	if invalid != nil {
+		return "", "InvalidSignature", fmt.Errorf("%w: %w", errUnverified, invalid)
+	}
+	return "", "UnknownKey", fmt.Errorf("%w: not signed by a trusted OpenPGP key", errUnverified)
+}
+
+// loadTrustedKeys reads the site's trusted keys from its verification
+// Secret. Every entry holds an ASCII-armored OpenPGP key block or SSH public
+// keys, one per line in authorized_keys or allowed_signers format.
+func (s *Syncer) loadTrustedKeys(ctx context.Context, site *staticSiteData) (*trustedKeys, error) {
+	secret, err := s.ClientSet.CoreV1().Secrets(site.Namespace).Get(ctx, site.Verification.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trusted keys: %w", err)
+	}
+
+	names := make([]string, 0, len(secret.Data))
+	for name := range secret.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := &trustedKeys{}
+	for _, name := range names {
+		data := secret.Data[name]
+		if bytes.Contains(data, []byte(pgpKeyBlockHeader)) {
+			if _, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err != nil {
+				return nil, fmt.Errorf("invalid OpenPGP key %s in secret %s: %w", name, secret.Name, err)
+			}
+			keys.pgp = append(keys.pgp, string(data))
+			continue
+		}
+		sshKeys, err := parseSSHSigners(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH keys %s in secret %s: %w", name, secret.Name, err)
+		}
+		keys.ssh = append(keys.ssh, sshKeys...)
+	}
+	if len(keys.pgp) == 0 && len(keys.ssh) == 0 {
+		return nil, fmt.Errorf("secret %s holds no trusted keys", secret.Name)
+	}
+	return keys, nil
+}
+
+// parseSSHSigners parses SSH public keys in authorized_keys format
+// ("<type> <key> [comment]") or allowed_signers format ("<principals>
+// [options] <type> <key>"). The identity of a key is its principals, its
+// comment or its fingerprint.
+func parseSSHSigners(data []byte) ([]trustedSSHKey, error) {
+	var keys []trustedSSHKey
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var trusted *trustedSSHKey
+		for i := 0; i+1 < len(fields) && trusted == nil; i++ {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[i] + " " + fields[i+1]))
+			if err != nil || key.Type() != fields[i] {
+				continue
+			}
+			identity := strings.Join(fields[i+2:], " ")
+			if i > 0 {
+				identity = fields[0]
+			}
+			if identity == "" {
+				identity = ssh.FingerprintSHA256(key)
+			}
+			trusted = &trustedSSHKey{key: key, identity: identity}
+		}
+		if trusted == nil {
+			return nil, fmt.Errorf("no public key in line %q", line)
+		}
+		keys = append(keys, *trusted)
+	}
+	return keys, nil
+}
+
+// sshSignature is the content of an armored SSH signature (sshsig)
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// verifySSHSignature verifies an armored SSH signature of message made in
+// the git namespace and returns the key it was made with
+func verifySSHSignature(armored string, message []byte) (ssh.PublicKey, error) {
+	block, _ := pem.Decode([]byte(armored))
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, fmt.Errorf("malformed SSH signature")
+	}
+	blob, ok := bytes.CutPrefix(block.Bytes, []byte("SSHSIG"))
+	if !ok {
+		return nil, fmt.Errorf("malformed SSH signature")
+	}
+	var sig sshSignature
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return nil, fmt.Errorf("malformed SSH signature: %w", err)
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return nil, fmt.Errorf("SSH signature is for namespace %q, not %q", sig.Namespace, sshSignatureNamespace)
+	}
+
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in SSH signature: %w", err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return nil, fmt.Errorf("malformed SSH signature: %w", err)
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSH signature hash %q", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	if err := key.Verify(sshSignedData(sig.Namespace, sig.HashAlgorithm, h.Sum(nil)), &signature); err != nil {
+		return nil, fmt.Errorf("bad SSH signature: %w", err)
+	}
+	return key, nil
+}
+
+// sshSignedData returns what an SSH signature of a message hash signs
+func sshSignedData(namespace, hashAlgorithm string, digest []byte) []byte {
+	return append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{namespace, "", hashAlgorithm, digest})...)
+}
@@ -0,0 +1,261 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/go-git/go-git/v5"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// sshCommitSigner signs commits with an SSH key like git does with
+// gpg.format=ssh
+type sshCommitSigner struct {
+	signer ssh.Signer
+}
+
+func newSSHCommitSigner(t *testing.T) sshCommitSigner {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshCommitSigner{signer: signer}
+}
+
+func (s sshCommitSigner) Sign(message io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(message)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum512(data)
+	sig, err := s.signer.Sign(rand.Reader, sshSignedData(sshSignatureNamespace, "sha512", digest[:]))
+	if err != nil {
+		return nil, err
+	}
+	blob := append([]byte("SSHSIG"), ssh.Marshal(sshSignature{
+		Version:       1,
+		PublicKey:     s.signer.PublicKey().Marshal(),
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	return pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}), nil
+}
+
+// authorizedKey returns the public key in authorized_keys format
+func (s sshCommitSigner) authorizedKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.signer.PublicKey())))
+}
+
+// newPGPKey returns an OpenPGP key and its armored public key block
+func newPGPKey(t *testing.T, name, email string) (*openpgp.Entity, string) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity(name, "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return entity, buf.String()
+}
+
+func TestSyncSite_Verification(t *testing.T) {
+	jane := newSSHCommitSigner(t)
+	john, johnPublic := newPGPKey(t, "John Maintainer", "john@example.com")
+	mallory := newSSHCommitSigner(t)
+	_, otherPublic := newPGPKey(t, "Other", "other@example.com")
+
+	repoURL, remoteRepo, _ := newServedTestRemote(t, map[string]string{"index.html": "unsigned"})
+	commitTestFilesWith(t, remoteRepo, map[string]string{"index.html": "v1"}, "Signed with SSH", &git.CommitOptions{Signer: jane})
+
+	client := &fakeDynamicClient{activeSites: []string{"site"}}
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: client,
+		ClientSet: newFakeClientset(newTestSecret("default", "maintainers", map[string][]byte{
+			"allowed_signers": []byte("# SSH keys\njane@example.com namespaces=\"git\" " + jane.authorizedKey() + "\n"),
+			"john.asc":        []byte(johnPublic),
+			"other.asc":       []byte(otherPublic),
+		})),
+	}
+	site := &staticSiteData{
+		Name: "site", Namespace: "default", Path: "/",
+		Repo: repoURL, Branch: "master",
+		Verification: &secretRef{Name: "maintainers"},
+	}
+
+	// Commits signed with a trusted SSH or OpenPGP key are published, the
+	// signer shows up in the Verified condition
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v1" {
+		t.Errorf("index.html = %q, want v1", got)
+	}
+	if !patchesContain(client, `"status":"True"`) || !patchesContain(client, "signed by jane@example.com (SSH key SHA256:") {
+		t.Errorf("Verified condition not reported: %s", client.lastPatch)
+	}
+
+	commitTestFilesWith(t, remoteRepo, map[string]string{"index.html": "v2"}, "Signed with OpenPGP", &git.CommitOptions{SignKey: john})
+	if err := s.syncSite(context.Background(), site); err != nil {
+		t.Fatalf("syncSite() with OpenPGP signature error = %v", err)
+	}
+	if got := readSiteFile(t, s, "default--site", "index.html"); got != "v2" {
+		t.Errorf("index.html = %q, want v2", got)
+	}
+	if !patchesContain(client, "signed by John Maintainer") || !patchesContain(client, "(OpenPGP key") {
+		t.Errorf("OpenPGP signer not reported")
+	}
+
+	// Anything else is refused before the worktree moves
+	rejected := []struct {
+		name       string
+		opts       *git.CommitOptions
+		wantErr    string
+		wantReason string
+	}{
+		{"unsigned", &git.CommitOptions{}, "commit is not signed", "Unsigned"},
+		{"unknown SSH key", &git.CommitOptions{Signer: mallory}, "unknown SSH key", "UnknownKey"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			commitTestFilesWith(t, remoteRepo, map[string]string{"index.html": tt.name}, tt.name, tt.opts)
+			err := s.syncSite(context.Background(), site)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("syncSite() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := readSiteFile(t, s, "default--site", "index.html"); got != "v2" {
+				t.Errorf("served index.html = %q, want v2", got)
+			}
+			checkout, _ := os.ReadFile(filepath.Join(s.repoDir("default--site"), "index.html"))
+			if string(checkout) != "v2" {
+				t.Errorf("checkout index.html = %q, want v2", checkout)
+			}
+			if !strings.Contains(string(client.lastPatch), `"status":"False"`) || !strings.Contains(string(client.lastPatch), tt.wantReason) {
+				t.Errorf("condition patch = %s", client.lastPatch)
+			}
+		})
+	}
+}
+
+func TestSyncSite_VerificationKeysMissing(t *testing.T) {
+	repoURL, _, _ := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"127.0.0.1"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(newTestSecret("default", "empty", map[string][]byte{})),
+	}
+
+	for _, name := range []string{"missing", "empty"} {
+		site := &staticSiteData{
+			Name: "site", Namespace: "default", Path: "/",
+			Repo: repoURL, Branch: "master",
+			Verification: &secretRef{Name: name},
+		}
+		if err := s.syncSite(context.Background(), site); err == nil {
+			t.Errorf("syncSite() with %s keys succeeded", name)
+		}
+		if s.currentRelease("default--site") != "" {
+			t.Errorf("site was published with %s keys", name)
+		}
+	}
+}
+
+func TestVerifySSHSignature(t *testing.T) {
+	signer := newSSHCommitSigner(t)
+	signature, err := signer.Sign(strings.NewReader("tree abc\n\nmessage\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := verifySSHSignature(string(signature), []byte("tree abc\n\nmessage\n"))
+	if err != nil {
+		t.Fatalf("verifySSHSignature() error = %v", err)
+	}
+	if !bytes.Equal(key.Marshal(), signer.signer.PublicKey().Marshal()) {
+		t.Error("verifySSHSignature() returned another key")
+	}
+
+	if _, err := verifySSHSignature(string(signature), []byte("tree abc\n\ntampered\n")); err == nil {
+		t.Error("tampered message verified")
+	}
+	if _, err := verifySSHSignature("-----BEGIN SSH SIGNATURE-----\nnonsense\n-----END SSH SIGNATURE-----\n", nil); err == nil {
+		t.Error("malformed signature verified")
+	}
+}
+
+func TestParseSSHSigners(t *testing.T) {
+	signer := newSSHCommitSigner(t)
+	key := signer.authorizedKey()
+
+	tests := []struct {
+		line     string
+		identity string
+	}{
+		{key + " jane@laptop", "jane@laptop"},
+		{"jane@example.com,j@example.com " + key, "jane@example.com,j@example.com"},
+		{`jane@example.com namespaces="git" ` + key, "jane@example.com"},
+		{key, ssh.FingerprintSHA256(signer.signer.PublicKey())},
+	}
+	for _, tt := range tests {
+		keys, err := parseSSHSigners([]byte(tt.line))
+		if err != nil {
+			t.Fatalf("parseSSHSigners(%q) error = %v", tt.line, err)
+		}
+		if len(keys) != 1 || keys[0].identity != tt.identity {
+			t.Errorf("parseSSHSigners(%q) = %+v, want identity %q", tt.line, keys, tt.identity)
+		}
+	}
+
+	if _, err := parseSSHSigners([]byte("jane@example.com not-a-key")); err == nil {
+		t.Error("line without key accepted")
+	}
+}
+
+func TestVerificationFromUnstructured(t *testing.T) {
+	site := &staticSiteData{}
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "site", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"repo":         "https://example.com/repo.git",
+			"verification": map[string]interface{}{"secretRef": map[string]interface{}{"name": "maintainers"}},
+		},
+	}}
+	if err := site.fromUnstructured(u); err != nil {
+		t.Fatal(err)
+	}
+	if site.Verification == nil || site.Verification.Name != "maintainers" {
+		t.Errorf("Verification = %+v", site.Verification)
+	}
+}
@@ -0,0 +1,129 @@
+// Package syncer - concurrency limits for syncs
+package syncer
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSyncWorkers is the default number of sites synced in parallel
+	DefaultSyncWorkers = 4
+
+	// DefaultMaxSyncsPerHost is the default number of parallel syncs against one Git host
+	DefaultMaxSyncsPerHost = 2
+)
+
+// syncLimits holds the per-site locks and per-host slots shared by all
+// sync paths (schedule, SyncAll, SyncOne, webhooks)
+type syncLimits struct {
+	sites sync.Map // siteKey -> *sync.Mutex
+	hosts sync.Map // host -> chan struct{}
+}
+
+// siteLock returns the lock that serializes syncs of one site
+func (s *Syncer) siteLock(namespace, name string) *sync.Mutex {
+	lock, _ := s.limits.sites.LoadOrStore(siteKey(namespace, name), &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// hostSlots returns the semaphore limiting parallel syncs against host,
+// or nil if syncs per host are not limited
+func (s *Syncer) hostSlots(host string) chan struct{} {
+	if s.MaxSyncsPerHost <= 0 || host == "" {
+		return nil
+	}
+	slots, _ := s.limits.hosts.LoadOrStore(host, make(chan struct{}, s.MaxSyncsPerHost))
+	return slots.(chan struct{})
+}
+
+// acquireHost blocks until a sync against host may start. The returned
+// function releases the slot; calling it again does nothing.
+func (s *Syncer) acquireHost(ctx context.Context, host string) (func(), error) {
+	slots := s.hostSlots(host)
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-slots }) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// hostBusy reports whether all slots for host are taken
+func (s *Syncer) hostBusy(host string) bool {
+	slots := s.hostSlots(host)
+	return slots != nil && len(slots) >= cap(slots)
+}
+
+// repoHost returns the lowercase host of a repo URL without port, or "" if
+// the URL cannot be parsed
+func repoHost(repoURL string) string {
+	remote, err := parseRemoteURL(repoURL)
+	if err != nil {
+		return ""
+	}
+	return remote.Host
+}
+
+// host returns the host a site's content is fetched from
+func (s *staticSiteData) host() string {
+	switch {
+	case s.OCI != nil:
+		ref, err := parseOCIReference(s.OCI.Image)
+		if err != nil {
+			return ""
+		}
+		return ref.Host
+	case s.Archive != nil:
+		return urlHost(s.Archive.URL)
+	case s.S3 != nil:
+		return urlHost(s.S3.Endpoint)
+	}
+	return repoHost(s.Repo)
+}
+
+// urlHost returns the lowercase host of an http(s) URL
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// workers returns the configured number of sync workers
+func (s *Syncer) workers() int {
+	if s.SyncWorkers <= 0 {
+		return DefaultSyncWorkers
+	}
+	return s.SyncWorkers
+}
+
+// syncSite synchronizes a single site. Syncs of the same site are
+// serialized: if the site is being synced already, syncSite waits and syncs
+// again afterwards, so a webhook never gets lost in a running sync.
+func (s *Syncer) syncSite(ctx context.Context, site *staticSiteData) error {
+	lock := s.siteLock(site.Namespace, site.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return s.syncSiteLocked(ctx, site)
+}
+
+// trySyncSite synchronizes a site unless it is being synced already.
+// Returns false if the sync was skipped.
+func (s *Syncer) trySyncSite(ctx context.Context, site *staticSiteData) (bool, error) {
+	lock := s.siteLock(site.Namespace, site.Name)
+	if !lock.TryLock() {
+		return false, nil
+	}
+	defer lock.Unlock()
+
+	return true, s.syncSiteLocked(ctx, site)
+}
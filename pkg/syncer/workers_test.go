@@ -0,0 +1,200 @@
+package syncer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRepoHost(t *testing.T) {
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{"https://github.com/user/repo.git", "github.com"},
+		{"https://Git.Example.COM:8443/user/repo.git", "git.example.com"},
+		{"http://localhost:3000/repo.git", "localhost"},
+		{"ssh://git@Git.Example.com:2222/repo.git", "git.example.com"},
+		{"git@github.com:user/repo.git", "github.com"},
+		{"://invalid", ""},
+	}
+
+	for _, tt := range tests {
+		if got := repoHost(tt.repo); got != tt.want {
+			t.Errorf("repoHost(%q) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	if got := (&Syncer{}).workers(); got != DefaultSyncWorkers {
+		t.Errorf("workers() = %d, want default %d", got, DefaultSyncWorkers)
+	}
+	if got := (&Syncer{SyncWorkers: 8}).workers(); got != 8 {
+		t.Errorf("workers() = %d, want 8", got)
+	}
+}
+
+func TestAcquireHost(t *testing.T) {
+	s := &Syncer{MaxSyncsPerHost: 1}
+	ctx := context.Background()
+
+	release, err := s.acquireHost(ctx, "git.example.com")
+	if err != nil {
+		t.Fatalf("acquireHost() error = %v", err)
+	}
+	if !s.hostBusy("git.example.com") {
+		t.Error("hostBusy() = false with all slots taken")
+	}
+	if s.hostBusy("github.com") {
+		t.Error("hostBusy() = true for another host")
+	}
+
+	// A second sync against the same host has to wait
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.acquireHost(timeoutCtx, "git.example.com"); err == nil {
+		t.Error("acquireHost() succeeded beyond the limit")
+	}
+
+	release()
+	if s.hostBusy("git.example.com") {
+		t.Error("hostBusy() = true after release")
+	}
+	release, err = s.acquireHost(ctx, "git.example.com")
+	if err != nil {
+		t.Fatalf("acquireHost() after release error = %v", err)
+	}
+	release()
+}
+
+func TestAcquireHost_Unlimited(t *testing.T) {
+	s := &Syncer{}
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		if _, err := s.acquireHost(ctx, "github.com"); err != nil {
+			t.Fatalf("acquireHost() error = %v", err)
+		}
+	}
+	if s.hostBusy("github.com") {
+		t.Error("hostBusy() = true without limit")
+	}
+}
+
+func TestSyncSite_SameSiteIsSerialized(t *testing.T) {
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"github.com"},
+		DynamicClient: &fakeDynamicClient{activeSites: []string{"site"}},
+		ClientSet:     newFakeClientset(),
+	}
+	// Repo on a host that is not allowed: the sync itself fails fast
+	site := &staticSiteData{Namespace: "default", Name: "site", Repo: "https://blocked.example.org/repo.git"}
+	ctx := context.Background()
+
+	lock := s.siteLock("default", "site")
+	lock.Lock()
+
+	// Scheduled syncs skip a site that is being synced
+	if synced, _ := s.trySyncSite(ctx, site); synced {
+		t.Error("trySyncSite() synced a locked site")
+	}
+
+	// The same name in another namespace is not affected
+	other := &staticSiteData{Namespace: "other", Name: "site", Repo: site.Repo}
+	if synced, _ := s.trySyncSite(ctx, other); !synced {
+		t.Error("trySyncSite() skipped a site in another namespace")
+	}
+
+	// Webhook syncs wait for the running sync and run afterwards
+	done := make(chan struct{})
+	go func() {
+		_ = s.syncSite(ctx, site)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("syncSite() did not wait for the running sync")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	lock.Unlock()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("syncSite() did not run after the running sync finished")
+	}
+}
+
+func TestSyncAll_Parallel(t *testing.T) {
+	var sites []siteSpec
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		sites = append(sites, siteSpec{name: name, namespace: "default", repo: "https://blocked.example.org/" + name + ".git"})
+	}
+	fakeClient := &fakeDynamicClientWithSites{sites: sites}
+
+	s := &Syncer{
+		SitesRoot:     t.TempDir(),
+		AllowedHosts:  []string{"github.com"},
+		DynamicClient: fakeClient,
+		ClientSet:     newFakeClientset(),
+		SyncWorkers:   2,
+	}
+
+	if err := s.SyncAll(context.Background()); err != nil {
+		t.Fatalf("SyncAll() error = %v", err)
+	}
+	if len(fakeClient.patched) != len(sites) {
+		t.Errorf("SyncAll() reported status for %d sites, want %d", len(fakeClient.patched), len(sites))
+	}
+}
+
+func TestRunLoop_WaitsForBusyHost(t *testing.T) {
+	repoURL, _, commit := newServedTestRemote(t, map[string]string{"index.html": "v1"})
+
+	fakeClient := &fakeDynamicClientWithSites{
+		sites: []siteSpec{
+			{name: "site", namespace: "default", repo: repoURL, branch: "master"},
+		},
+	}
+	s := &Syncer{
+		SitesRoot:       t.TempDir(),
+		AllowedHosts:    []string{"127.0.0.1"},
+		DynamicClient:   fakeClient,
+		ClientSet:       newFakeClientset(),
+		DefaultInterval: time.Minute,
+		MaxSyncsPerHost: 1,
+	}
+
+	// Another sync (e.g. from a webhook) occupies the only slot of the host
+	release, err := s.acquireHost(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("acquireHost() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.RunLoop(ctx)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if s.currentRelease("default--site") != "" {
+		t.Fatal("site was synced while its host was at the limit")
+	}
+
+	release()
+	deadline := time.Now().Add(3 * time.Second)
+	for s.currentRelease("default--site") != commit.String() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if s.currentRelease("default--site") != commit.String() {
+		t.Error("site was not synced after the host became free")
+	}
+
+	cancel()
+	<-done
+}